@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io/ioutil"
+	"strings"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// newHash returns a hash for the algorithm the server uses to checksum files. The
+// sha256 hash computed for the manifest is reused when the algorithm is SHA-256, and
+// hashing is skipped when the server has no hash support.
+func newHash(algorithm string, manifestHash hash.Hash) hash.Hash {
+	switch algorithm {
+	case ftp.HashSHA256:
+		return &sharedHash{manifestHash}
+	case ftp.HashSHA1:
+		return sha1.New()
+	case ftp.HashMD5:
+		return md5.New()
+	case ftp.HashCRC32:
+		return crc32.NewIEEE()
+	default:
+		return &sharedHash{manifestHash}
+	}
+}
+
+// sharedHash is a hash already fed by another writer, writes to it are discarded
+type sharedHash struct {
+	hash.Hash
+}
+
+func (s *sharedHash) Write(p []byte) (int, error) {
+	return ioutil.Discard.Write(p)
+}
+
+// checkTransfer compares the checksum of the downloaded file with the one computed
+// by the server. Servers without hash support only get the size checked, while a
+// failed hash command of a server that advertised one fails the transfer so that
+// it is downloaded again.
+func checkTransfer(folder sourceFolder, entry *ftp.Entry, size int64, algorithm string, localHash hash.Hash) error {
+	if entry.Size != 0 && uint64(size) != entry.Size {
+		return fmt.Errorf("downloaded %d bytes, expected %d", size, entry.Size)
+	}
+
+	if algorithm == "" {
+		return nil
+	}
+
+	remoteAlgorithm, remoteSum, err := folder.hash(entry.Name)
+	if err != nil {
+		return fmt.Errorf("server failed to hash with %s: %v", algorithm, err)
+	}
+	if remoteAlgorithm != algorithm {
+		return fmt.Errorf("server hashed with %s, expected %s", remoteAlgorithm, algorithm)
+	}
+
+	localSum := hex.EncodeToString(localHash.Sum(nil))
+	if algorithm == ftp.HashCRC32 {
+		// some servers drop the leading zeros of the crc
+		localSum, remoteSum = strings.TrimLeft(localSum, "0"), strings.TrimLeft(remoteSum, "0")
+	}
+	if localSum != remoteSum {
+		return fmt.Errorf("%s checksum is %s, server has %s", algorithm, localSum, remoteSum)
+	}
+	return nil
+}
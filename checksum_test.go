@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// hexSum returns the checksum of content as printed by servers
+func hexSum(h hash.Hash, content string) string {
+	h.Write([]byte(content))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestCheckTransfer(t *testing.T) {
+	const content = "GRIB message"
+	entry := &ftp.Entry{Name: "gfs.t06z.pgrb2.1p00.f000", Size: uint64(len(content))}
+
+	tests := []struct {
+		name      string
+		size      int64
+		algorithm string
+		folder    *testFolder
+		wantErr   string
+	}{
+		{"size only", int64(len(content)), "", &testFolder{hashErr: errNoServerHash}, ""},
+		{"short download", 5, "", &testFolder{}, "downloaded 5 bytes, expected 12"},
+		{"sha256", int64(len(content)), ftp.HashSHA256, &testFolder{algorithm: ftp.HashSHA256, hashes: map[string]string{entry.Name: hexSum(sha256.New(), content)}}, ""},
+		{"md5 mismatch", int64(len(content)), ftp.HashMD5, &testFolder{algorithm: ftp.HashMD5, hashes: map[string]string{entry.Name: hexSum(md5.New(), "other")}}, "MD5 checksum is"},
+		{"crc without leading zeros", int64(len(content)), ftp.HashCRC32, &testFolder{algorithm: ftp.HashCRC32, hashes: map[string]string{entry.Name: strings.TrimLeft(hexSum(crc32.NewIEEE(), content), "0")}}, ""},
+		{"other algorithm", int64(len(content)), ftp.HashMD5, &testFolder{algorithm: ftp.HashSHA1}, "server hashed with SHA-1"},
+		{"hash command failed", int64(len(content)), ftp.HashSHA256, &testFolder{algorithm: ftp.HashSHA256, hashErr: errors.New("550 Hash failed")}, "server failed to hash"},
+	}
+	for _, test := range tests {
+		manifestHash := sha256.New()
+		localHash := newHash(test.algorithm, manifestHash)
+		manifestHash.Write([]byte(content))
+		localHash.Write([]byte(content))
+		err := checkTransfer(test.folder, entry, test.size, test.algorithm, localHash)
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
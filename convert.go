@@ -0,0 +1,450 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+	"github.com/nilsmagnus/ftplistener/netcdf"
+)
+
+const netcdfFolderName = "netcdf"
+
+// fillValue marks missing values in the NetCDF files, as in the NCEP conversions
+const fillValue = float32(9.999e20)
+
+// netcdfCommand converts all GRIB2 files of a cycle to a NetCDF file, and returns
+// the process exit code.
+func netcdfCommand(args []string) int {
+	flags := flag.NewFlagSet("netcdf", flag.ExitOnError)
+	cycleFolder := flags.String("cycle", "", "folder of the downloaded cycle, e.g. gribfiles/gfs.20180405/06")
+	variables := flags.String("vars", "", "comma separated variables to convert, e.g. \"TMP:2 m above ground,UGRD:10 m above ground\" (default all)")
+	output := flags.String("output", "", "NetCDF file to write (default <cycle>/netcdf/gfs.tHHz.pgrb2.1p00.nc)")
+	flags.Parse(args)
+
+	if *cycleFolder == "" {
+		flags.Usage()
+		return 2
+	}
+	selectors, err := parseOptionalSelectors(*variables)
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+
+	fileName, err := convertCycle(*cycleFolder, *output, selectors)
+	if err != nil {
+		log.Println("Failed to convert", "cycle", *cycleFolder, "error", err.Error())
+		return 1
+	}
+	log.Println("Wrote", "file", fileName)
+	return 0
+}
+
+// netcdfFilePath returns the NetCDF file of a cycle folder, named after its files,
+// e.g. gribfiles/gfs.20180405/06/netcdf/gfs.t06z.pgrb2.1p00.nc
+func netcdfFilePath(cycleFolder string, gribFileName string) string {
+	hour := "00"
+	if match := gfsFileName.FindStringSubmatch(gribFileName); match != nil {
+		hour = match[1]
+	}
+	return filepath.Join(cycleFolder, netcdfFolderName, fmt.Sprintf("gfs.t%sz.pgrb2.1p00.nc", hour))
+}
+
+// convertDownloadedCycle converts a cycle once its downloads are complete. It is
+// skipped if nothing was downloaded and the NetCDF file already exists.
+func convertDownloadedCycle(destinationFolder, subDir string, downloaded int, options downloadOptions) {
+	cycleFolder := filepath.Join(destinationFolder, subDir)
+	sourceFolder := cycleSourceFolder(destinationFolder, subDir, options)
+	fileNames, err := cycleGribFiles(sourceFolder)
+	if err != nil || len(fileNames) == 0 {
+		return
+	}
+	fileName := netcdfFilePath(cycleFolder, fileNames[0])
+	if _, err := os.Stat(fileName); downloaded == 0 && err == nil {
+		return
+	}
+
+	if _, err := convertCycle(sourceFolder, fileName, options.netcdfVars); err != nil {
+		log.Println("Failed to convert", "cycle", cycleFolder, "error", err.Error())
+		return
+	}
+	log.Println("Converted", "cycle", cycleFolder, "file", fileName)
+}
+
+// cycleSourceFolder returns the folder with the files of a cycle to convert, the
+// cropped files when cropping.
+func cycleSourceFolder(destinationFolder, subDir string, options downloadOptions) string {
+	if options.crop != nil {
+		return filepath.Join(destinationFolder, subDir, cropFolderName)
+	}
+	return filepath.Join(destinationFolder, subDir)
+}
+
+// convertCycle writes the selected variables of all GRIB2 files of a folder to
+// a CF compliant NetCDF file with the forecast hours along the time dimension.
+// All variables are converted when no selectors are given. The file name is
+// returned, which defaults to the NetCDF file of the folder.
+func convertCycle(folder, fileName string, selectors []fieldSelector) (string, error) {
+	cycle, err := readCycleFields(folder, selectors)
+	if err != nil {
+		return "", err
+	}
+	if fileName == "" {
+		fileName = netcdfFilePath(folder, cycle.files[0])
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0777); err != nil {
+		return "", err
+	}
+	temporary := fileName + ".tmp"
+	out, err := os.Create(temporary)
+	if err != nil {
+		return "", err
+	}
+	err = writeNetCDF(out, cycle)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return "", err
+	}
+	return fileName, os.Rename(temporary, fileName)
+}
+
+// cycleFields are the fields of the GRIB2 files of a cycle, by variable
+type cycleFields struct {
+	files         []string
+	hours         []float64
+	grid          *grib2.Grid
+	referenceTime time.Time
+	variables     []*cycleVariable
+}
+
+// cycleVariable is a parameter at a level, and its field in each file of the cycle
+type cycleVariable struct {
+	selector fieldSelector
+	units    string
+	fields   []*grib2.Field
+}
+
+// variable returns the variable of a selector, or nil if the cycle has no fields of it
+func (c *cycleFields) variable(s fieldSelector) *cycleVariable {
+	for _, v := range c.variables {
+		if v.selector == s {
+			return v
+		}
+	}
+	return nil
+}
+
+// readCycleFields reads the fields of the selected variables from all GRIB2
+// files of a folder, all variables when no selectors are given. Fields on
+// another grid than the first one are skipped.
+func readCycleFields(folder string, selectors []fieldSelector) (*cycleFields, error) {
+	gribFiles, err := cycleGribFiles(folder)
+	if err != nil {
+		return nil, err
+	}
+	if len(gribFiles) == 0 {
+		return nil, fmt.Errorf("no GRIB2 files in %s", folder)
+	}
+
+	cycle := &cycleFields{
+		files:     gribFiles,
+		hours:     make([]float64, len(gribFiles)),
+		variables: make([]*cycleVariable, 0),
+	}
+	byName := make(map[string]*cycleVariable)
+
+	for i, gribFile := range gribFiles {
+		match := gfsFileName.FindStringSubmatch(filepath.Base(gribFile))
+		hour, _ := strconv.Atoi(match[2])
+		cycle.hours[i] = float64(hour)
+
+		file, err := grib2.Open(gribFile)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := file.Fields()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		for _, f := range fields {
+			s := fieldSelector{parameter: f.Parameter(), level: f.Product.Level()}
+			if !selected(selectors, f) {
+				continue
+			}
+			fieldGrid, err := grib2.ReadGrid(file, f.GridSection)
+			if err != nil {
+				log.Println("Skipping field", "file", gribFile, "field", s.String(), "error", err.Error())
+				continue
+			}
+			if cycle.grid == nil {
+				cycle.grid, cycle.referenceTime = fieldGrid, f.Message.ReferenceTime
+			} else if !sameGrid(cycle.grid, fieldGrid) {
+				log.Println("Skipping field on another grid", "file", gribFile, "field", s.String())
+				continue
+			}
+
+			v, ok := byName[s.name()]
+			if !ok {
+				v = &cycleVariable{selector: s, units: f.Units(), fields: make([]*grib2.Field, len(gribFiles))}
+				byName[s.name()] = v
+				cycle.variables = append(cycle.variables, v)
+			}
+			// the first field wins when a file has several, e.g. of different statistics
+			if v.fields[i] == nil {
+				v.fields[i] = f
+			}
+		}
+		file.Close()
+	}
+	if cycle.grid == nil {
+		return nil, fmt.Errorf("no fields to convert in %s", folder)
+	}
+	return cycle, nil
+}
+
+// float32Values decodes a field, missing values are replaced by missing
+func float32Values(r io.ReaderAt, f *grib2.Field, missing float32) ([]float32, error) {
+	values, err := f.Values(r)
+	if err != nil {
+		return nil, err
+	}
+	return float32Fill(values, missing), nil
+}
+
+// float32Fill converts values to float32, NaN values are replaced by missing
+func float32Fill(values []float64, missing float32) []float32 {
+	data := make([]float32, len(values))
+	for i, value := range values {
+		if math.IsNaN(value) {
+			data[i] = missing
+		} else {
+			data[i] = float32(value)
+		}
+	}
+	return data
+}
+
+func selected(selectors []fieldSelector, f *grib2.Field) bool {
+	if len(selectors) == 0 {
+		return true
+	}
+	for _, s := range selectors {
+		if s.matches(f) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameGrid(a, b *grib2.Grid) bool {
+	return a.Ni == b.Ni && a.Nj == b.Nj && a.La1 == b.La1 && a.Lo1 == b.Lo1 &&
+		a.Di == b.Di && a.Dj == b.Dj && a.ScanningMode == b.ScanningMode
+}
+
+func writeNetCDF(out *os.File, cycle *cycleFields) error {
+	grid := cycle.grid
+	header := netcdfHeader(grid, cycle.timeUnits(), filepath.Base(cycle.files[0]))
+	for _, v := range cycle.variables {
+		header.Variables = append(header.Variables, netcdfVariable(v.selector.netcdfName(), v.selector.String(), v.units))
+	}
+
+	writer, err := netcdf.NewWriter(out, header)
+	if err != nil {
+		return err
+	}
+	if err := writeCoordinates(writer, grid); err != nil {
+		return err
+	}
+
+	missing := make([]float32, grid.Points())
+	for i := range missing {
+		missing[i] = fillValue
+	}
+	for record, gribFile := range cycle.files {
+		if err := writer.Write("time", record, []float64{cycle.hours[record]}); err != nil {
+			return err
+		}
+		if err := writeRecord(writer, record, gribFile, cycle.variables, missing); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// forecastTitle returns the title of the files of a grid, with its resolution
+// and the area of regional grids, e.g. "GFS 1.0 degree forecast for 54N to 72N,
+// 10W to 35E"
+func forecastTitle(grid *grib2.Grid) string {
+	resolution := strconv.FormatFloat(grid.Di, 'f', -1, 64)
+	if grid.Di == math.Trunc(grid.Di) {
+		resolution = strconv.FormatFloat(grid.Di, 'f', 1, 64)
+	}
+	title := "GFS " + resolution + " degree forecast"
+	if float64(grid.Ni)*grid.Di >= 360 && float64(grid.Nj-1)*grid.Dj >= 180 {
+		return title
+	}
+	south, north := math.Min(grid.La1, grid.La2), math.Max(grid.La1, grid.La2)
+	return fmt.Sprintf("%s for %s to %s, %s to %s", title,
+		degreesLabel(south, "N", "S"), degreesLabel(north, "N", "S"),
+		degreesLabel(grid.Lo1, "E", "W"), degreesLabel(grid.Lo2, "E", "W"))
+}
+
+// degreesLabel formats an angle with the hemisphere, longitudes are given
+// between -180 and 180
+func degreesLabel(degrees float64, positive, negative string) string {
+	if positive == "E" && degrees > 180 {
+		degrees -= 360
+	}
+	if degrees < 0 {
+		return strconv.FormatFloat(-degrees, 'f', -1, 64) + negative
+	}
+	return strconv.FormatFloat(degrees, 'f', -1, 64) + positive
+}
+
+// netcdfHeader returns the header of a CF compliant NetCDF file on a grid, with
+// the coordinate variables and without data variables.
+func netcdfHeader(grid *grib2.Grid, timeUnits string, source string) *netcdf.Header {
+	return &netcdf.Header{
+		Dimensions: []netcdf.Dimension{
+			{Name: "time", Length: netcdf.Unlimited},
+			{Name: "lat", Length: grid.Nj},
+			{Name: "lon", Length: grid.Ni},
+		},
+		Attributes: []netcdf.Attribute{
+			{Name: "Conventions", Value: "CF-1.6"},
+			{Name: "title", Value: forecastTitle(grid)},
+			{Name: "institution", Value: "NOAA/NCEP"},
+			{Name: "source", Value: source},
+			{Name: "history", Value: time.Now().UTC().Format(time.RFC3339) + " converted from GRIB2 by ftplistener"},
+		},
+		Variables: []netcdf.Variable{
+			{Name: "time", Type: netcdf.Double, Dimensions: []string{"time"}, Attributes: []netcdf.Attribute{
+				{Name: "standard_name", Value: "time"},
+				{Name: "units", Value: timeUnits},
+				{Name: "calendar", Value: "standard"},
+				{Name: "axis", Value: "T"},
+			}},
+			{Name: "forecast_reference_time", Type: netcdf.Double, Attributes: []netcdf.Attribute{
+				{Name: "standard_name", Value: "forecast_reference_time"},
+				{Name: "units", Value: timeUnits},
+				{Name: "calendar", Value: "standard"},
+			}},
+			{Name: "lat", Type: netcdf.Float, Dimensions: []string{"lat"}, Attributes: []netcdf.Attribute{
+				{Name: "standard_name", Value: "latitude"},
+				{Name: "units", Value: "degrees_north"},
+				{Name: "axis", Value: "Y"},
+			}},
+			{Name: "lon", Type: netcdf.Float, Dimensions: []string{"lon"}, Attributes: []netcdf.Attribute{
+				{Name: "standard_name", Value: "longitude"},
+				{Name: "units", Value: "degrees_east"},
+				{Name: "axis", Value: "X"},
+			}},
+		},
+	}
+}
+
+// netcdfName returns the name of the variable of a field. NetCDF names start
+// with a letter or an underscore, names of parameters like 4LFTX are prefixed
+// with an underscore.
+func (s fieldSelector) netcdfName() string {
+	name := s.name()
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		return "_" + name
+	}
+	return name
+}
+
+// netcdfVariable returns a float variable along time, lat and lon
+func netcdfVariable(name, longName, units string, attributes ...netcdf.Attribute) netcdf.Variable {
+	all := []netcdf.Attribute{{Name: "long_name", Value: longName}}
+	if units != "" {
+		all = append(all, netcdf.Attribute{Name: "units", Value: units})
+	}
+	all = append(all, attributes...)
+	all = append(all, netcdf.Attribute{Name: "_FillValue", Value: fillValue})
+	return netcdf.Variable{
+		Name:       name,
+		Type:       netcdf.Float,
+		Dimensions: []string{"time", "lat", "lon"},
+		Attributes: all,
+	}
+}
+
+// writeCoordinates writes the reference time, latitudes and longitudes of a file
+func writeCoordinates(writer *netcdf.Writer, grid *grib2.Grid) error {
+	if err := writer.Write("forecast_reference_time", 0, []float64{0}); err != nil {
+		return err
+	}
+	if err := writer.Write("lat", 0, latitudes(grid)); err != nil {
+		return err
+	}
+	return writer.Write("lon", 0, longitudes(grid))
+}
+
+// writeRecord writes the values of the variables from one GRIB2 file, variables
+// missing from the file are written as fill values.
+func writeRecord(writer *netcdf.Writer, record int, gribFile string, variables []*cycleVariable, missing []float32) error {
+	file, err := os.Open(gribFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for _, v := range variables {
+		f := v.fields[record]
+		if f == nil {
+			if err := writer.Write(v.selector.netcdfName(), record, missing); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := float32Values(file, f, fillValue)
+		if err != nil {
+			return err
+		}
+		if err := writer.Write(v.selector.netcdfName(), record, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeUnits are the CF units of the forecast hours
+func (c *cycleFields) timeUnits() string {
+	return "hours since " + c.referenceTime.UTC().Format("2006-01-02 15:04:05")
+}
+
+func latitudes(grid *grib2.Grid) []float32 {
+	lat := make([]float32, grid.Nj)
+	for j := range lat {
+		lat[j] = float32(grid.Latitude(j))
+	}
+	return lat
+}
+
+// longitudes returns the longitudes of the columns, increasing even when the
+// grid crosses the Greenwich meridian, e.g. -10 to 35 instead of 350 to 35.
+func longitudes(grid *grib2.Grid) []float32 {
+	lon := make([]float32, grid.Ni)
+	first := grid.Longitude(0)
+	if first+float64(grid.Ni-1)*grid.Di >= 360 && float64(grid.Ni)*grid.Di < 360 {
+		first -= 360
+	}
+	for i := range lon {
+		lon[i] = float32(first + float64(i)*grid.Di)
+	}
+	return lon
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+func TestForecastTitle(t *testing.T) {
+	tests := []struct {
+		grid *grib2.Grid
+		want string
+	}{
+		{gfsGrid, "GFS 1.0 degree forecast"},
+		{&grib2.Grid{Ni: 1440, Nj: 721, La1: 90, Lo1: 0, La2: -90, Lo2: 359.75, Di: 0.25, Dj: 0.25}, "GFS 0.25 degree forecast"},
+		{&grib2.Grid{Ni: 46, Nj: 19, La1: 72, Lo1: 350, La2: 54, Lo2: 35, Di: 1, Dj: 1}, "GFS 1.0 degree forecast for 54N to 72N, 10W to 35E"},
+		{&grib2.Grid{Ni: 3, Nj: 3, La1: -40, Lo1: 170, La2: -30, Lo2: 190, Di: 10, Dj: 5, ScanningMode: grib2.ScanSouthToNorth}, "GFS 10.0 degree forecast for 40S to 30S, 170E to 170W"},
+	}
+	for _, test := range tests {
+		if got := forecastTitle(test.grid); got != test.want {
+			t.Errorf("got title %q, want %q", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+const cropFolderName = "crop"
+
+// Where to write cropped files, see downloadOptions
+const (
+	cropAlongside = "alongside"
+	cropInstead   = "instead"
+)
+
+// parseBoundingBox parses a bounding box given as south,west,north,east in degrees
+func parseBoundingBox(value string) (*grib2.BoundingBox, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid bounding box %q, expected south,west,north,east", value)
+	}
+	degrees := make([]float64, len(parts))
+	for i, p := range parts {
+		d, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bounding box %q: %v", value, err)
+		}
+		degrees[i] = d
+	}
+	if degrees[0] > degrees[2] {
+		return nil, fmt.Errorf("invalid bounding box %q, south is north of north", value)
+	}
+	if degrees[0] < -90 || degrees[2] > 90 || degrees[1] < -180 || degrees[1] > 360 || degrees[3] < -180 || degrees[3] > 360 {
+		return nil, fmt.Errorf("invalid bounding box %q, latitudes must be between -90 and 90, longitudes between -180 and 360", value)
+	}
+	return &grib2.BoundingBox{South: degrees[0], West: degrees[1], North: degrees[2], East: degrees[3]}, nil
+}
+
+// gfsGrid is the global 1 degree grid of the gfs.tCCz.pgrb2.1p00 files
+var gfsGrid = &grib2.Grid{Ni: 360, Nj: 181, La1: 90, Lo1: 0, La2: -90, Lo2: 359, Di: 1, Dj: 1, ScanningMode: grib2.ScanNorthToSouth}
+
+// croppedFilePath is where the cropped version of a downloaded file is written
+func croppedFilePath(folderName, subdir, name string) string {
+	return fmt.Sprintf("%s%s/%s", fileFolder(folderName, subdir), cropFolderName, name)
+}
+
+// cropDownload writes the cropped version of a downloaded file and returns its
+// name. The global file is removed if the crop replaces it.
+func cropDownload(downloadItem ftpEntryForDownload, fileName string, modTime time.Time, options downloadOptions) (string, error) {
+	croppedFileName := croppedFilePath(downloadItem.destinationFolder, downloadItem.subDir, downloadItem.entry.Name)
+	if err := os.MkdirAll(fileFolder(downloadItem.destinationFolder, downloadItem.subDir)+cropFolderName, 0777); err != nil {
+		return "", err
+	}
+	if err := grib2.CropFile(fileName, croppedFileName, *options.crop); err != nil {
+		return "", err
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(croppedFileName, modTime, modTime); err != nil {
+			return "", err
+		}
+	}
+
+	if options.cropMode == cropInstead {
+		return croppedFileName, os.Remove(fileName)
+	}
+	return croppedFileName, nil
+}
+
+// replacedByCrop reports whether a downloaded file is missing because it was
+// replaced by its cropped version.
+func replacedByCrop(folderName, subdir, name string) bool {
+	if _, err := os.Stat(fileFolder(folderName, subdir) + name); !os.IsNotExist(err) {
+		return false
+	}
+	_, err := os.Stat(croppedFilePath(folderName, subdir, name))
+	return err == nil
+}
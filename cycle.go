@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// cycleTracker counts the pending downloads of each cycle folder and calls
+// onComplete once all files of a cycle queued for download have been downloaded
+// or given up on, with the names of the files the server listed and of those
+// given up on.
+type cycleTracker struct {
+	mutex      sync.Mutex
+	pending    map[string]int
+	downloaded map[string]int
+	listed     map[string][]string
+	failures   map[string][]string
+	onComplete func(destinationFolder, subDir string, downloaded int, listed, failed []string)
+}
+
+func newCycleTracker(onComplete func(destinationFolder, subDir string, downloaded int, listed, failed []string)) *cycleTracker {
+	return &cycleTracker{
+		pending:    make(map[string]int),
+		downloaded: make(map[string]int),
+		listed:     make(map[string][]string),
+		failures:   make(map[string][]string),
+		onComplete: onComplete,
+	}
+}
+
+// queued registers the number of files of a cycle put on the download channel.
+// Downloads may complete before they are registered, the cycle is complete when
+// both counts meet. Cycles with nothing to download are left alone.
+func (t *cycleTracker) queued(destinationFolder, subDir string, files int, listed []*ftp.Entry) {
+	if files == 0 {
+		return
+	}
+	key := fileFolder(destinationFolder, subDir)
+	names := make([]string, 0, len(listed))
+	for _, e := range listed {
+		names = append(names, e.Name)
+	}
+	t.mutex.Lock()
+	t.listed[key] = names
+	t.mutex.Unlock()
+	if t.add(key, files) {
+		t.complete(destinationFolder, subDir)
+	}
+}
+
+// done registers a completed download
+func (t *cycleTracker) done(downloadItem ftpEntryForDownload) {
+	key := fileFolder(downloadItem.destinationFolder, downloadItem.subDir)
+	t.mutex.Lock()
+	t.downloaded[key]++
+	t.mutex.Unlock()
+	if t.add(key, -1) {
+		t.complete(downloadItem.destinationFolder, downloadItem.subDir)
+	}
+}
+
+// failed registers a download given up on
+func (t *cycleTracker) failed(downloadItem ftpEntryForDownload) {
+	key := fileFolder(downloadItem.destinationFolder, downloadItem.subDir)
+	t.mutex.Lock()
+	t.failures[key] = append(t.failures[key], downloadItem.entry.Name)
+	t.mutex.Unlock()
+	if t.add(key, -1) {
+		t.complete(downloadItem.destinationFolder, downloadItem.subDir)
+	}
+}
+
+// add changes the pending count of a cycle and reports whether it reached zero
+func (t *cycleTracker) add(key string, files int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.pending[key] += files
+	return t.pending[key] == 0
+}
+
+func (t *cycleTracker) complete(destinationFolder, subDir string) {
+	key := fileFolder(destinationFolder, subDir)
+	t.mutex.Lock()
+	downloaded, listed, failed := t.downloaded[key], t.listed[key], t.failures[key]
+	delete(t.pending, key)
+	delete(t.downloaded, key)
+	delete(t.listed, key)
+	delete(t.failures, key)
+	t.mutex.Unlock()
+
+	t.onComplete(destinationFolder, subDir, downloaded, listed, failed)
+}
+
+// cycleComplete reports whether the server listed the file of the last forecast
+// hour of a cycle, and every listed file up to it has been downloaded to the folder.
+func cycleComplete(folder string, listed []string, lastHour int) bool {
+	last := false
+	for _, name := range listed {
+		match := gfsFileName.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		if hour, _ := strconv.Atoi(match[2]); hour > lastHour {
+			continue
+		} else if hour == lastHour {
+			last = true
+		}
+		if _, err := os.Stat(filepath.Join(folder, name)); err != nil {
+			return false
+		}
+	}
+	return last
+}
+
+// cycleCompleteFileName marks a cycle folder whose files have all been downloaded,
+// and holds the cycle event once its outputs have been written
+const cycleCompleteFileName = "cycle.json"
+
+// cycleEvent is published when the outputs of a complete cycle have been written
+type cycleEvent struct {
+	Cycle         string    `json:"cycle"`
+	ReferenceTime time.Time `json:"referenceTime"`
+	Derived       []string  `json:"derived,omitempty"`
+	Quicklooks    string    `json:"quicklooks,omitempty"`
+	Diff          string    `json:"diff,omitempty"`
+	Zarr          string    `json:"zarr,omitempty"`
+	Stations      []string  `json:"stations,omitempty"`
+	// Failed are the files given up on, the cycle then has no outputs
+	Failed []string `json:"failed,omitempty"`
+}
+
+// completeCycle runs the stages that need all files of a cycle once its downloads
+// are complete, and publishes a cycle event when any of them wrote output. The
+// downloads may be complete before the server lists all files of the cycle, then
+// nothing is done. A cycle with files given up on has no outputs, it is logged
+// and published with the names of those files. Complete cycles are marked with
+// cycleCompleteFileName.
+func completeCycle(destinationFolder, subDir string, downloaded int, listed, failed []string, options downloadOptions, publish func(subject string, event interface{})) {
+	referenceTime, _ := cycleTime(subDir)
+	if len(failed) > 0 {
+		log.Println("Cycle incomplete, gave up on files, skipping its outputs", "cycle", subDir, "files", strings.Join(failed, ","))
+		publish(cyclesSubject, cycleEvent{Cycle: subDir, ReferenceTime: referenceTime, Failed: failed})
+		return
+	}
+	if !cycleComplete(cycleSourceFolder(destinationFolder, subDir, options), listed, options.lastHour) {
+		log.Println("Cycle incomplete, skipping its outputs", "cycle", subDir)
+		return
+	}
+	if options.netcdf {
+		convertDownloadedCycle(destinationFolder, subDir, downloaded, options)
+	}
+
+	event := cycleEvent{Cycle: subDir, ReferenceTime: referenceTime}
+	if len(options.derived) > 0 {
+		fileNames, err := deriveDownloadedCycle(destinationFolder, subDir, downloaded, options)
+		if err != nil {
+			log.Println("Failed to derive", "cycle", subDir, "error", err.Error())
+		}
+		event.Derived = fileNames
+	}
+	if len(options.quicklooks) > 0 {
+		index, err := renderDownloadedCycle(destinationFolder, subDir, downloaded, options)
+		if err != nil {
+			log.Println("Failed to render", "cycle", subDir, "error", err.Error())
+		}
+		event.Quicklooks = index
+	}
+	if options.diff {
+		report, err := diffDownloadedCycle(destinationFolder, subDir, downloaded, options)
+		if err != nil {
+			log.Println("Failed to compare", "cycle", subDir, "error", err.Error())
+		}
+		event.Diff = report
+	}
+	if options.zarr != "" {
+		location, err := assembleDownloadedCycle(destinationFolder, subDir, downloaded, options)
+		if err != nil {
+			log.Println("Failed to assemble", "cycle", subDir, "error", err.Error())
+		}
+		event.Zarr = location
+	}
+	if options.stations != nil {
+		fileNames, err := extractDownloadedCycle(destinationFolder, subDir, downloaded, options)
+		if err != nil {
+			log.Println("Failed to extract stations", "cycle", subDir, "error", err.Error())
+		}
+		event.Stations = fileNames
+	}
+	if err := markCycleComplete(filepath.Join(destinationFolder, subDir), event); err != nil {
+		log.Println("Failed to mark complete", "cycle", subDir, "error", err.Error())
+	}
+
+	if len(event.Derived) > 0 || event.Quicklooks != "" || event.Diff != "" || event.Zarr != "" || len(event.Stations) > 0 {
+		publish(cyclesSubject, event)
+	}
+}
+
+// markCycleComplete writes the cycle event to the folder of a complete cycle
+func markCycleComplete(folder string, event cycleEvent) error {
+	content, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(folder, cycleCompleteFileName), content, 0666)
+}
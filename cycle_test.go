@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jlaffaye/ftp"
+)
+
+func TestCycleComplete(t *testing.T) {
+	folder, err := ioutil.TempDir("", "cycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	listed := []string{"gfs.t06z.pgrb2.1p00.f000", "gfs.t06z.pgrb2.1p00.f003", "gfs.t06z.pgrb2.1p00.f006", "gfs.t06z.pgrb2.1p00.f009"}
+	download := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(folder, name), []byte("GRIB"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	download(listed[0])
+	download(listed[2])
+	if cycleComplete(folder, listed, 6) {
+		t.Error("cycle with a missing hour before the last is complete")
+	}
+	download(listed[1])
+	if !cycleComplete(folder, listed, 6) {
+		t.Error("cycle with all hours up to the last is incomplete")
+	}
+	if cycleComplete(folder, listed, 9) {
+		t.Error("cycle without the file of the last hour is complete")
+	}
+	if cycleComplete(folder, listed[:2], 6) {
+		t.Error("cycle is complete although the server has not listed the last hour yet")
+	}
+}
+
+func TestCycleTracker(t *testing.T) {
+	folder, err := ioutil.TempDir("", "cycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	var completed []int
+	tracker := newCycleTracker(func(destinationFolder, subDir string, downloaded int, listed, failed []string) {
+		if len(listed) != 2 {
+			t.Errorf("got listed files %v", listed)
+		}
+		completed = append(completed, downloaded)
+	})
+	listed := []*ftp.Entry{{Name: "gfs.t06z.pgrb2.1p00.f000"}, {Name: "gfs.t06z.pgrb2.1p00.f003"}}
+	item := ftpEntryForDownload{destinationFolder: folder, subDir: "gfs.20180405/06", entry: listed[1]}
+
+	// nothing to download, the cycle was handled before
+	tracker.queued(folder, "gfs.20180405/00", 0, listed)
+	if len(completed) != 0 {
+		t.Fatal("cycle without downloads completed")
+	}
+
+	// a download may complete before it is registered
+	tracker.done(item)
+	tracker.queued(folder, "gfs.20180405/06", 2, listed)
+	if len(completed) != 0 {
+		t.Fatal("cycle completed with a pending download")
+	}
+	tracker.done(item)
+	if len(completed) != 1 || completed[0] != 2 {
+		t.Fatalf("got completions %v, want one of 2 downloads", completed)
+	}
+}
+
+func TestCycleTrackerFailed(t *testing.T) {
+	folder, err := ioutil.TempDir("", "cycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	var failures [][]string
+	tracker := newCycleTracker(func(destinationFolder, subDir string, downloaded int, listed, failed []string) {
+		if downloaded != 1 {
+			t.Errorf("got %d downloads, want 1", downloaded)
+		}
+		failures = append(failures, failed)
+	})
+	listed := []*ftp.Entry{{Name: "gfs.t06z.pgrb2.1p00.f000"}, {Name: "gfs.t06z.pgrb2.1p00.f003"}}
+	tracker.queued(folder, "gfs.20180405/06", 2, listed)
+	tracker.done(ftpEntryForDownload{destinationFolder: folder, subDir: "gfs.20180405/06", entry: listed[0]})
+	tracker.failed(ftpEntryForDownload{destinationFolder: folder, subDir: "gfs.20180405/06", entry: listed[1]})
+	if len(failures) != 1 || len(failures[0]) != 1 || failures[0][0] != listed[1].Name {
+		t.Fatalf("got completions with failed files %v, want one with f003", failures)
+	}
+
+	// the cycle is published with the failed files instead of its outputs
+	var events []interface{}
+	completeCycle(folder, "gfs.20180405/06", 1, []string{listed[0].Name, listed[1].Name}, failures[0], downloadOptions{diff: true}, func(subject string, event interface{}) {
+		if subject != cyclesSubject {
+			t.Errorf("published on %s", subject)
+		}
+		events = append(events, event)
+	})
+	if len(events) != 1 {
+		t.Fatalf("got events %v, want one", events)
+	}
+	if event := events[0].(cycleEvent); len(event.Failed) != 1 || event.Diff != "" || event.ReferenceTime.Hour() != 6 {
+		t.Errorf("got event %+v", event)
+	}
+	if fileExists(filepath.Join(folder, "gfs.20180405/06", cycleCompleteFileName)) {
+		t.Error("cycle with failed files marked complete")
+	}
+}
+
+
+func TestCompleteCycleMarksFolder(t *testing.T) {
+	folder, err := ioutil.TempDir("", "cycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	values := make([]float64, testGlobalGrid.Points())
+	listed := []string{
+		filepath.Base(testCycleFile(t, folder, testReferenceTime, 0, testGlobalGrid, tmp2m(values))),
+		filepath.Base(testCycleFile(t, folder, testReferenceTime, 3, testGlobalGrid)),
+	}
+	marker := filepath.Join(folder, "gfs.20180405/06", cycleCompleteFileName)
+	options := downloadOptions{lastHour: 3}
+	publish := func(subject string, event interface{}) {}
+
+	completeCycle(folder, "gfs.20180405/06", 1, listed, nil, options, publish)
+	if fileExists(marker) {
+		t.Fatal("cycle without the last hour marked complete")
+	}
+	testCycleFile(t, folder, testReferenceTime, 3, testGlobalGrid, tmp2m(values))
+	completeCycle(folder, "gfs.20180405/06", 1, listed, nil, options, publish)
+	content, err := ioutil.ReadFile(marker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event cycleEvent
+	if err := json.Unmarshal(content, &event); err != nil || event.Cycle != "gfs.20180405/06" {
+		t.Errorf("got marker %s, %v", content, err)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+	"github.com/nilsmagnus/ftplistener/netcdf"
+)
+
+const derivedFolderName = "derived"
+
+// Formats of the derived fields
+const (
+	derivedGRIB2  = "grib2"
+	derivedNetCDF = "netcdf"
+)
+
+// isobaricSurface is the fixed surface type of pressure levels, e.g. 500 mb
+const isobaricSurface = 100
+
+// derivation computes a derived parameter at a level from the fields of a file,
+// and of the previous file of the cycle for de-accumulations.
+type derivation struct {
+	grib2.Derived
+	// description is appended to the long name of NetCDF variables
+	description string
+	attributes  []netcdf.Attribute
+	inputs      func(level string) []fieldSelector
+	compute     func(level string, current, previous *forecastFile) (*derivedValues, error)
+}
+
+// derivedValues are the values of a derived field, and the field they were computed
+// from whose grid and product definition are kept.
+type derivedValues struct {
+	source     *grib2.Field
+	values     []float64
+	startHours int
+}
+
+// derivations are the parameters that can be derived, by abbreviation
+var derivations = map[string]derivation{
+	"WIND": {
+		Derived:     grib2.Derived{Category: 2, Number: 1, DecimalScale: 2},
+		description: "wind speed",
+		inputs:      windInputs,
+		compute:     windSpeed,
+	},
+	"WDIR": {
+		Derived:     grib2.Derived{Category: 2, Number: 0, DecimalScale: 1},
+		description: "direction the wind blows from",
+		inputs:      windInputs,
+		compute:     windDirection,
+	},
+	"RH": {
+		Derived:     grib2.Derived{Category: 1, Number: 1, DecimalScale: 1},
+		description: "relative humidity from specific humidity",
+		inputs: func(level string) []fieldSelector {
+			return []fieldSelector{{"SPFH", level}, {"TMP", level}, {"PRES", level}, {"PRES", "surface"}}
+		},
+		compute: relativeHumidity,
+	},
+	"APCP": {
+		Derived:     grib2.Derived{Category: 1, Number: 8, DecimalScale: 2},
+		description: "accumulated over the forecast step",
+		attributes:  []netcdf.Attribute{{Name: "cell_methods", Value: "time: sum"}},
+		inputs: func(level string) []fieldSelector {
+			return []fieldSelector{{"APCP", level}}
+		},
+		compute: stepPrecipitation,
+	},
+}
+
+// parseDerivedFields parses the derived fields to compute, e.g. WIND:10m,RH:2m,APCP:sfc
+func parseDerivedFields(list string) ([]fieldSelector, error) {
+	if list == "" {
+		return nil, nil
+	}
+	selectors, err := parsePointVariables(list)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range selectors {
+		if _, ok := derivations[s.parameter]; !ok {
+			return nil, fmt.Errorf("cannot derive %s, expected WIND, WDIR, RH or APCP", s.parameter)
+		}
+	}
+	return selectors, nil
+}
+
+// deriveCommand computes derived fields of a downloaded cycle, and returns the
+// process exit code.
+func deriveCommand(args []string) int {
+	flags := flag.NewFlagSet("derive", flag.ExitOnError)
+	cycleFolder := flags.String("cycle", "", "folder of the downloaded cycle, e.g. gribfiles/gfs.20180405/06")
+	fields := flags.String("fields", "", "comma separated fields to derive, e.g. \"WIND:10m,WDIR:10m,RH:2m,APCP:sfc\"")
+	format := flags.String("format", derivedGRIB2, "write the derived fields as grib2 files or a netcdf file")
+	output := flags.String("output", "", "folder to write the derived fields to (default <cycle>/derived)")
+	flags.Parse(args)
+
+	if *cycleFolder == "" || *fields == "" {
+		flags.Usage()
+		return 2
+	}
+	selectors, err := parseDerivedFields(*fields)
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+	if *format != derivedGRIB2 && *format != derivedNetCDF {
+		log.Println("invalid format", *format, "expected grib2 or netcdf")
+		return 2
+	}
+	if *output == "" {
+		*output = filepath.Join(*cycleFolder, derivedFolderName)
+	}
+
+	fileNames, err := deriveCycle(*cycleFolder, *output, selectors, *format)
+	if err != nil {
+		log.Println("Failed to derive", "cycle", *cycleFolder, "error", err.Error())
+		return 1
+	}
+	log.Println("Derived", "cycle", *cycleFolder, "files", len(fileNames))
+	return 0
+}
+
+// deriveDownloadedCycle computes the derived fields of a cycle once its downloads
+// are complete and returns the written files. Cycles without files are skipped,
+// and a NetCDF file is not rewritten if nothing was downloaded.
+func deriveDownloadedCycle(destinationFolder, subDir string, downloaded int, options downloadOptions) ([]string, error) {
+	sourceFolder := cycleSourceFolder(destinationFolder, subDir, options)
+	outputFolder := filepath.Join(destinationFolder, subDir, derivedFolderName)
+	gribFiles, err := cycleGribFiles(sourceFolder)
+	if err != nil || len(gribFiles) == 0 {
+		return nil, nil
+	}
+	if options.derivedFormat == derivedNetCDF {
+		if _, err := os.Stat(derivedNetCDFPath(outputFolder, gribFiles[0])); downloaded == 0 && err == nil {
+			return nil, nil
+		}
+	}
+
+	fileNames, err := deriveCycle(sourceFolder, outputFolder, options.derived, options.derivedFormat)
+	if err != nil {
+		return nil, err
+	}
+	if len(fileNames) > 0 {
+		log.Println("Derived", "cycle", sourceFolder, "files", len(fileNames))
+	}
+	return fileNames, nil
+}
+
+// derivedNetCDFPath returns the NetCDF file of the derived fields of a cycle,
+// e.g. derived/gfs.t06z.derived.1p00.nc
+func derivedNetCDFPath(outputFolder, gribFileName string) string {
+	hour := "00"
+	if match := gfsFileName.FindStringSubmatch(gribFileName); match != nil {
+		hour = match[1]
+	}
+	return filepath.Join(outputFolder, fmt.Sprintf("gfs.t%sz.derived.1p00.nc", hour))
+}
+
+// deriveCycle computes the selected derived fields of all GRIB2 files of a folder
+// and returns the written files. In GRIB2 each file gets a file of the same name
+// in the output folder, files that are newer than their sources are kept.
+func deriveCycle(folder, outputFolder string, selectors []fieldSelector, format string) ([]string, error) {
+	inputs := make([]fieldSelector, 0)
+	for _, s := range selectors {
+		inputs = append(inputs, derivations[s.parameter].inputs(s.level)...)
+	}
+	cycle, err := readCycleFields(folder, inputs)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outputFolder, 0777); err != nil {
+		return nil, err
+	}
+
+	if format == derivedNetCDF {
+		fileName := derivedNetCDFPath(outputFolder, cycle.files[0])
+		if err := writeDerivedNetCDF(fileName, cycle, selectors); err != nil {
+			return nil, err
+		}
+		return []string{fileName}, nil
+	}
+
+	written := make([]string, 0)
+	err = eachForecastFile(cycle, func(record int, current, previous *forecastFile) error {
+		fileName := filepath.Join(outputFolder, filepath.Base(current.Name()))
+		if upToDate(fileName, current, previous) {
+			return nil
+		}
+		wrote, err := writeDerivedGRIB2(fileName, current, previous, selectors)
+		if wrote {
+			written = append(written, fileName)
+		}
+		return err
+	})
+	return written, err
+}
+
+// forecastFile is an open GRIB2 file of a cycle with its fields
+type forecastFile struct {
+	*grib2.File
+	hour   int
+	fields []*grib2.Field
+}
+
+// eachForecastFile calls fn with every file of a cycle and the one before it, nil
+// for the first file.
+func eachForecastFile(cycle *cycleFields, fn func(record int, current, previous *forecastFile) error) error {
+	var previous *forecastFile
+	defer func() {
+		if previous != nil {
+			previous.Close()
+		}
+	}()
+	for record, gribFile := range cycle.files {
+		file, err := grib2.Open(gribFile)
+		if err != nil {
+			return err
+		}
+		fields, err := file.Fields()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		current := &forecastFile{File: file, hour: int(cycle.hours[record]), fields: fields}
+		err = fn(record, current, previous)
+		if previous != nil {
+			previous.Close()
+		}
+		previous = current
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// field returns the first field of a parameter at a level, or nil if there is none
+func (f *forecastFile) field(parameter, level string) *grib2.Field {
+	s := fieldSelector{parameter: parameter, level: level}
+	for _, field := range f.fields {
+		if s.matches(field) {
+			return field
+		}
+	}
+	return nil
+}
+
+// values decodes the first field of a parameter at a level, the field is nil if
+// there is none.
+func (f *forecastFile) values(parameter, level string) (*grib2.Field, []float64, error) {
+	field := f.field(parameter, level)
+	if field == nil {
+		return nil, nil, nil
+	}
+	values, err := field.Values(f)
+	return field, values, err
+}
+
+// upToDate reports whether a derived file is newer than the files it is derived from
+func upToDate(fileName string, current, previous *forecastFile) bool {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return false
+	}
+	for _, source := range []*forecastFile{current, previous} {
+		if source == nil {
+			continue
+		}
+		sourceInfo, err := source.Stat()
+		if err != nil || sourceInfo.ModTime().After(info.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeDerivedGRIB2 writes the derived fields of a file as GRIB2 messages, and
+// reports whether any field could be derived.
+func writeDerivedGRIB2(fileName string, current, previous *forecastFile, selectors []fieldSelector) (bool, error) {
+	temporary := fileName + ".tmp"
+	out, err := os.Create(temporary)
+	if err != nil {
+		return false, err
+	}
+	written := 0
+	for _, s := range selectors {
+		d := derivations[s.parameter]
+		derived, err := d.compute(s.level, current, previous)
+		if err != nil {
+			out.Close()
+			os.Remove(temporary)
+			return false, fmt.Errorf("%s %s: %v", current.Name(), s.String(), err)
+		}
+		if derived == nil {
+			continue
+		}
+		grid, err := grib2.ReadGrid(current, derived.source.GridSection)
+		if err == nil {
+			parameter := d.Derived
+			parameter.StartHours = derived.startHours
+			err = grib2.WriteDerivedField(out, current, derived.source, grid, derived.values, parameter)
+		}
+		if err != nil {
+			out.Close()
+			os.Remove(temporary)
+			return false, err
+		}
+		written++
+	}
+	if err := out.Close(); err != nil || written == 0 {
+		os.Remove(temporary)
+		return false, err
+	}
+	return true, os.Rename(temporary, fileName)
+}
+
+// writeDerivedNetCDF writes the derived fields of all files of a cycle to a NetCDF file
+func writeDerivedNetCDF(fileName string, cycle *cycleFields, selectors []fieldSelector) error {
+	header := netcdfHeader(cycle.grid, cycle.timeUnits(), filepath.Base(cycle.files[0]))
+	for _, s := range selectors {
+		d := derivations[s.parameter]
+		units := grib2.ParameterUnits(0, d.Category, d.Number)
+		header.Variables = append(header.Variables, netcdfVariable(s.netcdfName(), s.String()+" "+d.description, units, d.attributes...))
+	}
+
+	temporary := fileName + ".tmp"
+	out, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+	writer, err := netcdf.NewWriter(out, header)
+	if err == nil {
+		err = writeCoordinates(writer, cycle.grid)
+	}
+	if err == nil {
+		err = eachForecastFile(cycle, func(record int, current, previous *forecastFile) error {
+			return writeDerivedRecord(writer, record, cycle, current, previous, selectors)
+		})
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return os.Rename(temporary, fileName)
+}
+
+// writeDerivedRecord writes the derived fields of one file, fields that cannot be
+// derived are written as fill values.
+func writeDerivedRecord(writer *netcdf.Writer, record int, cycle *cycleFields, current, previous *forecastFile, selectors []fieldSelector) error {
+	if err := writer.Write("time", record, []float64{cycle.hours[record]}); err != nil {
+		return err
+	}
+	for _, s := range selectors {
+		derived, err := derivations[s.parameter].compute(s.level, current, previous)
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", current.Name(), s.String(), err)
+		}
+		values := make([]float64, cycle.grid.Points())
+		if derived != nil && len(derived.values) == len(values) {
+			values = derived.values
+		} else {
+			for i := range values {
+				values[i] = math.NaN()
+			}
+		}
+		if err := writer.Write(s.netcdfName(), record, float32Fill(values, fillValue)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func windInputs(level string) []fieldSelector {
+	return []fieldSelector{{"UGRD", level}, {"VGRD", level}}
+}
+
+// windComponents decodes the U and V components of the wind at a level
+func windComponents(level string, current *forecastFile) (*grib2.Field, []float64, []float64, error) {
+	uField, u, err := current.values("UGRD", level)
+	if err != nil || uField == nil {
+		return nil, nil, nil, err
+	}
+	vField, v, err := current.values("VGRD", level)
+	if err != nil || vField == nil {
+		return nil, nil, nil, err
+	}
+	if len(u) != len(v) {
+		return nil, nil, nil, fmt.Errorf("wind components on different grids")
+	}
+	return uField, u, v, nil
+}
+
+func windSpeed(level string, current, previous *forecastFile) (*derivedValues, error) {
+	source, u, v, err := windComponents(level, current)
+	if err != nil || source == nil {
+		return nil, err
+	}
+	speed := make([]float64, len(u))
+	for i := range u {
+		speed[i] = math.Hypot(u[i], v[i])
+	}
+	return &derivedValues{source: source, values: speed}, nil
+}
+
+// windDirection is the direction the wind blows from in degrees clockwise from
+// north, 0 for calm.
+func windDirection(level string, current, previous *forecastFile) (*derivedValues, error) {
+	source, u, v, err := windComponents(level, current)
+	if err != nil || source == nil {
+		return nil, err
+	}
+	direction := make([]float64, len(u))
+	for i := range u {
+		if u[i] == 0 && v[i] == 0 {
+			continue
+		}
+		direction[i] = math.Mod(math.Atan2(-u[i], -v[i])*180/math.Pi+360, 360)
+	}
+	return &derivedValues{source: source, values: direction}, nil
+}
+
+// relativeHumidity computes the relative humidity over water in percent from the
+// specific humidity, temperature and pressure at a level. The pressure of pressure
+// levels is their level, otherwise the pressure at the level or at the surface is
+// used.
+func relativeHumidity(level string, current, previous *forecastFile) (*derivedValues, error) {
+	_, q, err := current.values("SPFH", level)
+	if err != nil || q == nil {
+		return nil, err
+	}
+	source, t, err := current.values("TMP", level)
+	if err != nil || source == nil {
+		return nil, err
+	}
+
+	var pressure []float64
+	if source.Product.FirstSurface.Type != isobaricSurface {
+		for _, pressureLevel := range []string{level, "surface"} {
+			if _, pressure, err = current.values("PRES", pressureLevel); err != nil || pressure != nil {
+				break
+			}
+		}
+		if err != nil || pressure == nil {
+			return nil, err
+		}
+	}
+	if len(q) != len(t) || pressure != nil && len(pressure) != len(t) {
+		return nil, fmt.Errorf("humidity, temperature and pressure on different grids")
+	}
+
+	rh := make([]float64, len(t))
+	for i := range t {
+		p := source.Product.FirstSurface.Value
+		if pressure != nil {
+			p = pressure[i]
+		}
+		// vapour pressure from the specific humidity, saturation over water by Bolton (1980)
+		e := q[i] * p / (0.622 + 0.378*q[i])
+		saturation := 611.2 * math.Exp(17.67*(t[i]-273.15)/(t[i]-29.65))
+		rh[i] = math.Max(0, math.Min(100, 100*e/saturation))
+	}
+	return &derivedValues{source: source, values: rh}, nil
+}
+
+// stepPrecipitation de-accumulates precipitation to the amount of the forecast
+// step since the previous file. GFS accumulates from the start of the run or of
+// the last 6 hour period, the amount of the step is either a field of the file or
+// the difference of fields of both files accumulated from the same start.
+func stepPrecipitation(level string, current, previous *forecastFile) (*derivedValues, error) {
+	start := 0
+	if previous != nil {
+		start = previous.hour
+	}
+	accumulations := func(f *forecastFile) []*grib2.Field {
+		fields := make([]*grib2.Field, 0)
+		if f == nil {
+			return fields
+		}
+		s := fieldSelector{parameter: "APCP", level: level}
+		for _, field := range f.fields {
+			if s.matches(field) && field.Product.Statistic == grib2.StatisticAccumulated {
+				fields = append(fields, field)
+			}
+		}
+		return fields
+	}
+
+	for _, field := range accumulations(current) {
+		if field.Product.StartHours() == start {
+			values, err := field.Values(current)
+			return &derivedValues{source: field, values: values, startHours: start}, err
+		}
+	}
+	for _, field := range accumulations(current) {
+		for _, earlier := range accumulations(previous) {
+			if earlier.Product.StartHours() != field.Product.StartHours() || earlier.Product.ForecastHours() != start {
+				continue
+			}
+			total, err := field.Values(current)
+			if err != nil {
+				return nil, err
+			}
+			before, err := earlier.Values(previous)
+			if err != nil {
+				return nil, err
+			}
+			if len(total) != len(before) {
+				return nil, fmt.Errorf("accumulations on different grids")
+			}
+			for i := range total {
+				// packing may make the difference slightly negative
+				total[i] = math.Max(0, total[i]-before[i])
+			}
+			return &derivedValues{source: field, values: total, startHours: start}, nil
+		}
+	}
+	if len(accumulations(current)) > 0 {
+		log.Println("Cannot de-accumulate", "file", current.Name(), "field", "APCP:"+level, "from hour", start)
+	}
+	return nil, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+// testPointsGrid is a row of 5 points along the equator, one for each case of a test
+var testPointsGrid = grib2.Grid{Ni: 5, Nj: 1, La1: 0, Lo1: 0, La2: 0, Lo2: 40, Di: 10, Dj: 10, ScanningMode: grib2.ScanNorthToSouth}
+
+// testForecastFile writes the fields of a forecast hour and opens the file
+func testForecastFile(t *testing.T, folder string, hour int, fields ...testField) *forecastFile {
+	file, err := grib2.Open(testCycleFile(t, folder, testReferenceTime, hour, testPointsGrid, fields...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gribFields, err := file.Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &forecastFile{File: file, hour: hour, fields: gribFields}
+}
+
+func checkDerived(t *testing.T, name string, derived *derivedValues, want []float64, tolerance float64) {
+	if derived == nil {
+		t.Errorf("%s: nothing derived", name)
+		return
+	}
+	for i := range want {
+		if math.Abs(derived.values[i]-want[i]) > tolerance {
+			t.Errorf("%s: got %v, want %v", name, derived.values, want)
+			return
+		}
+	}
+}
+
+func TestWindDerivations(t *testing.T) {
+	folder, err := ioutil.TempDir("", "derive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	// wind from the north, east, south and north-west, and calm
+	u := []float64{0, -5, 0, 3, 0}
+	v := []float64{-5, 0, 5, -3, 0}
+	current := testForecastFile(t, folder, 3,
+		testField{category: 2, number: 2, surface: 103, value: 10, values: u},
+		testField{category: 2, number: 3, surface: 103, value: 10, values: v})
+	defer current.Close()
+
+	direction, err := windDirection("10 m above ground", current, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDerived(t, "direction", direction, []float64{0, 90, 180, 315, 0}, 1e-9)
+	speed, err := windSpeed("10 m above ground", current, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDerived(t, "speed", speed, []float64{5, 5, 5, 3 * math.Sqrt2, 0}, 1e-9)
+
+	if direction, err := windDirection("850 mb", current, nil); err != nil || direction != nil {
+		t.Errorf("got %v, %v for a level without wind", direction, err)
+	}
+}
+
+func TestRelativeHumidity(t *testing.T) {
+	folder, err := ioutil.TempDir("", "derive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	// the saturation vapour pressure of Bolton is 23.37 hPa at 20C, 42.46 hPa at 30C
+	// and 6.112 hPa at 0C. The specific humidities give 50 and 100 percent at 20C and
+	// 1000 hPa, more than saturation, none, and 30 percent at 30C and 700 hPa.
+	humidity := []float64{0.007300, 0.014665, 0.02, 0, 0.011396}
+	temperature := []float64{293.15, 293.15, 293.15, 293.15, 303.15}
+	pressure := []float64{100000, 100000, 100000, 100000, 70000}
+	current := testForecastFile(t, folder, 3,
+		testField{category: 1, number: 0, surface: 103, value: 2, decimalScale: 6, values: humidity},
+		testField{category: 0, number: 0, surface: 103, value: 2, values: temperature},
+		testField{category: 3, number: 0, surface: 1, values: pressure},
+		// pressure levels have no pressure field
+		testField{category: 1, number: 0, surface: 100, value: 85000, decimalScale: 6, values: []float64{0.003586, 0, 0, 0, 0}},
+		testField{category: 0, number: 0, surface: 100, value: 85000, values: []float64{273.15, 273.15, 273.15, 273.15, 273.15}},
+		testField{category: 1, number: 0, surface: 103, value: 10, decimalScale: 6, values: humidity})
+	defer current.Close()
+
+	rh, err := relativeHumidity("2 m above ground", current, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDerived(t, "surface pressure", rh, []float64{50, 100, 100, 0, 30}, 0.01)
+	rh, err = relativeHumidity("850 mb", current, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDerived(t, "pressure level", rh, []float64{80, 0, 0, 0, 0}, 0.01)
+
+	if rh, err := relativeHumidity("10 m above ground", current, nil); err != nil || rh != nil {
+		t.Errorf("got %v, %v for a level without temperature", rh, err)
+	}
+}
+
+func TestStepPrecipitation(t *testing.T) {
+	folder, err := ioutil.TempDir("", "derive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	apcp := func(hours int, values ...float64) testField {
+		return testField{category: 1, number: 8, surface: 1, accumulated: hours, values: values}
+	}
+
+	// GFS accumulates from the start of the run up to hour 6, then from hour 6 on
+	tests := []struct {
+		hour      int
+		fields    []testField
+		want      []float64
+		wantStart int
+	}{
+		{0, []testField{tmp2m(make([]float64, 5))}, nil, 0},
+		{3, []testField{apcp(3, 1, 0, 2, 0, 0.5)}, []float64{1, 0, 2, 0, 0.5}, 0},
+		// packing may give less than the hour before
+		{6, []testField{apcp(6, 3, 0, 2, 1, 0.49)}, []float64{2, 0, 0, 1, 0}, 3},
+		// the bucket starts again at hour 6
+		{9, []testField{apcp(3, 4, 1, 0, 0, 0)}, []float64{4, 1, 0, 0, 0}, 6},
+		{12, []testField{apcp(6, 5, 1, 3, 0, 0)}, []float64{1, 0, 3, 0, 0}, 9},
+		// an accumulation from the start of the run cannot follow one from hour 6
+		{15, []testField{apcp(15, 2, 0, 0, 0, 0)}, nil, 0},
+	}
+	var previous *forecastFile
+	for _, test := range tests {
+		current := testForecastFile(t, folder, test.hour, test.fields...)
+		derived, err := stepPrecipitation("surface", current, previous)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case test.want == nil && derived != nil:
+			t.Errorf("hour %d: got %v, want nothing", test.hour, derived.values)
+		case test.want != nil:
+			checkDerived(t, current.Name(), derived, test.want, 1e-6)
+			if derived != nil && derived.startHours != test.wantStart {
+				t.Errorf("hour %d: got interval from hour %d, want %d", test.hour, derived.startHours, test.wantStart)
+			}
+		}
+		if previous != nil {
+			previous.Close()
+		}
+		previous = current
+	}
+	previous.Close()
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+const diffFileName = "diff.json"
+
+// diffReport compares the forecasts of a cycle with those of the previous cycle
+// for the same valid times.
+type diffReport struct {
+	Cycle                 string         `json:"cycle"`
+	ReferenceTime         time.Time      `json:"referenceTime"`
+	Previous              string         `json:"previous"`
+	PreviousReferenceTime time.Time      `json:"previousReferenceTime"`
+	Variables             []variableDiff `json:"variables"`
+}
+
+// variableDiff are the differences of a variable over all valid times, and at
+// each of them. Differences are the new value minus the previous one.
+type variableDiff struct {
+	Field string `json:"field"`
+	Units string `json:"units,omitempty"`
+	differenceStats
+	Times []timeDiff `json:"times"`
+}
+
+// timeDiff are the differences of a variable at a valid time
+type timeDiff struct {
+	Time         time.Time `json:"time"`
+	Hour         int       `json:"hour"`
+	PreviousHour int       `json:"previousHour"`
+	differenceStats
+}
+
+// differenceStats are the mean absolute difference and the largest difference of
+// the points present in both forecasts, and its location.
+type differenceStats struct {
+	MeanAbsoluteDifference float64    `json:"meanAbsoluteDifference"`
+	MaxDifference          float64    `json:"maxDifference"`
+	MaxLat                 float64    `json:"maxLat"`
+	MaxLon                 float64    `json:"maxLon"`
+	MaxTime                *time.Time `json:"maxTime,omitempty"`
+	points                 int
+	sum                    float64
+}
+
+// add adds the differences of another set of points
+func (s *differenceStats) add(other differenceStats, validTime time.Time) {
+	if other.points == 0 {
+		return
+	}
+	if s.points == 0 || math.Abs(other.MaxDifference) > math.Abs(s.MaxDifference) {
+		s.MaxDifference, s.MaxLat, s.MaxLon = other.MaxDifference, other.MaxLat, other.MaxLon
+		s.MaxTime = &validTime
+	}
+	s.points += other.points
+	s.sum += other.sum
+	s.MeanAbsoluteDifference = s.sum / float64(s.points)
+}
+
+// diffCommand writes the differences of a cycle to the previous one and returns
+// the process exit code.
+func diffCommand(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	cycleFolder := flags.String("cycle", "", "folder of the downloaded cycle, e.g. gribfiles/gfs.20180405/06")
+	previousFolder := flags.String("previous", "", "folder of the cycle to compare with (default the cycle before it in the same destination)")
+	variables := flags.String("vars", "", "comma separated variables to compare, e.g. \"TMP:2m,PRMSL:msl\" (default all)")
+	output := flags.String("output", "", "json report to write (default <cycle>/diff.json)")
+	flags.Parse(args)
+
+	if *cycleFolder == "" {
+		flags.Usage()
+		return 2
+	}
+	selectors, err := parseOptionalPointVariables(*variables)
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+
+	folder, previous := *cycleFolder, *previousFolder
+	if previous == "" {
+		destination := filepath.Dir(filepath.Dir(filepath.Clean(folder)))
+		if previous, err = previousCycleFolder(destination, cycleFolderName.FindString(filepath.ToSlash(folder))); err != nil {
+			log.Println("No previous cycle", "cycle", folder, "error", err.Error())
+			return 1
+		}
+	}
+	if *output == "" {
+		*output = filepath.Join(folder, diffFileName)
+	}
+
+	report, err := diffCycles(gribFolder(folder), gribFolder(previous), selectors)
+	if err == nil {
+		err = writeDiffReport(*output, report)
+	}
+	if err != nil {
+		log.Println("Failed to compare", "cycle", folder, "previous", previous, "error", err.Error())
+		return 1
+	}
+	log.Println("Compared", "cycle", folder, "previous", previous, "variables", len(report.Variables), "report", *output)
+	return 0
+}
+
+// parseOptionalPointVariables parses a list of variables like the point API, an
+// empty list selects all fields.
+func parseOptionalPointVariables(list string) ([]fieldSelector, error) {
+	if list == "" {
+		return nil, nil
+	}
+	return parsePointVariables(list)
+}
+
+// gribFolder returns the folder with the GRIB2 files of a cycle folder, its crop
+// folder if the cycle only has cropped files.
+func gribFolder(cycleFolder string) string {
+	if fileNames, err := cycleGribFiles(cycleFolder); err == nil && len(fileNames) > 0 {
+		return cycleFolder
+	}
+	return filepath.Join(cycleFolder, cropFolderName)
+}
+
+// previousCycleFolder returns the folder of the newest cycle with files before a
+// cycle of the destination, e.g. gribfiles/gfs.20180405/00 for gfs.20180405/06.
+func previousCycleFolder(destination, subDir string) (string, error) {
+	cycles, err := cycleFolders(destination)
+	if err != nil {
+		return "", err
+	}
+	for _, candidate := range cycles {
+		if candidate >= subDir {
+			continue
+		}
+		if _, _, err := resolveCycle(destination, candidate); err == nil {
+			return filepath.Join(destination, candidate), nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// diffDownloadedCycle compares a cycle with the previous one once its downloads
+// are complete and returns the report, or "" if there is no previous cycle. The
+// report is not rewritten if nothing was downloaded.
+func diffDownloadedCycle(destinationFolder, subDir string, downloaded int, options downloadOptions) (string, error) {
+	cycleFolder := filepath.Join(destinationFolder, subDir)
+	fileName := filepath.Join(cycleFolder, diffFileName)
+	if _, err := os.Stat(fileName); downloaded == 0 && err == nil {
+		return "", nil
+	}
+	if gribFiles, err := cycleGribFiles(cycleSourceFolder(destinationFolder, subDir, options)); err != nil || len(gribFiles) == 0 {
+		return "", nil
+	}
+	previous, err := previousCycleFolder(destinationFolder, subDir)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// both cycles are compared on the same grid, cropped ones when cropping
+	previousFolder := gribFolder(previous)
+	if options.crop != nil {
+		previousFolder = filepath.Join(previous, cropFolderName)
+	}
+	report, err := diffCycles(cycleSourceFolder(destinationFolder, subDir, options), previousFolder, options.diffVars)
+	if err != nil {
+		return "", err
+	}
+	if err := writeDiffReport(fileName, report); err != nil {
+		return "", err
+	}
+	log.Println("Compared", "cycle", cycleFolder, "previous", previous, "variables", len(report.Variables))
+	return fileName, nil
+}
+
+// diffCycles compares the selected variables of the GRIB2 files of two cycle
+// folders at the valid times of both, all variables when no selectors are given.
+func diffCycles(folder, previousFolder string, selectors []fieldSelector) (*diffReport, error) {
+	current, err := readCycleFields(folder, selectors)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := readCycleFields(previousFolder, selectors)
+	if err != nil {
+		return nil, err
+	}
+	if !sameGrid(current.grid, previous.grid) {
+		return nil, fmt.Errorf("%s and %s are on different grids", folder, previousFolder)
+	}
+
+	report := &diffReport{
+		Cycle:                 cycleFolderName.FindString(filepath.ToSlash(folder)),
+		ReferenceTime:         current.referenceTime,
+		Previous:              cycleFolderName.FindString(filepath.ToSlash(previousFolder)),
+		PreviousReferenceTime: previous.referenceTime,
+		Variables:             make([]variableDiff, 0),
+	}
+	pairs := make([][2]*cycleVariable, 0)
+	for _, v := range current.variables {
+		if p := previous.variable(v.selector); p != nil {
+			pairs = append(pairs, [2]*cycleVariable{v, p})
+			report.Variables = append(report.Variables, variableDiff{Field: v.selector.String(), Units: v.units, Times: make([]timeDiff, 0)})
+		}
+	}
+
+	offset := current.referenceTime.Sub(previous.referenceTime).Hours()
+	for record, hour := range current.hours {
+		previousRecord := -1
+		for k, previousHour := range previous.hours {
+			if previousHour == hour+offset {
+				previousRecord = k
+			}
+		}
+		if previousRecord < 0 {
+			continue
+		}
+		validTime := current.referenceTime.Add(time.Duration(hour) * time.Hour)
+		err := diffRecord(current, previous, record, previousRecord, pairs, func(i int, stats differenceStats) {
+			report.Variables[i].Times = append(report.Variables[i].Times, timeDiff{
+				Time:            validTime,
+				Hour:            int(hour),
+				PreviousHour:    int(previous.hours[previousRecord]),
+				differenceStats: stats,
+			})
+			report.Variables[i].add(stats, validTime)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// diffRecord compares the variables of a file of each cycle, and calls add with the
+// index and the differences of the variables present in both.
+func diffRecord(current, previous *cycleFields, record, previousRecord int, pairs [][2]*cycleVariable, add func(int, differenceStats)) error {
+	file, err := os.Open(current.files[record])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	previousFile, err := os.Open(previous.files[previousRecord])
+	if err != nil {
+		return err
+	}
+	defer previousFile.Close()
+
+	for i, pair := range pairs {
+		f, p := pair[0].fields[record], pair[1].fields[previousRecord]
+		if f == nil || p == nil {
+			continue
+		}
+		values, err := f.Values(file)
+		if err != nil {
+			return err
+		}
+		previousValues, err := p.Values(previousFile)
+		if err != nil {
+			return err
+		}
+		add(i, differences(current.grid, values, previousValues))
+	}
+	return nil
+}
+
+// differences returns the statistics of the differences of two fields on a grid
+func differences(grid *grib2.Grid, values, previous []float64) differenceStats {
+	stats := differenceStats{}
+	largest := -1
+	for k := range values {
+		d := values[k] - previous[k]
+		if math.IsNaN(d) {
+			continue
+		}
+		stats.points++
+		stats.sum += math.Abs(d)
+		if largest < 0 || math.Abs(d) > math.Abs(stats.MaxDifference) {
+			stats.MaxDifference, largest = d, k
+		}
+	}
+	if stats.points > 0 {
+		stats.MeanAbsoluteDifference = stats.sum / float64(stats.points)
+		stats.MaxLat = grid.Latitude(largest / grid.Ni)
+		stats.MaxLon = grid.Longitude(largest % grid.Ni)
+		if stats.MaxLon > 180 {
+			stats.MaxLon -= 360
+		}
+	}
+	return stats
+}
+
+// writeDiffReport writes a report through a temporary file
+func writeDiffReport(fileName string, report *diffReport) error {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := fileName + ".tmp"
+	if err := ioutil.WriteFile(temporary, content, 0666); err != nil {
+		return err
+	}
+	return os.Rename(temporary, fileName)
+}
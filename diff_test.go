@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+// writeDiffCycles writes the 00 cycle with hours 0, 6 and 12 and the 06 cycle
+// with hours 0 and 6. The 06 cycle is one warmer everywhere, and five warmer at
+// 40N 160W.
+func writeDiffCycles(t *testing.T, destination string) {
+	previousReference := testReferenceTime.Add(-6 * time.Hour)
+	base := func(hour int) func(lat, lon float64) float64 {
+		return func(lat, lon float64) float64 {
+			return 250 + lat/2 + lon/10 + float64(hour)
+		}
+	}
+	for _, hour := range []int{0, 6, 12} {
+		testCycleFile(t, destination, previousReference, hour, testGlobalGrid, tmp2m(fill(testGlobalGrid, base(hour))))
+	}
+	for _, hour := range []int{0, 6} {
+		validHour := base(hour + 6)
+		testCycleFile(t, destination, testReferenceTime, hour, testGlobalGrid, tmp2m(fill(testGlobalGrid, func(lat, lon float64) float64 {
+			if lat == 40 && lon == 200 {
+				return validHour(lat, lon) + 5
+			}
+			return validHour(lat, lon) + 1
+		})))
+	}
+}
+
+func TestDiffCycles(t *testing.T) {
+	destination, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+	writeDiffCycles(t, destination)
+
+	report, err := diffCycles(filepath.Join(destination, "gfs.20180405/06"), filepath.Join(destination, "gfs.20180405/00"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Cycle != "gfs.20180405/06" || report.Previous != "gfs.20180405/00" || len(report.Variables) != 1 {
+		t.Fatalf("got report %+v", report)
+	}
+	v := report.Variables[0]
+	if v.Field != "TMP:2 m above ground" || v.Units != "K" {
+		t.Errorf("got variable %s in %s", v.Field, v.Units)
+	}
+
+	// hours 0 and 6 are compared with hours 6 and 12 of the previous cycle
+	if len(v.Times) != 2 || v.Times[0].Hour != 0 || v.Times[0].PreviousHour != 6 || v.Times[1].Hour != 6 || v.Times[1].PreviousHour != 12 {
+		t.Fatalf("got times %+v", v.Times)
+	}
+	if !v.Times[1].Time.Equal(time.Date(2018, 4, 5, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("got valid time %v for hour 6", v.Times[1].Time)
+	}
+	points := float64(testGlobalGrid.Points())
+	if mean := (points - 1 + 5) / points; math.Abs(v.MeanAbsoluteDifference-mean) > 1e-6 {
+		t.Errorf("got mean absolute difference %g, want %g", v.MeanAbsoluteDifference, mean)
+	}
+	if math.Abs(v.MaxDifference-5) > 1e-6 || v.MaxLat != 40 || v.MaxLon != -160 {
+		t.Errorf("got largest difference %g at %g, %g, want 5 at 40, -160", v.MaxDifference, v.MaxLat, v.MaxLon)
+	}
+	if v.MaxTime == nil || !v.MaxTime.Equal(time.Date(2018, 4, 5, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("got time of the largest difference %v", v.MaxTime)
+	}
+}
+
+func TestDiffDownloadedCycleCropped(t *testing.T) {
+	destination, err := ioutil.TempDir("", "diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+	writeDiffCycles(t, destination)
+
+	// -cropMode alongside keeps the global files next to the crop folder
+	box := grib2.BoundingBox{South: 30, West: -170, North: 50, East: -150}
+	for _, subDir := range []string{"gfs.20180405/00", "gfs.20180405/06"} {
+		folder := filepath.Join(destination, subDir)
+		fileNames, err := cycleGribFiles(folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.MkdirAll(filepath.Join(folder, cropFolderName), 0777)
+		for _, fileName := range fileNames {
+			if err := grib2.CropFile(fileName, filepath.Join(folder, cropFolderName, filepath.Base(fileName)), box); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	fileName, err := diffDownloadedCycle(destination, "gfs.20180405/06", 2, downloadOptions{crop: &box, diff: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report diffReport
+	if err := json.Unmarshal(content, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Previous != "gfs.20180405/00" || len(report.Variables) != 1 || len(report.Variables[0].Times) != 2 {
+		t.Fatalf("got report %s", content)
+	}
+	v := report.Variables[0]
+	if mean := (9.0 - 1 + 5) / 9; math.Abs(v.MeanAbsoluteDifference-mean) > 1e-6 {
+		t.Errorf("got mean absolute difference %g of the 9 cropped points, want %g", v.MeanAbsoluteDifference, mean)
+	}
+	if v.MaxLat != 40 || v.MaxLon != -160 {
+		t.Errorf("got largest difference at %g, %g, want 40, -160", v.MaxLat, v.MaxLon)
+	}
+}
+
+func TestDifferences(t *testing.T) {
+	grid := &grib2.Grid{Ni: 2, Nj: 2, La1: 10, Lo1: 350, Di: 10, Dj: 10, ScanningMode: grib2.ScanNorthToSouth}
+	nan := math.NaN()
+	stats := differences(grid, []float64{1, 2, nan, 4}, []float64{1, 5, 3, nan})
+	if stats.points != 2 || stats.MeanAbsoluteDifference != 1.5 || stats.MaxDifference != -3 {
+		t.Errorf("got %d points, mean %g and largest difference %g, want 2, 1.5 and -3", stats.points, stats.MeanAbsoluteDifference, stats.MaxDifference)
+	}
+	if stats.MaxLat != 10 || stats.MaxLon != 0 {
+		t.Errorf("got largest difference at %g, %g, want 10, 0", stats.MaxLat, stats.MaxLon)
+	}
+
+	if stats := differences(grid, []float64{nan, nan, nan, nan}, []float64{1, 2, 3, 4}); stats.points != 0 || stats.MeanAbsoluteDifference != 0 {
+		t.Errorf("got %+v for fields without common points", stats)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// fakeSource lists a single entry named after the source, or fails with err
+type fakeSource struct {
+	name  string
+	err   error
+	calls int
+}
+
+func (s *fakeSource) list(folder string, keep func(*ftp.Entry) bool) ([]*ftp.Entry, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []*ftp.Entry{{Name: s.name + folder}}, nil
+}
+
+func (s *fakeSource) open(folder string) (sourceFolder, error) {
+	return nil, errors.New("not supported")
+}
+
+func newTestFailover(threshold int, cooldown time.Duration, sources ...*fakeSource) *failoverSource {
+	s := &failoverSource{baseDir: "/"}
+	for _, src := range sources {
+		s.mirrors = append(s.mirrors, &mirror{
+			host:    src.name,
+			baseDir: "/" + src.name + "/",
+			source:  src,
+			breaker: &circuitBreaker{threshold: threshold, cooldown: cooldown},
+		})
+	}
+	return s
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, cooldown: 50 * time.Millisecond}
+	if !b.allow() {
+		t.Fatal("new breaker is open")
+	}
+	if b.failure() {
+		t.Fatal("first failure tripped the breaker")
+	}
+	if !b.allow() {
+		t.Fatal("breaker open below the threshold")
+	}
+	if !b.failure() {
+		t.Fatal("failure at the threshold did not trip the breaker")
+	}
+	if b.allow() {
+		t.Fatal("tripped breaker allows requests")
+	}
+	if wait := b.retryIn(); wait <= 0 || wait > 50*time.Millisecond {
+		t.Fatalf("retryIn of tripped breaker is %v, expected up to the cooldown", wait)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if b.retryIn() != 0 {
+		t.Fatal("retryIn is not zero after the cooldown")
+	}
+	if !b.allow() {
+		t.Fatal("breaker does not let a request through after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("breaker lets more than one request through after the cooldown")
+	}
+	if b.failure() {
+		t.Fatal("failure of an open breaker reported as tripping it")
+	}
+	if b.allow() {
+		t.Fatal("breaker allows requests after the retry failed")
+	}
+
+	b.success()
+	if !b.allow() || b.retryIn() != 0 {
+		t.Fatal("success did not close the breaker")
+	}
+}
+
+func TestFailoverOrder(t *testing.T) {
+	primary, secondary := &fakeSource{name: "primary"}, &fakeSource{name: "secondary"}
+	s := newTestFailover(1, time.Hour, primary, secondary)
+
+	entries, err := s.list("/gfs.20180405", nil)
+	if err != nil || entries[0].Name != "primary/primary/gfs.20180405" {
+		t.Fatalf("healthy primary not used first: %v %v", entries, err)
+	}
+	if secondary.calls != 0 {
+		t.Fatal("secondary tried although the primary succeeded")
+	}
+
+	// missing folders are looked for on the next mirror, but do not trip the breaker
+	primary.err = errNotFound
+	if entries, err = s.list("/gfs.20180405", nil); err != nil || entries[0].Name != "secondary/secondary/gfs.20180405" {
+		t.Fatalf("missing folder not looked for on the secondary: %v %v", entries, err)
+	}
+	if !s.mirrors[0].breaker.allow() {
+		t.Fatal("missing folder tripped the breaker of the primary")
+	}
+
+	primary.err = errors.New("connection refused")
+	if _, err = s.list("/gfs.20180405", nil); err != nil {
+		t.Fatalf("failover to the secondary failed: %v", err)
+	}
+	primary.calls = 0
+	if _, err = s.list("/gfs.20180405", nil); err != nil || primary.calls != 0 {
+		t.Fatalf("primary with an open breaker was tried: calls %d, error %v", primary.calls, err)
+	}
+}
+
+func TestFailoverReturnsFirstError(t *testing.T) {
+	firstErr := errors.New("connection refused")
+	s := newTestFailover(3, time.Hour, &fakeSource{name: "primary", err: firstErr}, &fakeSource{name: "secondary", err: errors.New("timeout")})
+	if _, err := s.list("/", nil); err != firstErr {
+		t.Fatalf("got error %v, expected that of the primary", err)
+	}
+}
+
+func TestFailoverWaitsForCooldown(t *testing.T) {
+	primary, secondary := &fakeSource{name: "primary", err: errors.New("down")}, &fakeSource{name: "secondary", err: errors.New("down")}
+	s := newTestFailover(1, 50*time.Millisecond, primary, secondary)
+	if _, err := s.list("/", nil); err == nil {
+		t.Fatal("list succeeded with all mirrors down")
+	}
+
+	// with all breakers open the next request waits for the first cooldown
+	primary.err, secondary.err = nil, nil
+	start := time.Now()
+	entries, err := s.list("/", nil)
+	if err != nil || entries[0].Name != "primary/primary/" {
+		t.Fatalf("list after the cooldown failed: %v %v", entries, err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("list returned after %v, before the cooldown", elapsed)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+// testReferenceTime is the reference time of the synthetic cycles of the tests
+var testReferenceTime = time.Date(2018, 4, 5, 6, 0, 0, 0, time.UTC)
+
+// testGlobalGrid is a global grid of 10 degrees going north to south from 90N 0E,
+// small enough to write fields of by hand
+var testGlobalGrid = grib2.Grid{Ni: 36, Nj: 19, La1: 90, Lo1: 0, La2: -90, Lo2: 350, Di: 10, Dj: 10, ScanningMode: grib2.ScanNorthToSouth}
+
+// testField is a field of a synthetic GRIB2 message: a parameter of a discipline,
+// 0 unless set, at a fixed surface, e.g. 103 and 2 for 2 m above ground. Fields accumulated
+// over the hours before the forecast hour are written with template 4.8. Values
+// are packed at a decimal scale of 2 unless decimalScale is set.
+type testField struct {
+	discipline       int
+	category, number int
+	surface          int
+	value            int
+	accumulated      int
+	decimalScale     int
+	values           []float64
+}
+
+// tmp2m returns TMP at 2 m above ground
+func tmp2m(values []float64) testField {
+	return testField{category: 0, number: 0, surface: 103, value: 2, values: values}
+}
+
+// fill returns the values of a field of grid computed from the location of each point
+func fill(grid grib2.Grid, value func(lat, lon float64) float64) []float64 {
+	values := make([]float64, 0, grid.Points())
+	for j := 0; j < grid.Nj; j++ {
+		for i := 0; i < grid.Ni; i++ {
+			values = append(values, value(grid.Latitude(j), grid.Longitude(i)))
+		}
+	}
+	return values
+}
+
+// testCycleFile returns the name of the file of a forecast hour of a cycle
+// below a destination, writing its fields if any are given
+func testCycleFile(t *testing.T, destination string, reference time.Time, hour int, grid grib2.Grid, fields ...testField) string {
+	folder := filepath.Join(destination, reference.Format("gfs.20060102/15"))
+	fileName := filepath.Join(folder, fmt.Sprintf("gfs.t%02dz.pgrb2.1p00.f%03d", reference.Hour(), hour))
+	if len(fields) == 0 {
+		return fileName
+	}
+	if err := os.MkdirAll(folder, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileName, testGRIB(reference, hour, grid, fields...), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// testGRIB returns a GRIB2 message for each field, packed with simple packing.
+// NaN values are masked by a bitmap.
+func testGRIB(reference time.Time, hour int, grid grib2.Grid, fields ...testField) []byte {
+	var out bytes.Buffer
+	for _, f := range fields {
+		sections := [][]byte{
+			testIdentification(reference),
+			testGridSection(grid),
+			testProduct(reference, hour, f),
+		}
+		decimalScale := 2
+		if f.decimalScale != 0 {
+			decimalScale = f.decimalScale
+		}
+		sections = append(sections, testSimplePacking(f.values, decimalScale)...)
+		sections = append(sections, []byte("7777"))
+
+		length := 16
+		for _, s := range sections {
+			length += len(s)
+		}
+		indicator := make([]byte, 16)
+		copy(indicator, "GRIB")
+		indicator[6], indicator[7] = byte(f.discipline), 2
+		binary.BigEndian.PutUint64(indicator[8:], uint64(length))
+		out.Write(indicator)
+		for _, s := range sections {
+			out.Write(s)
+		}
+	}
+	return out.Bytes()
+}
+
+func testIdentification(reference time.Time) []byte {
+	b := make([]byte, 21)
+	binary.BigEndian.PutUint32(b, 21)
+	b[4] = 1
+	binary.BigEndian.PutUint16(b[5:], 7) // NCEP
+	b[9], b[10], b[11] = 2, 1, 1
+	binary.BigEndian.PutUint16(b[12:], uint16(reference.Year()))
+	b[14], b[15], b[16] = byte(reference.Month()), byte(reference.Day()), byte(reference.Hour())
+	b[20] = 1
+	return b
+}
+
+func testGridSection(g grib2.Grid) []byte {
+	b := make([]byte, 72)
+	binary.BigEndian.PutUint32(b, 72)
+	b[4] = 3
+	binary.BigEndian.PutUint32(b[6:], uint32(g.Points()))
+	b[14] = 6
+	binary.BigEndian.PutUint32(b[30:], uint32(g.Ni))
+	binary.BigEndian.PutUint32(b[34:], uint32(g.Nj))
+	binary.BigEndian.PutUint32(b[42:], math.MaxUint32)
+	putTestSigned32(b[46:], g.La1)
+	putTestSigned32(b[50:], g.Lo1)
+	b[54] = 0x30
+	putTestSigned32(b[55:], g.La2)
+	putTestSigned32(b[59:], g.Lo2)
+	putTestSigned32(b[63:], g.Di)
+	putTestSigned32(b[67:], g.Dj)
+	b[71] = byte(g.ScanningMode)
+	return b
+}
+
+// putTestSigned32 writes degrees as sign and magnitude micro degrees
+func putTestSigned32(b []byte, degrees float64) {
+	v := int64(math.Round(degrees * 1e6))
+	if v < 0 {
+		binary.BigEndian.PutUint32(b, uint32(-v)|0x80000000)
+		return
+	}
+	binary.BigEndian.PutUint32(b, uint32(v))
+}
+
+// testProduct returns a product definition of template 4.0, or 4.8 for
+// accumulated fields
+func testProduct(reference time.Time, hour int, f testField) []byte {
+	length := 34
+	if f.accumulated > 0 {
+		length = 58
+	}
+	b := make([]byte, length)
+	binary.BigEndian.PutUint32(b, uint32(length))
+	b[4] = 4
+	b[9], b[10] = byte(f.category), byte(f.number)
+	b[11], b[13] = 2, 96
+	b[17] = 1 // hours
+	binary.BigEndian.PutUint32(b[18:], uint32(hour-f.accumulated))
+	b[22] = byte(f.surface)
+	binary.BigEndian.PutUint32(b[24:], uint32(f.value))
+	b[28] = 255
+	if f.accumulated > 0 {
+		binary.BigEndian.PutUint16(b[7:], 8)
+		end := reference.Add(time.Duration(hour) * time.Hour)
+		binary.BigEndian.PutUint16(b[34:], uint16(end.Year()))
+		b[36], b[37], b[38] = byte(end.Month()), byte(end.Day()), byte(end.Hour())
+		b[41] = 1
+		b[46], b[47], b[48] = 1, 2, 1 // accumulation, forecast time increased, hours
+		binary.BigEndian.PutUint32(b[49:], uint32(f.accumulated))
+		b[53] = 1
+	}
+	return b
+}
+
+// testSimplePacking returns the data representation, bitmap and data sections of
+// values packed with template 5.0
+func testSimplePacking(values []float64, decimalScale int) [][]byte {
+	scale := math.Pow10(decimalScale)
+	reference, maximum := math.Inf(1), math.Inf(-1)
+	present := make([]int64, 0, len(values))
+	bitmap := make([]byte, 6+(len(values)+7)/8)
+	for i, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		bitmap[6+i/8] |= 0x80 >> uint(i%8)
+		x := math.Round(v * scale)
+		reference, maximum = math.Min(reference, x), math.Max(maximum, x)
+		present = append(present, int64(x))
+	}
+	if len(present) == 0 {
+		reference, maximum = 0, 0
+	}
+	bits := 0
+	for int64(maximum-reference) >= int64(1)<<uint(bits) {
+		bits++
+	}
+
+	representation := make([]byte, 21)
+	binary.BigEndian.PutUint32(representation, 21)
+	representation[4] = 5
+	binary.BigEndian.PutUint32(representation[5:], uint32(len(present)))
+	binary.BigEndian.PutUint32(representation[11:], math.Float32bits(float32(reference)))
+	binary.BigEndian.PutUint16(representation[17:], uint16(decimalScale))
+	representation[19] = byte(bits)
+
+	binary.BigEndian.PutUint32(bitmap, uint32(len(bitmap)))
+	bitmap[4] = 6
+	if len(present) == len(values) {
+		bitmap = []byte{0, 0, 0, 6, 6, 255}
+	}
+
+	data := []byte{0, 0, 0, 0, 7}
+	var acc uint64
+	var used uint
+	for _, x := range present {
+		acc = acc<<uint(bits) | uint64(x-int64(reference))
+		used += uint(bits)
+		for used >= 8 {
+			data = append(data, byte(acc>>(used-8)))
+			used -= 8
+		}
+	}
+	if used > 0 {
+		data = append(data, byte(acc<<(8-used)))
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+	return [][]byte{representation, bitmap, data}
+}
+
+// testFolder is a sourceFolder serving files from memory. The server hashes
+// with algorithm, hash returns the sum of hashes or hashErr.
+type testFolder struct {
+	files     map[string]string
+	algorithm string
+	hashes    map[string]string
+	hashErr   error
+}
+
+func (f *testFolder) modTime(entry *ftp.Entry) time.Time {
+	return entry.Time
+}
+
+func (f *testFolder) retrieve(name string, offset int64) (io.ReadCloser, int64, error) {
+	content, ok := f.files[name]
+	if !ok {
+		return nil, 0, errNotFound
+	}
+	return ioutil.NopCloser(strings.NewReader(content[offset:])), offset, nil
+}
+
+func (f *testFolder) hashAlgorithm() string {
+	return f.algorithm
+}
+
+func (f *testFolder) hash(name string) (string, string, error) {
+	return f.algorithm, f.hashes[name], f.hashErr
+}
+
+func (f *testFolder) location(name string) string {
+	return "ftp://ftp.ncep.noaa.gov/gfs.20180405/06/" + name
+}
+
+func (f *testFolder) close() error {
+	return nil
+}
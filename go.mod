@@ -7,4 +7,7 @@ require (
 	github.com/nats-io/go-nats-streaming v0.4.4
 	github.com/nats-io/nats-server v1.4.1 // indirect
 	github.com/nats-io/nats-streaming-server v0.15.1 // indirect
+	golang.org/x/crypto v0.0.0-20190530122614-20be4c3c3ed5
 )
+
+replace github.com/jlaffaye/ftp => ./vendor/github.com/jlaffaye/ftp
@@ -0,0 +1,165 @@
+package grib2
+
+import (
+	"fmt"
+	"os"
+)
+
+// epsilon absorbs the rounding of grid coordinates stored in micro degrees
+const epsilon = 1e-6
+
+// BoundingBox is an area in degrees. Longitudes may be given between -180 and 180
+// or between 0 and 360, an area crossing the Greenwich meridian has West > East
+// in the latter case.
+type BoundingBox struct {
+	South, West, North, East float64
+}
+
+// Crop returns the part of the grid inside the bounding box, and the values of
+// its points taken from values, which holds a value for each point of the grid.
+func (g *Grid) Crop(values []float64, box BoundingBox) (*Grid, []float64, error) {
+	if len(values) != g.Points() {
+		return nil, nil, fmt.Errorf("grib2: %d values for %d grid points", len(values), g.Points())
+	}
+
+	rows, columns := g.rows(box), g.columns(box)
+	if len(rows) == 0 || len(columns) == 0 {
+		return nil, nil, fmt.Errorf("grib2: bounding box %+v does not intersect the grid", box)
+	}
+
+	cropped := &Grid{
+		Ni:           len(columns),
+		Nj:           len(rows),
+		La1:          g.Latitude(rows[0]),
+		Lo1:          g.Longitude(columns[0]),
+		La2:          g.Latitude(rows[len(rows)-1]),
+		Lo2:          g.Longitude(columns[len(columns)-1]),
+		Di:           g.Di,
+		Dj:           g.Dj,
+		ScanningMode: g.ScanningMode,
+		section:      g.section,
+	}
+
+	croppedValues := make([]float64, 0, cropped.Points())
+	for _, j := range rows {
+		for _, i := range columns {
+			croppedValues = append(croppedValues, values[j*g.Ni+i])
+		}
+	}
+	return cropped, croppedValues, nil
+}
+
+// Intersects reports whether any point of the grid is inside the bounding box
+func (g *Grid) Intersects(box BoundingBox) bool {
+	return len(g.rows(box)) > 0 && len(g.columns(box)) > 0
+}
+
+// rows returns the indexes of the rows inside the latitudes of the box
+func (g *Grid) rows(box BoundingBox) []int {
+	rows := make([]int, 0, g.Nj)
+	for j := 0; j < g.Nj; j++ {
+		if lat := g.Latitude(j); lat >= box.South-epsilon && lat <= box.North+epsilon {
+			rows = append(rows, j)
+		}
+	}
+	return rows
+}
+
+// columns returns the indexes of the columns inside the longitudes of the box,
+// west to east. On global grids the columns may wrap around the last one.
+func (g *Grid) columns(box BoundingBox) []int {
+	west := normalizeLongitude(box.West)
+	width := normalizeLongitude(box.East - box.West)
+	if width == 0 && box.East != box.West {
+		width = 360
+	}
+	inside := func(i int) bool {
+		return normalizeLongitude(g.Longitude(i)-west+epsilon) <= width+2*epsilon
+	}
+
+	global := float64(g.Ni)*g.Di >= 360-epsilon
+	start := -1
+	for i := 0; i < g.Ni; i++ {
+		previous := i - 1
+		if previous < 0 && global {
+			previous = g.Ni - 1
+		}
+		if inside(i) && (previous < 0 || !inside(previous)) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		if !global || !inside(0) {
+			return nil
+		}
+		start = 0 // the box covers all longitudes
+	}
+
+	columns := make([]int, 0, g.Ni)
+	for k := 0; k < g.Ni; k++ {
+		i := start + k
+		if i >= g.Ni {
+			if !global {
+				break
+			}
+			i -= g.Ni
+		}
+		if !inside(i) {
+			break
+		}
+		columns = append(columns, i)
+	}
+	return columns
+}
+
+// CropFile writes the fields of a GRIB2 file cropped to the bounding box to a new
+// file. Only regular lat/lon grids with simple or complex packing are supported,
+// the cropped fields are written with simple packing.
+func CropFile(fileName, croppedFileName string, box BoundingBox) error {
+	file, err := Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fields, err := file.Fields()
+	if err != nil {
+		return err
+	}
+
+	temporary := croppedFileName + ".tmp"
+	out, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if err = cropField(out, file, f, box); err != nil {
+			break
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return os.Rename(temporary, croppedFileName)
+}
+
+func cropField(out *os.File, file *File, f *Field, box BoundingBox) error {
+	grid, err := ReadGrid(file, f.GridSection)
+	if err != nil {
+		return err
+	}
+	values, err := f.Values(file)
+	if err != nil {
+		return err
+	}
+	croppedGrid, croppedValues, err := grid.Crop(values, box)
+	if err != nil {
+		return err
+	}
+	return WriteField(out, file, f, croppedGrid, croppedValues)
+}
@@ -0,0 +1,56 @@
+package grib2
+
+import (
+	"fmt"
+	"io"
+)
+
+// Derived is the parameter of a field computed from the values of another one,
+// e.g. the wind speed from the U component of the wind.
+type Derived struct {
+	Category int
+	Number   int
+	// DecimalScale is the decimal scale factor the values are packed with, the
+	// binary scale factor follows from their range
+	DecimalScale int
+	// StartHours is the start of the interval of statistically processed fields,
+	// for example of precipitation accumulated over the last forecast step. The
+	// interval still ends at the end of the interval of the source field.
+	StartHours int
+}
+
+// WriteDerivedField writes a GRIB2 message holding a field computed from f, like
+// WriteField, with the parameter of the product definition replaced by that of d.
+func WriteDerivedField(w io.Writer, r io.ReaderAt, f *Field, grid *Grid, values []float64, d Derived) error {
+	identification, err := readSectionBytes(r, f.Message.sections(1)[0])
+	if err != nil {
+		return err
+	}
+	product, err := readSectionBytes(r, f.ProductSection)
+	if err != nil {
+		return err
+	}
+	original, err := ReadDataRepresentation(r, f.RepresentationSection)
+	if err != nil {
+		return err
+	}
+
+	product[9] = byte(d.Category)
+	product[10] = byte(d.Number)
+	if f.Product.Statistic != StatisticNone {
+		end := f.Product.ForecastHours()
+		if d.StartHours > end {
+			return fmt.Errorf("grib2: interval starts at hour %d after its end at hour %d", d.StartHours, end)
+		}
+		// the time range is rewritten in hours, the end of the overall interval is kept
+		statistic, _ := statisticOffset(f.Product.Template)
+		product[17] = 1
+		putSigned32(product[18:22], int32(d.StartHours))
+		timeRange := product[statistic+12:]
+		timeRange[2] = 1
+		putSigned32(timeRange[3:7], int32(end-d.StartHours))
+	}
+
+	representation, bitmap, data := packSimple(values, 0, d.DecimalScale, original.OriginalValueType)
+	return writeMessage(w, f.Message.Discipline, identification, grid.bytes(), product, representation, bitmap, data)
+}
@@ -0,0 +1,64 @@
+package grib2
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestWriteDerivedField(t *testing.T) {
+	values := fill(&testGrid, func(lat, lon float64) float64 {
+		return math.Abs(lat) / 10
+	})
+	representation, bitmap, data := packSimple(values, 0, 2, 0)
+	wind := testProduct{template: 0, category: 2, number: 2, hour: 9, surface: 103, value: 10}
+	accumulated := testProduct{template: 8, category: 1, number: 8, hour: 12, surface: 1, statistic: StatisticAccumulated, hours: 6}
+	member := testProduct{template: 11, category: 1, number: 8, hour: 12, surface: 1, statistic: StatisticAccumulated, hours: 12, ensembleType: 3, member: 4}
+
+	tests := []struct {
+		name      string
+		product   testProduct
+		derived   Derived
+		parameter string
+		level     string
+		forecast  string
+		ensemble  string
+	}{
+		{"wind speed", wind, Derived{Category: 2, Number: 1, DecimalScale: 1}, "WIND", "10 m above ground", "9 hour fcst", ""},
+		{"same interval", accumulated, Derived{Category: 1, Number: 8, DecimalScale: 2, StartHours: 6}, "APCP", "surface", "6-12 hour acc fcst", ""},
+		{"step of the interval", accumulated, Derived{Category: 1, Number: 8, DecimalScale: 2, StartHours: 9}, "APCP", "surface", "9-12 hour acc fcst", ""},
+		{"ensemble member", member, Derived{Category: 1, Number: 8, DecimalScale: 2, StartHours: 6}, "APCP", "surface", "6-12 hour acc fcst", "ENS=+4"},
+	}
+	for _, test := range tests {
+		r, fields := testFields(t, testMessage(t, &testGrid, test.product, representation, bitmap, data))
+		var out bytes.Buffer
+		if err := WriteDerivedField(&out, r, fields[0], &testGrid, values, test.derived); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		r, fields = testFields(t, out.Bytes())
+		p := fields[0].Product
+		if fields[0].Parameter() != test.parameter || p.Forecast() != test.forecast || p.Ensemble() != test.ensemble || p.Level() != test.level {
+			t.Errorf("%s: got %s %s %s %s", test.name, fields[0].Parameter(), p.Level(), p.Forecast(), p.Ensemble())
+		}
+		written, err := fields[0].Values(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := ReadDataRepresentation(r, fields[0].RepresentationSection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tolerance := 0.5 / math.Pow10(d.DecimalScale)
+		for i := range values {
+			if d.DecimalScale != test.derived.DecimalScale || math.Abs(written[i]-values[i]) > tolerance {
+				t.Errorf("%s: got %g at point %d with decimal scale %d, want %g", test.name, written[i], i, d.DecimalScale, values[i])
+				break
+			}
+		}
+	}
+
+	r, fields := testFields(t, testMessage(t, &testGrid, accumulated, representation, bitmap, data))
+	if err := WriteDerivedField(&bytes.Buffer{}, r, fields[0], &testGrid, values, Derived{Category: 1, Number: 8, StartHours: 13}); err == nil {
+		t.Error("interval starting after its end written")
+	}
+}
@@ -0,0 +1,89 @@
+package grib2
+
+import (
+	"fmt"
+	"io"
+)
+
+// Field is one field of a message. Messages usually hold a single field, but
+// sections 3 to 7 may be repeated, a field then reuses the sections of the
+// previous field that are not repeated.
+type Field struct {
+	Message *Message
+	// Number is the number of the field within its message, starting at 1
+	Number  int
+	Product *Product
+
+	GridSection           Section
+	ProductSection        Section
+	RepresentationSection Section
+	BitmapSection         Section
+	DataSection           Section
+}
+
+// Fields returns the fields of the messages, in order
+func Fields(r io.ReaderAt, messages []*Message) ([]*Field, error) {
+	fields := make([]*Field, 0, len(messages))
+	for _, m := range messages {
+		current := &Field{Message: m}
+		number := 0
+		for _, s := range m.Sections {
+			switch s.Number {
+			case 3:
+				current.GridSection = s
+			case 4:
+				current.ProductSection = s
+			case 5:
+				current.RepresentationSection = s
+			case 6:
+				current.BitmapSection = s
+			case 7:
+				current.DataSection = s
+				if current.GridSection.Length == 0 || current.ProductSection.Length == 0 || current.RepresentationSection.Length == 0 {
+					return nil, &FormatError{s.Offset, "data section without grid, product or data representation"}
+				}
+				product, err := ReadProduct(r, current.ProductSection)
+				if err != nil {
+					return nil, err
+				}
+				number++
+				field := *current
+				field.Number = number
+				field.Product = product
+				fields = append(fields, &field)
+			}
+		}
+		if number == 0 {
+			return nil, &FormatError{m.Offset, "message without data section"}
+		}
+	}
+	return fields, nil
+}
+
+// Parameter returns the abbreviation of the parameter of the field, e.g. "TMP"
+func (f *Field) Parameter() string {
+	return ParameterName(f.Message.Discipline, f.Product.Category, f.Product.Number)
+}
+
+// IndexEntry returns the .idx line of the field. fields is the number of fields
+// in the message, fields of messages with several fields are numbered like 1.2.
+func (f *Field) IndexEntry(messageNumber, fields int) IndexEntry {
+	number := fmt.Sprintf("%d", messageNumber)
+	if fields > 1 {
+		number = fmt.Sprintf("%d.%d", messageNumber, f.Number)
+	}
+	return IndexEntry{
+		Number:    number,
+		Offset:    f.Message.Offset,
+		Date:      f.Message.ReferenceTime.Format("2006010215"),
+		Parameter: f.Parameter(),
+		Level:     f.Product.Level(),
+		Forecast:  f.Product.Forecast(),
+		Ensemble:  f.Product.Ensemble(),
+	}
+}
+
+// Units returns the units of the parameter of the field, e.g. "K"
+func (f *Field) Units() string {
+	return ParameterUnits(f.Message.Discipline, f.Product.Category, f.Product.Number)
+}
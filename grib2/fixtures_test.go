@@ -0,0 +1,115 @@
+package grib2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// testReferenceTime is the reference time of the synthetic messages of the tests
+var testReferenceTime = time.Date(2018, 4, 5, 6, 0, 0, 0, time.UTC)
+
+// testGrid is a global grid of 30 degrees going north to south from 90N 0E
+var testGrid = Grid{Ni: 12, Nj: 7, La1: 90, Lo1: 0, La2: -90, Lo2: 330, Di: 30, Dj: 30, ScanningMode: ScanNorthToSouth}
+
+// testProduct is the product definition of a synthetic message, of template 4.0,
+// 4.1 with an ensemble member, 4.8 with a statistical process over the hours
+// before the forecast hour, or 4.11 with both.
+type testProduct struct {
+	template         int
+	category, number int
+	hour             int
+	surface, value   int
+	statistic        int
+	hours            int
+	ensembleType     int
+	member           int
+}
+
+// tmp2m is TMP at 2 m above ground
+var tmp2m = testProduct{template: 0, category: 0, number: 0, surface: 103, value: 2}
+
+func (p testProduct) bytes(reference time.Time) []byte {
+	statistic, _ := statisticOffset(p.template)
+	length := 34
+	switch {
+	case statistic > 0:
+		length = statistic + 24
+	case p.template == 1:
+		length = 37
+	}
+	b := make([]byte, length)
+	binary.BigEndian.PutUint32(b, uint32(length))
+	b[4] = 4
+	binary.BigEndian.PutUint16(b[7:], uint16(p.template))
+	b[9], b[10] = byte(p.category), byte(p.number)
+	b[11], b[13] = 2, 96
+	b[17] = 1 // hours
+	putSigned32(b[18:], int32(p.hour-p.hours))
+	b[22] = byte(p.surface)
+	putSigned32(b[24:], int32(p.value))
+	b[28] = 255
+	if p.template == 1 || p.template == 11 {
+		b[34], b[35], b[36] = byte(p.ensembleType), byte(p.member), 30
+	}
+	if statistic > 0 {
+		end := reference.Add(time.Duration(p.hour) * time.Hour)
+		binary.BigEndian.PutUint16(b[statistic:], uint16(end.Year()))
+		b[statistic+2], b[statistic+3], b[statistic+4] = byte(end.Month()), byte(end.Day()), byte(end.Hour())
+		b[statistic+7] = 1
+		timeRange := b[statistic+12:]
+		timeRange[0], timeRange[1], timeRange[2] = byte(p.statistic), 2, 1
+		putSigned32(timeRange[3:], int32(p.hours))
+		timeRange[7] = 1
+	}
+	return b
+}
+
+func testIdentification(reference time.Time) []byte {
+	b := make([]byte, 21)
+	binary.BigEndian.PutUint32(b, 21)
+	b[4] = 1
+	binary.BigEndian.PutUint16(b[5:], 7) // NCEP
+	b[9], b[10], b[11] = 2, 1, 1
+	binary.BigEndian.PutUint16(b[12:], uint16(reference.Year()))
+	b[14], b[15], b[16] = byte(reference.Month()), byte(reference.Day()), byte(reference.Hour())
+	b[20] = 1
+	return b
+}
+
+// testMessage returns a message of discipline 0 with a field of the grid and
+// product, packed into the data representation, bitmap and data sections
+func testMessage(t *testing.T, grid *Grid, product testProduct, packed ...[]byte) []byte {
+	var out bytes.Buffer
+	sections := append([][]byte{testIdentification(testReferenceTime), grid.bytes(), product.bytes(testReferenceTime)}, packed...)
+	if err := writeMessage(&out, 0, sections...); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// testFields reads the fields of the messages of content
+func testFields(t *testing.T, content []byte) (*bytes.Reader, []*Field) {
+	r := bytes.NewReader(content)
+	messages, err := ReadMessages(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := Fields(r, messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, fields
+}
+
+// fill returns the values of a field of grid computed from the location of each point
+func fill(grid *Grid, value func(lat, lon float64) float64) []float64 {
+	values := make([]float64, 0, grid.Points())
+	for j := 0; j < grid.Nj; j++ {
+		for i := 0; i < grid.Ni; i++ {
+			values = append(values, value(grid.Latitude(j), grid.Longitude(i)))
+		}
+	}
+	return values
+}
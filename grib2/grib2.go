@@ -0,0 +1,212 @@
+// Package grib2 reads the structure of GRIB edition 2 files as described in
+// WMO Manual on Codes, FM 92 GRIB.
+//
+// A GRIB2 file is a sequence of messages. Each message starts with the
+// indicator section (section 0, the "GRIB" magic), followed by the
+// identification section (section 1), any number of repetitions of sections 2
+// to 7, and ends with the end section (section 8, "7777").
+package grib2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	indicatorLength = 16
+	endMarker       = "7777"
+)
+
+// FormatError describes a structural problem in a GRIB2 file
+type FormatError struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("grib2: %s at offset %d", e.Msg, e.Offset)
+}
+
+// Section is the location of a section within a file
+type Section struct {
+	Number int
+	Offset int64
+	Length int64
+}
+
+// Message is the location and identification of a GRIB2 message within a file
+type Message struct {
+	Offset        int64
+	Length        int64
+	Discipline    int
+	ReferenceTime time.Time
+	Sections      []Section
+}
+
+// ReadMessages walks all messages of a GRIB2 file, checking the magic, edition,
+// declared lengths and end markers of each of them.
+func ReadMessages(r io.ReaderAt, size int64) ([]*Message, error) {
+	messages := make([]*Message, 0)
+	for offset := int64(0); offset < size; {
+		m, err := readMessage(r, offset, size)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, m)
+		offset += m.Length
+	}
+	if len(messages) == 0 {
+		return nil, &FormatError{0, "no messages"}
+	}
+	return messages, nil
+}
+
+// ReadFile is ReadMessages on the named file
+func ReadFile(fileName string) ([]*Message, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return ReadMessages(file, stat.Size())
+}
+
+// File is an open GRIB2 file with the location of its messages
+type File struct {
+	*os.File
+	Messages []*Message
+}
+
+// Open opens the named file and walks its messages
+func Open(fileName string) (*File, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	messages, err := ReadMessages(file, stat.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &File{File: file, Messages: messages}, nil
+}
+
+// Fields returns the fields of all messages of the file
+func (f *File) Fields() ([]*Field, error) {
+	return Fields(f, f.Messages)
+}
+
+// CopyMessage writes the bytes of a message read from r to w, as is
+func CopyMessage(w io.Writer, r io.ReaderAt, m *Message) error {
+	_, err := io.Copy(w, io.NewSectionReader(r, m.Offset, m.Length))
+	return err
+}
+
+func readMessage(r io.ReaderAt, offset, size int64) (*Message, error) {
+	indicator := make([]byte, indicatorLength)
+	if _, err := r.ReadAt(indicator, offset); err != nil {
+		return nil, &FormatError{offset, "truncated indicator section"}
+	}
+	if string(indicator[0:4]) != "GRIB" {
+		return nil, &FormatError{offset, "missing GRIB magic"}
+	}
+	if edition := indicator[7]; edition != 2 {
+		return nil, &FormatError{offset, fmt.Sprintf("unsupported edition %d", edition)}
+	}
+
+	m := &Message{
+		Offset:     offset,
+		Length:     int64(binary.BigEndian.Uint64(indicator[8:16])),
+		Discipline: int(indicator[6]),
+		Sections:   []Section{{Number: 0, Offset: offset, Length: indicatorLength}},
+	}
+	end := offset + m.Length
+	if m.Length < int64(indicatorLength+len(endMarker)) || end > size {
+		return nil, &FormatError{offset, fmt.Sprintf("declared length %d exceeds file size %d", m.Length, size)}
+	}
+
+	header := make([]byte, 5)
+	for pos := offset + indicatorLength; ; {
+		if _, err := r.ReadAt(header[:4], pos); err != nil {
+			return nil, &FormatError{pos, "truncated section"}
+		}
+		if string(header[:4]) == endMarker {
+			if pos+int64(len(endMarker)) != end {
+				return nil, &FormatError{pos, "end section before declared message length"}
+			}
+			m.Sections = append(m.Sections, Section{Number: 8, Offset: pos, Length: int64(len(endMarker))})
+			break
+		}
+
+		if _, err := r.ReadAt(header, pos); err != nil {
+			return nil, &FormatError{pos, "truncated section"}
+		}
+		s := Section{
+			Number: int(header[4]),
+			Offset: pos,
+			Length: int64(binary.BigEndian.Uint32(header[:4])),
+		}
+		if s.Number < 1 || s.Number > 7 {
+			return nil, &FormatError{pos, fmt.Sprintf("invalid section number %d", s.Number)}
+		}
+		if s.Length < 5 || pos+s.Length > end-int64(len(endMarker)) {
+			return nil, &FormatError{pos, fmt.Sprintf("section %d length %d exceeds message", s.Number, s.Length)}
+		}
+		if (len(m.Sections) == 1) != (s.Number == 1) {
+			return nil, &FormatError{pos, fmt.Sprintf("section %d out of order", s.Number)}
+		}
+		if s.Number == 1 {
+			referenceTime, err := readReferenceTime(r, s)
+			if err != nil {
+				return nil, err
+			}
+			m.ReferenceTime = referenceTime
+		}
+
+		m.Sections = append(m.Sections, s)
+		pos += s.Length
+	}
+
+	if m.ReferenceTime.IsZero() {
+		return nil, &FormatError{offset, "missing identification section"}
+	}
+	return m, nil
+}
+
+// readReferenceTime reads octets 13-19 of the identification section
+func readReferenceTime(r io.ReaderAt, s Section) (time.Time, error) {
+	if s.Length < 21 {
+		return time.Time{}, &FormatError{s.Offset, "identification section too short"}
+	}
+	b := make([]byte, 7)
+	if _, err := r.ReadAt(b, s.Offset+12); err != nil {
+		return time.Time{}, &FormatError{s.Offset, "truncated identification section"}
+	}
+	year := int(binary.BigEndian.Uint16(b[0:2]))
+	return time.Date(year, time.Month(b[2]), int(b[3]), int(b[4]), int(b[5]), int(b[6]), 0, time.UTC), nil
+}
+
+// sections returns the sections of the message with the given number
+func (m *Message) sections(number int) []Section {
+	sections := make([]Section, 0, 1)
+	for _, s := range m.Sections {
+		if s.Number == number {
+			sections = append(sections, s)
+		}
+	}
+	return sections
+}
@@ -0,0 +1,77 @@
+package grib2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadMessages(t *testing.T) {
+	representation, bitmap, data := packSimple(make([]float64, testGrid.Points()), 0, 0, 0)
+	valid := testMessage(t, &testGrid, tmp2m, representation, bitmap, data)
+	// modify returns a copy of the valid message changed by f
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), valid...))
+	}
+
+	tests := []struct {
+		name     string
+		content  []byte
+		messages int
+		err      string
+	}{
+		{"valid message", valid, 1, ""},
+		{"two messages", append(append([]byte(nil), valid...), valid...), 2, ""},
+		{"empty file", nil, 0, "no messages"},
+		{"truncated file", valid[:len(valid)-10], 0, "exceeds file size"},
+		{"truncated section", modify(func(b []byte) []byte {
+			// the data section claims more bytes than the message has
+			binary.BigEndian.PutUint32(b[len(b)-4-len(data):], uint32(len(data)+4))
+			return b
+		}), 0, "section 7 length"},
+		{"bad 7777 trailer", modify(func(b []byte) []byte {
+			copy(b[len(b)-4:], "7778")
+			return b
+		}), 0, "truncated section"},
+		{"missing magic", modify(func(b []byte) []byte {
+			copy(b, "GRIP")
+			return b
+		}), 0, "missing GRIB magic"},
+		{"edition 1", modify(func(b []byte) []byte {
+			b[7] = 1
+			return b
+		}), 0, "unsupported edition 1"},
+		{"sections out of order", modify(func(b []byte) []byte {
+			b[indicatorLength+4] = 3
+			return b
+		}), 0, "out of order"},
+		{"trailing bytes", append(append([]byte(nil), valid...), "GRIB"...), 1, "truncated indicator section"},
+	}
+	for _, test := range tests {
+		messages, err := ReadMessages(bytes.NewReader(test.content), int64(len(test.content)))
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+		if len(messages) != test.messages {
+			t.Errorf("%s: got %d messages, want %d", test.name, len(messages), test.messages)
+		}
+	}
+
+	messages, err := ReadMessages(bytes.NewReader(valid), int64(len(valid)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := messages[0]
+	if m.Length != int64(len(valid)) || m.Discipline != 0 || !m.ReferenceTime.Equal(time.Date(2018, 4, 5, 6, 0, 0, 0, time.UTC)) {
+		t.Errorf("got message %+v", m)
+	}
+	numbers := make([]string, len(m.Sections))
+	for i, s := range m.Sections {
+		numbers[i] = string(rune('0' + s.Number))
+	}
+	if got := strings.Join(numbers, " "); got != "0 1 3 4 5 6 7 8" {
+		t.Errorf("got sections %s, want 0 to 8 without section 2", got)
+	}
+}
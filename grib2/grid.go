@@ -0,0 +1,194 @@
+package grib2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Scanning modes of flag table 3.4 the values of a Grid are ordered by
+const (
+	ScanNorthToSouth = 0x00
+	ScanSouthToNorth = 0x40
+)
+
+// Other flags of table 3.4, values scanned this way are reordered by Values
+const (
+	scanEastToWest   = 0x80
+	scanColumns      = 0x20 // adjacent points are consecutive in latitude
+	scanAlternating  = 0x10 // every other row or column goes the opposite way
+	scanReorderFlags = scanEastToWest | scanColumns | scanAlternating
+)
+
+// Grid is a regular lat/lon grid of template 3.0. Angles are in degrees, points
+// are stored west to east, consecutive in longitude, rows going north to south
+// or south to north according to ScanningMode.
+type Grid struct {
+	Ni, Nj       int
+	La1, Lo1     float64
+	La2, Lo2     float64
+	Di, Dj       float64
+	ScanningMode int
+
+	// section is the grid definition section the grid was read from, its shape
+	// of the earth and resolution flags are kept when the grid is written.
+	section []byte
+	// scan is the scanning mode of the section, the values of the field are in
+	// its order until reordered
+	scan int
+}
+
+// ReadGrid reads a grid definition section of template 3.0. Grids scanned east
+// to west, by columns or alternating directions are returned in the order of
+// ScanningMode, Values reorders their values likewise.
+func ReadGrid(r io.ReaderAt, s Section) (*Grid, error) {
+	if s.Number != 3 {
+		return nil, &FormatError{s.Offset, fmt.Sprintf("section %d is not a grid definition", s.Number)}
+	}
+	b := make([]byte, s.Length)
+	if _, err := r.ReadAt(b, s.Offset); err != nil {
+		return nil, &FormatError{s.Offset, "truncated grid definition section"}
+	}
+	if len(b) < 14 {
+		return nil, &FormatError{s.Offset, "grid definition section too short"}
+	}
+	if template := binary.BigEndian.Uint16(b[12:14]); template != 0 {
+		return nil, &FormatError{s.Offset, fmt.Sprintf("unsupported grid definition template 3.%d", template)}
+	}
+	if len(b) < 72 || b[10] != 0 {
+		return nil, &FormatError{s.Offset, "unsupported grid definition section layout"}
+	}
+
+	// angles are in micro degrees unless a basic angle and subdivisions are given
+	unit := 1e-6
+	basicAngle, subdivisions := binary.BigEndian.Uint32(b[38:42]), binary.BigEndian.Uint32(b[42:46])
+	if basicAngle != 0 && basicAngle != math.MaxUint32 && subdivisions != 0 && subdivisions != math.MaxUint32 {
+		unit = float64(basicAngle) / float64(subdivisions)
+	}
+
+	g := &Grid{
+		Ni:           int(binary.BigEndian.Uint32(b[30:34])),
+		Nj:           int(binary.BigEndian.Uint32(b[34:38])),
+		La1:          float64(signed32(b[46:50])) * unit,
+		Lo1:          float64(signed32(b[50:54])) * unit,
+		La2:          float64(signed32(b[55:59])) * unit,
+		Lo2:          float64(signed32(b[59:63])) * unit,
+		Di:           float64(binary.BigEndian.Uint32(b[63:67])) * unit,
+		Dj:           float64(binary.BigEndian.Uint32(b[67:71])) * unit,
+		ScanningMode: int(b[71]) & ScanSouthToNorth,
+		section:      b,
+		scan:         int(b[71]),
+	}
+	if g.scan&^(scanReorderFlags|ScanSouthToNorth) != 0 {
+		return nil, &FormatError{s.Offset, fmt.Sprintf("unsupported scanning mode %#x", g.scan)}
+	}
+	if g.scan&scanEastToWest != 0 {
+		g.Lo1, g.Lo2 = normalizeLongitude(g.Lo1-float64(g.Ni-1)*g.Di), g.Lo1
+	}
+	return g, nil
+}
+
+// reorder returns values in the scanning order of the section as values in the
+// order of ScanningMode
+func (g *Grid) reorder(values []float64) []float64 {
+	if g.scan&scanReorderFlags == 0 {
+		return values
+	}
+	ordered := make([]float64, len(values))
+	for n, v := range values {
+		var i, j int
+		if g.scan&scanColumns == 0 {
+			i, j = n%g.Ni, n/g.Ni
+			if g.scan&scanAlternating != 0 && j%2 == 1 {
+				i = g.Ni - 1 - i
+			}
+		} else {
+			i, j = n/g.Nj, n%g.Nj
+			if g.scan&scanAlternating != 0 && i%2 == 1 {
+				j = g.Nj - 1 - j
+			}
+		}
+		if g.scan&scanEastToWest != 0 {
+			i = g.Ni - 1 - i
+		}
+		ordered[j*g.Ni+i] = v
+	}
+	return ordered
+}
+
+// Points returns the number of points of the grid
+func (g *Grid) Points() int {
+	return g.Ni * g.Nj
+}
+
+// Latitude returns the latitude of row j
+func (g *Grid) Latitude(j int) float64 {
+	if g.ScanningMode == ScanSouthToNorth {
+		return g.La1 + float64(j)*g.Dj
+	}
+	return g.La1 - float64(j)*g.Dj
+}
+
+// Longitude returns the longitude of column i, between 0 and 360
+func (g *Grid) Longitude(i int) float64 {
+	return normalizeLongitude(g.Lo1 + float64(i)*g.Di)
+}
+
+// bytes encodes the grid as a grid definition section of template 3.0
+func (g *Grid) bytes() []byte {
+	b := make([]byte, 72)
+	if len(g.section) >= 72 {
+		copy(b, g.section[:72])
+	} else {
+		b[14] = 6    // shape of the earth: spherical, radius 6371229 m
+		b[54] = 0x30 // u and v relative to the easterly and northerly directions
+	}
+	binary.BigEndian.PutUint32(b[0:4], 72)
+	b[4] = 3
+	b[5] = 0
+	binary.BigEndian.PutUint32(b[6:10], uint32(g.Points()))
+	b[10], b[11] = 0, 0
+	binary.BigEndian.PutUint16(b[12:14], 0)
+
+	binary.BigEndian.PutUint32(b[30:34], uint32(g.Ni))
+	binary.BigEndian.PutUint32(b[34:38], uint32(g.Nj))
+	binary.BigEndian.PutUint32(b[38:42], 0)
+	binary.BigEndian.PutUint32(b[42:46], math.MaxUint32)
+	putSigned32(b[46:50], microDegrees(g.La1))
+	putSigned32(b[50:54], microDegrees(normalizeLongitude(g.Lo1)))
+	putSigned32(b[55:59], microDegrees(g.La2))
+	putSigned32(b[59:63], microDegrees(normalizeLongitude(g.Lo2)))
+	binary.BigEndian.PutUint32(b[63:67], uint32(microDegrees(g.Di)))
+	binary.BigEndian.PutUint32(b[67:71], uint32(microDegrees(g.Dj)))
+	b[71] = byte(g.ScanningMode)
+	return b
+}
+
+func microDegrees(degrees float64) int32 {
+	return int32(math.Round(degrees * 1e6))
+}
+
+func normalizeLongitude(lon float64) float64 {
+	lon = math.Mod(lon, 360)
+	if lon < 0 {
+		lon += 360
+	}
+	return lon
+}
+
+func putSigned32(b []byte, v int32) {
+	if v < 0 {
+		binary.BigEndian.PutUint32(b, uint32(-v)|0x80000000)
+		return
+	}
+	binary.BigEndian.PutUint32(b, uint32(v))
+}
+
+func putSigned16(b []byte, v int16) {
+	if v < 0 {
+		binary.BigEndian.PutUint16(b, uint16(-v)|0x8000)
+		return
+	}
+	binary.BigEndian.PutUint16(b, uint16(v))
+}
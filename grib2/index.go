@@ -0,0 +1,83 @@
+package grib2
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// IndexEntry is a line of a wgrib2 style .idx inventory, e.g.
+//
+//	1:0:d=2018040506:HGT:planetary boundary layer:anl:
+//
+// Fields of messages holding several fields are numbered 1.1, 1.2 and so on and
+// share the offset of their message. Lines of ensemble members end with the
+// member after the forecast, e.g. 6 hour fcst:ENS=+1.
+type IndexEntry struct {
+	Number    string
+	Offset    int64
+	Date      string
+	Parameter string
+	Level     string
+	Forecast  string
+	Ensemble  string
+}
+
+// ParseIndex reads the lines of an .idx inventory
+func ParseIndex(r io.Reader) ([]IndexEntry, error) {
+	entries := make([]IndexEntry, 0)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		fields := strings.SplitN(text, ":", 7)
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("grib2: invalid index line %d: %q", line, text)
+		}
+		offset, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("grib2: invalid offset on index line %d: %q", line, text)
+		}
+		entries = append(entries, IndexEntry{
+			Number:    fields[0],
+			Offset:    offset,
+			Date:      strings.TrimPrefix(fields[2], "d="),
+			Parameter: fields[3],
+			Level:     fields[4],
+			Forecast:  fields[5],
+		})
+		if len(fields) == 7 && strings.HasPrefix(fields[6], "ENS=") {
+			entries[len(entries)-1].Ensemble = strings.TrimSuffix(fields[6], ":")
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// MessageOffsets returns the distinct message offsets of the index, in order
+func MessageOffsets(entries []IndexEntry) []int64 {
+	offsets := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		if len(offsets) == 0 || offsets[len(offsets)-1] != e.Offset {
+			offsets = append(offsets, e.Offset)
+		}
+	}
+	return offsets
+}
+
+// CheckIndex verifies that the messages of a file are those listed in its index
+func CheckIndex(messages []*Message, entries []IndexEntry) error {
+	offsets := MessageOffsets(entries)
+	if len(offsets) != len(messages) {
+		return fmt.Errorf("grib2: file has %d messages, index lists %d", len(messages), len(offsets))
+	}
+	for i, m := range messages {
+		if m.Offset != offsets[i] {
+			return fmt.Errorf("grib2: message %d is at offset %d, index has %d", i+1, m.Offset, offsets[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package grib2
+
+import (
+	"strings"
+	"testing"
+)
+
+// testIndex has lines of the .idx of a GFS file and of wgrib2 -s for an ensemble
+// member and for a message with two fields
+const testIndex = `1:0:d=2018040506:PRMSL:mean sea level:3 hour fcst:
+2:38452:d=2018040506:CLWMR:1 hybrid level:3 hour fcst:
+
+3:46733:d=2018040506:APCP:surface:0-3 hour acc fcst:
+4:63120:d=2018040506:HGT:10 mb:3 hour fcst:ENS=+1
+5.1:80011:d=2018040506:UGRD:10 m above ground:3 hour fcst:
+5.2:80011:d=2018040506:VGRD:10 m above ground:3 hour fcst:
+`
+
+func TestParseIndex(t *testing.T) {
+	entries, err := ParseIndex(strings.NewReader(testIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("got %d entries, want 6", len(entries))
+	}
+	want := IndexEntry{Number: "3", Offset: 46733, Date: "2018040506", Parameter: "APCP", Level: "surface", Forecast: "0-3 hour acc fcst"}
+	if entries[2] != want {
+		t.Errorf("got %+v, want %+v", entries[2], want)
+	}
+	if entries[3].Forecast != "3 hour fcst" || entries[4].Number != "5.1" {
+		t.Errorf("got %+v and %+v", entries[3], entries[4])
+	}
+	// the lines of the first entries, after the blank line
+	lines := strings.Split(testIndex, "\n")
+	for i, line := range []string{lines[0], lines[1], lines[3]} {
+		if entries[i].String() != line {
+			t.Errorf("got line %q, want %q", entries[i].String(), line)
+		}
+	}
+
+	offsets := MessageOffsets(entries)
+	if len(offsets) != 5 || offsets[4] != 80011 {
+		t.Errorf("got offsets %v, want one per message", offsets)
+	}
+
+	for _, line := range []string{"1:0:d=2018040506:PRMSL", "1:zero:d=2018040506:PRMSL:mean sea level:anl:"} {
+		if _, err := ParseIndex(strings.NewReader(line)); err == nil {
+			t.Errorf("invalid line %q parsed", line)
+		}
+	}
+}
+
+func TestCheckIndex(t *testing.T) {
+	entries, err := ParseIndex(strings.NewReader(testIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := func(offsets ...int64) []*Message {
+		m := make([]*Message, len(offsets))
+		for i, offset := range offsets {
+			m[i] = &Message{Offset: offset}
+		}
+		return m
+	}
+
+	if err := CheckIndex(messages(0, 38452, 46733, 63120, 80011), entries); err != nil {
+		t.Error(err)
+	}
+	if err := CheckIndex(messages(0, 38452, 46733, 63120), entries); err == nil || !strings.Contains(err.Error(), "file has 4 messages, index lists 5") {
+		t.Errorf("got error %v for a missing message", err)
+	}
+	if err := CheckIndex(messages(0, 38452, 46734, 63120, 80011), entries); err == nil || !strings.Contains(err.Error(), "message 3 is at offset 46734") {
+		t.Errorf("got error %v for a moved message", err)
+	}
+}
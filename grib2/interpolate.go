@@ -0,0 +1,98 @@
+package grib2
+
+import (
+	"fmt"
+	"math"
+)
+
+// position returns the fractional column and row of a location on the grid.
+// Longitudes wrap around on global grids.
+func (g *Grid) position(lat, lon float64) (x, y float64, err error) {
+	if g.ScanningMode == ScanSouthToNorth {
+		y = (lat - g.La1) / g.Dj
+	} else {
+		y = (g.La1 - lat) / g.Dj
+	}
+	// on global grids x may be between the last column and the first one
+	x = normalizeLongitude(lon-g.Lo1) / g.Di
+	if x > float64(g.Ni-1)+epsilon && !g.global() {
+		return 0, 0, fmt.Errorf("grib2: longitude %g is outside the grid", lon)
+	}
+	if y < -epsilon || y > float64(g.Nj-1)+epsilon {
+		return 0, 0, fmt.Errorf("grib2: latitude %g is outside the grid", lat)
+	}
+	return x, math.Max(0, math.Min(y, float64(g.Nj-1))), nil
+}
+
+// Contains reports whether a location is inside the grid, where it can be
+// interpolated
+func (g *Grid) Contains(lat, lon float64) bool {
+	_, _, err := g.position(lat, lon)
+	return err == nil
+}
+
+// global reports whether the columns go around the earth
+func (g *Grid) global() bool {
+	return float64(g.Ni)*g.Di >= 360-epsilon
+}
+
+// column returns the index of column i, wrapped around on global grids
+func (g *Grid) column(i int) int {
+	if i >= g.Ni {
+		return i - g.Ni
+	}
+	return i
+}
+
+// Nearest returns the value of the grid point nearest to a location. values
+// holds a value for each point of the grid.
+func (g *Grid) Nearest(values []float64, lat, lon float64) (float64, error) {
+	x, y, err := g.position(lat, lon)
+	if err != nil {
+		return 0, err
+	}
+	i, j := int(math.Floor(x+0.5)), int(math.Floor(y+0.5))
+	return values[j*g.Ni+g.column(i)], nil
+}
+
+// Bilinear interpolates the values of the four grid points around a location.
+// Missing values are left out and the weights of the others scaled up, the
+// result is NaN if all four are missing.
+func (g *Grid) Bilinear(values []float64, lat, lon float64) (float64, error) {
+	x, y, err := g.position(lat, lon)
+	if err != nil {
+		return 0, err
+	}
+	i0, j0 := int(math.Floor(x)), int(math.Floor(y))
+	i1, j1 := i0+1, j0+1
+	if j1 >= g.Nj {
+		j1 = j0
+	}
+	if i1 >= g.Ni && !g.global() {
+		i1 = i0
+	}
+	dx, dy := x-float64(i0), y-float64(j0)
+
+	sum, weights := 0.0, 0.0
+	corners := []struct {
+		i, j   int
+		weight float64
+	}{
+		{i0, j0, (1 - dx) * (1 - dy)},
+		{i1, j0, dx * (1 - dy)},
+		{i0, j1, (1 - dx) * dy},
+		{i1, j1, dx * dy},
+	}
+	for _, c := range corners {
+		v := values[c.j*g.Ni+g.column(c.i)]
+		if math.IsNaN(v) || c.weight == 0 {
+			continue
+		}
+		sum += v * c.weight
+		weights += c.weight
+	}
+	if weights == 0 {
+		return g.Nearest(values, lat, lon)
+	}
+	return sum / weights, nil
+}
@@ -0,0 +1,77 @@
+package grib2
+
+import (
+	"math"
+	"testing"
+)
+
+func TestInterpolation(t *testing.T) {
+	// the value of each point is its latitude and longitude, e.g. 60330 at 60N 330E
+	position := func(lat, lon float64) float64 {
+		return lat*1000 + lon
+	}
+	southFirst := testGrid
+	southFirst.La1, southFirst.La2, southFirst.ScanningMode = -90, 90, ScanSouthToNorth
+	regional := Grid{Ni: 3, Nj: 2, La1: 60, Lo1: 0, La2: 30, Lo2: 60, Di: 30, Dj: 30, ScanningMode: ScanNorthToSouth}
+
+	tests := []struct {
+		name              string
+		grid              *Grid
+		lat, lon          float64
+		nearest, bilinear float64
+	}{
+		{"grid point", &testGrid, 60, 30, 60030, 60030},
+		{"between points", &testGrid, 50, 40, 60030, 50040},
+		{"west of the meridian", &testGrid, 0, 350, 0, 110},
+		{"negative longitude", &testGrid, 0, -10, 0, 110},
+		{"east of the last column", &testGrid, 0, 340, 330, 220},
+		{"north pole", &testGrid, 90, 200, 90210, 90200},
+		{"near the north pole", &testGrid, 85, 10, 90000, 85010},
+		{"south pole", &testGrid, -90, 10, -90000, -89990},
+		{"south to north", &southFirst, 50, 40, 60030, 50040},
+		{"south to north at the pole", &southFirst, -90, 0, -90000, -90000},
+		{"east edge of a regional grid", &regional, 50, 60, 60060, 50060},
+	}
+	for _, test := range tests {
+		gridValues := fill(test.grid, position)
+		nearest, err := test.grid.Nearest(gridValues, test.lat, test.lon)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		bilinear, err := test.grid.Bilinear(gridValues, test.lat, test.lon)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if nearest != test.nearest || math.Abs(bilinear-test.bilinear) > 1e-9 {
+			t.Errorf("%s: got nearest %g and bilinear %g, want %g and %g", test.name, nearest, bilinear, test.nearest, test.bilinear)
+		}
+	}
+
+	values := fill(&regional, position)
+	if _, err := regional.Nearest(values, 45, 90); err == nil {
+		t.Error("longitude east of a regional grid interpolated")
+	}
+	if _, err := regional.Bilinear(values, 70, 30); err == nil {
+		t.Error("latitude north of a regional grid interpolated")
+	}
+}
+
+func TestBilinearMissingValues(t *testing.T) {
+	values := make([]float64, testGrid.Points())
+	for i := range values {
+		values[i] = math.NaN()
+	}
+	// 60N 0E and 60N 30E, the points south of them are missing
+	values[testGrid.Ni], values[testGrid.Ni+1] = 10, 20
+	value, err := testGrid.Bilinear(values, 45, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(value-(10+10.0/3)) > 1e-9 {
+		t.Errorf("got %g, want the weights of the present points scaled up", value)
+	}
+	value, err = testGrid.Bilinear(values, 15, 10)
+	if err != nil || !math.IsNaN(value) {
+		t.Errorf("got %g, %v where all points are missing, want NaN", value, err)
+	}
+}
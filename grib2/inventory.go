@@ -0,0 +1,55 @@
+package grib2
+
+import (
+	"fmt"
+	"io"
+)
+
+// Inventory describes the fields of the messages of a file, in the format of
+// wgrib2 -s and the .idx files published by NCEP.
+func Inventory(r io.ReaderAt, messages []*Message) ([]IndexEntry, error) {
+	fields, err := Fields(r, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[*Message]int)
+	for _, f := range fields {
+		counts[f.Message]++
+	}
+
+	entries := make([]IndexEntry, 0, len(fields))
+	messageNumber := 0
+	for _, f := range fields {
+		if f.Number == 1 {
+			messageNumber++
+		}
+		entries = append(entries, f.IndexEntry(messageNumber, counts[f.Message]))
+	}
+	return entries, nil
+}
+
+// InventoryFile is Inventory on all messages of the named file
+func InventoryFile(fileName string) ([]IndexEntry, error) {
+	file, err := Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Inventory(file, file.Messages)
+}
+
+// String formats the entry as an .idx line
+func (e IndexEntry) String() string {
+	return fmt.Sprintf("%s:%d:d=%s:%s:%s:%s:%s", e.Number, e.Offset, e.Date, e.Parameter, e.Level, e.Forecast, e.Ensemble)
+}
+
+// WriteIndex writes entries as the lines of an .idx file
+func WriteIndex(w io.Writer, entries []IndexEntry) error {
+	for _, e := range entries {
+		if _, err := fmt.Fprintln(w, e.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package grib2
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+	representation, bitmap, data := packSimple(make([]float64, testGrid.Points()), 0, 0, 0)
+	var content bytes.Buffer
+	var offsets []interface{}
+	for _, product := range []testProduct{
+		tmp2m,
+		{template: 0, category: 0, number: 0, hour: 3, surface: 103, value: 2},
+		{template: 8, category: 1, number: 8, hour: 6, surface: 1, statistic: StatisticAccumulated, hours: 3},
+		{template: 8, category: 0, number: 4, hour: 6, surface: 103, value: 2, statistic: StatisticMaximum, hours: 6},
+		{template: 1, category: 3, number: 5, surface: 100, value: 50000, ensembleType: 1},
+		{template: 1, category: 3, number: 5, hour: 6, surface: 100, value: 50000, ensembleType: 3, member: 1},
+		{template: 11, category: 1, number: 8, hour: 6, surface: 1, statistic: StatisticAccumulated, hours: 6, ensembleType: 2, member: 2},
+	} {
+		offsets = append(offsets, content.Len())
+		content.Write(testMessage(t, &testGrid, product, representation, bitmap, data))
+	}
+	// the winds share a message like in the GFS files
+	u := testProduct{template: 0, category: 2, number: 2, hour: 3, surface: 103, value: 10}
+	v := u
+	v.number = 3
+	offsets = append(offsets, content.Len(), content.Len())
+	if err := writeMessage(&content, 0, testIdentification(testReferenceTime), testGrid.bytes(),
+		u.bytes(testReferenceTime), representation, bitmap, data,
+		v.bytes(testReferenceTime), representation, bitmap, data); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bytes.NewReader(content.Bytes())
+	messages, err := ReadMessages(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := Inventory(r, messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the lines of wgrib2 -s for the same messages
+	want := []string{
+		"1:%d:d=2018040506:TMP:2 m above ground:anl:",
+		"2:%d:d=2018040506:TMP:2 m above ground:3 hour fcst:",
+		"3:%d:d=2018040506:APCP:surface:3-6 hour acc fcst:",
+		"4:%d:d=2018040506:TMAX:2 m above ground:0-6 hour max fcst:",
+		"5:%d:d=2018040506:HGT:500 mb:anl:ENS=low-res ctl",
+		"6:%d:d=2018040506:HGT:500 mb:6 hour fcst:ENS=+1",
+		"7:%d:d=2018040506:APCP:surface:0-6 hour acc fcst:ENS=-2",
+		"8.1:%d:d=2018040506:UGRD:10 m above ground:3 hour fcst:",
+		"8.2:%d:d=2018040506:VGRD:10 m above ground:3 hour fcst:",
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		if line := fmt.Sprintf(want[i], offsets[i]); e.String() != line {
+			t.Errorf("got %q, want %q", e.String(), line)
+		}
+	}
+
+	// the lines parse back to the same entries
+	var index bytes.Buffer
+	if err := WriteIndex(&index, entries); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseIndex(&index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		if parsed[i] != entries[i] {
+			t.Errorf("got parsed entry %+v, want %+v", parsed[i], entries[i])
+		}
+	}
+}
+
+func TestLevel(t *testing.T) {
+	missing := Surface{Type: 255, Value: math.NaN()}
+	tests := []struct {
+		first, second Surface
+		want          string
+	}{
+		{Surface{1, math.NaN()}, missing, "surface"},
+		{Surface{101, 0}, missing, "mean sea level"},
+		{Surface{100, 85000}, missing, "850 mb"},
+		{Surface{100, 92.5e2}, missing, "92.5 mb"},
+		{Surface{103, 2}, missing, "2 m above ground"},
+		{Surface{106, 0}, Surface{106, 0.1}, "0-0.1 m below ground"},
+		{Surface{108, 3000}, Surface{108, 0}, "30-0 mb above ground"},
+		{Surface{104, 0.995}, missing, "0.995 sigma level"},
+		{Surface{104, 0.44}, Surface{104, 1}, "0.44-1 sigma layer"},
+		{Surface{109, 2e-6}, missing, "PV=2e-06 (Km^2/kg/s) surface"},
+		{Surface{200, math.NaN()}, missing, "entire atmosphere (considered as a single layer)"},
+		{Surface{150, 3}, missing, "level type 150 value 3"},
+	}
+	for _, test := range tests {
+		p := &Product{FirstSurface: test.first, SecondSurface: test.second}
+		if got := p.Level(); got != test.want {
+			t.Errorf("surfaces %v and %v: got %q, want %q", test.first, test.second, got, test.want)
+		}
+	}
+}
+
+func TestForecast(t *testing.T) {
+	tests := []struct {
+		product Product
+		want    string
+		hours   int
+	}{
+		{Product{TimeUnit: 1, Statistic: StatisticNone}, "anl", 0},
+		{Product{TimeUnit: 1, ForecastTime: 120, Statistic: StatisticNone}, "120 hour fcst", 120},
+		{Product{TimeUnit: 1, ForecastTime: 0, Statistic: StatisticAccumulated, StatisticUnit: 1, StatisticLength: 6}, "0-6 hour acc fcst", 6},
+		{Product{TimeUnit: 1, ForecastTime: 6, Statistic: StatisticAverage, StatisticUnit: 1, StatisticLength: 3}, "6-9 hour ave fcst", 9},
+		{Product{TimeUnit: 1, ForecastTime: 240, Statistic: StatisticMinimum, StatisticUnit: 11, StatisticLength: 2}, "240-252 hour min fcst", 252},
+		{Product{TimeUnit: 0, ForecastTime: 30, Statistic: StatisticNone}, "30 min fcst", 0},
+	}
+	for _, test := range tests {
+		if got := test.product.Forecast(); got != test.want {
+			t.Errorf("product %+v: got %q, want %q", test.product, got, test.want)
+		}
+		if got := test.product.ForecastHours(); got != test.hours {
+			t.Errorf("product %+v: got forecast hours %d, want %d", test.product, got, test.hours)
+		}
+	}
+}
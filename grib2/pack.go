@@ -0,0 +1,177 @@
+package grib2
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// maxPackingBits caps the width of packed values, precision beyond it is lost
+// through the binary scale factor.
+const maxPackingBits = 24
+
+// WriteField writes a GRIB2 message holding a single field with the given grid and
+// values, packed with simple packing (template 5.0). The identification and product
+// definition are copied from f, and so are the binary and decimal scale factors of
+// its packing. NaN values are masked by a bitmap.
+func WriteField(w io.Writer, r io.ReaderAt, f *Field, grid *Grid, values []float64) error {
+	identification, err := readSectionBytes(r, f.Message.sections(1)[0])
+	if err != nil {
+		return err
+	}
+	product, err := readSectionBytes(r, f.ProductSection)
+	if err != nil {
+		return err
+	}
+	original, err := ReadDataRepresentation(r, f.RepresentationSection)
+	if err != nil {
+		return err
+	}
+
+	representation, bitmap, data := packSimple(values, original.BinaryScale, original.DecimalScale, original.OriginalValueType)
+	return writeMessage(w, f.Message.Discipline, identification, grid.bytes(), product, representation, bitmap, data)
+}
+
+// writeMessage writes a message of a single field made of the given sections
+func writeMessage(w io.Writer, discipline int, sections ...[]byte) error {
+	sections = append(sections, []byte(endMarker))
+	length := indicatorLength
+	for _, s := range sections {
+		length += len(s)
+	}
+
+	indicator := make([]byte, indicatorLength)
+	copy(indicator, "GRIB")
+	indicator[6] = byte(discipline)
+	indicator[7] = 2
+	binary.BigEndian.PutUint64(indicator[8:16], uint64(length))
+
+	if _, err := w.Write(indicator); err != nil {
+		return err
+	}
+	for _, s := range sections {
+		if _, err := w.Write(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packSimple returns the data representation, bitmap and data sections of values
+// packed with simple packing at the given binary and decimal scales. The binary
+// scale is raised when the values would need more than maxPackingBits.
+func packSimple(values []float64, binaryScale, decimalScale int, originalValueType int) ([]byte, []byte, []byte) {
+	decimal := math.Pow10(decimalScale)
+	minimum, maximum := math.Inf(1), math.Inf(-1)
+	present := 0
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		present++
+		minimum = math.Min(minimum, v*decimal)
+		maximum = math.Max(maximum, v*decimal)
+	}
+	if present == 0 {
+		minimum, maximum = 0, 0
+	}
+
+	// the reference value is a float32 and must not exceed the minimum
+	reference := float32(minimum)
+	if float64(reference) > minimum {
+		reference = math.Nextafter32(reference, float32(math.Inf(-1)))
+	}
+
+	bits := 0
+	for span := maximum - float64(reference); ; binaryScale++ {
+		steps := math.Round(span / math.Pow(2, float64(binaryScale)))
+		bits = 0
+		if steps > 0 {
+			bits = int(math.Ceil(math.Log2(steps + 1)))
+		}
+		if bits <= maxPackingBits {
+			break
+		}
+	}
+
+	representation := make([]byte, 21)
+	binary.BigEndian.PutUint32(representation[0:4], 21)
+	representation[4] = 5
+	binary.BigEndian.PutUint32(representation[5:9], uint32(present))
+	binary.BigEndian.PutUint16(representation[9:11], SimplePacking)
+	binary.BigEndian.PutUint32(representation[11:15], math.Float32bits(reference))
+	putSigned16(representation[15:17], int16(binaryScale))
+	putSigned16(representation[17:19], int16(decimalScale))
+	representation[19] = byte(bits)
+	representation[20] = byte(originalValueType)
+
+	bitmap := []byte{0, 0, 0, 6, 6, 255}
+	if present < len(values) {
+		bitmap = make([]byte, 6+(len(values)+7)/8)
+		bitmap[4] = 6
+		for i, v := range values {
+			if !math.IsNaN(v) {
+				bitmap[6+i/8] |= 0x80 >> uint(i%8)
+			}
+		}
+		binary.BigEndian.PutUint32(bitmap[0:4], uint32(len(bitmap)))
+	}
+
+	packed := newBitWriter(5 + (present*bits+7)/8)
+	packed.data = packed.data[:5]
+	scale := math.Pow(2, float64(binaryScale))
+	largest := uint64(1)<<uint(bits) - 1
+	if bits > 0 {
+		for _, v := range values {
+			if math.IsNaN(v) {
+				continue
+			}
+			x := math.Round((v*decimal - float64(reference)) / scale)
+			packed.write(uint64(math.Min(math.Max(x, 0), float64(largest))), bits)
+		}
+	}
+	data := packed.bytes()
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(data)))
+	data[4] = 7
+
+	return representation, bitmap, data
+}
+
+func readSectionBytes(r io.ReaderAt, s Section) ([]byte, error) {
+	b := make([]byte, s.Length)
+	if _, err := r.ReadAt(b, s.Offset); err != nil {
+		return nil, &FormatError{s.Offset, "truncated section"}
+	}
+	return b, nil
+}
+
+// bitWriter appends big endian unsigned integers of any width to a byte slice
+type bitWriter struct {
+	data []byte
+	used uint // bits used in the last byte, 0 when it is full
+}
+
+func newBitWriter(capacity int) *bitWriter {
+	return &bitWriter{data: make([]byte, 0, capacity)}
+}
+
+func (b *bitWriter) write(v uint64, bits int) {
+	for remaining := uint(bits); remaining > 0; {
+		if b.used == 0 {
+			b.data = append(b.data, 0)
+		}
+		free := 8 - b.used
+		take := free
+		if remaining < take {
+			take = remaining
+		}
+		chunk := byte(v>>(remaining-take)) & (1<<take - 1)
+		b.data[len(b.data)-1] |= chunk << (free - take)
+		b.used = (b.used + take) % 8
+		remaining -= take
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	return b.data
+}
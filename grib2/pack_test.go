@@ -0,0 +1,314 @@
+package grib2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bitsFor returns the number of bits needed for x
+func bitsFor(x uint64) int {
+	bits := 0
+	for x>>uint(bits) != 0 {
+		bits++
+	}
+	return bits
+}
+
+func writeSigned(w *bitWriter, v int64, bits int) {
+	if v < 0 {
+		w.write(uint64(-v)|1<<uint(bits-1), bits)
+		return
+	}
+	w.write(uint64(v), bits)
+}
+
+// testComplexPacking returns the data representation, bitmap and data sections
+// of integers packed with complex packing and spatial differencing of the given
+// order (template 5.3), in groups of 4 values. The values are ints / 10^decimalScale.
+func testComplexPacking(ints []int64, decimalScale, order int) [][]byte {
+	const groupLength = 4
+	n := len(ints)
+	differences := make([]int64, n)
+	minimum := int64(math.MaxInt64)
+	for i := order; i < n; i++ {
+		if order == 1 {
+			differences[i] = ints[i] - ints[i-1]
+		} else {
+			differences[i] = ints[i] - 2*ints[i-1] + ints[i-2]
+		}
+		if differences[i] < minimum {
+			minimum = differences[i]
+		}
+	}
+	packed := make([]uint64, n)
+	for i := order; i < n; i++ {
+		packed[i] = uint64(differences[i] - minimum)
+	}
+
+	groups := (n + groupLength - 1) / groupLength
+	references, widths := make([]uint64, groups), make([]uint64, groups)
+	var referenceBits, widthBits int
+	for g := range references {
+		low, high := uint64(math.MaxUint64), uint64(0)
+		for _, x := range packed[g*groupLength : int(math.Min(float64(n), float64((g+1)*groupLength)))] {
+			low, high = uint64(math.Min(float64(low), float64(x))), uint64(math.Max(float64(high), float64(x)))
+		}
+		references[g], widths[g] = low, uint64(bitsFor(high-low))
+		if b := bitsFor(references[g]); b > referenceBits {
+			referenceBits = b
+		}
+		if b := bitsFor(widths[g]); b > widthBits {
+			widthBits = b
+		}
+	}
+
+	representation := make([]byte, 49)
+	binary.BigEndian.PutUint32(representation, 49)
+	representation[4] = 5
+	binary.BigEndian.PutUint32(representation[5:], uint32(n))
+	binary.BigEndian.PutUint16(representation[9:], ComplexPackingSpatialDifferencing)
+	putSigned16(representation[17:], int16(decimalScale))
+	representation[19] = byte(referenceBits)
+	representation[21] = 1
+	binary.BigEndian.PutUint32(representation[31:], uint32(groups))
+	representation[36] = byte(widthBits)
+	binary.BigEndian.PutUint32(representation[37:], groupLength)
+	representation[41] = 1
+	binary.BigEndian.PutUint32(representation[42:], uint32(n-(groups-1)*groupLength))
+	representation[46] = 1
+	representation[47], representation[48] = byte(order), 2
+
+	w := newBitWriter(n)
+	w.write(0, 32)
+	w.write(7, 8)
+	writeSigned(w, ints[0], 16)
+	if order == 2 {
+		writeSigned(w, ints[1], 16)
+	}
+	writeSigned(w, minimum, 16)
+	for _, r := range references {
+		w.write(r, referenceBits)
+	}
+	w.used = 0
+	for _, width := range widths {
+		w.write(width, widthBits)
+	}
+	w.used = 0
+	for range references {
+		w.write(0, 1)
+	}
+	w.used = 0
+	for i, x := range packed {
+		if width := int(widths[i/groupLength]); width > 0 {
+			w.write(x-references[i/groupLength], width)
+		}
+	}
+	data := w.bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+	return [][]byte{representation, {0, 0, 0, 6, 6, 255}, data}
+}
+
+func TestPackSimpleRoundTrip(t *testing.T) {
+	temperatures := fill(&testGrid, func(lat, lon float64) float64 {
+		return 273.15 + lat/7 - lon/100
+	})
+	masked := append([]float64(nil), temperatures...)
+	masked[3], masked[40] = math.NaN(), math.NaN()
+	large := fill(&testGrid, func(lat, lon float64) float64 {
+		return 1e9 * (lon / 330)
+	})
+
+	tests := []struct {
+		name                      string
+		values                    []float64
+		binaryScale, decimalScale int
+		wantBinaryScale           int
+	}{
+		{"decimal scale", temperatures, 0, 2, 0},
+		{"negative binary scale", temperatures, -6, 0, -6},
+		{"bitmap", masked, -6, 0, -6},
+		{"constant", make([]float64, testGrid.Points()), 0, 1, 0},
+		// 1e9 steps need 30 bits, the binary scale is raised to fit 24
+		{"binary scale raised", large, 0, 0, 6},
+	}
+	for _, test := range tests {
+		representation, bitmap, data := packSimple(test.values, test.binaryScale, test.decimalScale, 0)
+		r, fields := testFields(t, testMessage(t, &testGrid, tmp2m, representation, bitmap, data))
+		d, err := ReadDataRepresentation(r, fields[0].RepresentationSection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.BinaryScale != test.wantBinaryScale || d.DecimalScale != test.decimalScale || d.Bits > maxPackingBits {
+			t.Errorf("%s: got binary scale %d, decimal scale %d and %d bits", test.name, d.BinaryScale, d.DecimalScale, d.Bits)
+		}
+		values, err := fields[0].Values(r)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		// half a packing step, and the rounding of the float32 reference value
+		tolerance := math.Pow(2, float64(d.BinaryScale-1))/math.Pow10(d.DecimalScale) + 1e-7*math.Abs(float64(d.ReferenceValue))
+		for i, want := range test.values {
+			if math.IsNaN(want) != math.IsNaN(values[i]) || math.Abs(values[i]-want) > tolerance {
+				t.Errorf("%s: got %g at point %d, want %g within %g", test.name, values[i], i, want, tolerance)
+				break
+			}
+		}
+	}
+}
+
+func TestWriteFieldKeepsBinaryScale(t *testing.T) {
+	values := fill(&testGrid, func(lat, lon float64) float64 {
+		return 0.001 * (lat + lon/1000)
+	})
+	representation, bitmap, data := packSimple(values, -20, 0, 0)
+	r, fields := testFields(t, testMessage(t, &testGrid, tmp2m, representation, bitmap, data))
+
+	var out bytes.Buffer
+	if err := WriteField(&out, r, fields[0], &testGrid, values); err != nil {
+		t.Fatal(err)
+	}
+	r, fields = testFields(t, out.Bytes())
+	written, err := fields[0].Values(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range values {
+		if math.Abs(written[i]-values[i]) > 1e-6 {
+			t.Fatalf("got %g at point %d, want %g", written[i], i, values[i])
+		}
+	}
+}
+
+func TestComplexPackingRoundTrip(t *testing.T) {
+	ints := make([]int64, testGrid.Points())
+	for i := range ints {
+		ints[i] = 27315 + int64(i%12*i%7*13) - int64(i/3)
+	}
+	for _, order := range []int{1, 2} {
+		r, fields := testFields(t, testMessage(t, &testGrid, tmp2m, testComplexPacking(ints, 2, order)...))
+		values, err := fields[0].Values(r)
+		if err != nil {
+			t.Fatalf("order %d: %v", order, err)
+		}
+		for i, x := range ints {
+			if want := float64(x) / 100; math.Abs(values[i]-want) > 1e-9 {
+				t.Errorf("order %d: got %g at point %d, want %g", order, values[i], i, want)
+				break
+			}
+		}
+	}
+}
+
+func TestCropAcrossMeridian(t *testing.T) {
+	values := fill(&testGrid, func(lat, lon float64) float64 {
+		return lat*1000 + lon
+	})
+	// the same area with longitudes from -180 to 180 and from 0 to 360
+	for _, box := range []BoundingBox{{South: -30, West: -60, North: 30, East: 60}, {South: -30, West: 300, North: 30, East: 60}} {
+		if columns := testGrid.columns(box); len(columns) != 5 || columns[0] != 10 || columns[4] != 2 {
+			t.Errorf("box %+v: got columns %v, want 10, 11, 0, 1, 2", box, columns)
+		}
+		grid, cropped, err := testGrid.Crop(values, box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if grid.Ni != 5 || grid.Nj != 3 || grid.Lo1 != 300 || grid.Lo2 != 60 || grid.La1 != 30 || grid.La2 != -30 {
+			t.Errorf("box %+v: got grid %+v", box, grid)
+		}
+		for k, want := range []float64{30300, 30330, 30000, 30030, 30060} {
+			if cropped[k] != want {
+				t.Errorf("box %+v: got first row %v", box, cropped[:5])
+				break
+			}
+		}
+	}
+	if testGrid.Intersects(BoundingBox{South: 10, West: 40, North: 20, East: 50}) {
+		t.Error("box between the grid points intersects the grid")
+	}
+
+	folder, err := ioutil.TempDir("", "grib2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	representation, bitmap, data := packSimple(values, 0, 0, 0)
+	fileName := filepath.Join(folder, "gfs.t06z.pgrb2.1p00.f000")
+	if err := ioutil.WriteFile(fileName, testMessage(t, &testGrid, tmp2m, representation, bitmap, data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := CropFile(fileName, fileName+".cropped", BoundingBox{South: -30, West: -60, North: 30, East: 60}); err != nil {
+		t.Fatal(err)
+	}
+	file, err := Open(fileName + ".cropped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fields, err := file.Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	grid, err := ReadGrid(file, fields[0].GridSection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cropped, err := fields[0].Values(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grid.Lo1 != 300 || grid.Ni != 5 || len(cropped) != 15 || cropped[2] != 30000 || cropped[14] != -30000+60 {
+		t.Errorf("got cropped file of grid %+v with values %v", grid, cropped)
+	}
+}
+
+func TestScanningModes(t *testing.T) {
+	grid := Grid{Ni: 3, Nj: 2, La1: 10, Lo1: 0, La2: 0, Lo2: 20, Di: 10, Dj: 10}
+	// values in the order of ScanNorthToSouth are the row and column, e.g. 12 at row 1 and column 2
+	tests := []struct {
+		mode   int
+		lo1    float64
+		values []float64
+	}{
+		{0x80, 20, []float64{2, 1, 0, 12, 11, 10}},
+		{0x20, 0, []float64{0, 10, 1, 11, 2, 12}},
+		{0x10, 0, []float64{0, 1, 2, 12, 11, 10}},
+		{0xa0, 20, []float64{2, 12, 1, 11, 0, 10}},
+	}
+	for _, test := range tests {
+		scanned := grid
+		scanned.ScanningMode, scanned.Lo1 = test.mode, test.lo1
+		representation, bitmap, data := packSimple(test.values, 0, 0, 0)
+		r, fields := testFields(t, testMessage(t, &scanned, tmp2m, representation, bitmap, data))
+		read, err := ReadGrid(r, fields[0].GridSection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read.ScanningMode != ScanNorthToSouth || read.Lo1 != 0 || read.Lo2 != 20 {
+			t.Errorf("mode %#x: got grid %+v", test.mode, read)
+		}
+		values, err := fields[0].Values(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range []float64{0, 1, 2, 10, 11, 12} {
+			if values[k] != want {
+				t.Errorf("mode %#x: got values %v", test.mode, values)
+				break
+			}
+		}
+	}
+
+	scanned := grid
+	scanned.ScanningMode = 0x08
+	representation, bitmap, data := packSimple(make([]float64, 6), 0, 0, 0)
+	r, fields := testFields(t, testMessage(t, &scanned, tmp2m, representation, bitmap, data))
+	if _, err := ReadGrid(r, fields[0].GridSection); err == nil {
+		t.Error("grid with unsupported scanning mode 0x08 read")
+	}
+}
@@ -0,0 +1,144 @@
+package grib2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Statistical processes of table 4.10
+const (
+	StatisticNone        = -1
+	StatisticAverage     = 0
+	StatisticAccumulated = 1
+	StatisticMaximum     = 2
+	StatisticMinimum     = 3
+)
+
+// Surface is a fixed surface of table 4.5, e.g. type 103 and value 2 for 2 m
+// above ground. A surface of type 255 is missing.
+type Surface struct {
+	Type  int
+	Value float64
+}
+
+// Product is the product definition of a field, read from section 4. Only the
+// templates used by NCEP for deterministic and ensemble forecasts are supported:
+// 4.0, 4.1, 4.8 and 4.11.
+type Product struct {
+	Template      int
+	Category      int
+	Number        int
+	TimeUnit      int
+	ForecastTime  int
+	FirstSurface  Surface
+	SecondSurface Surface
+
+	// Statistic is the statistical process of templates 4.8 and 4.11 over the
+	// StatisticLength following ForecastTime, or StatisticNone.
+	Statistic       int
+	StatisticUnit   int
+	StatisticLength int
+
+	// EnsembleType of table 4.6 and Perturbation identify the ensemble member of
+	// templates 4.1 and 4.11, EnsembleType is -1 for other templates.
+	EnsembleType int
+	Perturbation int
+}
+
+// ReadProduct reads a product definition section
+func ReadProduct(r io.ReaderAt, s Section) (*Product, error) {
+	if s.Number != 4 {
+		return nil, &FormatError{s.Offset, fmt.Sprintf("section %d is not a product definition", s.Number)}
+	}
+	b := make([]byte, s.Length)
+	if _, err := r.ReadAt(b, s.Offset); err != nil {
+		return nil, &FormatError{s.Offset, "truncated product definition section"}
+	}
+
+	p := &Product{
+		Template:     int(binary.BigEndian.Uint16(b[7:9])),
+		Statistic:    StatisticNone,
+		EnsembleType: -1,
+	}
+
+	statistic, ok := statisticOffset(p.Template)
+	if !ok {
+		return nil, &FormatError{s.Offset, fmt.Sprintf("unsupported product definition template 4.%d", p.Template)}
+	}
+	ensemble := p.Template == 1 || p.Template == 11
+	if len(b) < 34 || len(b) < statistic+24 || ensemble && len(b) < 37 {
+		return nil, &FormatError{s.Offset, "product definition section too short"}
+	}
+
+	p.Category = int(b[9])
+	p.Number = int(b[10])
+	p.TimeUnit = int(b[17])
+	p.ForecastTime = int(signed32(b[18:22]))
+	p.FirstSurface = readSurface(b[22:28])
+	p.SecondSurface = readSurface(b[28:34])
+	if ensemble {
+		p.EnsembleType = int(b[34])
+		p.Perturbation = int(b[35])
+	}
+
+	if statistic > 0 {
+		// skip the end of the overall time interval, number of time ranges and
+		// number of missing values
+		timeRange := b[statistic+12:]
+		p.Statistic = int(timeRange[0])
+		p.StatisticUnit = int(timeRange[2])
+		p.StatisticLength = int(signed32(timeRange[3:7]))
+	}
+	return p, nil
+}
+
+// statisticOffset returns the offset of the statistical process octets of a
+// template, after the ensemble octets of 4.11, 0 for templates without them.
+func statisticOffset(template int) (int, bool) {
+	switch template {
+	case 0, 1:
+		return 0, true
+	case 8:
+		return 34, true
+	case 11:
+		return 37, true
+	}
+	return 0, false
+}
+
+func readSurface(b []byte) Surface {
+	if b[0] == 255 || b[1] == 255 {
+		return Surface{Type: int(b[0]), Value: math.NaN()}
+	}
+	return Surface{
+		Type:  int(b[0]),
+		Value: float64(signed32(b[2:6])) / math.Pow10(int(signed8(b[1]))),
+	}
+}
+
+// signed8, signed16 and signed32 decode the sign and magnitude integers of GRIB2,
+// where the most significant bit is the sign.
+func signed8(b byte) int8 {
+	if b&0x80 != 0 {
+		return -int8(b & 0x7f)
+	}
+	return int8(b)
+}
+
+func signed16(b []byte) int16 {
+	v := binary.BigEndian.Uint16(b)
+	if v&0x8000 != 0 {
+		return -int16(v & 0x7fff)
+	}
+	return int16(v)
+}
+
+func signed32(b []byte) int32 {
+	v := binary.BigEndian.Uint32(b)
+	if v&0x80000000 != 0 {
+		return -int32(v & 0x7fffffff)
+	}
+	return int32(v)
+}
@@ -0,0 +1,341 @@
+package grib2
+
+import (
+	"fmt"
+	"math"
+)
+
+type parameterKey struct {
+	discipline, category, number int
+}
+
+// parameterNames are the wgrib2 abbreviations of the WMO and NCEP local parameters
+// found in the GFS pgrb2 files.
+var parameterNames = map[parameterKey]string{
+	{0, 0, 0}:    "TMP",
+	{0, 0, 1}:    "VTMP",
+	{0, 0, 2}:    "POT",
+	{0, 0, 3}:    "EPOT",
+	{0, 0, 4}:    "TMAX",
+	{0, 0, 5}:    "TMIN",
+	{0, 0, 6}:    "DPT",
+	{0, 0, 7}:    "DEPR",
+	{0, 0, 10}:   "LHTFL",
+	{0, 0, 11}:   "SHTFL",
+	{0, 0, 21}:   "APTMP",
+	{0, 0, 192}:  "SNOHF",
+	{0, 1, 0}:    "SPFH",
+	{0, 1, 1}:    "RH",
+	{0, 1, 2}:    "MIXR",
+	{0, 1, 3}:    "PWAT",
+	{0, 1, 7}:    "PRATE",
+	{0, 1, 8}:    "APCP",
+	{0, 1, 10}:   "ACPCP",
+	{0, 1, 11}:   "SNOD",
+	{0, 1, 13}:   "WEASD",
+	{0, 1, 22}:   "CLWMR",
+	{0, 1, 23}:   "ICMR",
+	{0, 1, 24}:   "RWMR",
+	{0, 1, 25}:   "SNMR",
+	{0, 1, 32}:   "GRLE",
+	{0, 1, 39}:   "CPOFP",
+	{0, 1, 192}:  "CRAIN",
+	{0, 1, 193}:  "CFRZR",
+	{0, 1, 194}:  "CICEP",
+	{0, 1, 195}:  "CSNOW",
+	{0, 1, 196}:  "CPRAT",
+	{0, 1, 225}:  "FRZR",
+	{0, 2, 0}:    "WDIR",
+	{0, 2, 1}:    "WIND",
+	{0, 2, 2}:    "UGRD",
+	{0, 2, 3}:    "VGRD",
+	{0, 2, 8}:    "VVEL",
+	{0, 2, 9}:    "DZDT",
+	{0, 2, 10}:   "ABSV",
+	{0, 2, 17}:   "UFLX",
+	{0, 2, 18}:   "VFLX",
+	{0, 2, 22}:   "GUST",
+	{0, 2, 192}:  "VWSH",
+	{0, 2, 194}:  "USTM",
+	{0, 2, 195}:  "VSTM",
+	{0, 3, 0}:    "PRES",
+	{0, 3, 1}:    "PRMSL",
+	{0, 3, 5}:    "HGT",
+	{0, 3, 192}:  "MSLET",
+	{0, 3, 196}:  "HPBL",
+	{0, 4, 192}:  "DSWRF",
+	{0, 4, 193}:  "USWRF",
+	{0, 5, 192}:  "DLWRF",
+	{0, 5, 193}:  "ULWRF",
+	{0, 6, 1}:    "TCDC",
+	{0, 6, 3}:    "LCDC",
+	{0, 6, 4}:    "MCDC",
+	{0, 6, 5}:    "HCDC",
+	{0, 6, 6}:    "CWAT",
+	{0, 7, 6}:    "CAPE",
+	{0, 7, 7}:    "CIN",
+	{0, 7, 8}:    "HLCY",
+	{0, 7, 192}:  "LFTX",
+	{0, 7, 193}:  "4LFTX",
+	{0, 14, 0}:   "TOZNE",
+	{0, 14, 192}: "O3MR",
+	{0, 19, 0}:   "VIS",
+	{2, 0, 0}:    "LAND",
+	{2, 0, 1}:    "SFCR",
+	{2, 0, 192}:  "SOILW",
+	{2, 0, 193}:  "GFLUX",
+	{2, 3, 192}:  "SOILL",
+	{10, 2, 0}:   "ICEC",
+}
+
+// parameterUnits are the units of the parameters of parameterNames, in udunits notation
+var parameterUnits = map[parameterKey]string{
+	{0, 0, 0}:    "K",
+	{0, 0, 1}:    "K",
+	{0, 0, 2}:    "K",
+	{0, 0, 3}:    "K",
+	{0, 0, 4}:    "K",
+	{0, 0, 5}:    "K",
+	{0, 0, 6}:    "K",
+	{0, 0, 7}:    "K",
+	{0, 0, 10}:   "W m-2",
+	{0, 0, 11}:   "W m-2",
+	{0, 0, 21}:   "K",
+	{0, 0, 192}:  "W m-2",
+	{0, 1, 0}:    "kg kg-1",
+	{0, 1, 1}:    "%",
+	{0, 1, 2}:    "kg kg-1",
+	{0, 1, 3}:    "kg m-2",
+	{0, 1, 7}:    "kg m-2 s-1",
+	{0, 1, 8}:    "kg m-2",
+	{0, 1, 10}:   "kg m-2",
+	{0, 1, 11}:   "m",
+	{0, 1, 13}:   "kg m-2",
+	{0, 1, 22}:   "kg kg-1",
+	{0, 1, 23}:   "kg kg-1",
+	{0, 1, 24}:   "kg kg-1",
+	{0, 1, 25}:   "kg kg-1",
+	{0, 1, 32}:   "kg kg-1",
+	{0, 1, 39}:   "%",
+	{0, 1, 192}:  "1",
+	{0, 1, 193}:  "1",
+	{0, 1, 194}:  "1",
+	{0, 1, 195}:  "1",
+	{0, 1, 196}:  "kg m-2 s-1",
+	{0, 1, 225}:  "kg m-2",
+	{0, 2, 0}:    "degree",
+	{0, 2, 1}:    "m s-1",
+	{0, 2, 2}:    "m s-1",
+	{0, 2, 3}:    "m s-1",
+	{0, 2, 8}:    "Pa s-1",
+	{0, 2, 9}:    "m s-1",
+	{0, 2, 10}:   "s-1",
+	{0, 2, 17}:   "N m-2",
+	{0, 2, 18}:   "N m-2",
+	{0, 2, 22}:   "m s-1",
+	{0, 2, 192}:  "s-1",
+	{0, 2, 194}:  "m s-1",
+	{0, 2, 195}:  "m s-1",
+	{0, 3, 0}:    "Pa",
+	{0, 3, 1}:    "Pa",
+	{0, 3, 5}:    "gpm",
+	{0, 3, 192}:  "Pa",
+	{0, 3, 196}:  "m",
+	{0, 4, 192}:  "W m-2",
+	{0, 4, 193}:  "W m-2",
+	{0, 5, 192}:  "W m-2",
+	{0, 5, 193}:  "W m-2",
+	{0, 6, 1}:    "%",
+	{0, 6, 3}:    "%",
+	{0, 6, 4}:    "%",
+	{0, 6, 5}:    "%",
+	{0, 6, 6}:    "kg m-2",
+	{0, 7, 6}:    "J kg-1",
+	{0, 7, 7}:    "J kg-1",
+	{0, 7, 8}:    "m2 s-2",
+	{0, 7, 192}:  "K",
+	{0, 7, 193}:  "K",
+	{0, 14, 0}:   "DU",
+	{0, 14, 192}: "kg kg-1",
+	{0, 19, 0}:   "m",
+	{2, 0, 0}:    "1",
+	{2, 0, 1}:    "m",
+	{2, 0, 192}:  "1",
+	{2, 0, 193}:  "W m-2",
+	{2, 3, 192}:  "1",
+	{10, 2, 0}:   "1",
+}
+
+// ParameterName returns the abbreviation of a parameter, as printed by wgrib2
+func ParameterName(discipline, category, number int) string {
+	if name, ok := parameterNames[parameterKey{discipline, category, number}]; ok {
+		return name
+	}
+	return fmt.Sprintf("var discipline=%d parmcat=%d parm=%d", discipline, category, number)
+}
+
+// ParameterUnits returns the units of a parameter, or "" if they are unknown
+func ParameterUnits(discipline, category, number int) string {
+	return parameterUnits[parameterKey{discipline, category, number}]
+}
+
+// surfaceNames are the descriptions of the fixed surfaces of table 4.5 that have no value
+var surfaceNames = map[int]string{
+	1:   "surface",
+	2:   "cloud base",
+	3:   "cloud top",
+	4:   "0C isotherm",
+	6:   "max wind",
+	7:   "tropopause",
+	8:   "top of atmosphere",
+	10:  "entire atmosphere",
+	101: "mean sea level",
+	200: "entire atmosphere (considered as a single layer)",
+	204: "highest tropospheric freezing level",
+	211: "boundary layer cloud layer",
+	212: "low cloud bottom level",
+	213: "low cloud top level",
+	214: "low cloud layer",
+	215: "cloud ceiling",
+	220: "planetary boundary layer",
+	222: "middle cloud bottom level",
+	223: "middle cloud top level",
+	224: "middle cloud layer",
+	232: "high cloud bottom level",
+	233: "high cloud top level",
+	234: "high cloud layer",
+	242: "convective cloud bottom level",
+	243: "convective cloud top level",
+	244: "convective cloud layer",
+}
+
+// Level describes the surfaces of a product like wgrib2 does, e.g. "2 m above ground"
+// or "0-0.1 m below ground".
+func (p *Product) Level() string {
+	first, second := p.FirstSurface, p.SecondSurface
+	if name, ok := surfaceNames[first.Type]; ok {
+		return name
+	}
+
+	layer := second.Type == first.Type && !math.IsNaN(second.Value)
+	value := func(scale float64) string {
+		if layer {
+			return fmt.Sprintf("%g-%g", first.Value*scale, second.Value*scale)
+		}
+		return fmt.Sprintf("%g", first.Value*scale)
+	}
+
+	switch first.Type {
+	case 100:
+		return value(0.01) + " mb"
+	case 102:
+		return value(1) + " m above mean sea level"
+	case 103:
+		return value(1) + " m above ground"
+	case 104:
+		if layer {
+			return value(1) + " sigma layer"
+		}
+		return value(1) + " sigma level"
+	case 106:
+		return value(1) + " m below ground"
+	case 108:
+		return value(0.01) + " mb above ground"
+	case 109:
+		return fmt.Sprintf("PV=%g (Km^2/kg/s) surface", first.Value)
+	}
+	return fmt.Sprintf("level type %d value %g", first.Type, first.Value)
+}
+
+var timeUnitNames = map[int]string{
+	0:  "min",
+	1:  "hour",
+	2:  "day",
+	3:  "month",
+	4:  "year",
+	10: "3 hour",
+	11: "6 hour",
+	12: "12 hour",
+	13: "sec",
+}
+
+var statisticNames = map[int]string{
+	StatisticAverage:     "ave",
+	StatisticAccumulated: "acc",
+	StatisticMaximum:     "max",
+	StatisticMinimum:     "min",
+}
+
+// Forecast describes the forecast time of a product like wgrib2 does, e.g. "anl",
+// "6 hour fcst" or "0-6 hour acc fcst".
+func (p *Product) Forecast() string {
+	unit := timeUnitNames[p.TimeUnit]
+	if p.Statistic == StatisticNone {
+		if p.ForecastTime == 0 {
+			return "anl"
+		}
+		return fmt.Sprintf("%d %s fcst", p.ForecastTime, unit)
+	}
+
+	statistic, ok := statisticNames[p.Statistic]
+	if !ok {
+		statistic = fmt.Sprintf("statistic %d", p.Statistic)
+	}
+	end := p.ForecastTime + p.StatisticLength
+	if p.StatisticUnit != p.TimeUnit {
+		end = p.ForecastTime + p.StatisticLength*timeUnitMinutes(p.StatisticUnit)/timeUnitMinutes(p.TimeUnit)
+	}
+	return fmt.Sprintf("%d-%d %s %s fcst", p.ForecastTime, end, unit, statistic)
+}
+
+// Ensemble describes the ensemble member of a product like wgrib2 does, e.g.
+// "ENS=+1" or "ENS=low-res ctl", or returns "" for deterministic products.
+func (p *Product) Ensemble() string {
+	switch p.EnsembleType {
+	case -1:
+		return ""
+	case 0:
+		return "ENS=hi-res ctl"
+	case 1:
+		return "ENS=low-res ctl"
+	case 2:
+		return fmt.Sprintf("ENS=-%d", p.Perturbation)
+	case 3:
+		return fmt.Sprintf("ENS=+%d", p.Perturbation)
+	case 4:
+		return "ENS=multi-model"
+	}
+	return fmt.Sprintf("ENS=type %d member %d", p.EnsembleType, p.Perturbation)
+}
+
+// ForecastHours returns the forecast time in hours, the end of the statistical
+// interval for templates 4.8 and 4.11.
+func (p *Product) ForecastHours() int {
+	minutes := p.ForecastTime * timeUnitMinutes(p.TimeUnit)
+	if p.Statistic != StatisticNone {
+		minutes += p.StatisticLength * timeUnitMinutes(p.StatisticUnit)
+	}
+	return minutes / 60
+}
+
+// StartHours returns the forecast time in hours, the start of the statistical
+// interval for templates 4.8 and 4.11.
+func (p *Product) StartHours() int {
+	return p.ForecastTime * timeUnitMinutes(p.TimeUnit) / 60
+}
+
+func timeUnitMinutes(unit int) int {
+	switch unit {
+	case 0:
+		return 1
+	case 2:
+		return 24 * 60
+	case 10:
+		return 3 * 60
+	case 11:
+		return 6 * 60
+	case 12:
+		return 12 * 60
+	}
+	return 60
+}
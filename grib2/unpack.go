@@ -0,0 +1,384 @@
+package grib2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Data representation templates supported by Values
+const (
+	SimplePacking                     = 0
+	ComplexPacking                    = 2
+	ComplexPackingSpatialDifferencing = 3
+)
+
+// DataRepresentation holds the packing parameters of section 5. The value of a
+// packed integer X is (R + X * 2^E) / 10^D.
+type DataRepresentation struct {
+	Template int
+	// Values is the number of packed values, the grid points not masked by the bitmap
+	Values            int
+	ReferenceValue    float32
+	BinaryScale       int
+	DecimalScale      int
+	Bits              int
+	OriginalValueType int
+
+	// complex packing, templates 5.2 and 5.3
+	MissingManagement     int
+	Groups                int
+	GroupWidthReference   int
+	GroupWidthBits        int
+	GroupLengthReference  int
+	GroupLengthIncrement  int
+	LastGroupLength       int
+	GroupLengthBits       int
+	SpatialOrder          int
+	SpatialDescriptorSize int
+}
+
+// ReadDataRepresentation reads a data representation section
+func ReadDataRepresentation(r io.ReaderAt, s Section) (*DataRepresentation, error) {
+	if s.Number != 5 {
+		return nil, &FormatError{s.Offset, fmt.Sprintf("section %d is not a data representation", s.Number)}
+	}
+	b := make([]byte, s.Length)
+	if _, err := r.ReadAt(b, s.Offset); err != nil {
+		return nil, &FormatError{s.Offset, "truncated data representation section"}
+	}
+	if len(b) < 21 {
+		return nil, &FormatError{s.Offset, "data representation section too short"}
+	}
+
+	d := &DataRepresentation{
+		Values:            int(binary.BigEndian.Uint32(b[5:9])),
+		Template:          int(binary.BigEndian.Uint16(b[9:11])),
+		ReferenceValue:    math.Float32frombits(binary.BigEndian.Uint32(b[11:15])),
+		BinaryScale:       int(signed16(b[15:17])),
+		DecimalScale:      int(signed16(b[17:19])),
+		Bits:              int(b[19]),
+		OriginalValueType: int(b[20]),
+	}
+
+	switch d.Template {
+	case SimplePacking:
+	case ComplexPacking, ComplexPackingSpatialDifferencing:
+		if len(b) < 47 || d.Template == ComplexPackingSpatialDifferencing && len(b) < 49 {
+			return nil, &FormatError{s.Offset, "data representation section too short"}
+		}
+		d.MissingManagement = int(b[22])
+		d.Groups = int(binary.BigEndian.Uint32(b[31:35]))
+		d.GroupWidthReference = int(b[35])
+		d.GroupWidthBits = int(b[36])
+		d.GroupLengthReference = int(binary.BigEndian.Uint32(b[37:41]))
+		d.GroupLengthIncrement = int(b[41])
+		d.LastGroupLength = int(binary.BigEndian.Uint32(b[42:46]))
+		d.GroupLengthBits = int(b[46])
+		if d.Template == ComplexPackingSpatialDifferencing {
+			d.SpatialOrder = int(b[47])
+			d.SpatialDescriptorSize = int(b[48])
+			if d.SpatialOrder != 1 && d.SpatialOrder != 2 {
+				return nil, &FormatError{s.Offset, fmt.Sprintf("unsupported spatial differencing order %d", d.SpatialOrder)}
+			}
+		}
+		if d.MissingManagement > 2 {
+			return nil, &FormatError{s.Offset, fmt.Sprintf("unsupported missing value management %d", d.MissingManagement)}
+		}
+	default:
+		return nil, &FormatError{s.Offset, fmt.Sprintf("unsupported data representation template 5.%d", d.Template)}
+	}
+	return d, nil
+}
+
+// Values decodes the field into one value per grid point, in the order of the
+// grid returned by ReadGrid. Points masked by the bitmap and missing values are NaN.
+func (f *Field) Values(r io.ReaderAt) ([]float64, error) {
+	grid, err := ReadGrid(r, f.GridSection)
+	if err != nil {
+		return nil, err
+	}
+	representation, err := ReadDataRepresentation(r, f.RepresentationSection)
+	if err != nil {
+		return nil, err
+	}
+	bitmap, err := f.bitmap(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, f.DataSection.Length-5)
+	if _, err := r.ReadAt(data, f.DataSection.Offset+5); err != nil {
+		return nil, &FormatError{f.DataSection.Offset, "truncated data section"}
+	}
+
+	var packed []float64
+	switch representation.Template {
+	case SimplePacking:
+		packed, err = unpackSimple(data, representation)
+	default:
+		packed, err = unpackComplex(data, representation)
+	}
+	if err != nil {
+		return nil, &FormatError{f.DataSection.Offset, err.Error()}
+	}
+
+	values := make([]float64, grid.Points())
+	if bitmap == nil {
+		if len(packed) != len(values) {
+			return nil, &FormatError{f.DataSection.Offset, fmt.Sprintf("%d values for %d grid points", len(packed), len(values))}
+		}
+		copy(values, packed)
+		return grid.reorder(values), nil
+	}
+
+	if len(bitmap)*8 < len(values) {
+		return nil, &FormatError{f.BitmapSection.Offset, "bitmap shorter than grid"}
+	}
+	next := 0
+	for i := range values {
+		if bitmap[i/8]&(0x80>>uint(i%8)) == 0 {
+			values[i] = math.NaN()
+			continue
+		}
+		if next >= len(packed) {
+			return nil, &FormatError{f.DataSection.Offset, "bitmap has more points than packed values"}
+		}
+		values[i] = packed[next]
+		next++
+	}
+	return grid.reorder(values), nil
+}
+
+// bitmap returns the bitmap of the field, or nil if all points have a value
+func (f *Field) bitmap(r io.ReaderAt) ([]byte, error) {
+	s := f.BitmapSection
+	if s.Length == 0 {
+		return nil, nil
+	}
+	b := make([]byte, s.Length)
+	if _, err := r.ReadAt(b, s.Offset); err != nil || len(b) < 6 {
+		return nil, &FormatError{s.Offset, "truncated bitmap section"}
+	}
+	switch b[5] {
+	case 0:
+		return b[6:], nil
+	case 255:
+		return nil, nil
+	}
+	return nil, &FormatError{s.Offset, fmt.Sprintf("unsupported bitmap indicator %d", b[5])}
+}
+
+func (d *DataRepresentation) scale() func(x float64) float64 {
+	reference := float64(d.ReferenceValue)
+	binaryScale := math.Pow(2, float64(d.BinaryScale))
+	decimalScale := math.Pow10(-d.DecimalScale)
+	return func(x float64) float64 {
+		return (reference + x*binaryScale) * decimalScale
+	}
+}
+
+func unpackSimple(data []byte, d *DataRepresentation) ([]float64, error) {
+	values := make([]float64, d.Values)
+	scale := d.scale()
+	if d.Bits == 0 {
+		for i := range values {
+			values[i] = scale(0)
+		}
+		return values, nil
+	}
+
+	bits := newBitReader(data)
+	for i := range values {
+		x, err := bits.read(d.Bits)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = scale(float64(x))
+	}
+	return values, nil
+}
+
+// unpackComplex decodes complex packing with or without spatial differencing,
+// see the documentation of templates 5.2, 5.3, 7.2 and 7.3.
+func unpackComplex(data []byte, d *DataRepresentation) ([]float64, error) {
+	bits := newBitReader(data)
+
+	var first, second, minimum int64
+	if d.Template == ComplexPackingSpatialDifferencing && d.SpatialDescriptorSize > 0 {
+		size := d.SpatialDescriptorSize * 8
+		var err error
+		if first, err = bits.readSigned(size); err != nil {
+			return nil, err
+		}
+		if d.SpatialOrder == 2 {
+			if second, err = bits.readSigned(size); err != nil {
+				return nil, err
+			}
+		}
+		if minimum, err = bits.readSigned(size); err != nil {
+			return nil, err
+		}
+	}
+
+	references, err := bits.readGroup(d.Groups, d.Bits)
+	if err != nil {
+		return nil, err
+	}
+	widths, err := bits.readGroup(d.Groups, d.GroupWidthBits)
+	if err != nil {
+		return nil, err
+	}
+	lengths, err := bits.readGroup(d.Groups, d.GroupLengthBits)
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0
+	for g := range lengths {
+		widths[g] += uint64(d.GroupWidthReference)
+		lengths[g] = uint64(d.GroupLengthReference) + lengths[g]*uint64(d.GroupLengthIncrement)
+		if g == d.Groups-1 {
+			lengths[g] = uint64(d.LastGroupLength)
+		}
+		total += int(lengths[g])
+	}
+	if total != d.Values {
+		return nil, fmt.Errorf("groups hold %d values, expected %d", total, d.Values)
+	}
+
+	// integer values, and whether they are missing
+	ints := make([]int64, 0, total)
+	missing := make([]bool, 0, total)
+	for g := 0; g < d.Groups; g++ {
+		width := int(widths[g])
+		for k := uint64(0); k < lengths[g]; k++ {
+			var x uint64
+			if width > 0 {
+				if x, err = bits.read(width); err != nil {
+					return nil, err
+				}
+			}
+			isMissing := false
+			switch {
+			case d.MissingManagement == 0:
+			case width == 0:
+				isMissing = d.Bits > 0 && references[g] == 1<<uint(d.Bits)-1 ||
+					d.MissingManagement == 2 && d.Bits > 0 && references[g] == 1<<uint(d.Bits)-2
+			default:
+				isMissing = x == 1<<uint(width)-1 || d.MissingManagement == 2 && x == 1<<uint(width)-2
+			}
+			ints = append(ints, int64(references[g]+x))
+			missing = append(missing, isMissing)
+		}
+	}
+
+	if d.Template == ComplexPackingSpatialDifferencing {
+		undifference(ints, missing, d.SpatialOrder, first, second, minimum)
+	}
+
+	values := make([]float64, len(ints))
+	scale := d.scale()
+	for i, x := range ints {
+		if missing[i] {
+			values[i] = math.NaN()
+		} else {
+			values[i] = scale(float64(x))
+		}
+	}
+	return values, nil
+}
+
+// undifference reverts first or second order spatial differencing over the
+// values that are not missing.
+func undifference(ints []int64, missing []bool, order int, first, second, minimum int64) {
+	n := 0
+	var previous, beforePrevious int64
+	for i := range ints {
+		if missing[i] {
+			continue
+		}
+		switch {
+		case n == 0:
+			ints[i] = first
+		case n == 1 && order == 2:
+			ints[i] = second
+		case order == 1:
+			ints[i] = ints[i] + minimum + previous
+		default:
+			ints[i] = ints[i] + minimum + 2*previous - beforePrevious
+		}
+		beforePrevious, previous = previous, ints[i]
+		n++
+	}
+}
+
+// bitReader reads big endian unsigned integers of any width from a byte slice
+type bitReader struct {
+	data   []byte
+	offset uint
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+func (b *bitReader) read(bits int) (uint64, error) {
+	if bits > 64 {
+		return 0, fmt.Errorf("can not read %d bit integers", bits)
+	}
+	if b.offset+uint(bits) > uint(len(b.data))*8 {
+		return 0, fmt.Errorf("data section too short")
+	}
+	var v uint64
+	for remaining := uint(bits); remaining > 0; {
+		index, shift := b.offset/8, b.offset%8
+		available := 8 - shift
+		take := available
+		if remaining < take {
+			take = remaining
+		}
+		chunk := uint64(b.data[index]>>(available-take)) & (1<<take - 1)
+		v = v<<take | chunk
+		b.offset += take
+		remaining -= take
+	}
+	return v, nil
+}
+
+// readSigned reads a sign and magnitude integer
+func (b *bitReader) readSigned(bits int) (int64, error) {
+	v, err := b.read(bits)
+	if err != nil {
+		return 0, err
+	}
+	magnitude := int64(v & (1<<uint(bits-1) - 1))
+	if v>>uint(bits-1) == 1 {
+		return -magnitude, nil
+	}
+	return magnitude, nil
+}
+
+// readGroup reads n integers of the same width, then skips to the next octet
+func (b *bitReader) readGroup(n, bits int) ([]uint64, error) {
+	values := make([]uint64, n)
+	for i := range values {
+		if bits == 0 {
+			continue
+		}
+		v, err := b.read(bits)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	b.align()
+	return values, nil
+}
+
+func (b *bitReader) align() {
+	if b.offset%8 != 0 {
+		b.offset += 8 - b.offset%8
+	}
+}
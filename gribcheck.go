@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+var cycleFolderName = regexp.MustCompile(`gfs\.([0-9]{8})/([0-9]{2})`)
+
+// cycleTime returns the reference time of a cycle folder such as gfs.20180405/06
+func cycleTime(subDir string) (time.Time, error) {
+	match := cycleFolderName.FindStringSubmatch(subDir)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("%s is not a cycle folder", subDir)
+	}
+	return time.Parse("2006010215", match[1]+match[2])
+}
+
+// validateGrib checks the structure of a downloaded GRIB2 file, and that all its
+// messages have the reference time of the cycle it was downloaded from.
+func validateGrib(fileName, subDir string) ([]*grib2.Message, error) {
+	messages, err := grib2.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	cycle, err := cycleTime(subDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		if !m.ReferenceTime.Equal(cycle) {
+			return nil, fmt.Errorf("message at offset %d has reference time %v, expected %v", m.Offset, m.ReferenceTime, cycle)
+		}
+	}
+	return messages, nil
+}
+
+// quarantine moves an invalid file out of the way, keeping it for inspection. A
+// file quarantined again replaces the earlier copy.
+func quarantine(destinationFolder, subDir, fileName string) error {
+	folder := filepath.Join(destinationFolder, "quarantine", subDir)
+	if err := os.MkdirAll(folder, 0777); err != nil {
+		return err
+	}
+	return os.Rename(fileName, filepath.Join(folder, filepath.Base(fileName)))
+}
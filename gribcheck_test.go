@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateGrib(t *testing.T) {
+	destination, err := ioutil.TempDir("", "gribcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+	fileName := testCycleFile(t, destination, testReferenceTime, 3, testGlobalGrid, tmp2m(make([]float64, testGlobalGrid.Points())))
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := fileName + ".truncated"
+	if err := ioutil.WriteFile(truncated, content[:len(content)-100], 0666); err != nil {
+		t.Fatal(err)
+	}
+	// a message of the 00 cycle in the file of the 06 cycle
+	mixed := testCycleFile(t, destination, testReferenceTime.Add(-6*time.Hour), 3, testGlobalGrid, tmp2m(make([]float64, testGlobalGrid.Points())))
+	previous, err := ioutil.ReadFile(mixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mixed, append(content, previous...), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fileName, subDir string
+		err              string
+	}{
+		{fileName, "gfs.20180405/06", ""},
+		{fileName, "gfs.20180405/00", "has reference time 2018-04-05 06:00:00 +0000 UTC, expected 2018-04-05 00:00:00 +0000 UTC"},
+		{mixed, "gfs.20180405/06", "message at offset"},
+		{truncated, "gfs.20180405/06", "exceeds file size"},
+		{fileName, "gfs.20180405", "is not a cycle folder"},
+	}
+	for _, test := range tests {
+		messages, err := validateGrib(test.fileName, test.subDir)
+		if test.err == "" && (err != nil || len(messages) != 1) {
+			t.Errorf("%s: got %d messages and error %v", test.subDir, len(messages), err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s in %s: got error %v, want %q", test.fileName, test.subDir, err, test.err)
+		}
+	}
+}
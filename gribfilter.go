@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+// filterScript matches the path of a NOMADS grib filter, e.g. /cgi-bin/filter_gfs_1p00.pl
+var filterScript = regexp.MustCompile(`/filter_[A-Za-z0-9_]+\.pl$`)
+
+// errNotFiltered is returned for files the grib filter does not serve, like inventories
+var errNotFiltered = errors.New("only GRIB2 files are served by the grib filter")
+
+// gribFilter are the variables, levels and area requested from a grib filter,
+// all of them when empty.
+type gribFilter struct {
+	variables []string
+	levels    []string
+	area      *grib2.BoundingBox
+	perMinute int
+}
+
+// parseGribFilter parses the comma separated variables and levels, and the
+// bounding box of a grib filter
+func parseGribFilter(variables, levels, bbox string, perMinute int) (gribFilter, error) {
+	area, err := parseBoundingBox(bbox)
+	if err != nil {
+		return gribFilter{}, err
+	}
+	if perMinute <= 0 {
+		return gribFilter{}, fmt.Errorf("invalid filter rate %d, expected requests per minute above 0", perMinute)
+	}
+	filter := gribFilter{area: area, perMinute: perMinute}
+	if filter.variables, err = splitFilterList(variables); err != nil {
+		return gribFilter{}, err
+	}
+	if filter.levels, err = splitFilterList(levels); err != nil {
+		return gribFilter{}, err
+	}
+	return filter, nil
+}
+
+func splitFilterList(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	values := make([]string, 0)
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return nil, fmt.Errorf("invalid filter list %q, empty entry", list)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// query returns the query requesting a file of a folder, e.g. dir=/gfs.20180405/06
+// and file=gfs.t06z.pgrb2.1p00.f000, levels are named with underscores:
+// lev_2_m_above_ground=on.
+func (f gribFilter) query(dir, file string) url.Values {
+	query := url.Values{"dir": {dir}, "file": {file}}
+	if len(f.variables) == 0 {
+		query.Set("all_var", "on")
+	}
+	for _, v := range f.variables {
+		query.Set("var_"+v, "on")
+	}
+	if len(f.levels) == 0 {
+		query.Set("all_lev", "on")
+	}
+	for _, l := range f.levels {
+		query.Set("lev_"+strings.Replace(l, " ", "_", -1), "on")
+	}
+	if f.area != nil {
+		query.Set("subregion", "")
+		query.Set("leftlon", strconv.FormatFloat(f.area.West, 'f', -1, 64))
+		query.Set("rightlon", strconv.FormatFloat(f.area.East, 'f', -1, 64))
+		query.Set("toplat", strconv.FormatFloat(f.area.North, 'f', -1, 64))
+		query.Set("bottomlat", strconv.FormatFloat(f.area.South, 'f', -1, 64))
+	}
+	return query
+}
+
+// filterSource lists the files on the index pages of a NOMADS server, and
+// downloads them through a grib filter script that only returns the requested
+// variables and levels of an area. All requests to the server are spaced to
+// stay below its rate limit.
+type filterSource struct {
+	index   *httpSource
+	script  *url.URL
+	baseDir string
+	filter  gribFilter
+}
+
+// newFilterSource returns the source of a script URL like
+// https://nomads.ncep.noaa.gov/cgi-bin/filter_gfs_1p00.pl, its index pages are
+// the -baseDir of the same server.
+func newFilterSource(script *url.URL, baseDir string, filter gribFilter) *filterSource {
+	index := newHTTPSource(&url.URL{Scheme: script.Scheme, User: script.User, Host: script.Host})
+	index.limiter = newRateLimiter(filter.perMinute)
+	return &filterSource{index: index, script: script, baseDir: baseDir, filter: filter}
+}
+
+// list leaves the size of files unknown, filtered files are smaller than listed
+func (s *filterSource) list(folder string, keep func(*ftp.Entry) bool) ([]*ftp.Entry, error) {
+	entries, err := s.index.index(s.index.folderURL(folder))
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]*ftp.Entry, 0)
+	for _, e := range entries {
+		if keep != nil && !keep(e) {
+			continue
+		}
+		if e.Type == ftp.EntryTypeFile {
+			e.Size = 0
+		}
+		kept = append(kept, e)
+	}
+	return kept, nil
+}
+
+func (s *filterSource) open(folder string) (sourceFolder, error) {
+	relative := strings.TrimPrefix(path.Clean("/"+folder), path.Clean("/"+s.baseDir))
+	return &filterFolder{source: s, dir: "/" + strings.Trim(relative, "/")}, nil
+}
+
+// filterFolder requests the files of a folder from the grib filter
+type filterFolder struct {
+	source *filterSource
+	dir    string
+}
+
+func (f *filterFolder) modTime(entry *ftp.Entry) time.Time {
+	return entry.Time
+}
+
+// retrieve cannot resume, the filter always returns the whole file. The script
+// answers errors like missing files with an html page, so the content is checked
+// to be GRIB2.
+func (f *filterFolder) retrieve(name string, offset int64) (io.ReadCloser, int64, error) {
+	if !gfsFileName.MatchString(name) || strings.HasSuffix(name, ".idx") {
+		return nil, 0, errNotFiltered
+	}
+	response, err := f.source.index.get("GET", f.request(name), 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	body := bufio.NewReader(response.Body)
+	if magic, err := body.Peek(4); err != nil || string(magic) != "GRIB" {
+		page, _ := ioutil.ReadAll(io.LimitReader(body, 1024))
+		response.Body.Close()
+		message := strings.Join(strings.Fields(indexTag.ReplaceAllString(string(page), " ")), " ")
+		return nil, 0, fmt.Errorf("grib filter returned no GRIB2 for %s/%s: %q", f.dir, name, message)
+	}
+	return &bufferedBody{body, response.Body}, 0, nil
+}
+
+// request returns the URL requesting a file from the filter
+func (f *filterFolder) request(name string) *url.URL {
+	u := *f.source.script
+	u.RawQuery = f.source.filter.query(f.dir, name).Encode()
+	return &u
+}
+
+func (f *filterFolder) hashAlgorithm() string {
+	return ""
+}
+
+func (f *filterFolder) hash(name string) (string, string, error) {
+	return "", "", errNoServerHash
+}
+
+func (f *filterFolder) location(name string) string {
+	return f.request(name).Redacted()
+}
+
+func (f *filterFolder) close() error {
+	return nil
+}
+
+// bufferedBody reads a response body through a buffer
+type bufferedBody struct {
+	*bufio.Reader
+	io.Closer
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+// filterServer serves GRIB2 content, or the page, and records the queries
+type filterServer struct {
+	mutex   sync.Mutex
+	queries []url.Values
+	page    string
+}
+
+func (s *filterServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.queries = append(s.queries, r.URL.Query())
+	s.mutex.Unlock()
+	if s.page != "" {
+		w.Write([]byte(s.page))
+		return
+	}
+	w.Write([]byte("GRIB content"))
+}
+
+func newTestFilterFolder(t *testing.T, server *httptest.Server, filter gribFilter) sourceFolder {
+	script, err := url.Parse(server.URL + "/cgi-bin/filter_gfs_1p00.pl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter.perMinute = 60000
+	folder, err := newFilterSource(script, "/pub/data/nccf/com/gfs/prod/", filter).open("/pub/data/nccf/com/gfs/prod/gfs.20180405/06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return folder
+}
+
+func TestFilterQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter gribFilter
+		want   url.Values
+	}{
+		{"everything", gribFilter{}, url.Values{
+			"dir":     {"/gfs.20180405/06"},
+			"file":    {"gfs.t06z.pgrb2.1p00.f000"},
+			"all_var": {"on"},
+			"all_lev": {"on"},
+		}},
+		{"variables, levels and subregion", gribFilter{
+			variables: []string{"TMP", "UGRD"},
+			levels:    []string{"2 m above ground", "10 m above ground"},
+			area:      &grib2.BoundingBox{South: 54, West: -10.5, North: 72, East: 35},
+		}, url.Values{
+			"dir":                   {"/gfs.20180405/06"},
+			"file":                  {"gfs.t06z.pgrb2.1p00.f000"},
+			"var_TMP":               {"on"},
+			"var_UGRD":              {"on"},
+			"lev_2_m_above_ground":  {"on"},
+			"lev_10_m_above_ground": {"on"},
+			"subregion":             {""},
+			"leftlon":               {"-10.5"},
+			"rightlon":              {"35"},
+			"toplat":                {"72"},
+			"bottomlat":             {"54"},
+		}},
+	}
+	for _, test := range tests {
+		handler := &filterServer{}
+		server := httptest.NewServer(handler)
+		body, _, err := newTestFilterFolder(t, server, test.filter).retrieve("gfs.t06z.pgrb2.1p00.f000", 0)
+		if err != nil {
+			server.Close()
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		content, _ := ioutil.ReadAll(body)
+		body.Close()
+		server.Close()
+
+		if string(content) != "GRIB content" {
+			t.Errorf("%s: got content %q", test.name, content)
+		}
+		if len(handler.queries) != 1 {
+			t.Fatalf("%s: got %d requests, want 1", test.name, len(handler.queries))
+		}
+		if got := handler.queries[0].Encode(); got != test.want.Encode() {
+			t.Errorf("%s: got query %s, want %s", test.name, got, test.want.Encode())
+		}
+	}
+}
+
+func TestFilterRejectsErrorPage(t *testing.T) {
+	handler := &filterServer{page: "<html><body><h1>Error</h1>\n<p>data file is not present: /gfs.20180405/06</p></body></html>"}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	folder := newTestFilterFolder(t, server, gribFilter{})
+
+	_, _, err := folder.retrieve("gfs.t06z.pgrb2.1p00.f000", 0)
+	if err == nil {
+		t.Fatal("error page accepted as GRIB2")
+	}
+	if !strings.Contains(err.Error(), "Error data file is not present: /gfs.20180405/06") {
+		t.Errorf("error does not have the text of the page: %v", err)
+	}
+
+	// inventories are not served by the filter, and not asked for
+	if _, _, err := folder.retrieve("gfs.t06z.pgrb2.1p00.f000.idx", 0); err != errNotFiltered {
+		t.Errorf("got error %v for an inventory, want errNotFiltered", err)
+	}
+	if len(handler.queries) != 1 {
+		t.Errorf("got %d requests, want 1", len(handler.queries))
+	}
+}
+
+func TestRateLimiterSpacing(t *testing.T) {
+	limiter := newRateLimiter(1200) // 50ms apart
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		limiter.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("4 requests sent within %v, want at least 150ms", elapsed)
+	}
+}
+
+func TestRateLimiterRetryAfter(t *testing.T) {
+	var mutex sync.Mutex
+	var requests []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests = append(requests, time.Now())
+		if len(requests) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	base, _ := url.Parse(server.URL)
+	source := newHTTPSource(base)
+	source.limiter = newRateLimiter(60000)
+	if _, err := source.get("GET", base, 0); err == nil {
+		t.Fatal("429 response accepted")
+	}
+	response, err := source.get("GET", base, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if delay := requests[1].Sub(requests[0]); delay < 900*time.Millisecond {
+		t.Errorf("request sent %v after a Retry-After of 1 second", delay)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if got := retryAfter("120"); got != 2*time.Minute {
+		t.Errorf("retryAfter of seconds is %v", got)
+	}
+	if got := retryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("retryAfter of a date an hour ahead is %v", got)
+	}
+	if got := retryAfter(""); got != time.Minute {
+		t.Errorf("retryAfter of a missing header is %v", got)
+	}
+}
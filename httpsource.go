@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+var (
+	indexLink = regexp.MustCompile(`(?i)<a\s[^>]*href="([^"]*)"[^>]*>`)
+	indexTag  = regexp.MustCompile(`<[^>]*>`)
+	indexTime = regexp.MustCompile(`([0-9]{2}-[A-Za-z]{3}-[0-9]{4}|[0-9]{4}-[0-9]{2}-[0-9]{2}) ([0-9]{2}:[0-9]{2})`)
+	indexSize = regexp.MustCompile(`^\s*([0-9.]+)([KMGT]?)\b`)
+)
+
+// nomadsHost blocks clients sending too many requests a minute, so requests to
+// it are spaced like those to its grib filter
+const nomadsHost = "nomads.ncep.noaa.gov"
+
+// errNoServerHash is returned by servers that cannot checksum files for us
+var errNoServerHash = errors.New("server has no checksums")
+
+// httpSource is a web server with directory index pages, like nomads.ncep.noaa.gov
+// or ftpprd.ncep.noaa.gov. Folders of the -baseDir are below the path of its URL.
+type httpSource struct {
+	base   *url.URL
+	client *http.Client
+	// limiter spaces the requests to servers with rate limits, nil for none
+	limiter *rateLimiter
+}
+
+func newHTTPSource(base *url.URL) *httpSource {
+	return &httpSource{
+		base: base,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 15 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   15 * time.Second,
+			ResponseHeaderTimeout: time.Minute,
+		}},
+	}
+}
+
+// folderURL returns the URL of a folder, with a trailing slash as index pages
+// link relative to it
+func (s *httpSource) folderURL(folder string) *url.URL {
+	u := *s.base
+	u.Path = path.Join("/", u.Path, folder) + "/"
+	u.RawPath = ""
+	return &u
+}
+
+// get sends a request, ranged from offset if it is above zero, and fails on
+// error statuses.
+func (s *httpSource) get(method string, u *url.URL, offset int64) (*http.Response, error) {
+	request, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	if s.limiter != nil {
+		s.limiter.wait()
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if s.limiter != nil && (response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable) {
+		s.limiter.backoff(retryAfter(response.Header.Get("Retry-After")))
+	}
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, fmt.Errorf("%s %s: %w", method, u.Redacted(), errNotFound)
+	}
+	if response.StatusCode/100 != 2 {
+		response.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, u.Redacted(), response.Status)
+	}
+	return response, nil
+}
+
+// list reads the index page of a folder, with the sizes and times it lists.
+// Those are rounded, stat asks for the exact ones of a file.
+func (s *httpSource) list(folder string, keep func(*ftp.Entry) bool) ([]*ftp.Entry, error) {
+	entries, err := s.index(s.folderURL(folder))
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make([]*ftp.Entry, 0)
+	for _, e := range entries {
+		if keep == nil || keep(e) {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+// index returns the entries of the index page of a folder
+func (s *httpSource) index(u *url.URL) ([]*ftp.Entry, error) {
+	response, err := s.get("GET", u, 0)
+	if err != nil {
+		return nil, err
+	}
+	page, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return parseIndexPage(u, string(page)), nil
+}
+
+// stat sets the size and time of a file entry from the headers of a HEAD request
+func (s *httpSource) stat(folder string, e *ftp.Entry) error {
+	response, err := s.get("HEAD", s.folderURL(folder).ResolveReference(&url.URL{Path: e.Name}), 0)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.ContentLength >= 0 {
+		e.Size = uint64(response.ContentLength)
+	}
+	if modTime, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		e.Time = modTime.UTC()
+	}
+	return nil
+}
+
+// parseIndexPage returns the entries linked from an index page of the folder at
+// u, with the time and size listed next to them. Links leaving the folder, like
+// the parent folder or sort orders, are skipped.
+func parseIndexPage(u *url.URL, page string) []*ftp.Entry {
+	entries := make([]*ftp.Entry, 0)
+	links := indexLink.FindAllStringSubmatchIndex(page, -1)
+	for i, link := range links {
+		href, err := url.Parse(html.UnescapeString(page[link[2]:link[3]]))
+		if err != nil || href.RawQuery != "" || href.Fragment != "" {
+			continue
+		}
+		target := u.ResolveReference(href)
+		if target.Host != u.Host || path.Dir(strings.TrimSuffix(target.Path, "/"))+"/" != u.Path {
+			continue
+		}
+
+		e := &ftp.Entry{Name: path.Base(target.Path), Type: ftp.EntryTypeFile}
+		if strings.HasSuffix(target.Path, "/") {
+			e.Type = ftp.EntryTypeFolder
+		}
+
+		// the time and size follow the link up to the next one
+		end := len(page)
+		if i+1 < len(links) {
+			end = links[i+1][0]
+		}
+		rest := indexTag.ReplaceAllString(page[link[1]:end], " ")
+		if match := indexTime.FindStringSubmatchIndex(rest); match != nil {
+			e.Time = parseIndexTime(rest[match[2]:match[3]], rest[match[4]:match[5]])
+			e.Size = parseIndexSize(rest[match[1]:])
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func parseIndexTime(date, clock string) time.Time {
+	for _, layout := range []string{"02-Jan-2006 15:04", "2006-01-02 15:04"} {
+		if t, err := time.Parse(layout, date+" "+clock); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseIndexSize parses sizes like 1234, 41M or 1.2G, or "-" for folders
+func parseIndexSize(value string) uint64 {
+	match := indexSize.FindStringSubmatch(value)
+	if match == nil {
+		return 0
+	}
+	size, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0
+	}
+	exponent := 0
+	if match[2] != "" {
+		exponent = strings.Index("KMGT", match[2]) + 1
+	}
+	return uint64(size * float64(uint64(1)<<uint(10*exponent)))
+}
+
+func (s *httpSource) open(folder string) (sourceFolder, error) {
+	return &httpFolder{source: s, url: s.folderURL(folder)}, nil
+}
+
+// httpFolder downloads files of a folder with a request each
+type httpFolder struct {
+	source *httpSource
+	url    *url.URL
+}
+
+func (f *httpFolder) modTime(entry *ftp.Entry) time.Time {
+	return entry.Time
+}
+
+// retrieve resumes with a Range request, servers ignoring it send the whole file
+func (f *httpFolder) retrieve(name string, offset int64) (io.ReadCloser, int64, error) {
+	response, err := f.source.get("GET", f.url.ResolveReference(&url.URL{Path: name}), offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		return response.Body, 0, nil
+	}
+	var start int64
+	if _, err := fmt.Sscanf(response.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+		response.Body.Close()
+		return nil, 0, fmt.Errorf("unexpected content range %q for offset %d", response.Header.Get("Content-Range"), offset)
+	}
+	return response.Body, start, nil
+}
+
+func (f *httpFolder) hashAlgorithm() string {
+	return ""
+}
+
+func (f *httpFolder) hash(name string) (string, string, error) {
+	return "", "", errNoServerHash
+}
+
+func (f *httpFolder) location(name string) string {
+	return f.url.ResolveReference(&url.URL{Path: name}).Redacted()
+}
+
+func (f *httpFolder) close() error {
+	return nil
+}
+
+// rateLimiter spaces requests evenly, and holds all of them off while the server
+// asks to back off
+type rateLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{interval: time.Minute / time.Duration(perMinute)}
+}
+
+// wait blocks until the next request may be sent
+func (l *rateLimiter) wait() {
+	l.mutex.Lock()
+	now := time.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next = slot.Add(l.interval)
+	l.mutex.Unlock()
+	time.Sleep(slot.Sub(now))
+}
+
+// backoff holds off requests for a while
+func (l *rateLimiter) backoff(delay time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	log.Println("Server asked to back off", "delay", delay)
+	if until := time.Now().Add(delay); until.After(l.next) {
+		l.next = until
+	}
+}
+
+// retryAfter parses a Retry-After header given in seconds or as a date, a
+// minute if it is missing
+func retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(time.Now()) {
+		return time.Until(t)
+	}
+	return time.Minute
+}
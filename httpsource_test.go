@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testIndexPage = `<html><body><pre>
+<a href="../">Parent Directory</a>
+<a href="gfs.t06z.pgrb2.1p00.f000">gfs.t06z.pgrb2.1p00.f000</a>  05-Apr-2018 09:30   41M
+<a href="gfs.t06z.pgrb2.1p00.f003">gfs.t06z.pgrb2.1p00.f003</a>  05-Apr-2018 09:31   41M
+<a href="gfs.t06z.pgrb2.1p00.f006">gfs.t06z.pgrb2.1p00.f006</a>  05-Apr-2018 09:32   41M
+</pre></body></html>`
+
+// indexServer serves an index page and HEAD requests for the files that exist,
+// and records the requests
+type indexServer struct {
+	mutex    sync.Mutex
+	requests []string
+	exists   map[string]bool
+}
+
+func (s *indexServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	if r.Method == "GET" && r.URL.Path == "/gfs.20180405/06/" {
+		w.Write([]byte(testIndexPage))
+		return
+	}
+	if r.Method != "HEAD" || !s.exists[filepath.Base(r.URL.Path)] {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Length", "42000123")
+	w.Header().Set("Last-Modified", time.Date(2018, 4, 5, 9, 30, 12, 0, time.UTC).Format(http.TimeFormat))
+}
+
+func TestHTTPStatComplete(t *testing.T) {
+	handler := &indexServer{exists: map[string]bool{"gfs.t06z.pgrb2.1p00.f000": true}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	base, _ := url.Parse(server.URL)
+	src := newHTTPSource(base)
+
+	entries, err := src.list("/gfs.20180405/06", isGribEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || len(handler.requests) != 1 {
+		t.Fatalf("got %d entries with requests %v, want 3 with a single GET", len(entries), handler.requests)
+	}
+	if entries[0].Size != 41<<20 || !entries[0].Time.Equal(time.Date(2018, 4, 5, 9, 30, 0, 0, time.UTC)) {
+		t.Errorf("got size %d and time %v from the index", entries[0].Size, entries[0].Time)
+	}
+
+	// f000 looks complete, f003 was removed from the server since, f006 is partial
+	destination, err := ioutil.TempDir("", "httpsource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+	folder := filepath.Join(destination, "gfs.20180405", "06")
+	os.MkdirAll(folder, 0777)
+	for name, size := range map[string]int64{"gfs.t06z.pgrb2.1p00.f000": 42000123, "gfs.t06z.pgrb2.1p00.f003": 42000000, "gfs.t06z.pgrb2.1p00.f006": 1000} {
+		if err := ioutil.WriteFile(filepath.Join(folder, name), make([]byte, size), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kept := statComplete(src, "/gfs.20180405/06", destination, "gfs.20180405/06", entries)
+	if len(kept) != 2 || kept[0].Name != "gfs.t06z.pgrb2.1p00.f000" || kept[1].Name != "gfs.t06z.pgrb2.1p00.f006" {
+		t.Fatalf("got entries %v, want f000 and f006", kept)
+	}
+	if kept[0].Size != 42000123 || kept[0].Time.Second() != 12 {
+		t.Errorf("got size %d and time %v of f000, want those of the HEAD request", kept[0].Size, kept[0].Time)
+	}
+	if kept[1].Size != 41<<20 {
+		t.Errorf("partial f006 was asked for its size")
+	}
+	want := []string{"GET /gfs.20180405/06/", "HEAD /gfs.20180405/06/gfs.t06z.pgrb2.1p00.f000", "HEAD /gfs.20180405/06/gfs.t06z.pgrb2.1p00.f003"}
+	if len(handler.requests) != len(want) {
+		t.Fatalf("got requests %v, want %v", handler.requests, want)
+	}
+	for i := range want {
+		if handler.requests[i] != want[i] {
+			t.Errorf("got requests %v, want %v", handler.requests, want)
+			break
+		}
+	}
+}
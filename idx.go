@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+// inventorySummary describes the content of a downloaded file according to its
+// .idx. Skipped is why the file was not checked against the .idx of the server.
+type inventorySummary struct {
+	Messages int      `json:"messages"`
+	Fields   []string `json:"fields"`
+	Skipped  string   `json:"skipped,omitempty"`
+}
+
+// checkIndex downloads the .idx inventory of a GRIB2 file and verifies that the
+// messages of the downloaded file are at the offsets it lists. Files whose
+// inventory can not be fetched are not checked, their inventory is generated
+// instead, and have no summary if that fails.
+func checkIndex(folder sourceFolder, entry *ftp.Entry, fileName string, messages []*grib2.Message, keepIndex bool) (*inventorySummary, error) {
+	var entries []grib2.IndexEntry
+	skipped := ""
+	index, err := fetchIndex(folder, entry.Name+".idx")
+	if err != nil {
+		if isNotFound(err) {
+			log.Println("No inventory, skipping index check", "entry", entry.Name, "error", err.Error())
+		} else {
+			log.Println("Failed to fetch inventory, skipping index check", "entry", entry.Name, "error", err.Error())
+		}
+		skipped = err.Error()
+		entries, err = localIndex(fileName, messages, keepIndex)
+		if err != nil { // e.g. a product this decoder does not know, the file itself is fine
+			log.Println("Failed to generate inventory, skipping summary", "entry", entry.Name, "error", err.Error())
+			return nil, nil
+		}
+	} else {
+		entries, err = grib2.ParseIndex(bytes.NewReader(index))
+		if err != nil {
+			return nil, err
+		}
+		if err := grib2.CheckIndex(messages, entries); err != nil {
+			return nil, err
+		}
+
+		if keepIndex {
+			if err := ioutil.WriteFile(fileName+".idx", index, 0666); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	summary := &inventorySummary{
+		Messages: len(messages),
+		Fields:   make([]string, 0, len(entries)),
+		Skipped:  skipped,
+	}
+	for _, e := range entries {
+		summary.Fields = append(summary.Fields, e.Parameter+":"+e.Level+":"+e.Forecast)
+	}
+	return summary, nil
+}
+
+func fetchIndex(folder sourceFolder, name string) ([]byte, error) {
+	response, _, err := folder.retrieve(name, 0)
+	if err != nil {
+		return nil, err
+	}
+	index, err := ioutil.ReadAll(response)
+	if closeErr := response.Close(); err == nil {
+		err = closeErr
+	}
+	return index, err
+}
+
+// localIndex generates the inventory of a downloaded file, and keeps it as a sidecar
+// if asked to.
+func localIndex(fileName string, messages []*grib2.Message, keepIndex bool) ([]grib2.IndexEntry, error) {
+	if keepIndex {
+		return writeIndexSidecar(fileName)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return grib2.Inventory(file, messages)
+}
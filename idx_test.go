@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+func TestCheckIndex(t *testing.T) {
+	destination, err := ioutil.TempDir("", "idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+	values := make([]float64, testGlobalGrid.Points())
+	fileName := testCycleFile(t, destination, testReferenceTime, 3, testGlobalGrid,
+		tmp2m(values), testField{category: 1, number: 8, surface: 1, accumulated: 3, values: values})
+	messages, err := grib2.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &ftp.Entry{Name: "gfs.t06z.pgrb2.1p00.f003"}
+	index := fmt.Sprintf("1:0:d=2018040506:TMP:2 m above ground:3 hour fcst:\n2:%d:d=2018040506:APCP:surface:0-3 hour acc fcst:\n", messages[1].Offset)
+
+	// the inventory of the server
+	folder := &testFolder{files: map[string]string{entry.Name + ".idx": index}}
+	summary, err := checkIndex(folder, entry, fileName, messages, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Messages != 2 || strings.Join(summary.Fields, ",") != "TMP:2 m above ground:3 hour fcst,APCP:surface:0-3 hour acc fcst" || summary.Skipped != "" {
+		t.Errorf("got summary %+v", summary)
+	}
+	if kept, err := ioutil.ReadFile(fileName + ".idx"); err != nil || string(kept) != index {
+		t.Errorf("got kept index %q, %v", kept, err)
+	}
+
+	// an inventory listing other offsets
+	moved := strings.Replace(index, fmt.Sprintf("2:%d:", messages[1].Offset), "2:100:", 1)
+	folder.files[entry.Name+".idx"] = moved
+	if _, err := checkIndex(folder, entry, fileName, messages, false); err == nil || !strings.Contains(err.Error(), "index has 100") {
+		t.Errorf("got error %v for an index of other offsets", err)
+	}
+
+	// without an inventory on the server the file is not checked, and says so
+	delete(folder.files, entry.Name+".idx")
+	summary, err = checkIndex(folder, entry, fileName, messages, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Messages != 2 || len(summary.Fields) != 2 || summary.Skipped != errNotFound.Error() {
+		t.Errorf("got summary %+v of a generated inventory", summary)
+	}
+}
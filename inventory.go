@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+// inventoryCommand prints the .idx inventory of local GRIB2 files, or writes it to
+// sidecar files, and returns the process exit code.
+func inventoryCommand(args []string) int {
+	flags := flag.NewFlagSet("inventory", flag.ExitOnError)
+	write := flags.Bool("write", false, "write a .idx sidecar next to each file instead of printing the inventory")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage of inventory: ftplistener inventory [-write] file...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	failed := 0
+	for _, fileName := range flags.Args() {
+		var err error
+		if *write {
+			_, err = writeIndexSidecar(fileName)
+		} else {
+			err = printInventory(fileName)
+		}
+		if err != nil {
+			log.Println("Failed to make inventory", "file", fileName, "error", err.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printInventory(fileName string) error {
+	entries, err := grib2.InventoryFile(fileName)
+	if err != nil {
+		return err
+	}
+	return grib2.WriteIndex(os.Stdout, entries)
+}
+
+// writeIndexSidecar writes the inventory of a GRIB2 file to <file>.idx, for files
+// that have no inventory published with them.
+func writeIndexSidecar(fileName string) ([]grib2.IndexEntry, error) {
+	entries, err := grib2.InventoryFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(fileName + ".idx")
+	if err != nil {
+		return nil, err
+	}
+	if err := grib2.WriteIndex(file, entries); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return entries, file.Close()
+}
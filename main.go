@@ -1,10 +1,15 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net"
 	"os"
 	"regexp"
 	"sort"
@@ -15,8 +20,11 @@ import (
 
 	"github.com/jlaffaye/ftp"
 	nats "github.com/nats-io/go-nats-streaming"
+	"github.com/nilsmagnus/ftplistener/grib2"
 )
 
+var gfsFileName = regexp.MustCompile("gfs.t([0-9]{2})z.pgrb2.1p00.f([0-9]{3})")
+
 type ByDate []*ftp.Entry
 
 func (a ByDate) Len() int           { return len(a) }
@@ -29,30 +37,184 @@ func (f *ftpEntryForDownload) isEmpty() bool {
 
 func main() {
 
-	hostName := flag.String("host", "ftp.ncep.noaa.gov", "Ftp host to ftpConnect to")
-	port := flag.String("port", "21", "Ftp port to ftpConnect to")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(verifyCommand(os.Args[2:]))
+		case "inventory":
+			os.Exit(inventoryCommand(os.Args[2:]))
+		case "subset":
+			os.Exit(subsetCommand(os.Args[2:]))
+		case "netcdf":
+			os.Exit(netcdfCommand(os.Args[2:]))
+		case "derive":
+			os.Exit(deriveCommand(os.Args[2:]))
+		case "quicklook":
+			os.Exit(quicklookCommand(os.Args[2:]))
+		case "diff":
+			os.Exit(diffCommand(os.Args[2:]))
+		case "qc":
+			os.Exit(qcCommand(os.Args[2:]))
+		case "serve":
+			os.Exit(serveCommand(os.Args[2:]))
+		}
+	}
+
+	hostName := flag.String("host", "ftp.ncep.noaa.gov", "Ftp host to ftpConnect to, or the ftp://, ftps://, ftpes://, sftp://, http://, https:// or s3:// URL of a mirror")
+	port := flag.String("port", "21", "Ftp port to ftpConnect to, unless given in the URL")
 	baseDir := flag.String("baseDir", "/pub/data/nccf/com/gfs/prod/", "Base dir")
 	user := flag.String("user", "anonymous", "ftp user")
 	password := flag.String("password", "anything", "ftp password")
 	saveFolder := flag.String("destination", "gribfiles", "destination for downloaded files")
+	tlsCA := flag.String("tlsCA", "", "PEM bundle of CA certificates trusted by ftps:// and ftpes:// hosts besides the system roots")
+	tlsCert := flag.String("tlsCert", "", "PEM client certificate presented to ftps:// and ftpes:// hosts")
+	tlsKey := flag.String("tlsKey", "", "PEM private key of the -tlsCert")
+	ftpMode := flag.String("ftpMode", ftpPassive, "open FTP data connections in passive mode, or in active mode where the server connects to us")
+	activeAddr := flag.String("activeAddr", "", "IP address advertised to FTP servers in active mode, e.g. the public address of a NAT (default the local address)")
+	activePorts := flag.String("activePorts", "", "range of ports listened on for FTP data connections in active mode, e.g. 50000-50100 (default any)")
+	ftpProxy := flag.String("ftpProxy", "", "socks5://, socks5h://, http:// or https:// proxy, with user and password if needed, FTP hosts are reached through (default $FTP_PROXY or $ALL_PROXY)")
+	sshKey := flag.String("sshKey", "", "private key file authenticating the -user on sftp:// hosts, besides the -password")
+	knownHosts := flag.String("knownHosts", "", "known_hosts file with the host keys of sftp:// hosts (default ~/.ssh/known_hosts)")
+	maxAttempts := flag.Int("maxAttempts", 5, "attempts to download a file, with a growing delay between them, before it is given up")
+	mirrorsFile := flag.String("mirrors", "", "json file with equivalent hosts to fail over to, in order, when the -host fails")
+	mirrorFailures := flag.Int("mirrorFailures", 3, "failures in a row after which the downloads move on to the next mirror")
+	mirrorCooldown := flag.Duration("mirrorCooldown", 5*time.Minute, "how long a failed mirror is skipped before it is tried again")
+	cycleSubDir := flag.String("cycleSubDir", "", "folder below each cycle folder on the host with the files, e.g. atmos")
+	keepIndex := flag.Bool("keepIdx", false, "keep the .idx inventory next to downloaded files")
+	bbox := flag.String("bbox", "", "crop downloaded files to south,west,north,east, e.g. 54,-10,72,35")
+	cropMode := flag.String("cropMode", cropAlongside, "write cropped files alongside or instead of the downloaded files")
+	convert := flag.Bool("netcdf", false, "convert each cycle to NetCDF when its downloads are complete")
+	zarrOutput := flag.String("zarr", "", "write complete cycles to zarr stores below this folder or s3://bucket/prefix")
+	zarrVars := flag.String("zarrVars", "", "comma separated variables to write to zarr, e.g. \"TMP:2 m above ground\" (default all)")
+	stationsFile := flag.String("stations", "", "json file with the stations and variables to extract from complete cycles")
+	lastHour := flag.Int("lastHour", 384, "forecast hour of the last file of a cycle, a cycle is complete once it and all files before it are downloaded")
+	derived := flag.String("derived", "", "comma separated fields to derive when a cycle's downloads are complete, e.g. \"WIND:10m,WDIR:10m,RH:2m,APCP:sfc\"")
+	derivedFormat := flag.String("derivedFormat", derivedGRIB2, "write derived fields as grib2 files or a netcdf file")
+	quicklooks := flag.String("quicklooks", "", "comma separated variables to render as PNG quicklooks of each cycle, e.g. \"TMP:2m,PRMSL:msl\"")
+	coastlinesFile := flag.String("coastlines", "", "geojson file with the coastlines drawn on quicklooks (default traced from the LAND field)")
+	qcFile := flag.String("qc", "", "json file with the QC rules checked on the decoded fields of downloaded files")
+	diff := flag.Bool("diff", false, "compare each cycle with the previous one when its downloads are complete")
+	diffVars := flag.String("diffVars", "", "comma separated variables to compare with the previous cycle, e.g. \"TMP:2m,PRMSL:msl\" (default all)")
+	filterVars := flag.String("filterVars", "", "comma separated variables requested from a grib filter -host, e.g. \"TMP,UGRD,VGRD\" (default all)")
+	filterLevels := flag.String("filterLevels", "", "comma separated levels requested from a grib filter -host, e.g. \"2 m above ground,10 m above ground\" (default all)")
+	filterBbox := flag.String("filterBbox", "", "area requested from a grib filter -host as south,west,north,east (default global)")
+	filterRate := flag.Int("filterRate", 60, "requests per minute sent to a grib filter or other nomads.ncep.noaa.gov -host")
+	netcdfVars := flag.String("netcdfVars", "", "comma separated variables to convert to NetCDF, e.g. \"TMP:2 m above ground\" (default all)")
 
 	flag.Parse()
 
-	host := fmt.Sprintf("%s:%s", *hostName, *port)
-
-	credentials := map[string]string{
-		"user":     *user,
-		"password": *password,
-		"host":     host,
+	crop, bboxErr := parseBoundingBox(*bbox)
+	if bboxErr != nil {
+		log.Fatal(bboxErr)
 	}
-
-	conn, connectErr := ftpConnect(credentials)
-
-	if connectErr != nil {
-		panic(connectErr)
+	if crop != nil && !gfsGrid.Intersects(*crop) {
+		log.Fatalf("invalid bbox %q, it has no point of the 1 degree grid of the GFS files", *bbox)
+	}
+	if *cropMode != cropAlongside && *cropMode != cropInstead {
+		log.Fatalf("invalid cropMode %q, expected %s or %s", *cropMode, cropAlongside, cropInstead)
+	}
+	netcdfSelectors, selectorErr := parseOptionalSelectors(*netcdfVars)
+	if selectorErr != nil {
+		log.Fatal(selectorErr)
+	}
+	zarrSelectors, selectorErr := parseOptionalSelectors(*zarrVars)
+	if selectorErr != nil {
+		log.Fatal(selectorErr)
+	}
+	derivedSelectors, selectorErr := parseDerivedFields(*derived)
+	if selectorErr != nil {
+		log.Fatal(selectorErr)
+	}
+	if *derivedFormat != derivedGRIB2 && *derivedFormat != derivedNetCDF {
+		log.Fatalf("invalid derivedFormat %q, expected %s or %s", *derivedFormat, derivedGRIB2, derivedNetCDF)
+	}
+	var quicklookSelectors []fieldSelector
+	if *quicklooks != "" {
+		if quicklookSelectors, selectorErr = parsePointVariables(*quicklooks); selectorErr != nil {
+			log.Fatal(selectorErr)
+		}
+	}
+	coastlines, coastlinesErr := readCoastlines(*coastlinesFile)
+	if coastlinesErr != nil {
+		log.Fatal(coastlinesErr)
+	}
+	diffSelectors, selectorErr := parseOptionalPointVariables(*diffVars)
+	if selectorErr != nil {
+		log.Fatal(selectorErr)
+	}
+	var qc *qcRules
+	if *qcFile != "" {
+		var qcErr error
+		if qc, qcErr = readQCRules(*qcFile); qcErr != nil {
+			log.Fatal(qcErr)
+		}
+	}
+	filter, filterErr := parseGribFilter(*filterVars, *filterLevels, *filterBbox, *filterRate)
+	if filterErr != nil {
+		log.Fatal(filterErr)
+	}
+	var stations *stationConfig
+	if *stationsFile != "" {
+		grid, stationsErr := stationsGrid(filter.area, crop)
+		if stationsErr == nil {
+			stations, stationsErr = readStationConfig(*stationsFile, grid)
+		}
+		if stationsErr != nil {
+			log.Fatal(stationsErr)
+		}
+	}
+	tlsConfig, tlsErr := newTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+	if tlsErr != nil {
+		log.Fatal(tlsErr)
+	}
+	if *ftpMode != ftpPassive && *ftpMode != ftpActive {
+		log.Fatalf("invalid ftpMode %q, expected %s or %s", *ftpMode, ftpPassive, ftpActive)
+	}
+	var active ftp.ActiveMode
+	if *activeAddr != "" {
+		if active.Address = net.ParseIP(*activeAddr); active.Address == nil {
+			log.Fatalf("invalid activeAddr %q, expected an IP address", *activeAddr)
+		}
+	}
+	var portsErr error
+	if active.PortMin, active.PortMax, portsErr = parsePortRange(*activePorts); portsErr != nil {
+		log.Fatal(portsErr)
+	}
+	config := sourceConfig{
+		host:       *hostName,
+		port:       *port,
+		user:       *user,
+		password:   *password,
+		baseDir:    *baseDir,
+		filter:     filter,
+		tls:        tlsConfig,
+		sshKey:     *sshKey,
+		knownHosts: *knownHosts,
+		ftpMode:    *ftpMode,
+		active:     active,
+		proxy:      *ftpProxy,
+	}
+	if *maxAttempts < 1 {
+		log.Fatalf("invalid maxAttempts %d, expected at least 1", *maxAttempts)
+	}
+	if *mirrorFailures < 1 {
+		log.Fatalf("invalid mirrorFailures %d, expected at least 1", *mirrorFailures)
+	}
+	var src source
+	var sourceErr error
+	if *mirrorsFile == "" {
+		src, sourceErr = newSource(config)
+	} else {
+		var mirrors []sourceConfig
+		if mirrors, sourceErr = readMirrors(*mirrorsFile, config); sourceErr == nil {
+			src, sourceErr = newFailoverSource(append([]sourceConfig{config}, mirrors...), *mirrorFailures, *mirrorCooldown)
+		}
+	}
+	if sourceErr != nil {
+		log.Fatal(sourceErr)
 	}
-	//
-	folderList, listErr := conn.List(*baseDir)
+
+	folderList, listErr := src.list(*baseDir, nil)
 
 	if listErr != nil {
 		panic(listErr)
@@ -69,7 +231,36 @@ func main() {
 	wg := sync.WaitGroup{}
 	maxConcurrentDownloads := make(chan int, 16)
 
-	onDone, sc := postToNatsFunc("nats://pi.hole:4222")
+	publish, sc := postToNatsFunc("nats://pi.hole:4222")
+	onDone := func(event downloadEvent) {
+		publish(filesSubject, event.File)
+		publish(fileEventsSubject, event)
+		if event.QC != nil && !event.QC.Passed {
+			publish(qcSubject, qcFailedEvent(event))
+		}
+	}
+	options := downloadOptions{
+		cycleSubDir:   *cycleSubDir,
+		keepIndex:     *keepIndex,
+		qc:            qc,
+		crop:          crop,
+		cropMode:      *cropMode,
+		netcdf:        *convert,
+		netcdfVars:    netcdfSelectors,
+		derived:       derivedSelectors,
+		derivedFormat: *derivedFormat,
+		quicklooks:    quicklookSelectors,
+		diff:          *diff,
+		diffVars:      diffSelectors,
+		coastlines:    coastlines,
+		zarr:          *zarrOutput,
+		zarrVars:      zarrSelectors,
+		stations:      stations,
+		lastHour:      *lastHour,
+	}
+	cycles := newCycleTracker(func(destinationFolder, subDir string, downloaded int, listed, failed []string) {
+		completeCycle(destinationFolder, subDir, downloaded, listed, failed, options, publish)
+	})
 
 	if sc != nil {
 		defer sc.Close()
@@ -81,10 +272,19 @@ func main() {
 			case entry := <-downloadItemChannel:
 				wg.Add(1)
 				go func() {
-					err := downloadSingle(credentials, entry, maxConcurrentDownloads, onDone)
+					err := downloadSingle(src, entry, maxConcurrentDownloads, onDone, options)
 					if err != nil {
-						log.Println("Failed to download entry", "entry", entry.entry.Name, "date", entry.entry.Time, "error", err.Error())
-						downloadItemChannel <- entry
+						entry.attempts++
+						if entry.attempts >= *maxAttempts {
+							log.Println("Giving up on entry", "entry", entry.entry.Name, "date", entry.entry.Time, "attempts", entry.attempts, "error", err.Error())
+							cycles.failed(entry)
+						} else {
+							log.Println("Failed to download entry", "entry", entry.entry.Name, "date", entry.entry.Time, "attempts", entry.attempts, "error", err.Error())
+							time.Sleep(retryDelay(entry.attempts))
+							downloadItemChannel <- entry
+						}
+					} else {
+						cycles.done(entry)
 					}
 					wg.Done()
 				}()
@@ -97,10 +297,12 @@ func main() {
 			log.Println("hit ftpFolder ", "foldername", ftpFolder.Name)
 			for _, subFolderName := range []string{"00", "06", "12", "18"} {
 				aboluteFolder := fmt.Sprintf("%s/%s", ftpFolder.Name, subFolderName)
-				if gribFiles, err := listFiles(credentials, *baseDir, aboluteFolder); err == nil {
+				if gribFiles, err := listFiles(src, remoteFolder(*baseDir, aboluteFolder, options.cycleSubDir)); err == nil {
 					sort.Sort(ByDate(gribFiles))
 					log.Printf("Found %d files in subfolder %s\n", len(gribFiles), aboluteFolder)
-					putAllEntriesInFolderOnChannel(downloadItemChannel, *baseDir, aboluteFolder, gribFiles, *saveFolder)
+					gribFiles = statComplete(src, remoteFolder(*baseDir, aboluteFolder, options.cycleSubDir), *saveFolder, aboluteFolder, gribFiles)
+					queued := putAllEntriesInFolderOnChannel(downloadItemChannel, *baseDir, aboluteFolder, gribFiles, *saveFolder)
+					cycles.queued(*saveFolder, aboluteFolder, queued, gribFiles)
 				} else {
 					log.Println("Error listing files in folder ", "folder", ftpFolder.Name)
 				}
@@ -117,20 +319,76 @@ func main() {
 
 }
 
-func putAllEntriesInFolderOnChannel(downloadChannel chan<- ftpEntryForDownload, baseDir, subDir string, entries []*ftp.Entry, destinationFolder string) {
+// statComplete asks a source with rounded listings for the exact size and time
+// of the files whose local copy looks complete, the others are downloaded
+// anyway. Files missing on the server by now are left out.
+func statComplete(src source, folder, destinationFolder, subDir string, entries []*ftp.Entry) []*ftp.Entry {
+	statter, ok := src.(statSource)
+	if !ok {
+		return entries
+	}
+	kept := make([]*ftp.Entry, 0, len(entries))
 	for _, fileEntry := range entries {
 		stat, err := os.Stat(filePath(destinationFolder, fileEntry, subDir))
+		if err == nil && roughlySameSize(stat.Size(), fileEntry.Size) {
+			if err := statter.stat(folder, fileEntry); isNotFound(err) {
+				log.Println("Skipping entry gone from server", "entry", filePath(destinationFolder, fileEntry, subDir))
+				continue
+			} else if err != nil {
+				log.Println("Failed to stat entry, skipping it", "entry", filePath(destinationFolder, fileEntry, subDir), "error", err.Error())
+				continue
+			}
+		}
+		kept = append(kept, fileEntry)
+	}
+	return kept
+}
 
-		if os.IsNotExist(err) { // if file does not exist
+// roughlySameSize reports whether a local size is within the rounding of a
+// listed size like 41M, or the listed size is unknown
+func roughlySameSize(local int64, listed uint64) bool {
+	if listed == 0 {
+		return true
+	}
+	difference := float64(local) - float64(listed)
+	return math.Abs(difference) <= 0.05*float64(listed)
+}
+
+// putAllEntriesInFolderOnChannel queues the entries that need to be downloaded and
+// returns how many were queued.
+func putAllEntriesInFolderOnChannel(downloadChannel chan<- ftpEntryForDownload, baseDir, subDir string, entries []*ftp.Entry, destinationFolder string) int {
+	queued := 0
+	for _, fileEntry := range entries {
+		stat, err := os.Stat(filePath(destinationFolder, fileEntry, subDir))
+
+		if replacedByCrop(destinationFolder, subDir, fileEntry.Name) { // if only the cropped file was kept
+			log.Println("Skipping cropped entry", "entry", filePath(destinationFolder, fileEntry, subDir))
+			continue
+		} else if os.IsNotExist(err) { // if file does not exist
+			downloadChannel <- ftpEntryForDownload{
+				baseDir:           baseDir,
+				subDir:            subDir,
+				entry:             fileEntry,
+				destinationFolder: destinationFolder,
+			}
+		} else if stat != nil && fileEntry.Size != 0 && stat.Size() != int64(fileEntry.Size) { // if filesize is different from existing file, resumed when smaller
+			log.Println("Queueing incomplete entry ", "entry", filePath(destinationFolder, fileEntry, subDir))
 			downloadChannel <- ftpEntryForDownload{
 				baseDir:           baseDir,
 				subDir:            subDir,
 				entry:             fileEntry,
 				destinationFolder: destinationFolder,
 			}
-		} else if stat != nil && stat.Size() != int64(fileEntry.Size) { // if filesize is different from existing file
-			log.Println("Deleting incomplete entry ", "entry", filePath(destinationFolder, fileEntry, subDir))
-			os.Remove(stat.Name())
+		} else if stat != nil && fileEntry.Size == 0 && !sameMinute(stat.ModTime(), fileEntry.Time) { // if the size is unknown, files without the remote time are unfinished
+			log.Println("Queueing unfinished entry ", "entry", filePath(destinationFolder, fileEntry, subDir))
+			downloadChannel <- ftpEntryForDownload{
+				baseDir:           baseDir,
+				subDir:            subDir,
+				entry:             fileEntry,
+				destinationFolder: destinationFolder,
+			}
+		} else if stat != nil && remoteIsNewer(fileEntry, stat) { // if remote file has been modified since download
+			log.Println("Replacing outdated entry ", "entry", filePath(destinationFolder, fileEntry, subDir))
 			downloadChannel <- ftpEntryForDownload{
 				baseDir:           baseDir,
 				subDir:            subDir,
@@ -139,8 +397,11 @@ func putAllEntriesInFolderOnChannel(downloadChannel chan<- ftpEntryForDownload,
 			}
 		} else {
 			log.Println("Skipping existing entry", "entry", filePath(destinationFolder, fileEntry, subDir))
+			continue
 		}
+		queued++
 	}
+	return queued
 }
 
 type ftpEntryForDownload struct {
@@ -148,90 +409,252 @@ type ftpEntryForDownload struct {
 	subDir            string
 	entry             *ftp.Entry
 	destinationFolder string
+	attempts          int // failed downloads so far
 }
 
-func downloadSingle(credentials map[string]string, downloadItem ftpEntryForDownload, maxConcurrentDownloads chan int, onDone func(filename string)) error {
+const (
+	firstRetryDelay = 10 * time.Second
+	maxRetryDelay   = 10 * time.Minute
+)
+
+// retryDelay is the wait before a failed download is tried again, doubling with
+// each attempt
+func retryDelay(attempts int) time.Duration {
+	delay := firstRetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+// downloadOptions are the settings that apply to every download
+type downloadOptions struct {
+	cycleSubDir   string
+	keepIndex     bool
+	qc            *qcRules
+	crop          *grib2.BoundingBox
+	cropMode      string
+	netcdf        bool
+	netcdfVars    []fieldSelector
+	derived       []fieldSelector
+	derivedFormat string
+	quicklooks    []fieldSelector
+	diff          bool
+	diffVars      []fieldSelector
+	coastlines    [][]lonLat
+	zarr          string
+	zarrVars      []fieldSelector
+	stations      *stationConfig
+	lastHour      int
+}
+
+func downloadSingle(src source, downloadItem ftpEntryForDownload, maxConcurrentDownloads chan int, onDone func(event downloadEvent), options downloadOptions) error {
 	maxConcurrentDownloads <- 0
 
 	defer func() {
-		filename := filePath(downloadItem.destinationFolder, downloadItem.entry, downloadItem.subDir)
-		onDone(filename)
-		log.Println("Done downloading ", "file", filename)
+		log.Println("Done downloading ", "file", filePath(downloadItem.destinationFolder, downloadItem.entry, downloadItem.subDir))
 		<-maxConcurrentDownloads
 	}()
 	log.Println("Downloading ", "file", filePath(downloadItem.destinationFolder, downloadItem.entry, downloadItem.subDir))
 
 	os.MkdirAll(fileFolder(downloadItem.destinationFolder, downloadItem.subDir), 0777)
 
-	conn, err := ftpConnect(credentials)
+	folder, err := src.open(remoteFolder(downloadItem.baseDir, downloadItem.subDir, options.cycleSubDir))
 	if err != nil {
 		return err
 	}
-	defer conn.Logout()
-
-	conn.ChangeDir(downloadItem.baseDir + "/" + downloadItem.subDir)
+	defer folder.close()
 
-	response, err := conn.Retr(downloadItem.entry.Name)
-	if err != nil {
-		return err
+	// the exact size checks the transfer, where the listing rounds it
+	if statter, ok := src.(statSource); ok {
+		if err := statter.stat(remoteFolder(downloadItem.baseDir, downloadItem.subDir, options.cycleSubDir), downloadItem.entry); err != nil {
+			return err
+		}
 	}
-	defer response.Close()
+
+	modTime := folder.modTime(downloadItem.entry)
 
 	fileName := filePath(downloadItem.destinationFolder, downloadItem.entry, downloadItem.subDir)
 
-	file, ferr := os.Create(fileName)
+	file, ferr := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0666)
 	if ferr != nil {
 		return ferr
 	}
 
 	defer file.Close()
-	_, writeErr := io.Copy(file, response) // todo inspect content if you want to here
+
+	response, offset, err := folder.retrieve(downloadItem.entry.Name, resumableSize(file, downloadItem.entry))
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+	location := folder.location(downloadItem.entry.Name)
+
+	hash := sha256.New()
+	algorithm := folder.hashAlgorithm()
+	remoteHash := newHash(algorithm, hash)
+	if err := resume(file, offset, io.MultiWriter(hash, remoteHash)); err != nil {
+		return err
+	}
+	written, writeErr := io.Copy(io.MultiWriter(file, hash, remoteHash), response) // todo inspect content if you want to here
+	size := offset + written
 
 	if writeErr != nil {
+		if downloadItem.entry.Size == 0 { // without a size the partial file cannot be resumed
+			file.Close()
+			os.Remove(fileName)
+		}
 		return writeErr
 	}
+
+	// the transfer must be completed before the control connection can be used again
+	if closeErr := response.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	if checkErr := checkTransfer(folder, downloadItem.entry, size, algorithm, remoteHash); checkErr != nil {
+		file.Close()
+		os.Remove(fileName)
+		return checkErr
+	}
+
+	messages, gribErr := validateGrib(fileName, downloadItem.subDir)
+	var inventory *inventorySummary
+	if gribErr == nil {
+		inventory, gribErr = checkIndex(folder, downloadItem.entry, fileName, messages, options.keepIndex)
+	}
+	if gribErr != nil {
+		file.Close()
+		if err := quarantine(downloadItem.destinationFolder, downloadItem.subDir, fileName); err != nil {
+			log.Println("Failed to quarantine", "file", fileName, "error", err.Error())
+			os.Remove(fileName)
+		}
+		return gribErr
+	}
+
+	var quality *qcResult
+	if options.qc != nil {
+		var qcErr error
+		if quality, qcErr = checkQuality(fileName, options.qc); qcErr != nil {
+			// the file is valid GRIB2, downloading it again would not help
+			quality = &qcResult{Failures: []qcFailure{{Check: "decode", Detail: qcErr.Error()}}}
+		}
+		if !quality.Passed {
+			log.Println("Failed quality checks", "file", fileName, "failures", len(quality.Failures))
+		}
+	}
+
+	if !modTime.IsZero() {
+		file.Close()
+		if err := os.Chtimes(fileName, modTime, modTime); err != nil {
+			return err
+		}
+	}
+
+	// a file that cannot be cropped is kept whole, downloading it again would not help
+	event := downloadEvent{File: fileName, Source: location, Inventory: inventory, QC: quality}
+	if options.crop != nil {
+		if croppedFileName, cropErr := cropDownload(downloadItem, fileName, modTime, options); cropErr != nil {
+			log.Println("Failed to crop", "file", fileName, "error", cropErr.Error())
+			event.CropError = cropErr.Error()
+		} else if options.cropMode == cropInstead {
+			event.File = croppedFileName
+		} else {
+			event.Cropped = croppedFileName
+		}
+	}
+
+	manifestErr := appendManifest(manifestPath(downloadItem.destinationFolder, downloadItem.subDir), manifestEntry{
+		Name:         downloadItem.entry.Name,
+		Size:         size,
+		ModTime:      modTime,
+		Sha256:       hex.EncodeToString(hash.Sum(nil)),
+		Source:       location,
+		DownloadedAt: time.Now().UTC(),
+		QC:           quality,
+	})
+	if manifestErr != nil {
+		return manifestErr
+	}
+
+	onDone(event)
 	return nil
 }
 
-func fileFolder(folderName, subdir string) string {
-	return fmt.Sprintf("%s/%s/", folderName, subdir)
+// resumableSize returns the size of a partial download to resume from, or zero
+// if the file is complete or the remote file was modified since it was written.
+func resumableSize(file *os.File, entry *ftp.Entry) int64 {
+	stat, err := file.Stat()
+	if err != nil || stat.Size() == 0 || stat.Size() >= int64(entry.Size) || remoteIsNewer(entry, stat) {
+		return 0
+	}
+	log.Println("Resuming incomplete entry", "entry", file.Name(), "offset", stat.Size())
+	return stat.Size()
 }
-func filePath(folderName string, entry *ftp.Entry, subdir string) string {
-	return fmt.Sprintf("%s%s", fileFolder(folderName, subdir), entry.Name)
+
+// resume truncates a partial download to the offset the transfer starts at, and
+// hashes the bytes before it.
+func resume(file *os.File, offset int64, hash io.Writer) error {
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(hash, file, offset)
+	return err
 }
 
-func listFiles(credentials map[string]string, baseDir string, subDir string) ([]*ftp.Entry, error) {
-	conn, conErr := ftpConnect(credentials)
-	if conErr != nil {
-		return nil, conErr
+// remoteIsNewer reports whether the remote entry was modified after the local file,
+// compared at minute precision since that is all LIST guarantees.
+func remoteIsNewer(entry *ftp.Entry, local os.FileInfo) bool {
+	if entry.Time.IsZero() {
+		return false
 	}
+	return local.ModTime().Truncate(time.Minute).Before(entry.Time.Truncate(time.Minute))
+}
 
-	list, err := conn.List(baseDir + "/" + subDir)
+// sameMinute reports whether a local time is the time of a remote entry at the
+// minute precision of listings
+func sameMinute(local, remote time.Time) bool {
+	return local.Truncate(time.Minute).Equal(remote.Truncate(time.Minute))
+}
 
-	if err != nil {
-		return nil, err
-	}
+func fileFolder(folderName, subdir string) string {
+	return fmt.Sprintf("%s/%s/", folderName, subdir)
+}
+func filePath(folderName string, entry *ftp.Entry, subdir string) string {
+	return fmt.Sprintf("%s%s", fileFolder(folderName, subdir), entry.Name)
+}
 
-	gfsFileName, _ := regexp.Compile("gfs.t([0-9]{2})z.pgrb2.1p00.f([0-9]{3})")
+func listFiles(src source, folder string) ([]*ftp.Entry, error) {
+	return src.list(folder, isGribEntry)
+}
 
-	relevantList := make([]*ftp.Entry, 0)
-	for _, e := range list {
-		if e.Type == ftp.EntryTypeFile &&
-			gfsFileName.MatchString(e.Name) &&
-			!strings.Contains(e.Name, "idx") {
-			relevantList = append(relevantList, e)
-		}
+// remoteFolder returns the folder of the files of a cycle on the source, e.g.
+// /pub/data/nccf/com/gfs/prod/gfs.20180405/06/atmos
+func remoteFolder(baseDir, subDir, cycleSubDir string) string {
+	folder := baseDir + "/" + subDir
+	if cycleSubDir != "" {
+		folder += "/" + cycleSubDir
 	}
+	return folder
+}
 
-	return relevantList, nil
-
+func isGribEntry(e *ftp.Entry) bool {
+	return e.Type == ftp.EntryTypeFile &&
+		gfsFileName.MatchString(e.Name) &&
+		!strings.Contains(e.Name, "idx")
 }
 
 func folderIsRelevant(l *ftp.Entry, gfsFolderName *regexp.Regexp) bool {
 	return l.Type == ftp.EntryTypeFolder && gfsFolderName.MatchString(l.Name)
 }
-func ftpConnect(credentials map[string]string) (*ftp.ServerConn, error) {
-	conn, err := ftp.DialTimeout(credentials["host"], 15*time.Second)
+func ftpConnect(credentials map[string]string, options ...ftp.DialOption) (*ftp.ServerConn, error) {
+	conn, err := ftp.Dial(credentials["host"], append([]ftp.DialOption{ftp.DialWithTimeout(15 * time.Second)}, options...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -242,20 +665,49 @@ func ftpConnect(credentials map[string]string) (*ftp.ServerConn, error) {
 	return conn, nil
 }
 
-func postToNatsFunc(natsUrl string) (func(filename string), nats.Conn) {
+// downloadEvent is published when a file has been downloaded and checked
+type downloadEvent struct {
+	File      string            `json:"file"`
+	Source    string            `json:"source"`
+	Cropped   string            `json:"cropped,omitempty"`
+	CropError string            `json:"cropError,omitempty"`
+	Inventory *inventorySummary `json:"inventory,omitempty"`
+	QC        *qcResult         `json:"qc,omitempty"`
+}
+
+// Subjects of the published events
+const (
+	filesSubject      = "leia.noaa.files"
+	fileEventsSubject = "leia.noaa.files.json"
+	cyclesSubject     = "leia.noaa.cycles"
+	qcSubject         = "leia.noaa.qc"
+)
+
+func postToNatsFunc(natsUrl string) (func(subject string, event interface{}), nats.Conn) {
 	sc, connectError := nats.Connect("test-cluster", "ftplistener", nats.NatsURL(natsUrl))
 
 	if connectError != nil {
 		log.Println("Nats unavailable", connectError.Error())
-		return func(name string) {
-			log.Println("Error connecting to nats, ", connectError.Error(), " not publishing events", name)
+		return func(subject string, event interface{}) {
+			log.Println("Error connecting to nats, ", connectError.Error(), " not publishing events", subject)
 		}, nil
 	}
 
 	log.Println("Connected to nats on ", natsUrl)
 
-	return func(name string) {
-		if publishError := sc.Publish("leia.noaa.files", []byte(name)); publishError != nil {
+	// strings are published as they are, like the file names of leia.noaa.files
+	return func(subject string, event interface{}) {
+		var payload []byte
+		if name, ok := event.(string); ok {
+			payload = []byte(name)
+		} else {
+			var err error
+			if payload, err = json.Marshal(event); err != nil {
+				log.Println(err.Error())
+				return
+			}
+		}
+		if publishError := sc.Publish(subject, payload); publishError != nil {
 			log.Println(publishError.Error())
 		}
 	}, sc
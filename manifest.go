@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const manifestFileName = "manifest.jsonl"
+
+// manifestEntry describes one downloaded file. Entries are appended to the manifest
+// of the cycle folder, so a file downloaded twice appears twice; the last one wins.
+type manifestEntry struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"modTime"`
+	Sha256       string    `json:"sha256"`
+	Source       string    `json:"source,omitempty"`
+	DownloadedAt time.Time `json:"downloadedAt"`
+	QC           *qcResult `json:"qc,omitempty"`
+}
+
+// manifestMutex serializes appends from concurrent downloads to the same manifest
+var manifestMutex sync.Mutex
+
+func manifestPath(folderName, subdir string) string {
+	return fileFolder(folderName, subdir) + manifestFileName
+}
+
+func appendManifest(path string, entry manifestEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// readManifest returns the latest entry for each file in the manifest, in the order
+// the files were first downloaded.
+func readManifest(path string) ([]manifestEntry, error) {
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]manifestEntry, 0)
+	index := make(map[string]int)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry manifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		if i, ok := index[entry.Name]; ok {
+			entries[i] = entry
+		} else {
+			index[entry.Name] = len(entries)
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
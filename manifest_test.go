@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	folder, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	path := filepath.Join(folder, manifestFileName)
+
+	downloadedAt := time.Date(2018, 4, 5, 9, 31, 12, 0, time.UTC)
+	entries := []manifestEntry{
+		{Name: "gfs.t06z.pgrb2.1p00.f000", Size: 40, ModTime: downloadedAt.Add(-time.Hour), Sha256: "aa", Source: "ftp://ftp.ncep.noaa.gov/gfs.20180405/06/gfs.t06z.pgrb2.1p00.f000", DownloadedAt: downloadedAt},
+		{Name: "gfs.t06z.pgrb2.1p00.f003", Size: 41, Sha256: "bb", DownloadedAt: downloadedAt,
+			QC: &qcResult{Checked: 1, Failures: []qcFailure{{Field: "TMP:2 m above ground:3 hour fcst", Check: "range", Detail: "1 values outside 180 to 340"}}}},
+		// f000 downloaded again after it changed on the server
+		{Name: "gfs.t06z.pgrb2.1p00.f000", Size: 42, Sha256: "cc", DownloadedAt: downloadedAt.Add(time.Hour)},
+	}
+	for _, entry := range entries {
+		if err := appendManifest(path, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read, err := readManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 {
+		t.Fatalf("got %d entries, want the last one of each of 2 files", len(read))
+	}
+	if read[0].Name != entries[2].Name || read[0].Size != 42 || read[0].Sha256 != "cc" || !read[0].DownloadedAt.Equal(entries[2].DownloadedAt) || read[0].Source != "" {
+		t.Errorf("got %+v, want the second download of f000", read[0])
+	}
+	if read[1].Name != entries[1].Name || read[1].QC == nil || read[1].QC.Passed || read[1].QC.Failures[0] != entries[1].QC.Failures[0] {
+		t.Errorf("got %+v, want f003 with its QC result", read[1])
+	}
+
+	if _, err := readManifest(filepath.Join(folder, "missing.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing manifest", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("{\"name\":\"gfs.t06z.pgrb2.1p00.f000\"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readManifest(path); err == nil {
+		t.Error("manifest with a truncated line read")
+	}
+}
+
+func TestManifestConcurrentAppends(t *testing.T) {
+	folder, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	path := filepath.Join(folder, manifestFileName)
+
+	var wg sync.WaitGroup
+	for hour := 0; hour < 50; hour++ {
+		wg.Add(1)
+		go func(hour int) {
+			defer wg.Done()
+			if err := appendManifest(path, manifestEntry{Name: fmt.Sprintf("gfs.t06z.pgrb2.1p00.f%03d", hour)}); err != nil {
+				t.Error(err)
+			}
+		}(hour)
+	}
+	wg.Wait()
+	entries, err := readManifest(path)
+	if err != nil || len(entries) != 50 {
+		t.Errorf("got %d entries, %v, want 50", len(entries), err)
+	}
+}
@@ -0,0 +1,412 @@
+// Package netcdf writes NetCDF classic files in the 64-bit offset format (CDF-2)
+// as described in the NetCDF Classic and 64-bit Offset Format specification.
+//
+// A file starts with a header declaring its dimensions, global attributes and
+// variables, followed by the data of the fixed size variables and then by the
+// records of the variables along the unlimited dimension, interleaved.
+package netcdf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Type is an external data type of table "nc_type"
+type Type int32
+
+// Data types of the classic format
+const (
+	Byte   Type = 1
+	Char   Type = 2
+	Short  Type = 3
+	Int    Type = 4
+	Float  Type = 5
+	Double Type = 6
+)
+
+// Size returns the size in bytes of a value of the type
+func (t Type) Size() int64 {
+	switch t {
+	case Byte, Char:
+		return 1
+	case Short:
+		return 2
+	case Int, Float:
+		return 4
+	case Double:
+		return 8
+	}
+	return 0
+}
+
+const (
+	tagDimension = 0x0A
+	tagVariable  = 0x0B
+	tagAttribute = 0x0C
+)
+
+// Unlimited is the length of the record dimension
+const Unlimited = 0
+
+// Dimension is a named dimension. A file has at most one dimension of length
+// Unlimited, it must be the first dimension of the variables using it.
+type Dimension struct {
+	Name   string
+	Length int
+}
+
+// Attribute is a named value. Value is a string, or an int8, int16, int32,
+// float32 or float64 or a slice of one of them.
+type Attribute struct {
+	Name  string
+	Value interface{}
+}
+
+// Variable is an array of Type along the named dimensions
+type Variable struct {
+	Name       string
+	Type       Type
+	Dimensions []string
+	Attributes []Attribute
+}
+
+// Header declares the content of a file
+type Header struct {
+	Dimensions []Dimension
+	Attributes []Attribute
+	Variables  []Variable
+}
+
+// Writer writes the data of the variables of a header. The header is written
+// when the writer is created and its number of records is updated by Close.
+type Writer struct {
+	w          io.WriterAt
+	header     *Header
+	variables  map[string]*layout
+	recordSize int64
+	records    int
+}
+
+// layout is the location of the data of a variable
+type layout struct {
+	variable *Variable
+	record   bool
+	// length is the size of the values of the variable, or of one record of it,
+	// size is length padded to 4 bytes
+	length, size int64
+	begin        int64
+}
+
+// NewWriter writes the header to w and returns a writer for the data of its variables
+func NewWriter(w io.WriterAt, h *Header) (*Writer, error) {
+	writer := &Writer{w: w, header: h, variables: make(map[string]*layout)}
+	layouts, err := writer.layout()
+	if err != nil {
+		return nil, err
+	}
+
+	// the header size does not depend on the offsets, it is computed first
+	header := writer.encodeHeader(layouts)
+	begin := int64(len(header))
+	for _, l := range layouts {
+		if !l.record {
+			l.begin = begin
+			begin += l.size
+		}
+	}
+	for _, l := range layouts {
+		if l.record {
+			l.begin = begin
+			begin += l.size
+		}
+	}
+
+	if _, err := w.WriteAt(writer.encodeHeader(layouts), 0); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Write writes the values of a variable, or of one record of a record variable.
+// values is a slice of the Go type matching the variable type, e.g. []float32
+// for Float, holding all values of the variable or record in row major order.
+func (w *Writer) Write(name string, record int, values interface{}) error {
+	l, ok := w.variables[name]
+	if !ok {
+		return fmt.Errorf("netcdf: no variable %s", name)
+	}
+	if !l.record && record != 0 {
+		return fmt.Errorf("netcdf: variable %s has no records", name)
+	}
+	if err := checkType(l.variable.Type, values); err != nil {
+		return fmt.Errorf("netcdf: variable %s: %v", name, err)
+	}
+
+	var buffer bytes.Buffer
+	if err := binary.Write(&buffer, binary.BigEndian, values); err != nil {
+		return err
+	}
+	if int64(buffer.Len()) != l.length {
+		return fmt.Errorf("netcdf: variable %s needs %d bytes, got %d", name, l.length, buffer.Len())
+	}
+	buffer.Write(make([]byte, l.size-l.length))
+
+	offset := l.begin
+	if l.record {
+		offset += int64(record) * w.recordSize
+		if record >= w.records {
+			w.records = record + 1
+		}
+	}
+	_, err := w.w.WriteAt(buffer.Bytes(), offset)
+	return err
+}
+
+// Close writes the number of records to the header
+func (w *Writer) Close() error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(w.records))
+	_, err := w.w.WriteAt(b, 4)
+	return err
+}
+
+// layout computes the sizes of the variables, in the order of the header
+func (w *Writer) layout() ([]*layout, error) {
+	dimensions := make(map[string]Dimension)
+	for i, d := range w.header.Dimensions {
+		if err := checkName("dimension", d.Name); err != nil {
+			return nil, err
+		}
+		if d.Length == Unlimited && i != w.recordDimension() {
+			return nil, fmt.Errorf("netcdf: more than one unlimited dimension")
+		}
+		dimensions[d.Name] = d
+	}
+	if err := checkAttributes("the file", w.header.Attributes); err != nil {
+		return nil, err
+	}
+
+	layouts := make([]*layout, 0, len(w.header.Variables))
+	recordVariables := 0
+	for i := range w.header.Variables {
+		v := &w.header.Variables[i]
+		if err := checkName("variable", v.Name); err != nil {
+			return nil, err
+		}
+		if err := checkAttributes("variable "+v.Name, v.Attributes); err != nil {
+			return nil, err
+		}
+		if v.Type.Size() == 0 {
+			return nil, fmt.Errorf("netcdf: variable %s has invalid type %d", v.Name, v.Type)
+		}
+		l := &layout{variable: v, length: v.Type.Size()}
+		for k, name := range v.Dimensions {
+			d, ok := dimensions[name]
+			if !ok {
+				return nil, fmt.Errorf("netcdf: variable %s has undeclared dimension %s", v.Name, name)
+			}
+			if d.Length == Unlimited {
+				if k != 0 {
+					return nil, fmt.Errorf("netcdf: unlimited dimension %s is not the first of variable %s", name, v.Name)
+				}
+				l.record = true
+				continue
+			}
+			l.length *= int64(d.Length)
+		}
+		if _, exists := w.variables[v.Name]; exists {
+			return nil, fmt.Errorf("netcdf: variable %s declared twice", v.Name)
+		}
+		w.variables[v.Name] = l
+		layouts = append(layouts, l)
+		if l.record {
+			recordVariables++
+		}
+	}
+
+	for _, l := range layouts {
+		// a single record variable is not padded so records of bytes are contiguous
+		l.size = l.length
+		if !l.record || recordVariables > 1 {
+			l.size += padding(l.length, 4)
+		}
+		if l.record {
+			w.recordSize += l.size
+		}
+	}
+	return layouts, nil
+}
+
+func (w *Writer) recordDimension() int {
+	for i, d := range w.header.Dimensions {
+		if d.Length == Unlimited {
+			return i
+		}
+	}
+	return -1
+}
+
+func (w *Writer) encodeHeader(layouts []*layout) []byte {
+	var b bytes.Buffer
+	b.WriteString("CDF\x02")
+	putInt(&b, int32(w.records))
+
+	if len(w.header.Dimensions) == 0 {
+		putInt(&b, 0)
+		putInt(&b, 0)
+	} else {
+		putInt(&b, tagDimension)
+		putInt(&b, int32(len(w.header.Dimensions)))
+		for _, d := range w.header.Dimensions {
+			putName(&b, d.Name)
+			putInt(&b, int32(d.Length))
+		}
+	}
+
+	putAttributes(&b, w.header.Attributes)
+
+	if len(layouts) == 0 {
+		putInt(&b, 0)
+		putInt(&b, 0)
+		return b.Bytes()
+	}
+	putInt(&b, tagVariable)
+	putInt(&b, int32(len(layouts)))
+	for _, l := range layouts {
+		v := l.variable
+		putName(&b, v.Name)
+		putInt(&b, int32(len(v.Dimensions)))
+		for _, name := range v.Dimensions {
+			putInt(&b, int32(w.dimensionID(name)))
+		}
+		putAttributes(&b, v.Attributes)
+		putInt(&b, int32(v.Type))
+		putInt(&b, int32(l.size))
+		binary.Write(&b, binary.BigEndian, l.begin)
+	}
+	return b.Bytes()
+}
+
+func (w *Writer) dimensionID(name string) int {
+	for i, d := range w.header.Dimensions {
+		if d.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func putAttributes(b *bytes.Buffer, attributes []Attribute) {
+	if len(attributes) == 0 {
+		putInt(b, 0)
+		putInt(b, 0)
+		return
+	}
+	putInt(b, tagAttribute)
+	putInt(b, int32(len(attributes)))
+	for _, a := range attributes {
+		putName(b, a.Name)
+		t, n := attributeType(a.Value)
+		putInt(b, int32(t))
+		putInt(b, int32(n))
+		start := b.Len()
+		if s, ok := a.Value.(string); ok {
+			b.WriteString(s)
+		} else {
+			binary.Write(b, binary.BigEndian, a.Value)
+		}
+		b.Write(make([]byte, padding(int64(b.Len()-start), 4)))
+	}
+}
+
+// attributeType returns the type and number of values of an attribute value, a
+// zero type if the value is not supported
+func attributeType(value interface{}) (Type, int) {
+	switch v := value.(type) {
+	case string:
+		return Char, len(v)
+	case int8:
+		return Byte, 1
+	case []int8:
+		return Byte, len(v)
+	case int16:
+		return Short, 1
+	case []int16:
+		return Short, len(v)
+	case int32:
+		return Int, 1
+	case []int32:
+		return Int, len(v)
+	case float32:
+		return Float, 1
+	case []float32:
+		return Float, len(v)
+	case float64:
+		return Double, 1
+	case []float64:
+		return Double, len(v)
+	}
+	return 0, 0
+}
+
+// checkAttributes checks that the values of attributes have supported types
+func checkAttributes(owner string, attributes []Attribute) error {
+	for _, a := range attributes {
+		if t, _ := attributeType(a.Value); t == 0 {
+			return fmt.Errorf("netcdf: attribute %s of %s has unsupported value %T", a.Name, owner, a.Value)
+		}
+	}
+	return nil
+}
+
+// checkName checks that a name starts with a letter or an underscore, as the
+// classic format requires
+func checkName(kind, name string) error {
+	if name == "" || !(name[0] == '_' || name[0] >= 'A' && name[0] <= 'Z' || name[0] >= 'a' && name[0] <= 'z' || name[0] >= 0x80) {
+		return fmt.Errorf("netcdf: invalid %s name %q, names start with a letter or an underscore", kind, name)
+	}
+	return nil
+}
+
+// checkType checks that values is a slice of the Go type of t
+func checkType(t Type, values interface{}) error {
+	var ok bool
+	switch t {
+	case Byte:
+		_, ok = values.([]int8)
+	case Char:
+		_, ok = values.([]byte)
+	case Short:
+		_, ok = values.([]int16)
+	case Int:
+		_, ok = values.([]int32)
+	case Float:
+		_, ok = values.([]float32)
+	case Double:
+		_, ok = values.([]float64)
+	}
+	if !ok {
+		return fmt.Errorf("values of type %T do not match type %d", values, t)
+	}
+	return nil
+}
+
+func putInt(b *bytes.Buffer, v int32) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func putName(b *bytes.Buffer, name string) {
+	putInt(b, int32(len(name)))
+	b.WriteString(name)
+	b.Write(make([]byte, padding(int64(len(name)), 4)))
+}
+
+// padding returns the number of bytes needed to align size to a multiple of to
+func padding(size, to int64) int64 {
+	if size%to == 0 {
+		return 0
+	}
+	return to - size%to
+}
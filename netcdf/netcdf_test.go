@@ -0,0 +1,166 @@
+package netcdf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buffer is a file in memory
+type buffer struct {
+	data []byte
+}
+
+func (b *buffer) WriteAt(p []byte, offset int64) (int, error) {
+	if end := int(offset) + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	return copy(b.data[offset:], p), nil
+}
+
+// file builds the expected bytes of a file
+type file struct {
+	bytes.Buffer
+}
+
+func (f *file) ints(values ...int32) *file {
+	binary.Write(f, binary.BigEndian, values)
+	return f
+}
+
+func (f *file) name(name string) *file {
+	f.ints(int32(len(name)))
+	f.WriteString(name)
+	f.Write(make([]byte, padding(int64(len(name)), 4)))
+	return f
+}
+
+func (f *file) offset(begin int64) *file {
+	binary.Write(f, binary.BigEndian, begin)
+	return f
+}
+
+func (f *file) values(values interface{}, pad int) *file {
+	binary.Write(f, binary.BigEndian, values)
+	f.Write(make([]byte, pad))
+	return f
+}
+
+func TestWriter(t *testing.T) {
+	header := &Header{
+		Dimensions: []Dimension{{Name: "time", Length: Unlimited}, {Name: "x", Length: 3}},
+		Attributes: []Attribute{{Name: "title", Value: "ab"}},
+		Variables: []Variable{
+			{Name: "x", Type: Short, Dimensions: []string{"x"}},
+			{Name: "t", Type: Double, Dimensions: []string{"time"}, Attributes: []Attribute{{Name: "scale", Value: []float32{1, 2}}}},
+			{Name: "v", Type: Short, Dimensions: []string{"time", "x"}},
+		},
+	}
+	out := &buffer{}
+	w, err := NewWriter(out, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, write := range []struct {
+		name   string
+		record int
+		values interface{}
+	}{
+		{"x", 0, []int16{1, 2, 3}},
+		{"t", 1, []float64{3}},
+		{"v", 1, []int16{20, 21, 22}},
+		{"t", 0, []float64{0}},
+		{"v", 0, []int16{10, 11, 12}},
+	} {
+		if err := w.Write(write.name, write.record, write.values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the header takes 232 bytes, x is padded from 6 to 8 bytes and each record
+	// holds t and v padded from 6 to 8 bytes
+	want := &file{}
+	want.WriteString("CDF\x02")
+	want.ints(2)
+	want.ints(tagDimension, 2).name("time").ints(0).name("x").ints(3)
+	want.ints(tagAttribute, 1).name("title").ints(int32(Char), 2).values([]byte("ab"), 2)
+	want.ints(tagVariable, 3)
+	want.name("x").ints(1, 1, 0, 0, int32(Short), 8).offset(232)
+	want.name("t").ints(1, 0, tagAttribute, 1).name("scale").ints(int32(Float), 2).values([]float32{1, 2}, 0).ints(int32(Double), 8).offset(240)
+	want.name("v").ints(2, 0, 1, 0, 0, int32(Short), 8).offset(248)
+	if want.Len() != 232 {
+		t.Fatalf("expected header of %d bytes", want.Len())
+	}
+	want.values([]int16{1, 2, 3}, 2)
+	want.values([]float64{0}, 0).values([]int16{10, 11, 12}, 2)
+	want.values([]float64{3}, 0).values([]int16{20, 21, 22}, 2)
+
+	if !bytes.Equal(out.data, want.Bytes()) {
+		t.Errorf("got file\n% x\nwant\n% x", out.data, want.Bytes())
+	}
+}
+
+func TestWriterSingleRecordVariable(t *testing.T) {
+	header := &Header{
+		Dimensions: []Dimension{{Name: "time", Length: Unlimited}, {Name: "x", Length: 3}},
+		Variables:  []Variable{{Name: "v", Type: Byte, Dimensions: []string{"time", "x"}}},
+	}
+	out := &buffer{}
+	w, err := NewWriter(out, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for record := 0; record < 2; record++ {
+		if err := w.Write("v", record, []int8{int8(record), 1, 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// records of a single variable are not padded
+	want := &file{}
+	want.WriteString("CDF\x02")
+	want.ints(2)
+	want.ints(tagDimension, 2).name("time").ints(0).name("x").ints(3)
+	want.ints(0, 0)
+	want.ints(tagVariable, 1).name("v").ints(2, 0, 1, 0, 0, int32(Byte), 3).offset(100)
+	want.values([]int8{0, 1, 2, 1, 1, 2}, 0)
+	if !bytes.Equal(out.data, want.Bytes()) {
+		t.Errorf("got file\n% x\nwant\n% x", out.data, want.Bytes())
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	dimensions := []Dimension{{Name: "time", Length: Unlimited}, {Name: "x", Length: 3}}
+	headers := map[string]*Header{
+		"two unlimited dimensions": {Dimensions: []Dimension{{Name: "time"}, {Name: "step"}}},
+		"undeclared dimension":     {Dimensions: dimensions, Variables: []Variable{{Name: "v", Type: Float, Dimensions: []string{"y"}}}},
+		"unlimited dimension last": {Dimensions: dimensions, Variables: []Variable{{Name: "v", Type: Float, Dimensions: []string{"x", "time"}}}},
+		"invalid name":             {Dimensions: dimensions, Variables: []Variable{{Name: "2t", Type: Float, Dimensions: []string{"x"}}}},
+		"unsupported attribute":    {Attributes: []Attribute{{Name: "count", Value: 3}}},
+	}
+	for name, header := range headers {
+		if _, err := NewWriter(&buffer{}, header); err == nil {
+			t.Errorf("%s: header accepted", name)
+		}
+	}
+
+	w, err := NewWriter(&buffer{}, &Header{Dimensions: dimensions, Variables: []Variable{{Name: "x", Type: Float, Dimensions: []string{"x"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write("x", 0, []float64{1, 2, 3}); err == nil {
+		t.Error("doubles written to a variable of floats")
+	}
+	if err := w.Write("x", 0, []float32{1, 2}); err == nil {
+		t.Error("2 values written to a variable of 3")
+	}
+	if err := w.Write("x", 1, []float32{1, 2, 3}); err == nil {
+		t.Error("record written to a variable without records")
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+const (
+	interpolationNearest  = "nearest"
+	interpolationBilinear = "bilinear"
+)
+
+// levelAliases expand the short levels accepted by the point API, e.g. 2m
+var levelAliases = []struct {
+	pattern *regexp.Regexp
+	level   string
+}{
+	{regexp.MustCompile("^([0-9.]+)m$"), "%s m above ground"},
+	{regexp.MustCompile("^([0-9.]+)mb$"), "%s mb"},
+	{regexp.MustCompile("^sfc$"), "surface"},
+	{regexp.MustCompile("^msl$"), "mean sea level"},
+}
+
+// parsePointVariables parses the variables of a point query, e.g. TMP:2m,UGRD:10 m above ground
+func parsePointVariables(list string) ([]fieldSelector, error) {
+	selectors, err := parseSelectors(list)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range selectors {
+		for _, alias := range levelAliases {
+			if match := alias.pattern.FindStringSubmatch(s.level); match != nil {
+				if len(match) > 1 {
+					selectors[i].level = fmt.Sprintf(alias.level, match[1])
+				} else {
+					selectors[i].level = alias.level
+				}
+				break
+			}
+		}
+	}
+	return selectors, nil
+}
+
+// gridReader decodes the fields of downloaded files, keeping the field lists
+// of the files and the most recently used decoded fields in memory.
+type gridReader struct {
+	files  *lruCache
+	fields *lruCache
+}
+
+// decodedField is a field with the values of all its grid points
+type decodedField struct {
+	grid   *grib2.Grid
+	values []float64
+}
+
+func newGridReader(size int) *gridReader {
+	return &gridReader{files: newLRUCache(1024), fields: newLRUCache(size)}
+}
+
+// cacheKey identifies a version of a file, it changes when the file is replaced
+func cacheKey(fileName string) (string, error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s@%d:%d", fileName, info.ModTime().UnixNano(), info.Size()), nil
+}
+
+// read returns the field matching a selector in a file, or nil if there is none
+func (r *gridReader) read(fileName string, s fieldSelector) (*decodedField, error) {
+	key, err := cacheKey(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []*grib2.Field
+	if cached, ok := r.files.get(key); ok {
+		fields = cached.([]*grib2.Field)
+	} else {
+		file, err := grib2.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		fields, err = file.Fields()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.files.put(key, fields)
+	}
+
+	var field *grib2.Field
+	for _, f := range fields {
+		if s.matches(f) {
+			field = f
+			break
+		}
+	}
+	if field == nil {
+		return nil, nil
+	}
+
+	fieldKey := fmt.Sprintf("%s:%d:%d", key, field.Message.Offset, field.Number)
+	if cached, ok := r.fields.get(fieldKey); ok {
+		return cached.(*decodedField), nil
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	grid, err := grib2.ReadGrid(file, field.GridSection)
+	if err != nil {
+		return nil, err
+	}
+	values, err := field.Values(file)
+	if err != nil {
+		return nil, err
+	}
+	decoded := &decodedField{grid: grid, values: values}
+	r.fields.put(fieldKey, decoded)
+	return decoded, nil
+}
+
+// units returns the units of the field matching a selector in a file
+func (r *gridReader) units(fileName string, s fieldSelector) string {
+	key, err := cacheKey(fileName)
+	if err != nil {
+		return ""
+	}
+	if cached, ok := r.files.get(key); ok {
+		for _, f := range cached.([]*grib2.Field) {
+			if s.matches(f) {
+				return f.Units()
+			}
+		}
+	}
+	return ""
+}
+
+// pointForecast is the response of a point query
+type pointForecast struct {
+	Cycle         string        `json:"cycle"`
+	ReferenceTime time.Time     `json:"referenceTime"`
+	Lat           float64       `json:"lat"`
+	Lon           float64       `json:"lon"`
+	Interpolation string        `json:"interpolation"`
+	Hours         []int         `json:"hours"`
+	Times         []time.Time   `json:"times"`
+	Variables     []pointSeries `json:"variables"`
+}
+
+// pointSeries are the values of a variable at each forecast hour, null when missing
+type pointSeries struct {
+	Name   string     `json:"name"`
+	Field  string     `json:"field"`
+	Units  string     `json:"units,omitempty"`
+	Values []*float64 `json:"values"`
+}
+
+// pointHandler serves the forecasts of the downloaded cycles at a location:
+// /point?lat=59.9&lon=10.7&vars=TMP:2m,UGRD:10m&cycle=latest&interpolation=bilinear&format=csv
+type pointHandler struct {
+	destination string
+	reader      *gridReader
+}
+
+func (h *pointHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	lat, latErr := strconv.ParseFloat(query.Get("lat"), 64)
+	lon, lonErr := strconv.ParseFloat(query.Get("lon"), 64)
+	// written to reject NaN too
+	if latErr != nil || lonErr != nil || !(lat >= -90 && lat <= 90) || !(lon >= -180 && lon <= 360) {
+		http.Error(w, "lat and lon are required, lat between -90 and 90, lon between -180 and 360", http.StatusBadRequest)
+		return
+	}
+	if query.Get("vars") == "" {
+		http.Error(w, "vars is required, e.g. vars=TMP:2m,UGRD:10m", http.StatusBadRequest)
+		return
+	}
+	selectors, err := parsePointVariables(query.Get("vars"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	interpolation := query.Get("interpolation")
+	if interpolation == "" {
+		interpolation = interpolationNearest
+	}
+	if interpolation != interpolationNearest && interpolation != interpolationBilinear {
+		http.Error(w, "interpolation must be nearest or bilinear", http.StatusBadRequest)
+		return
+	}
+
+	subDir, fileNames, err := resolveCycle(h.destination, query.Get("cycle"))
+	if os.IsNotExist(err) {
+		http.Error(w, "cycle not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	forecast, err := h.forecast(subDir, fileNames, selectors, lat, lon, interpolation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	names := strings.Split(query.Get("vars"), ",")
+	for i := range forecast.Variables {
+		forecast.Variables[i].Name = strings.TrimSpace(names[i])
+	}
+	if query.Get("format") == "csv" || query.Get("format") == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		w.Header().Set("Content-Type", "text/csv")
+		writePointCSV(w, forecast)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(forecast)
+}
+
+// forecast interpolates the selected variables of all files of a cycle
+func (h *pointHandler) forecast(subDir string, fileNames []string, selectors []fieldSelector, lat, lon float64, interpolation string) (*pointForecast, error) {
+	referenceTime, err := cycleTime(subDir)
+	if err != nil {
+		return nil, err
+	}
+	forecast := &pointForecast{
+		Cycle:         subDir,
+		ReferenceTime: referenceTime,
+		Lat:           lat,
+		Lon:           lon,
+		Interpolation: interpolation,
+		Hours:         make([]int, len(fileNames)),
+		Times:         make([]time.Time, len(fileNames)),
+		Variables:     make([]pointSeries, len(selectors)),
+	}
+	for i, s := range selectors {
+		forecast.Variables[i] = pointSeries{Field: s.String(), Values: make([]*float64, len(fileNames))}
+	}
+
+	for k, fileName := range fileNames {
+		match := gfsFileName.FindStringSubmatch(filepath.Base(fileName))
+		forecast.Hours[k], _ = strconv.Atoi(match[2])
+		forecast.Times[k] = referenceTime.Add(time.Duration(forecast.Hours[k]) * time.Hour)
+
+		for i, s := range selectors {
+			field, err := h.reader.read(fileName, s)
+			if err != nil {
+				return nil, err
+			}
+			if field == nil {
+				continue
+			}
+			value, err := interpolate(field.grid, field.values, lat, lon, interpolation)
+			if err != nil {
+				return nil, err
+			}
+			if !math.IsNaN(value) {
+				forecast.Variables[i].Values[k] = &value
+			}
+			if forecast.Variables[i].Units == "" {
+				forecast.Variables[i].Units = h.reader.units(fileName, s)
+			}
+		}
+	}
+	return forecast, nil
+}
+
+// interpolate returns the value of a field at a location
+func interpolate(grid *grib2.Grid, values []float64, lat, lon float64, interpolation string) (float64, error) {
+	if interpolation == interpolationBilinear {
+		return grid.Bilinear(values, lat, lon)
+	}
+	return grid.Nearest(values, lat, lon)
+}
+
+// writePointCSV writes a point forecast as a row per forecast hour
+func writePointCSV(w io.Writer, forecast *pointForecast) error {
+	out := csv.NewWriter(w)
+	header := []string{"time", "hour"}
+	for _, v := range forecast.Variables {
+		header = append(header, v.Name)
+	}
+	out.Write(header)
+	for k, hour := range forecast.Hours {
+		row := []string{forecast.Times[k].Format(time.RFC3339), strconv.Itoa(hour)}
+		for _, v := range forecast.Variables {
+			if v.Values[k] == nil {
+				row = append(row, "")
+			} else {
+				row = append(row, strconv.FormatFloat(*v.Values[k], 'g', -1, 64))
+			}
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// writePointJSONLines writes a point forecast as a json object per forecast hour
+// with the time, the hour and the value of each variable.
+func writePointJSONLines(w io.Writer, forecast *pointForecast) error {
+	encoder := json.NewEncoder(w)
+	for k, hour := range forecast.Hours {
+		line := map[string]interface{}{
+			"time": forecast.Times[k],
+			"hour": hour,
+		}
+		for _, v := range forecast.Variables {
+			line[v.Name] = v.Values[k]
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+// Package proxy dials TCP connections through a SOCKS5 proxy (RFC 1928, with
+// the username/password authentication of RFC 1929) or an HTTP proxy
+// supporting CONNECT, for protocols like FTP that net/http does not proxy.
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialer connects through a proxy given as socks5://, socks5h://, http:// or
+// https:// URL with optional user and password. socks5 resolves host names
+// locally, socks5h leaves it to the proxy like HTTP proxies do.
+type Dialer struct {
+	URL     *url.URL
+	Timeout time.Duration
+}
+
+// New returns a dialer of a proxy URL
+func New(proxyURL string, timeout time.Duration) (*Dialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, fmt.Errorf("proxy: unsupported scheme of %q, expected socks5, socks5h, http or https", u.Redacted())
+	}
+	if u.Port() == "" {
+		port := map[string]string{"socks5": "1080", "socks5h": "1080", "http": "80", "https": "443"}[u.Scheme]
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return &Dialer{URL: u, Timeout: timeout}, nil
+}
+
+// FromEnvironment returns the proxy URL for addr from the usual environment
+// variables: <scheme>_proxy, e.g. ftp_proxy, then all_proxy, in lower or upper
+// case. It is empty when none is set or addr matches no_proxy.
+func FromEnvironment(scheme, addr string) string {
+	proxyURL := getenv(scheme + "_proxy")
+	if proxyURL == "" {
+		proxyURL = getenv("all_proxy")
+	}
+	if proxyURL == "" || bypass(getenv("no_proxy"), addr) {
+		return ""
+	}
+	return proxyURL
+}
+
+func getenv(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return os.Getenv(strings.ToUpper(name))
+}
+
+// bypass reports whether addr matches a comma separated no_proxy list of host
+// names, domains, IP addresses or CIDR ranges, optionally with a port. * matches
+// every address.
+func bypass(noProxy, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryHost, entryPort, err := net.SplitHostPort(entry); err == nil {
+			if entryPort != port {
+				continue
+			}
+			entry = entryHost
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		if host == strings.TrimPrefix(entry, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dial connects to addr through the proxy, its signature is that of net.Dial
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("proxy: unsupported network %s", network)
+	}
+	conn, err := net.DialTimeout("tcp", d.URL.Host, d.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+
+	switch d.URL.Scheme {
+	case "socks5", "socks5h":
+		err = d.socks5(conn, addr)
+	case "https":
+		conn = tls.Client(conn, &tls.Config{ServerName: d.URL.Hostname()})
+		conn, err = d.connect(conn, addr)
+	default:
+		conn, err = d.connect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// SOCKS5 constants of RFC 1928 and RFC 1929
+const (
+	socksVersion         = 5
+	socksNoAuth          = 0
+	socksPasswordAuth    = 2
+	socksNoAcceptable    = 0xff
+	socksConnect         = 1
+	socksIPv4            = 1
+	socksDomain          = 3
+	socksIPv6            = 4
+	socksPasswordVersion = 1
+	socksSucceeded       = 0
+)
+
+var socksReplies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func (d *Dialer) socks5(conn net.Conn, addr string) error {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return fmt.Errorf("proxy: invalid port in %s", addr)
+	}
+	if d.URL.Scheme == "socks5" && net.ParseIP(host) == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return err
+		}
+		host = ips[0].String()
+	}
+
+	methods := []byte{socksVersion, 1, socksNoAuth}
+	if d.URL.User != nil {
+		methods = []byte{socksVersion, 2, socksNoAuth, socksPasswordAuth}
+	}
+	if _, err := conn.Write(methods); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return err
+	}
+	if choice[0] != socksVersion {
+		return fmt.Errorf("proxy: %s is no SOCKS5 proxy", d.URL.Host)
+	}
+	switch choice[1] {
+	case socksNoAuth:
+	case socksPasswordAuth:
+		if d.URL.User == nil {
+			return errors.New("proxy: SOCKS5 proxy asks for a user and password")
+		}
+		if err := d.socks5Password(conn); err != nil {
+			return err
+		}
+	case socksNoAcceptable:
+		return errors.New("proxy: SOCKS5 proxy accepts none of our authentication methods")
+	default:
+		return fmt.Errorf("proxy: SOCKS5 proxy chose unknown authentication method %d", choice[1])
+	}
+
+	request := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("proxy: host name %s too long", host)
+		}
+		request = append(request, socksDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socksIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socksIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// the reply has the bound address, which we skip
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != socksSucceeded {
+		message := fmt.Sprintf("reply %d", reply[1])
+		if int(reply[1]) < len(socksReplies) {
+			message = socksReplies[reply[1]]
+		}
+		return fmt.Errorf("proxy: SOCKS5 connect to %s failed: %s", addr, message)
+	}
+	var skip int
+	switch reply[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("proxy: SOCKS5 reply with unknown address type %d", reply[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func (d *Dialer) socks5Password(conn net.Conn) error {
+	user := d.URL.User.Username()
+	password, _ := d.URL.User.Password()
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("proxy: SOCKS5 user or password too long")
+	}
+	request := []byte{socksPasswordVersion, byte(len(user))}
+	request = append(request, user...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != socksSucceeded {
+		return errors.New("proxy: SOCKS5 authentication failed")
+	}
+	return nil
+}
+
+// connect asks an HTTP proxy for a tunnel to addr
+func (d *Dialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	request := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.URL.User != nil {
+		password, _ := d.URL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.URL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return conn, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return conn, err
+	}
+	// the body of a successful response is the tunnel
+	if response.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("proxy: CONNECT to %s failed: %s", addr, response.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what the proxy sent after its response first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBypass(t *testing.T) {
+	tests := []struct {
+		noProxy string
+		addr    string
+		want    bool
+	}{
+		{"", "ftp.ncep.noaa.gov:21", false},
+		{"*", "ftp.ncep.noaa.gov:21", true},
+		{"ftp.ncep.noaa.gov", "ftp.ncep.noaa.gov:21", true},
+		{"FTP.NCEP.NOAA.GOV", "ftp.ncep.noaa.gov:21", true},
+		{"noaa.gov", "ftp.ncep.noaa.gov:21", true},
+		{".noaa.gov", "ftp.ncep.noaa.gov:21", true},
+		{"*.noaa.gov", "ftp.ncep.noaa.gov:21", true},
+		{".noaa.gov", "noaa.gov:21", true},
+		{"aa.gov", "ftp.ncep.noaa.gov:21", false},
+		{"example.com, noaa.gov", "ftp.ncep.noaa.gov:21", true},
+		{"ftp.ncep.noaa.gov:21", "ftp.ncep.noaa.gov:21", true},
+		{"ftp.ncep.noaa.gov:990", "ftp.ncep.noaa.gov:21", false},
+		{"10.0.0.0/8", "10.1.2.3:21", true},
+		{"10.0.0.0/8", "192.168.1.1:21", false},
+		{"10.0.0.0/8", "ftp.ncep.noaa.gov:21", false},
+		{"::1", "[::1]:21", true},
+		{"fd00::/8", "[fd12::1]:21", true},
+		{"192.168.1.1", "192.168.1.1", true},
+		{" , ,", "ftp.ncep.noaa.gov:21", false},
+	}
+	for _, test := range tests {
+		if got := bypass(test.noProxy, test.addr); got != test.want {
+			t.Errorf("bypass(%q, %q) = %v, want %v", test.noProxy, test.addr, got, test.want)
+		}
+	}
+}
+
+func TestFromEnvironment(t *testing.T) {
+	for _, name := range []string{"ftp_proxy", "FTP_PROXY", "all_proxy", "ALL_PROXY", "no_proxy", "NO_PROXY"} {
+		t.Setenv(name, "")
+	}
+	if got := FromEnvironment("ftp", "ftp.ncep.noaa.gov:21"); got != "" {
+		t.Errorf("got %q without proxy variables", got)
+	}
+	t.Setenv("ALL_PROXY", "socks5://proxy:1080")
+	if got := FromEnvironment("ftp", "ftp.ncep.noaa.gov:21"); got != "socks5://proxy:1080" {
+		t.Errorf("got %q, want ALL_PROXY", got)
+	}
+	t.Setenv("ftp_proxy", "http://proxy:3128")
+	if got := FromEnvironment("ftp", "ftp.ncep.noaa.gov:21"); got != "http://proxy:3128" {
+		t.Errorf("got %q, want ftp_proxy before ALL_PROXY", got)
+	}
+	t.Setenv("NO_PROXY", "noaa.gov")
+	if got := FromEnvironment("ftp", "ftp.ncep.noaa.gov:21"); got != "" {
+		t.Errorf("got %q for a host of NO_PROXY", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for proxyURL, host := range map[string]string{
+		"socks5://proxy":          "proxy:1080",
+		"socks5h://proxy:9050":    "proxy:9050",
+		"http://user:pw@proxy":    "proxy:80",
+		"https://proxy.example":   "proxy.example:443",
+		"http://[2001:db8::1]":    "[2001:db8::1]:80",
+		"socks5://127.0.0.1:1081": "127.0.0.1:1081",
+	} {
+		d, err := New(proxyURL, time.Second)
+		if err != nil {
+			t.Errorf("%s: %v", proxyURL, err)
+			continue
+		}
+		if d.URL.Host != host {
+			t.Errorf("%s: got host %s, want %s", proxyURL, d.URL.Host, host)
+		}
+	}
+	if _, err := New("ftp://proxy", time.Second); err == nil {
+		t.Error("ftp:// accepted as proxy")
+	}
+}
+
+// listen starts a proxy serving a single connection with serve, and returns
+// its address
+func listen(t *testing.T, serve func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		serve(conn)
+	}()
+	return listener.Addr().String()
+}
+
+// socksRequest is what a fake SOCKS5 proxy was asked for
+type socksRequest struct {
+	methods  []byte
+	user     string
+	password string
+	addrType byte
+	host     string
+	port     int
+}
+
+// fakeSOCKS5 answers the handshake of RFC 1928 and RFC 1929, requiring the
+// password when one is set, with reply as the reply code to the connect request.
+// A successful connection greets with 220.
+func fakeSOCKS5(password string, reply byte, requests chan<- socksRequest) func(net.Conn) {
+	return func(conn net.Conn) {
+		var r socksRequest
+		defer func() { requests <- r }()
+
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil || header[0] != socksVersion {
+			return
+		}
+		r.methods = make([]byte, header[1])
+		if _, err := io.ReadFull(conn, r.methods); err != nil {
+			return
+		}
+		method := byte(socksNoAuth)
+		if password != "" {
+			method = socksNoAcceptable
+			if bytes.IndexByte(r.methods, socksPasswordAuth) >= 0 {
+				method = socksPasswordAuth
+			}
+		}
+		conn.Write([]byte{socksVersion, method})
+		switch method {
+		case socksNoAcceptable:
+			return
+		case socksPasswordAuth:
+			version := make([]byte, 2)
+			if _, err := io.ReadFull(conn, version); err != nil {
+				return
+			}
+			user := make([]byte, version[1])
+			io.ReadFull(conn, user)
+			length := make([]byte, 1)
+			io.ReadFull(conn, length)
+			pw := make([]byte, length[0])
+			io.ReadFull(conn, pw)
+			r.user, r.password = string(user), string(pw)
+			if r.password != password {
+				conn.Write([]byte{socksPasswordVersion, 1})
+				return
+			}
+			conn.Write([]byte{socksPasswordVersion, socksSucceeded})
+		}
+
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(conn, request); err != nil || request[1] != socksConnect {
+			return
+		}
+		r.addrType = request[3]
+		switch r.addrType {
+		case socksIPv4, socksIPv6:
+			ip := make(net.IP, map[byte]int{socksIPv4: net.IPv4len, socksIPv6: net.IPv6len}[r.addrType])
+			io.ReadFull(conn, ip)
+			r.host = ip.String()
+		case socksDomain:
+			length := make([]byte, 1)
+			io.ReadFull(conn, length)
+			host := make([]byte, length[0])
+			io.ReadFull(conn, host)
+			r.host = string(host)
+		}
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		r.port = int(binary.BigEndian.Uint16(port))
+
+		// the bound address is a domain name, which the client has to skip
+		bound := append([]byte{socksVersion, reply, 0, socksDomain, 5}, "relay"...)
+		conn.Write(append(bound, 0x04, 0x38))
+		if reply == socksSucceeded {
+			conn.Write([]byte("220 Service ready\r\n"))
+		}
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		password  string
+		reply     byte
+		addr      string
+		wantErr   string
+		wantHost  string
+		wantType  byte
+		wantUser  string
+		wantMeths []byte
+	}{
+		{name: "no auth", url: "socks5h://%s", addr: "ftp.ncep.noaa.gov:21", wantHost: "ftp.ncep.noaa.gov", wantType: socksDomain, wantMeths: []byte{socksNoAuth}},
+		{name: "ipv4", url: "socks5://%s", addr: "140.90.101.79:21", wantHost: "140.90.101.79", wantType: socksIPv4, wantMeths: []byte{socksNoAuth}},
+		{name: "ipv6", url: "socks5://%s", addr: "[2610:20:8040:2::79]:21", wantHost: "2610:20:8040:2::79", wantType: socksIPv6, wantMeths: []byte{socksNoAuth}},
+		{name: "password", url: "socks5h://bob:pw@%s", password: "pw", addr: "ftp.ncep.noaa.gov:21", wantHost: "ftp.ncep.noaa.gov", wantType: socksDomain, wantUser: "bob", wantMeths: []byte{socksNoAuth, socksPasswordAuth}},
+		{name: "wrong password", url: "socks5h://bob:wrong@%s", password: "pw", addr: "ftp.ncep.noaa.gov:21", wantErr: "authentication failed"},
+		{name: "password required", url: "socks5h://%s", password: "pw", addr: "ftp.ncep.noaa.gov:21", wantErr: "accepts none of our authentication methods"},
+		{name: "refused", url: "socks5h://%s", reply: 5, addr: "ftp.ncep.noaa.gov:21", wantErr: "connection refused"},
+	}
+	for _, test := range tests {
+		requests := make(chan socksRequest, 1)
+		addr := listen(t, fakeSOCKS5(test.password, test.reply, requests))
+		d, err := New(strings.Replace(test.url, "%s", addr, 1), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := d.Dial("tcp", test.addr)
+		r := <-requests
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		greeting, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil || greeting != "220 Service ready\r\n" {
+			t.Errorf("%s: got greeting %q through the proxy, error %v", test.name, greeting, err)
+		}
+		if r.host != test.wantHost || r.addrType != test.wantType || r.port != 21 {
+			t.Errorf("%s: proxy asked for %s port %d as type %d", test.name, r.host, r.port, r.addrType)
+		}
+		if r.user != test.wantUser || !bytes.Equal(r.methods, test.wantMeths) {
+			t.Errorf("%s: proxy got methods %v and user %q", test.name, r.methods, r.user)
+		}
+	}
+}
+
+// fakeConnect answers a CONNECT request with status, and when it is 200 sends
+// the greeting of the target in the same write, so that the client reads it
+// with the response.
+func fakeConnect(status int, requests chan<- *http.Request) func(net.Conn) {
+	return func(conn net.Conn) {
+		request, err := http.ReadRequest(bufio.NewReader(conn))
+		requests <- request
+		if err != nil {
+			return
+		}
+		response := "HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n"
+		if status == http.StatusOK {
+			conn.Write([]byte(response + "\r\n220 Service ready\r\n"))
+			ioutil.ReadAll(conn)
+			return
+		}
+		conn.Write([]byte(response + "Content-Length: 0\r\n\r\n"))
+	}
+}
+
+func TestConnect(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	addr := listen(t, fakeConnect(http.StatusOK, requests))
+	d, err := New("http://alice:secret@"+addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", "ftp.ncep.noaa.gov:21")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := <-requests
+	if r.Method != "CONNECT" || r.Host != "ftp.ncep.noaa.gov:21" || r.RequestURI != "ftp.ncep.noaa.gov:21" {
+		t.Errorf("got request %s %s for host %s", r.Method, r.RequestURI, r.Host)
+	}
+	if got := r.Header.Get("Proxy-Authorization"); got != "Basic YWxpY2U6c2VjcmV0" {
+		t.Errorf("got Proxy-Authorization %q", got)
+	}
+
+	// the greeting came with the response, and is read from the buffer
+	if _, ok := conn.(*bufferedConn); !ok {
+		t.Errorf("got a %T, the buffered greeting is lost", conn)
+	}
+	greeting, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || greeting != "220 Service ready\r\n" {
+		t.Errorf("got greeting %q, error %v", greeting, err)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	addr := listen(t, fakeConnect(http.StatusProxyAuthRequired, requests))
+	d, err := New("http://"+addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", "ftp.ncep.noaa.gov:21")
+	if err == nil {
+		conn.Close()
+		t.Fatal("tunnel opened although the proxy answered 407")
+	}
+	if !strings.Contains(err.Error(), "407") {
+		t.Errorf("error does not have the status: %v", err)
+	}
+	if r := <-requests; r.Header.Get("Proxy-Authorization") != "" {
+		t.Error("credentials sent without a user in the proxy URL")
+	}
+}
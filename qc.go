@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+// qcDefaultRule is the key of the rule applied to fields without a rule of their own
+const qcDefaultRule = "*"
+
+// qcRule are the checks of the decoded values of a field, a check is skipped
+// when its setting is missing.
+type qcRule struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+	// MaxMissing is the largest allowed fraction of missing values, from 0 to 1
+	MaxMissing  *float64 `json:"maxMissing"`
+	NonConstant bool     `json:"nonConstant"`
+}
+
+// qcRules are the rules by parameter and level, by parameter or the default
+// rule, the most specific rule of a field applies:
+//
+//	{
+//	  "TMP": {"min": 150, "max": 350, "nonConstant": true},
+//	  "TMP:2m": {"min": 180, "max": 340, "maxMissing": 0},
+//	  "*": {"maxMissing": 0.5}
+//	}
+type qcRules struct {
+	byField     map[fieldSelector]qcRule
+	byParameter map[string]qcRule
+	fallback    *qcRule
+}
+
+// qcResult is the outcome of the checks of a file
+type qcResult struct {
+	Passed   bool        `json:"passed"`
+	Checked  int         `json:"checked"`
+	Failures []qcFailure `json:"failures,omitempty"`
+}
+
+// qcFailure is a check failed by a field
+type qcFailure struct {
+	Field  string `json:"field"`
+	Check  string `json:"check"`
+	Detail string `json:"detail"`
+}
+
+// qcEvent is published when a downloaded file fails its checks, consumers should
+// hold off on the cycle.
+type qcEvent struct {
+	File     string      `json:"file"`
+	Cycle    string      `json:"cycle"`
+	Failures []qcFailure `json:"failures"`
+}
+
+// readQCRules reads and checks a file of QC rules
+func readQCRules(fileName string) (*qcRules, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var configured map[string]qcRule
+	if err := json.Unmarshal(content, &configured); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	rules := &qcRules{byField: make(map[fieldSelector]qcRule), byParameter: make(map[string]qcRule)}
+	for key, rule := range configured {
+		if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return nil, fmt.Errorf("%s: %s has min above max", fileName, key)
+		}
+		if rule.MaxMissing != nil && (*rule.MaxMissing < 0 || *rule.MaxMissing > 1) {
+			return nil, fmt.Errorf("%s: %s has maxMissing outside 0 to 1", fileName, key)
+		}
+		switch {
+		case key == qcDefaultRule:
+			r := rule
+			rules.fallback = &r
+		case strings.Contains(key, ":"):
+			selectors, err := parsePointVariables(key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fileName, err)
+			}
+			rules.byField[selectors[0]] = rule
+		default:
+			rules.byParameter[key] = rule
+		}
+	}
+	return rules, nil
+}
+
+// rule returns the rule of a field, or nil if no rule applies
+func (r *qcRules) rule(f *grib2.Field) *qcRule {
+	if rule, ok := r.byField[fieldSelector{parameter: f.Parameter(), level: f.Product.Level()}]; ok {
+		return &rule
+	}
+	if rule, ok := r.byParameter[f.Parameter()]; ok {
+		return &rule
+	}
+	return r.fallback
+}
+
+// qcCommand checks files against QC rules and returns the process exit code, 1
+// if any file fails.
+func qcCommand(args []string) int {
+	flags := flag.NewFlagSet("qc", flag.ExitOnError)
+	rulesFile := flags.String("rules", "", "json file with the QC rules by parameter")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage of qc: ftplistener qc -rules qc.json file...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *rulesFile == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	rules, err := readQCRules(*rulesFile)
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+
+	failed := 0
+	for _, fileName := range flags.Args() {
+		result, err := checkQuality(fileName, rules)
+		if err != nil {
+			log.Println("Failed to check", "file", fileName, "error", err.Error())
+			failed++
+			continue
+		}
+		for _, f := range result.Failures {
+			fmt.Printf("%s: %s: %s: %s\n", fileName, f.Field, f.Check, f.Detail)
+		}
+		if !result.Passed {
+			failed++
+		}
+	}
+	log.Printf("Checked %d files, %d failed\n", flags.NArg(), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkQuality decodes the fields of a file that have a rule and checks their
+// values, fields that cannot be decoded fail the "decode" check
+func checkQuality(fileName string, rules *qcRules) (*qcResult, error) {
+	file, err := grib2.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fields, err := file.Fields()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &qcResult{Passed: true, Failures: make([]qcFailure, 0)}
+	for _, f := range fields {
+		rule := rules.rule(f)
+		if rule == nil {
+			continue
+		}
+		field := f.Parameter() + ":" + f.Product.Level() + ":" + f.Product.Forecast()
+		result.Checked++
+		values, err := f.Values(file)
+		if err != nil { // e.g. a packing this decoder does not support
+			result.Failures = append(result.Failures, qcFailure{Field: field, Check: "decode", Detail: err.Error()})
+			continue
+		}
+		for _, failure := range rule.check(values) {
+			failure.Field = field
+			result.Failures = append(result.Failures, failure)
+		}
+	}
+	result.Passed = len(result.Failures) == 0
+	return result, nil
+}
+
+// check returns the checks of a rule failed by the values of a field
+func (r *qcRule) check(values []float64) []qcFailure {
+	missing, outside := 0, 0
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		if math.IsNaN(v) {
+			missing++
+			continue
+		}
+		min, max = math.Min(min, v), math.Max(max, v)
+		if r.Min != nil && v < *r.Min || r.Max != nil && v > *r.Max {
+			outside++
+		}
+	}
+
+	failures := make([]qcFailure, 0)
+	if r.MaxMissing != nil && len(values) > 0 {
+		if fraction := float64(missing) / float64(len(values)); fraction > *r.MaxMissing {
+			failures = append(failures, qcFailure{Check: "missing", Detail: fmt.Sprintf("%.2f%% missing, at most %.2f%% allowed", 100*fraction, 100**r.MaxMissing)})
+		}
+	}
+	if outside > 0 {
+		failures = append(failures, qcFailure{Check: "range", Detail: fmt.Sprintf("%d values outside %s, values from %g to %g", outside, r.describeRange(), min, max)})
+	}
+	if r.NonConstant && (missing == len(values) || min == max) {
+		detail := "all values are missing"
+		if missing < len(values) {
+			detail = fmt.Sprintf("all values are %g", min)
+		}
+		failures = append(failures, qcFailure{Check: "constant", Detail: detail})
+	}
+	return failures
+}
+
+// describeRange returns the valid range of a rule, e.g. "180 to 340" or "0 to +Inf"
+func (r *qcRule) describeRange() string {
+	min, max := math.Inf(-1), math.Inf(1)
+	if r.Min != nil {
+		min = *r.Min
+	}
+	if r.Max != nil {
+		max = *r.Max
+	}
+	return fmt.Sprintf("%g to %g", min, max)
+}
+
+// qcFailedEvent returns the event of a downloaded file that failed its checks
+func qcFailedEvent(event downloadEvent) qcEvent {
+	return qcEvent{File: event.File, Cycle: cycleFolderName.FindString(event.File), Failures: event.QC.Failures}
+}
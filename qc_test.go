@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+func float(x float64) *float64 {
+	return &x
+}
+
+func TestQCRuleCheck(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name   string
+		rule   qcRule
+		values []float64
+		want   []string
+	}{
+		{"in range", qcRule{Min: float(180), Max: float(340)}, []float64{180, 250, 340}, nil},
+		{"below min", qcRule{Min: float(180), Max: float(340)}, []float64{0, 250, 0}, []string{"range: 2 values outside 180 to 340, values from 0 to 250"}},
+		{"above max only", qcRule{Max: float(100)}, []float64{-5, 100.5}, []string{"range: 1 values outside -Inf to 100, values from -5 to 100.5"}},
+		{"missing values ignored by the range", qcRule{Min: float(0)}, []float64{nan, 1}, nil},
+		{"missing share allowed", qcRule{MaxMissing: float(0.5)}, []float64{nan, 1, nan, 2}, nil},
+		{"missing share exceeded", qcRule{MaxMissing: float(0.25)}, []float64{nan, 1, nan, 2}, []string{"missing: 50.00% missing, at most 25.00% allowed"}},
+		{"no missing values allowed", qcRule{MaxMissing: float(0)}, []float64{1, nan, 2, 3}, []string{"missing: 25.00% missing, at most 0.00% allowed"}},
+		{"constant", qcRule{NonConstant: true}, []float64{0, 0, nan}, []string{"constant: all values are 0"}},
+		{"all missing", qcRule{NonConstant: true, MaxMissing: float(1)}, []float64{nan, nan}, []string{"constant: all values are missing"}},
+		{"varying", qcRule{NonConstant: true}, []float64{0, 0.1}, nil},
+		{"no checks", qcRule{}, []float64{nan, -1e9}, nil},
+	}
+	for _, test := range tests {
+		failures := test.rule.check(test.values)
+		got := make([]string, 0, len(failures))
+		for _, f := range failures {
+			got = append(got, f.Check+": "+f.Detail)
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got failures %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func writeQCRules(t *testing.T, folder, content string) string {
+	fileName := filepath.Join(folder, "qc.json")
+	if err := ioutil.WriteFile(fileName, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestReadQCRules(t *testing.T) {
+	folder, err := ioutil.TempDir("", "qc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	for _, invalid := range []string{
+		`{"TMP": {"min": 350, "max": 150}}`,
+		`{"*": {"maxMissing": 1.5}}`,
+		`{"TMP:": {"min": 0}}`,
+		`{"TMP": {"min": "cold"}}`,
+	} {
+		if _, err := readQCRules(writeQCRules(t, folder, invalid)); err == nil {
+			t.Errorf("rules %s accepted", invalid)
+		}
+	}
+}
+
+func TestCheckQuality(t *testing.T) {
+	folder, err := ioutil.TempDir("", "qc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	temperatures := fill(testGlobalGrid, func(lat, lon float64) float64 {
+		return 300 - math.Abs(lat)
+	})
+	temperatures[0] = 100
+	pressure := fill(testGlobalGrid, func(lat, lon float64) float64 {
+		return 101325
+	})
+	for i := 0; i < testGlobalGrid.Ni; i++ {
+		pressure[i] = math.NaN()
+	}
+	fileName := testCycleFile(t, folder, testReferenceTime, 3, testGlobalGrid,
+		tmp2m(temperatures),
+		testField{category: 0, number: 0, surface: 100, value: 85000, values: temperatures},
+		testField{category: 3, number: 0, surface: 1, values: pressure},
+		testField{category: 1, number: 0, surface: 103, value: 2, values: make([]float64, testGlobalGrid.Points())})
+
+	// the humidity is packed with JPEG 2000, which the decoder does not support
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := grib2.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := file.Fields()
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[fields[3].RepresentationSection.Offset+10] = 40
+	if err := ioutil.WriteFile(fileName, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// TMP at 2 m has a rule of its own, TMP at 850 mb the rule of TMP, PRES the
+	// default rule and UGRD is not in the file
+	rules, err := readQCRules(writeQCRules(t, folder, `{
+		"TMP": {"min": 50, "max": 350},
+		"TMP:2m": {"min": 180, "max": 340},
+		"UGRD:10m": {"nonConstant": true},
+		"*": {"maxMissing": 0.01}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := checkQuality(fileName, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []qcFailure{
+		{Field: "TMP:2 m above ground:3 hour fcst", Check: "range", Detail: "1 values outside 180 to 340, values from 100 to 300"},
+		{Field: "PRES:surface:3 hour fcst", Check: "missing", Detail: "5.26% missing, at most 1.00% allowed"},
+		{Field: "SPFH:2 m above ground:3 hour fcst", Check: "decode"},
+	}
+	if result.Passed || result.Checked != 4 || len(result.Failures) != len(want) {
+		t.Fatalf("got result %+v", result)
+	}
+	for i, f := range result.Failures {
+		if f.Field != want[i].Field || f.Check != want[i].Check || want[i].Detail != "" && f.Detail != want[i].Detail {
+			t.Errorf("got failure %+v, want %+v", f, want[i])
+		}
+	}
+
+	// fields without a rule are not decoded
+	rules, err = readQCRules(writeQCRules(t, folder, `{"UGRD": {"nonConstant": true}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := checkQuality(fileName, rules); err != nil || !result.Passed || result.Checked != 0 {
+		t.Errorf("got result %+v, %v for rules of fields not in the file", result, err)
+	}
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+const (
+	quicklooksFolderName = "quicklooks"
+	quicklookIndexName   = "index.html"
+	quicklookListName    = "quicklooks.json"
+	// quicklookWidth is the minimum width of the images, small grids are scaled up
+	quicklookWidth = 720
+	// quicklookCachedValues is the number of values decoded for the colour scale
+	// that are kept for rendering, about all hours of a 1 degree cycle
+	quicklookCachedValues = 1 << 23
+)
+
+// landMask is the field coastlines are traced from when no coastline file is given
+var landMask = fieldSelector{parameter: "LAND", level: "surface"}
+
+// quicklook describes an image of a field at a forecast hour
+type quicklook struct {
+	File  string    `json:"file"`
+	Field string    `json:"field"`
+	Units string    `json:"units,omitempty"`
+	Hour  int       `json:"hour"`
+	Time  time.Time `json:"time"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	// ScaleMin and ScaleMax are the range of the colours, that of the variable
+	// over all forecast hours
+	ScaleMin float64 `json:"scaleMin"`
+	ScaleMax float64 `json:"scaleMax"`
+}
+
+// lonLat is a point of a coastline in degrees
+type lonLat [2]float64
+
+// quicklookCommand renders quicklooks of a downloaded cycle, and returns the
+// process exit code.
+func quicklookCommand(args []string) int {
+	flags := flag.NewFlagSet("quicklook", flag.ExitOnError)
+	cycleFolder := flags.String("cycle", "", "folder of the downloaded cycle, e.g. gribfiles/gfs.20180405/06")
+	variables := flags.String("vars", "", "comma separated variables to render, e.g. \"TMP:2m,PRMSL:msl\"")
+	coastlinesFile := flags.String("coastlines", "", "geojson file with the coastlines to draw (default traced from the LAND field)")
+	output := flags.String("output", "", "folder to write the images and index to (default <cycle>/quicklooks)")
+	flags.Parse(args)
+
+	if *cycleFolder == "" || *variables == "" {
+		flags.Usage()
+		return 2
+	}
+	selectors, err := parsePointVariables(*variables)
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+	coastlines, err := readCoastlines(*coastlinesFile)
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+	if *output == "" {
+		*output = filepath.Join(*cycleFolder, quicklooksFolderName)
+	}
+
+	images, err := renderCycle(*cycleFolder, *output, filepath.Base(filepath.Dir(*cycleFolder))+"/"+filepath.Base(*cycleFolder), selectors, coastlines)
+	if err != nil {
+		log.Println("Failed to render", "cycle", *cycleFolder, "error", err.Error())
+		return 1
+	}
+	log.Println("Rendered", "cycle", *cycleFolder, "images", len(images), "index", filepath.Join(*output, quicklookIndexName))
+	return 0
+}
+
+// renderDownloadedCycle renders the quicklooks of a cycle once its downloads are
+// complete, and returns its index page or "" if nothing was rendered. The
+// quicklooks are not rendered again if nothing was downloaded.
+func renderDownloadedCycle(destinationFolder, subDir string, downloaded int, options downloadOptions) (string, error) {
+	outputFolder := filepath.Join(destinationFolder, subDir, quicklooksFolderName)
+	if _, err := os.Stat(filepath.Join(outputFolder, quicklookIndexName)); downloaded == 0 && err == nil {
+		return "", nil
+	}
+	sourceFolder := cycleSourceFolder(destinationFolder, subDir, options)
+	if gribFiles, err := cycleGribFiles(sourceFolder); err != nil || len(gribFiles) == 0 {
+		return "", nil
+	}
+	images, err := renderCycle(sourceFolder, outputFolder, subDir, options.quicklooks, options.coastlines)
+	if err != nil || len(images) == 0 {
+		return "", err
+	}
+	log.Println("Rendered", "cycle", sourceFolder, "images", len(images))
+	return filepath.Join(outputFolder, quicklookIndexName), nil
+}
+
+// renderCycle renders the selected variables of all GRIB2 files of a folder and
+// writes the index page linking them. The colours of a variable run over its range
+// at all forecast hours. Images newer than their files and of the same range are
+// kept, and so is their range. The new images are returned. Coastlines are traced
+// from the land mask of the cycle if none are given.
+func renderCycle(folder, outputFolder, subDir string, selectors []fieldSelector, coastlines [][]lonLat) ([]quicklook, error) {
+	cycle, err := readCycleFields(folder, selectors)
+	if err != nil {
+		return nil, err
+	}
+	if coastlines == nil {
+		coastlines = traceCoastlines(cycle)
+	}
+	if err := os.MkdirAll(outputFolder, 0777); err != nil {
+		return nil, err
+	}
+
+	previous := make(map[string]quicklook)
+	for _, q := range readQuicklooks(outputFolder) {
+		previous[q.File] = q
+	}
+
+	all := make([]quicklook, 0)
+	rendered := make([]quicklook, 0)
+	for _, v := range cycle.variables {
+		images, records, current := make([]quicklook, 0), make([]int, 0), true
+		unchanged := make([]bool, 0)
+		for record, f := range v.fields {
+			if f == nil {
+				continue
+			}
+			hour := int(cycle.hours[record])
+			q := quicklook{
+				File:  fmt.Sprintf("%s_f%03d.png", v.selector.name(), hour),
+				Field: v.selector.String(),
+				Units: v.units,
+				Hour:  hour,
+				Time:  cycle.referenceTime.Add(time.Duration(hour) * time.Hour),
+			}
+			existing, ok := previous[q.File]
+			ok = ok && newerThan(filepath.Join(outputFolder, q.File), cycle.files[record])
+			if ok {
+				q = existing
+			} else {
+				current = false
+			}
+			images, records, unchanged = append(images, q), append(records, record), append(unchanged, ok)
+		}
+		if current && sharedScale(images) {
+			all = append(all, images...)
+			continue
+		}
+
+		// the colours of all forecast hours run over the range of the variable. Only
+		// changed files are decoded, images without values have a range of 0 to 0
+		// and are decoded again.
+		scaleMin, scaleMax := math.Inf(1), math.Inf(-1)
+		decoded, cached := make(map[int][]float64), 0
+		for k, record := range records {
+			min, max, ok := images[k].Min, images[k].Max, true
+			if !unchanged[k] || min == 0 && max == 0 {
+				values, err := fieldValues(cycle.files[record], v.fields[record])
+				if err != nil {
+					return nil, err
+				}
+				min, max, ok = valueRange(values)
+				if cached+len(values) <= quicklookCachedValues {
+					decoded[record], cached = values, cached+len(values)
+				}
+			}
+			if ok {
+				scaleMin, scaleMax = math.Min(scaleMin, min), math.Max(scaleMax, max)
+			}
+			images[k].Min, images[k].Max = min, max
+		}
+		if math.IsInf(scaleMin, 1) {
+			scaleMin, scaleMax = 0, 0
+		}
+
+		for k, record := range records {
+			q := &images[k]
+			q.ScaleMin, q.ScaleMax = scaleMin, scaleMax
+			fileName := filepath.Join(outputFolder, q.File)
+			if existing, ok := previous[q.File]; ok && existing.ScaleMin == scaleMin && existing.ScaleMax == scaleMax && newerThan(fileName, cycle.files[record]) {
+				all = append(all, *q)
+				continue
+			}
+			values, ok := decoded[record]
+			if !ok {
+				var err error
+				if values, err = fieldValues(cycle.files[record], v.fields[record]); err != nil {
+					return nil, err
+				}
+			}
+			if err := renderField(fileName, values, cycle.grid, coastlines, scaleMin, scaleMax); err != nil {
+				return nil, err
+			}
+			all = append(all, *q)
+			rendered = append(rendered, *q)
+		}
+	}
+
+	if err := writeQuicklooks(outputFolder, subDir, all); err != nil {
+		return nil, err
+	}
+	return rendered, nil
+}
+
+// newerThan reports whether a file exists and is newer than another one
+func newerThan(fileName, source string) bool {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return false
+	}
+	sourceInfo, err := os.Stat(source)
+	return err == nil && !sourceInfo.ModTime().After(info.ModTime())
+}
+
+// sharedScale reports whether images have the same colour scale, covering the
+// values of each
+func sharedScale(images []quicklook) bool {
+	for _, q := range images {
+		if q.ScaleMin != images[0].ScaleMin || q.ScaleMax != images[0].ScaleMax || q.Min < q.ScaleMin || q.Max > q.ScaleMax {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldValues decodes a field of a GRIB2 file
+func fieldValues(gribFile string, f *grib2.Field) ([]float64, error) {
+	file, err := os.Open(gribFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return f.Values(file)
+}
+
+// valueRange returns the smallest and largest value, and false with 0 and 0 if
+// all are missing
+func valueRange(values []float64) (float64, float64, bool) {
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			min, max = math.Min(min, v), math.Max(max, v)
+		}
+	}
+	if math.IsInf(min, 1) {
+		return 0, 0, false
+	}
+	return min, max, true
+}
+
+// renderField draws the values of a field, coloured from min to max, and the
+// coastlines to a PNG file.
+func renderField(fileName string, values []float64, grid *grib2.Grid, coastlines [][]lonLat, min, max float64) error {
+	v := newView(grid)
+	img := image.NewRGBA(image.Rect(0, 0, v.width(), v.height()))
+	for y := 0; y < v.height(); y++ {
+		for x := 0; x < v.width(); x++ {
+			i, j := v.point(x, y)
+			img.Set(x, y, colormap(values[j*grid.Ni+i], min, max))
+		}
+	}
+	for _, line := range coastlines {
+		for k := 1; k < len(line); k++ {
+			v.drawLine(img, line[k-1], line[k], color.Black)
+		}
+	}
+
+	temporary := fileName + ".tmp"
+	out, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(out, img)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return os.Rename(temporary, fileName)
+}
+
+// view maps the points of a grid to the pixels of an image with north up. Global
+// grids are shifted to start at the date line.
+type view struct {
+	grid       *grib2.Grid
+	scale      int
+	firstLon   float64
+	firstLat   float64
+	shift      int
+	northFirst bool
+}
+
+func newView(grid *grib2.Grid) *view {
+	v := &view{grid: grid, scale: 1, northFirst: grid.Latitude(0) > grid.Latitude(grid.Nj-1)}
+	for grid.Ni*v.scale < quicklookWidth {
+		v.scale++
+	}
+	if float64(grid.Ni)*grid.Di >= 360-1e-6 {
+		// the first column east of the date line
+		v.shift = int(math.Ceil(math.Mod(180-grid.Longitude(0)+360, 360)/grid.Di)) % grid.Ni
+	}
+	v.firstLon = grid.Longitude(v.shift)
+	v.firstLat = math.Max(grid.Latitude(0), grid.Latitude(grid.Nj-1))
+	return v
+}
+
+func (v *view) width() int  { return v.grid.Ni * v.scale }
+func (v *view) height() int { return v.grid.Nj * v.scale }
+
+// point returns the grid point drawn at a pixel
+func (v *view) point(x, y int) (int, int) {
+	i := (x/v.scale + v.shift) % v.grid.Ni
+	j := y / v.scale
+	if !v.northFirst {
+		j = v.grid.Nj - 1 - j
+	}
+	return i, j
+}
+
+// pixel returns the position of a location in the image, it may be outside it
+func (v *view) pixel(p lonLat) (float64, float64) {
+	lon := math.Mod(p[0]-v.firstLon+720, 360)
+	// points just west of the first column
+	if lon > 360-v.grid.Di/2 {
+		lon -= 360
+	}
+	x := (lon/v.grid.Di + 0.5) * float64(v.scale)
+	y := ((v.firstLat-p[1])/v.grid.Dj + 0.5) * float64(v.scale)
+	return x, y
+}
+
+// drawLine draws the part of a line inside the image. Lines leaving the image
+// on one side and coming back on the other are skipped.
+func (v *view) drawLine(img *image.RGBA, from, to lonLat, c color.Color) {
+	x0, y0 := v.pixel(from)
+	x1, y1 := v.pixel(to)
+	width, height := float64(v.width()), float64(v.height())
+	if math.Abs(x1-x0) > width/2 || x0 < -1 && x1 < -1 || x0 > width && x1 > width {
+		return
+	}
+	steps := int(math.Ceil(math.Max(math.Abs(x1-x0), math.Abs(y1-y0))))
+	for k := 0; k <= steps; k++ {
+		t := 0.0
+		if steps > 0 {
+			t = float64(k) / float64(steps)
+		}
+		x, y := x0+(x1-x0)*t, y0+(y1-y0)*t
+		if x >= 0 && x < width && y >= 0 && y < height {
+			img.Set(int(x), int(y), c)
+		}
+	}
+}
+
+// colormapStops are the colours of the colour map from the lowest to the highest
+// value, after viridis.
+var colormapStops = []color.RGBA{
+	{68, 1, 84, 255},
+	{65, 68, 135, 255},
+	{42, 120, 142, 255},
+	{34, 168, 132, 255},
+	{122, 209, 81, 255},
+	{253, 231, 37, 255},
+}
+
+// missingColor is the colour of missing values
+var missingColor = color.RGBA{200, 200, 200, 255}
+
+// colormap returns the colour of a value between min and max
+func colormap(value, min, max float64) color.RGBA {
+	if math.IsNaN(value) {
+		return missingColor
+	}
+	t := 0.5
+	if max > min {
+		t = (value - min) / (max - min)
+	}
+	position := math.Max(0, math.Min(1, t)) * float64(len(colormapStops)-1)
+	k := int(position)
+	if k == len(colormapStops)-1 {
+		return colormapStops[k]
+	}
+	a, b, f := colormapStops[k], colormapStops[k+1], position-float64(k)
+	mix := func(x, y uint8) uint8 {
+		return uint8(float64(x) + (float64(y)-float64(x))*f + 0.5)
+	}
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 255}
+}
+
+// traceCoastlines returns the edges between land and sea points of the land mask
+// of a cycle, or nothing if the cycle has no land mask on its grid. The files are
+// read up to the first one with a land mask.
+func traceCoastlines(cycle *cycleFields) [][]lonLat {
+	for _, gribFile := range cycle.files {
+		if values := readLandMask(gribFile, cycle.grid); values != nil {
+			return maskEdges(cycle.grid, values)
+		}
+	}
+	return [][]lonLat{}
+}
+
+// readLandMask decodes the land mask of a file, or returns nil if the file has
+// none on the grid
+func readLandMask(gribFile string, grid *grib2.Grid) []float64 {
+	file, err := grib2.Open(gribFile)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	fields, err := file.Fields()
+	if err != nil {
+		return nil
+	}
+	for _, f := range fields {
+		if !landMask.matches(f) {
+			continue
+		}
+		maskGrid, err := grib2.ReadGrid(file, f.GridSection)
+		if err != nil || !sameGrid(maskGrid, grid) {
+			return nil
+		}
+		values, err := f.Values(file)
+		if err != nil {
+			return nil
+		}
+		return values
+	}
+	return nil
+}
+
+// maskEdges returns the cell edges between points of a mask on either side of 0.5
+func maskEdges(grid *grib2.Grid, values []float64) [][]lonLat {
+	land := func(i, j int) bool {
+		return values[j*grid.Ni+i] >= 0.5
+	}
+	if grid.Nj < 2 {
+		return [][]lonLat{}
+	}
+	global := float64(grid.Ni)*grid.Di >= 360-1e-6
+	// half the distance to the next row, negative when rows go south
+	halfLat := (grid.Latitude(1) - grid.Latitude(0)) / 2
+	edges := make([][]lonLat, 0)
+	for j := 0; j < grid.Nj; j++ {
+		lat := grid.Latitude(j)
+		for i := 0; i < grid.Ni; i++ {
+			lon := grid.Longitude(i)
+			east := i + 1
+			if east == grid.Ni && global {
+				east = 0
+			}
+			if east < grid.Ni && land(i, j) != land(east, j) {
+				edges = append(edges, []lonLat{{lon + grid.Di/2, lat - halfLat}, {lon + grid.Di/2, lat + halfLat}})
+			}
+			if j+1 < grid.Nj && land(i, j) != land(i, j+1) {
+				edges = append(edges, []lonLat{{lon - grid.Di/2, lat + halfLat}, {lon + grid.Di/2, lat + halfLat}})
+			}
+		}
+	}
+	return edges
+}
+
+// geoJSON is the part of a GeoJSON object holding coastlines, a feature
+// collection, a feature or a geometry.
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Features    []geoJSON       `json:"features"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []geoJSON       `json:"geometries"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// readCoastlines reads the lines and polygon rings of a GeoJSON file, nil if no
+// file is given.
+func readCoastlines(fileName string) ([][]lonLat, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var object geoJSON
+	if err := json.Unmarshal(content, &object); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	lines := make([][]lonLat, 0)
+	if err := object.lines(&lines); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return lines, nil
+}
+
+func (g *geoJSON) lines(lines *[][]lonLat) error {
+	var err error
+	switch g.Type {
+	case "FeatureCollection":
+		for i := range g.Features {
+			if err = g.Features[i].lines(lines); err != nil {
+				return err
+			}
+		}
+	case "Feature":
+		if g.Geometry != nil {
+			err = g.Geometry.lines(lines)
+		}
+	case "GeometryCollection":
+		for i := range g.Geometries {
+			if err = g.Geometries[i].lines(lines); err != nil {
+				return err
+			}
+		}
+	case "LineString":
+		var line []lonLat
+		if err = json.Unmarshal(g.Coordinates, &line); err == nil {
+			*lines = append(*lines, line)
+		}
+	case "MultiLineString", "Polygon":
+		var rings [][]lonLat
+		if err = json.Unmarshal(g.Coordinates, &rings); err == nil {
+			*lines = append(*lines, rings...)
+		}
+	case "MultiPolygon":
+		var polygons [][][]lonLat
+		if err = json.Unmarshal(g.Coordinates, &polygons); err == nil {
+			for _, rings := range polygons {
+				*lines = append(*lines, rings...)
+			}
+		}
+	}
+	return err
+}
+
+// readQuicklooks reads the list of the images of a quicklooks folder
+func readQuicklooks(outputFolder string) []quicklook {
+	list := make([]quicklook, 0)
+	content, err := ioutil.ReadFile(filepath.Join(outputFolder, quicklookListName))
+	if err == nil {
+		json.Unmarshal(content, &list)
+	}
+	return list
+}
+
+var quicklookIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GFS {{.Cycle}}</title>
+<style>
+body { font-family: sans-serif; }
+figure { display: inline-block; margin: 4px; }
+figcaption { font-size: small; }
+</style>
+</head>
+<body>
+<h1>GFS {{.Cycle}}</h1>
+{{range .Fields}}<h2>{{.Field}}{{with .Units}} ({{.}}){{end}}</h2>
+<p>Colours from {{printf "%.6g" .ScaleMin}} to {{printf "%.6g" .ScaleMax}}</p>
+{{range .Images}}<figure><a href="{{.File}}"><img src="{{.File}}" width="360" alt="{{.Field}} +{{.Hour}}h"></a>
+<figcaption>+{{.Hour}}h {{.Time.Format "2006-01-02 15:04"}} UTC, {{printf "%.6g" .Min}} to {{printf "%.6g" .Max}}</figcaption></figure>
+{{end}}{{end}}</body>
+</html>
+`))
+
+// writeQuicklooks writes the list of the images of a cycle and the index page
+// linking them, by field and forecast hour.
+func writeQuicklooks(outputFolder, subDir string, images []quicklook) error {
+	content, err := json.MarshalIndent(images, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outputFolder, quicklookListName), content, 0666); err != nil {
+		return err
+	}
+
+	type fieldImages struct {
+		Field    string
+		Units    string
+		ScaleMin float64
+		ScaleMax float64
+		Images   []quicklook
+	}
+	fields := make([]*fieldImages, 0)
+	byField := make(map[string]*fieldImages)
+	for _, q := range images {
+		f, ok := byField[q.Field]
+		if !ok {
+			f = &fieldImages{Field: q.Field, Units: q.Units, ScaleMin: q.ScaleMin, ScaleMax: q.ScaleMax}
+			byField[q.Field] = f
+			fields = append(fields, f)
+		}
+		f.Images = append(f.Images, q)
+	}
+
+	temporary := filepath.Join(outputFolder, quicklookIndexName+".tmp")
+	out, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+	err = quicklookIndex.Execute(out, struct {
+		Cycle  string
+		Fields []*fieldImages
+	}{subDir, fields})
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return os.Rename(temporary, filepath.Join(outputFolder, quicklookIndexName))
+}
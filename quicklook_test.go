@@ -0,0 +1,163 @@
+package main
+
+import (
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+func TestColormap(t *testing.T) {
+	first, last := colormapStops[0], colormapStops[len(colormapStops)-1]
+	tests := []struct {
+		value, min, max float64
+		want            color.RGBA
+	}{
+		{0, 0, 10, first},
+		{10, 0, 10, last},
+		{-5, 0, 10, first},
+		{15, 0, 10, last},
+		{2, 0, 10, colormapStops[1]},
+		// halfway between the second and third stop
+		{3, 0, 10, color.RGBA{54, 94, 139, 255}},
+		// a constant field is drawn in the middle of the map
+		{7, 7, 7, color.RGBA{38, 144, 137, 255}},
+		{math.NaN(), 0, 10, missingColor},
+	}
+	for _, test := range tests {
+		if got := colormap(test.value, test.min, test.max); got != test.want {
+			t.Errorf("colormap(%g, %g, %g): got %v, want %v", test.value, test.min, test.max, got, test.want)
+		}
+	}
+}
+
+func TestMaskEdges(t *testing.T) {
+	// a single land point at 10N 10E of a regional grid
+	grid := &grib2.Grid{Ni: 3, Nj: 3, La1: 20, Lo1: 0, La2: 0, Lo2: 20, Di: 10, Dj: 10, ScanningMode: grib2.ScanNorthToSouth}
+	edges := maskEdges(grid, []float64{0, 0, 0, 0, 1, 0, 0, 0, 0})
+	want := [][]lonLat{
+		{{5, 15}, {15, 15}}, {{5, 15}, {5, 5}},
+		{{15, 15}, {15, 5}}, {{5, 5}, {15, 5}},
+	}
+	if len(edges) != len(want) {
+		t.Fatalf("got edges %v, want %v", edges, want)
+	}
+	for k := range want {
+		if edges[k][0] != want[k][0] || edges[k][1] != want[k][1] {
+			t.Errorf("got edges %v, want %v", edges, want)
+			break
+		}
+	}
+
+	// the edge of a global grid between its last and first column
+	global := &grib2.Grid{Ni: 4, Nj: 2, La1: 45, Lo1: 0, La2: -45, Lo2: 270, Di: 90, Dj: 90, ScanningMode: grib2.ScanNorthToSouth}
+	edges = maskEdges(global, []float64{1, 1, 1, 0, 1, 1, 1, 1})
+	if len(edges) != 3 || edges[1][0] != (lonLat{315, 90}) || edges[2][0] != (lonLat{225, 0}) {
+		t.Errorf("got edges %v of a global grid", edges)
+	}
+}
+
+// quicklookPixel returns the colour of the centre of a grid point in an image of testGlobalGrid
+func quicklookPixel(t *testing.T, fileName string, i, j int) color.RGBA {
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newView(&testGlobalGrid)
+	x := (i-v.shift+testGlobalGrid.Ni)%testGlobalGrid.Ni*v.scale + v.scale/2
+	r, g, b, a := img.At(x, j*v.scale+v.scale/2).RGBA()
+	return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+}
+
+func TestRenderCycle(t *testing.T) {
+	folder, err := ioutil.TempDir("", "quicklook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	// land between 30S and 30N and 0E and 60E, only in the first file
+	land := testField{discipline: 2, category: 0, number: 0, surface: 1, values: fill(testGlobalGrid, func(lat, lon float64) float64 {
+		if math.Abs(lat) <= 30 && lon <= 60 {
+			return 1
+		}
+		return 0
+	})}
+	temperatures := func(offset float64) []float64 {
+		return fill(testGlobalGrid, func(lat, lon float64) float64 {
+			return 250 + offset + (90-math.Abs(lat))/3
+		})
+	}
+	cycleFolder := filepath.Dir(testCycleFile(t, folder, testReferenceTime, 0, testGlobalGrid, tmp2m(temperatures(0)), land))
+	testCycleFile(t, folder, testReferenceTime, 3, testGlobalGrid, tmp2m(temperatures(10)))
+	outputFolder := filepath.Join(cycleFolder, quicklooksFolderName)
+	selectors := []fieldSelector{{"TMP", "2 m above ground"}}
+
+	rendered, err := renderCycle(cycleFolder, outputFolder, "gfs.20180405/06", selectors, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rendered) != 2 {
+		t.Fatalf("got %d images, want 2", len(rendered))
+	}
+	for k, q := range rendered {
+		wantMin := 250 + 10*float64(k)
+		if q.ScaleMin != 250 || q.ScaleMax != 290 || q.Min != wantMin || q.Max != wantMin+30 {
+			t.Errorf("got image %+v, want the range of both hours", q)
+		}
+	}
+	first := filepath.Join(outputFolder, "TMP_2_m_above_ground_f000.png")
+	// the poles are the coldest of the first hour, the equator the warmest of the second
+	if got := quicklookPixel(t, first, 20, 0); got != colormapStops[0] {
+		t.Errorf("got %v at the north pole, want %v", got, colormapStops[0])
+	}
+	if got := quicklookPixel(t, filepath.Join(outputFolder, "TMP_2_m_above_ground_f003.png"), 20, 9); got != colormapStops[len(colormapStops)-1] {
+		t.Errorf("got %v at the equator, want %v", got, colormapStops[len(colormapStops)-1])
+	}
+	// the coastline runs along the west edge of the land, between 10W and 0E
+	v := newView(&testGlobalGrid)
+	x := (0 - v.shift + testGlobalGrid.Ni) % testGlobalGrid.Ni * v.scale
+	file, err := os.Open(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := img.At(x, 9*v.scale+v.scale/2).RGBA(); r != 0 || g != 0 || b != 0 {
+		t.Errorf("got colour %d %d %d on the coastline", r>>8, g>>8, b>>8)
+	}
+
+	// nothing is rendered again until a file changes, changing the range of the variable
+	if rendered, err := renderCycle(cycleFolder, outputFolder, "gfs.20180405/06", selectors, nil); err != nil || len(rendered) != 0 {
+		t.Errorf("got %d images rendered again, %v", len(rendered), err)
+	}
+	later := time.Now().Add(time.Minute)
+	fileName := testCycleFile(t, folder, testReferenceTime, 3, testGlobalGrid, tmp2m(temperatures(20)))
+	if err := os.Chtimes(fileName, later, later); err != nil {
+		t.Fatal(err)
+	}
+	rendered, err = renderCycle(cycleFolder, outputFolder, "gfs.20180405/06", selectors, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rendered) != 2 || rendered[0].Min != 250 || rendered[0].ScaleMax != 300 || rendered[1].Min != 270 {
+		t.Errorf("got images %+v after the second hour changed", rendered)
+	}
+	if list := readQuicklooks(outputFolder); len(list) != 2 || list[1].Max != 300 {
+		t.Errorf("got list %+v", list)
+	}
+}
@@ -0,0 +1,355 @@
+// Package s3 is a small client for the parts of the Amazon S3 REST API used by
+// ftplistener, signing requests with AWS Signature Version 4. It also works with
+// S3 compatible stores like MinIO, buckets are always addressed path style.
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// Client sends requests to an S3 endpoint. Requests are anonymous when no
+// access key is set.
+type Client struct {
+	// Endpoint is the base URL of the store, e.g. https://s3.us-east-1.amazonaws.com
+	// or http://localhost:9000
+	Endpoint     string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	HTTPClient   *http.Client
+}
+
+// NewClientFromEnv returns a client configured by the usual AWS environment
+// variables: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN,
+// AWS_REGION and AWS_ENDPOINT_URL.
+func NewClientFromEnv() *Client {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	return &Client{
+		Endpoint:     strings.TrimSuffix(endpoint, "/"),
+		Region:       region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		HTTPClient:   http.DefaultClient,
+	}
+}
+
+// ParseURL splits an s3://bucket/prefix URL into bucket and prefix
+func ParseURL(value string) (bucket, prefix string, err error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("s3: invalid URL %q, expected s3://bucket/prefix", value)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// Error is an error response of the store
+type Error struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3: status %d: %s", e.StatusCode, e.Body)
+}
+
+// PutObject stores body as the object key of bucket
+func (c *Client) PutObject(bucket, key string, body []byte, contentType string) error {
+	header := make(http.Header)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	request, err := c.newRequest("PUT", bucket, key, nil, header, body)
+	if err != nil {
+		return err
+	}
+	response, err := c.do(request)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// DeleteObject removes the object key of bucket, removing a missing object
+// succeeds
+func (c *Client) DeleteObject(bucket, key string) error {
+	request, err := c.newRequest("DELETE", bucket, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	response, err := c.do(request)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// newRequest creates a signed request for an object, or for the bucket when
+// key is empty.
+func (c *Client) newRequest(method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	path := "/" + bucket
+	if key != "" {
+		path += "/" + key
+	}
+	target := c.Endpoint + escapePath(path)
+	if len(query) > 0 {
+		target += "?" + canonicalQuery(query)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	c.sign(request, body, time.Now().UTC())
+	return request, nil
+}
+
+func (c *Client) do(request *http.Request) (*http.Response, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+		return nil, &Error{StatusCode: response.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return response, nil
+}
+
+// sign adds the Signature Version 4 authorization headers to a request
+func (c *Client) sign(request *http.Request, body []byte, now time.Time) {
+	if c.AccessKey == "" {
+		return
+	}
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := signingAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signingAlgorithm, c.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// escapePath percent encodes all but the unreserved characters and slashes, as
+// the canonical URI of Signature Version 4 requires.
+func escapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || unreserved(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes a query with sorted keys and the escaping of escapePath
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, escapeQuery(k)+"="+escapeQuery(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func escapeQuery(value string) string {
+	return strings.Replace(escapePath(value), "/", "%2F", -1)
+}
+
+func unreserved(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+		c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+// ObjectExists reports whether the object key exists in bucket
+func (c *Client) ObjectExists(bucket, key string) (bool, error) {
+	request, err := c.newRequest("HEAD", bucket, key, nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	response, err := c.do(request)
+	if e, ok := err.(*Error); ok && e.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, response.Body.Close()
+}
+
+// Object is an object listed by ListObjects
+type Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+}
+
+// listBucketResult is the response of ListObjectsV2
+type listBucketResult struct {
+	Contents              []Object `xml:"Contents"`
+	CommonPrefixes        []string `xml:"CommonPrefixes>Prefix"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+// ListObjects returns the objects of bucket with keys starting with prefix, and
+// the common prefixes of the keys up to the next delimiter when a delimiter is
+// given, like the folders below the prefix for "/". Truncated listings are
+// continued until all keys are listed.
+func (c *Client) ListObjects(bucket, prefix, delimiter string) ([]Object, []string, error) {
+	objects := make([]Object, 0)
+	prefixes := make([]string, 0)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		request, err := c.newRequest("GET", bucket, "", query, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		response, err := c.do(request)
+		if err != nil {
+			return nil, nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		objects = append(objects, result.Contents...)
+		prefixes = append(prefixes, result.CommonPrefixes...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, prefixes, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// GetObject returns the content of the object key of bucket, from offset on if
+// it is above zero
+func (c *Client) GetObject(bucket, key string, offset int64) (io.ReadCloser, error) {
+	header := make(http.Header)
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	request, err := c.newRequest("GET", bucket, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.do(request)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && response.StatusCode != http.StatusPartialContent {
+		response.Body.Close()
+		return nil, fmt.Errorf("s3: range request of %s answered with status %d", key, response.StatusCode)
+	}
+	return response.Body, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/nilsmagnus/ftplistener/s3"
+)
+
+// s3Source is a bucket of an S3 compatible store, like the NOAA open data bucket
+// s3://noaa-gfs-bdp-pds. Folders are the common prefixes of the keys up to a
+// slash. The client is configured like the zarr output, by the AWS environment
+// variables, and is anonymous without an access key.
+type s3Source struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// newS3Source returns the source of an s3://bucket/prefix URL, the -baseDir is
+// below the prefix
+func newS3Source(location string) (*s3Source, error) {
+	bucket, prefix, err := s3.ParseURL(location)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Source{client: s3.NewClientFromEnv(), bucket: bucket, prefix: prefix}, nil
+}
+
+// folderPrefix returns the key prefix of the objects in a folder, e.g.
+// gfs.20180405/06/ for the folder /gfs.20180405/06
+func (s *s3Source) folderPrefix(folder string) string {
+	prefix := strings.Trim(path.Join(s.prefix, folder), "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+func (s *s3Source) list(folder string, keep func(*ftp.Entry) bool) ([]*ftp.Entry, error) {
+	prefix := s.folderPrefix(folder)
+	objects, prefixes, err := s.client.ListObjects(s.bucket, prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*ftp.Entry, 0, len(objects)+len(prefixes))
+	for _, p := range prefixes {
+		entries = append(entries, &ftp.Entry{Name: path.Base(p), Type: ftp.EntryTypeFolder})
+	}
+	for _, o := range objects {
+		if o.Key == prefix { // a folder placeholder
+			continue
+		}
+		entries = append(entries, &ftp.Entry{
+			Name: path.Base(o.Key),
+			Type: ftp.EntryTypeFile,
+			Size: uint64(o.Size),
+			Time: o.LastModified.UTC(),
+		})
+	}
+
+	kept := make([]*ftp.Entry, 0, len(entries))
+	for _, e := range entries {
+		if keep == nil || keep(e) {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+func (s *s3Source) open(folder string) (sourceFolder, error) {
+	return &s3Folder{source: s, prefix: s.folderPrefix(folder)}, nil
+}
+
+// s3Folder downloads the objects below a prefix with ranged requests
+type s3Folder struct {
+	source *s3Source
+	prefix string
+}
+
+// modTime is the LastModified of the listing, which has seconds
+func (f *s3Folder) modTime(entry *ftp.Entry) time.Time {
+	return entry.Time
+}
+
+// retrieve starts over when the partial download is not shorter than the object,
+// which the store answers with 416
+func (f *s3Folder) retrieve(name string, offset int64) (io.ReadCloser, int64, error) {
+	body, err := f.source.client.GetObject(f.source.bucket, f.prefix+name, offset)
+	var storeErr *s3.Error
+	if offset > 0 && errors.As(err, &storeErr) && storeErr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		offset = 0
+		body, err = f.source.client.GetObject(f.source.bucket, f.prefix+name, 0)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, offset, nil
+}
+
+func (f *s3Folder) hashAlgorithm() string {
+	return ""
+}
+
+func (f *s3Folder) hash(name string) (string, string, error) {
+	return "", "", errNoServerHash
+}
+
+func (f *s3Folder) location(name string) string {
+	return "s3://" + f.source.bucket + "/" + f.prefix + name
+}
+
+func (f *s3Folder) close() error {
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/nilsmagnus/ftplistener/s3"
+)
+
+func TestS3SourceList(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if prefix := r.URL.Query().Get("prefix"); prefix != "gfs.20180405/06/" {
+			t.Errorf("got prefix %q", prefix)
+		}
+		w.Write([]byte(`<ListBucketResult>
+  <Contents><Key>gfs.20180405/06/</Key><Size>0</Size></Contents>
+  <Contents><Key>gfs.20180405/06/gfs.t06z.pgrb2.1p00.f000</Key><LastModified>2018-04-05T09:30:12.000Z</LastModified><Size>100</Size></Contents>
+  <Contents><Key>gfs.20180405/06/gfs.t06z.pgrb2.1p00.f000.idx</Key><LastModified>2018-04-05T09:30:13.000Z</LastModified><Size>10</Size></Contents>
+  <CommonPrefixes><Prefix>gfs.20180405/06/atmos/</Prefix></CommonPrefixes>
+</ListBucketResult>`))
+	}))
+	defer server.Close()
+
+	source := &s3Source{client: &s3.Client{Endpoint: server.URL, Region: "us-east-1"}, bucket: "noaa-gfs-bdp-pds"}
+	entries, err := source.list("/gfs.20180405/06", func(e *ftp.Entry) bool { return e.Type == ftp.EntryTypeFolder || gfsFileName.MatchString(e.Name) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want the folder and 2 files without the placeholder", len(entries))
+	}
+	if entries[0].Name != "atmos" || entries[0].Type != ftp.EntryTypeFolder {
+		t.Errorf("got folder %+v", entries[0])
+	}
+	if entries[1].Name != "gfs.t06z.pgrb2.1p00.f000" || entries[1].Size != 100 || entries[1].Time.Minute() != 30 {
+		t.Errorf("got file %+v", entries[1])
+	}
+}
+
+func TestS3FolderRetrieveStartsOver(t *testing.T) {
+	content := "GRIB content 7777"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var offset int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err != nil {
+			w.Write([]byte(content))
+			return
+		}
+		if offset >= len(content) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(content[offset:]))
+	}))
+	defer server.Close()
+
+	source := &s3Source{client: &s3.Client{Endpoint: server.URL, Region: "us-east-1"}, bucket: "bucket"}
+	folder, _ := source.open("/gfs.20180405/06")
+	for _, test := range []struct {
+		offset, start int64
+		content       string
+	}{
+		{5, 5, "content 7777"},
+		{int64(len(content)) + 10, 0, content},
+	} {
+		body, start, err := folder.retrieve("gfs.t06z.pgrb2.1p00.f000", test.offset)
+		if err != nil {
+			t.Fatalf("offset %d: %v", test.offset, err)
+		}
+		got, _ := ioutil.ReadAll(body)
+		body.Close()
+		if start != test.start || string(got) != test.content {
+			t.Errorf("offset %d: got %q from %d, want %q from %d", test.offset, got, start, test.content, test.start)
+		}
+	}
+}
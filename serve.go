@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// serveCommand serves the downloaded files over HTTP and returns the process exit code
+func serveCommand(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	saveFolder := flags.String("destination", "gribfiles", "destination of the downloaded files to serve")
+	listen := flags.String("listen", ":8080", "address to listen on")
+	cacheSize := flags.Int("cacheSize", 256, "number of decoded fields kept in memory")
+	flags.Parse(args)
+
+	mux := http.NewServeMux()
+	mux.Handle("/point", &pointHandler{destination: *saveFolder, reader: newGridReader(*cacheSize)})
+	mux.Handle("/quicklooks/", &quicklookHandler{destination: *saveFolder})
+
+	log.Println("Serving", "destination", *saveFolder, "address", *listen)
+	if err := http.ListenAndServe(*listen, mux); err != nil {
+		log.Println("Failed to serve", "error", err.Error())
+		return 1
+	}
+	return 0
+}
+
+var cycleDateFolder = regexp.MustCompile("^gfs\\.[0-9]{8}$")
+var cycleHourFolder = regexp.MustCompile("^[0-9]{2}$")
+var cycleReferenceTime = regexp.MustCompile("^[0-9]{10}$")
+
+// isCycleFolder reports whether subDir is a cycle folder like gfs.20180405/06,
+// and nothing more
+func isCycleFolder(subDir string) bool {
+	parts := strings.Split(subDir, "/")
+	return len(parts) == 2 && cycleDateFolder.MatchString(parts[0]) && cycleHourFolder.MatchString(parts[1])
+}
+
+// cycleFolders returns the cycle folders below the destination, newest first,
+// e.g. gfs.20180405/06
+func cycleFolders(destination string) ([]string, error) {
+	days, err := ioutil.ReadDir(destination)
+	if err != nil {
+		return nil, err
+	}
+	cycles := make([]string, 0)
+	for _, day := range days {
+		if !day.IsDir() || !cycleDateFolder.MatchString(day.Name()) {
+			continue
+		}
+		hours, err := ioutil.ReadDir(filepath.Join(destination, day.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, hour := range hours {
+			if hour.IsDir() && cycleHourFolder.MatchString(hour.Name()) {
+				cycles = append(cycles, day.Name()+"/"+hour.Name())
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(cycles)))
+	return cycles, nil
+}
+
+// completeCycleFolders returns the cycle folders below the destination whose
+// downloads are complete, newest first. Destinations without any complete cycle,
+// e.g. downloaded before cycles were marked complete, have all cycle folders returned.
+func completeCycleFolders(destination string) ([]string, error) {
+	cycles, err := cycleFolders(destination)
+	if err != nil {
+		return nil, err
+	}
+	complete := make([]string, 0, len(cycles))
+	for _, subDir := range cycles {
+		if _, err := os.Stat(filepath.Join(destination, subDir, cycleCompleteFileName)); err == nil {
+			complete = append(complete, subDir)
+		}
+	}
+	if len(complete) == 0 {
+		return cycles, nil
+	}
+	return complete, nil
+}
+
+// resolveCycle returns the cycle folder of a cycle given as "latest", as a
+// reference time like 2018040506 or as a folder like gfs.20180405/06, and the
+// downloaded GRIB2 files of the cycle. The latest cycle is the newest complete
+// one, not one still downloading. Cropped files are used if the cycle only has those.
+func resolveCycle(destination, cycle string) (string, []string, error) {
+	candidates := []string{cycle}
+	switch {
+	case cycle == "" || cycle == "latest":
+		var err error
+		if candidates, err = completeCycleFolders(destination); err != nil {
+			return "", nil, err
+		}
+	case cycleReferenceTime.MatchString(cycle):
+		candidates = []string{fmt.Sprintf("gfs.%s/%s", cycle[:8], cycle[8:])}
+	case !isCycleFolder(cycle):
+		return "", nil, fmt.Errorf("invalid cycle %q, expected latest, YYYYMMDDHH or gfs.YYYYMMDD/HH", cycle)
+	}
+
+	for _, subDir := range candidates {
+		for _, folder := range []string{filepath.Join(destination, subDir), filepath.Join(destination, subDir, cropFolderName)} {
+			fileNames, err := cycleGribFiles(folder)
+			if err != nil && !os.IsNotExist(err) {
+				return "", nil, err
+			}
+			if len(fileNames) > 0 {
+				return subDir, fileNames, nil
+			}
+		}
+	}
+	return "", nil, os.ErrNotExist
+}
+
+// quicklookHandler serves the quicklooks of the cycles:
+// /quicklooks/ lists the cycles, /quicklooks/gfs.20180405/06/ or /quicklooks/latest/
+// is the index page of a cycle and links its images.
+type quicklookHandler struct {
+	destination string
+}
+
+var quicklookFileName = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+func (h *quicklookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/quicklooks/"), "/")
+	cycles, err := h.cycles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(parts) == 1 && parts[0] == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		quicklookCycles.Execute(w, cycles)
+		return
+	}
+
+	var subDir, fileName string
+	switch {
+	case parts[0] == "latest" && len(parts) == 2:
+		if len(cycles) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		subDir, fileName = cycles[0], parts[1]
+	case len(parts) == 3 && isCycleFolder(parts[0]+"/"+parts[1]):
+		subDir, fileName = parts[0]+"/"+parts[1], parts[2]
+	case len(parts) == 2 && isCycleFolder(parts[0]+"/"+parts[1]) || len(parts) == 1 && parts[0] == "latest":
+		// the images are linked relative to the folder
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if fileName == "" {
+		fileName = quicklookIndexName
+	}
+	if !quicklookFileName.MatchString(fileName) {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(h.destination, subDir, quicklooksFolderName, fileName))
+}
+
+// cycles returns the cycles with quicklooks, newest first
+func (h *quicklookHandler) cycles() ([]string, error) {
+	all, err := cycleFolders(h.destination)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	cycles := make([]string, 0)
+	for _, subDir := range all {
+		if fileExists(filepath.Join(h.destination, subDir, quicklooksFolderName, quicklookIndexName)) {
+			cycles = append(cycles, subDir)
+		}
+	}
+	return cycles, nil
+}
+
+var quicklookCycles = template.Must(template.New("cycles").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>GFS quicklooks</title></head>
+<body>
+<h1>GFS quicklooks</h1>
+<ul>
+{{range .}}<li><a href="{{.}}/">{{.}}</a></li>
+{{else}}<li>no cycles rendered yet</li>
+{{end}}</ul>
+</body>
+</html>
+`))
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPointHandlerRejectsInvalidRequests(t *testing.T) {
+	root, err := ioutil.TempDir("", "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// a cycle outside the destination, reachable with ../
+	destination := filepath.Join(root, "gribfiles")
+	outside := filepath.Join(root, "other", "gfs.20180405", "06")
+	for _, folder := range []string{destination, outside} {
+		if err := os.MkdirAll(folder, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "gfs.t06z.pgrb2.1p00.f000"), []byte("GRIB"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &pointHandler{destination: destination, reader: newGridReader(4)}
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+	}{
+		{"traversal", url.Values{"lat": {"60"}, "lon": {"10"}, "vars": {"TMP:2m"}, "cycle": {"../other/gfs.20180405/06"}}, http.StatusBadRequest},
+		{"traversal with suffix", url.Values{"lat": {"60"}, "lon": {"10"}, "vars": {"TMP:2m"}, "cycle": {"gfs.20180405/06/../../../other/gfs.20180405/06"}}, http.StatusBadRequest},
+		{"latitude out of range", url.Values{"lat": {"91"}, "lon": {"10"}, "vars": {"TMP:2m"}}, http.StatusBadRequest},
+		{"longitude out of range", url.Values{"lat": {"60"}, "lon": {"400"}, "vars": {"TMP:2m"}}, http.StatusBadRequest},
+		{"latitude not a number", url.Values{"lat": {"NaN"}, "lon": {"10"}, "vars": {"TMP:2m"}}, http.StatusBadRequest},
+		{"missing cycle", url.Values{"lat": {"60"}, "lon": {"10"}, "vars": {"TMP:2m"}, "cycle": {"gfs.20180405/06"}}, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/point?"+test.query.Encode(), nil))
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, recorder.Code, test.status, recorder.Body.String())
+		}
+	}
+}
+
+func TestIsCycleFolder(t *testing.T) {
+	for subDir, want := range map[string]bool{
+		"gfs.20180405/06":                  true,
+		"gfs.20180405/6":                   false,
+		"../gfs.20180405/06":               false,
+		"gfs.20180405/06/..":               false,
+		"x/gfs.20180405/06":                false,
+		"gfs.20180405/06/../../etc/passwd": false,
+	} {
+		if got := isCycleFolder(subDir); got != want {
+			t.Errorf("isCycleFolder(%q) = %v, want %v", subDir, got, want)
+		}
+	}
+}
+
+func TestResolveLatestCycle(t *testing.T) {
+	destination, err := ioutil.TempDir("", "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	// 00 is complete, 06 is still downloading
+	values := make([]float64, testGlobalGrid.Points())
+	earlier := testReferenceTime.Add(-6 * time.Hour)
+	testCycleFile(t, destination, earlier, 0, testGlobalGrid, tmp2m(values))
+	testCycleFile(t, destination, testReferenceTime, 0, testGlobalGrid, tmp2m(values))
+
+	// destinations from before cycles were marked complete serve the newest cycle
+	if subDir, _, err := resolveCycle(destination, "latest"); err != nil || subDir != "gfs.20180405/06" {
+		t.Errorf("got %q, %v without complete cycles, want the newest", subDir, err)
+	}
+	if err := markCycleComplete(filepath.Join(destination, "gfs.20180405", "00"), cycleEvent{Cycle: "gfs.20180405/00"}); err != nil {
+		t.Fatal(err)
+	}
+	subDir, fileNames, err := resolveCycle(destination, "latest")
+	if err != nil || subDir != "gfs.20180405/00" || len(fileNames) != 1 {
+		t.Errorf("got %q with files %v, %v, want the complete cycle", subDir, fileNames, err)
+	}
+	if subDir, _, err := resolveCycle(destination, "2018040506"); err != nil || subDir != "gfs.20180405/06" {
+		t.Errorf("got %q, %v for the cycle still downloading", subDir, err)
+	}
+}
@@ -0,0 +1,565 @@
+// Package sftp is a small client for the read only parts of the SSH File
+// Transfer Protocol version 3 used by ftplistener: listing folders, and reading
+// files from an offset. It runs over an SSH connection of
+// golang.org/x/crypto/ssh.
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Packet types of draft-ietf-secsh-filexfer-02
+const (
+	packetInit      = 1
+	packetVersion   = 2
+	packetOpen      = 3
+	packetClose     = 4
+	packetRead      = 5
+	packetOpendir   = 11
+	packetReaddir   = 12
+	packetStat      = 17
+	packetStatus    = 101
+	packetHandle    = 102
+	packetData      = 103
+	packetName      = 104
+	packetAttrs     = 105
+	protocolVersion = 3
+)
+
+// Status codes of the server
+const (
+	StatusOK               = 0
+	StatusEOF              = 1
+	StatusNoSuchFile       = 2
+	StatusPermissionDenied = 3
+	StatusFailure          = 4
+)
+
+const (
+	attrSize        = 0x00000001
+	attrUIDGID      = 0x00000002
+	attrPermissions = 0x00000004
+	attrACModTime   = 0x00000008
+	attrExtended    = 0x80000000
+
+	openRead = 0x00000001
+
+	// chunkSize is the length of each read, servers support at least 32 KiB
+	chunkSize = 32 * 1024
+	// readAhead is the number of reads sent before waiting for the first answer
+	readAhead = 16
+)
+
+// StatusError is an error status answered by the server
+type StatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("sftp: status %d: %s", e.Code, e.Message)
+}
+
+// FileInfo is an entry of a folder
+type FileInfo struct {
+	Name    string
+	Size    int64
+	Mode    uint32 // POSIX st_mode
+	ModTime time.Time
+}
+
+// IsDir reports whether the entry is a folder
+func (fi *FileInfo) IsDir() bool {
+	return fi.Mode&0170000 == 0040000
+}
+
+// IsRegular reports whether the entry is a regular file
+func (fi *FileInfo) IsRegular() bool {
+	return fi.Mode&0170000 == 0100000
+}
+
+// Client is an SFTP session. It is not safe for concurrent use, open a client
+// per goroutine.
+type Client struct {
+	conn      *ssh.Client
+	session   *ssh.Session
+	w         io.WriteCloser
+	r         io.Reader
+	nextID    uint32
+	responses map[uint32]*packet
+}
+
+// Dial connects to an SSH server and starts an SFTP session. The timeout of
+// config applies to the connection and the handshake.
+func Dial(addr string, config *ssh.ClientConfig) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c, err := NewClient(ssh.NewClient(sshConn, channels, requests))
+	if err != nil {
+		sshConn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient starts an SFTP session on an SSH connection, which is closed with
+// the client.
+func NewClient(conn *ssh.Client) (*Client, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	c := &Client{conn: conn, session: session, w: w, r: r, responses: make(map[uint32]*packet)}
+	hello := newPacket(packetInit)
+	hello.putUint32(protocolVersion)
+	if err := c.send(hello); err != nil {
+		session.Close()
+		return nil, err
+	}
+	version, err := c.receive()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if version.kind != packetVersion {
+		session.Close()
+		return nil, fmt.Errorf("sftp: expected version packet, got type %d", version.kind)
+	}
+	if v, _ := version.uint32(); v < protocolVersion {
+		session.Close()
+		return nil, fmt.Errorf("sftp: unsupported protocol version %d", v)
+	}
+	return c, nil
+}
+
+// Close ends the session and the SSH connection
+func (c *Client) Close() error {
+	c.session.Close()
+	return c.conn.Close()
+}
+
+// ReadDir returns the entries of a folder, without . and ..
+func (c *Client) ReadDir(path string) ([]*FileInfo, error) {
+	handle, err := c.openHandle(packetOpendir, path)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(handle)
+
+	entries := make([]*FileInfo, 0)
+	for {
+		request := c.newRequest(packetReaddir)
+		request.putString(handle)
+		response, err := c.call(request)
+		if err != nil {
+			return nil, err
+		}
+		if response.kind == packetStatus {
+			if err := response.status(); err != io.EOF {
+				return nil, err
+			}
+			return entries, nil
+		}
+		if response.kind != packetName {
+			return nil, unexpected(response, packetName)
+		}
+		count, err := response.uint32()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < count; i++ {
+			name, err := response.string()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := response.string(); err != nil { // the ls -l line
+				return nil, err
+			}
+			info, err := response.attrs()
+			if err != nil {
+				return nil, err
+			}
+			if name == "." || name == ".." {
+				continue
+			}
+			info.Name = name
+			entries = append(entries, info)
+		}
+	}
+}
+
+// Stat returns the attributes of a file or folder, following links
+func (c *Client) Stat(path string) (*FileInfo, error) {
+	request := c.newRequest(packetStat)
+	request.putString(path)
+	response, err := c.call(request)
+	if err != nil {
+		return nil, err
+	}
+	switch response.kind {
+	case packetStatus:
+		return nil, response.status()
+	case packetAttrs:
+		return response.attrs()
+	}
+	return nil, unexpected(response, packetAttrs)
+}
+
+// Open opens a file for reading from an offset
+func (c *Client) Open(path string, offset int64) (*File, error) {
+	handle, err := c.openHandle(packetOpen, path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{client: c, handle: handle, offset: offset}, nil
+}
+
+// openHandle opens a file for reading, or a folder for listing
+func (c *Client) openHandle(kind byte, path string) (string, error) {
+	request := c.newRequest(kind)
+	request.putString(path)
+	if kind == packetOpen {
+		request.putUint32(openRead)
+		request.putUint32(0) // no attributes
+	}
+	response, err := c.call(request)
+	if err != nil {
+		return "", err
+	}
+	switch response.kind {
+	case packetStatus:
+		return "", response.status()
+	case packetHandle:
+		return response.string()
+	}
+	return "", unexpected(response, packetHandle)
+}
+
+func (c *Client) closeHandle(handle string) error {
+	request := c.newRequest(packetClose)
+	request.putString(handle)
+	response, err := c.call(request)
+	if err != nil {
+		return err
+	}
+	if response.kind != packetStatus {
+		return unexpected(response, packetStatus)
+	}
+	return response.status()
+}
+
+// newRequest returns a packet starting with the next request id
+func (c *Client) newRequest(kind byte) *packet {
+	c.nextID++
+	p := newPacket(kind)
+	p.id = c.nextID
+	p.putUint32(c.nextID)
+	return p
+}
+
+// call sends a request and waits for its response
+func (c *Client) call(request *packet) (*packet, error) {
+	if err := c.send(request); err != nil {
+		return nil, err
+	}
+	return c.response(request.id)
+}
+
+func (c *Client) send(p *packet) error {
+	binary.BigEndian.PutUint32(p.data, uint32(len(p.data)-4))
+	_, err := c.w.Write(p.data)
+	return err
+}
+
+// response returns the response to a request, keeping the responses to other
+// requests read meanwhile
+func (c *Client) response(id uint32) (*packet, error) {
+	if p, ok := c.responses[id]; ok {
+		delete(c.responses, id)
+		return p, nil
+	}
+	for {
+		p, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		if p.id == id {
+			return p, nil
+		}
+		c.responses[p.id] = p
+	}
+}
+
+// receive reads a packet, and the request id of responses
+func (c *Client) receive() (*packet, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 256*1024 {
+		return nil, fmt.Errorf("sftp: invalid packet length %d", length)
+	}
+	p := &packet{kind: header[4], data: make([]byte, length-1)}
+	if _, err := io.ReadFull(c.r, p.data); err != nil {
+		return nil, err
+	}
+	if p.kind != packetVersion {
+		id, err := p.uint32()
+		if err != nil {
+			return nil, err
+		}
+		p.id = id
+	}
+	return p, nil
+}
+
+// File reads a file with several reads in flight
+type File struct {
+	client  *Client
+	handle  string
+	offset  int64 // of the next read to send
+	pending []*readRequest
+	buffer  []byte
+	eof     bool
+}
+
+type readRequest struct {
+	id     uint32
+	offset int64
+	length uint32
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	for len(f.buffer) == 0 {
+		if f.eof && len(f.pending) == 0 {
+			return 0, io.EOF
+		}
+		for !f.eof && len(f.pending) < readAhead {
+			request := f.client.newRequest(packetRead)
+			request.putString(f.handle)
+			request.putUint64(uint64(f.offset))
+			request.putUint32(chunkSize)
+			if err := f.client.send(request); err != nil {
+				return 0, err
+			}
+			f.pending = append(f.pending, &readRequest{id: request.id, offset: f.offset, length: chunkSize})
+			f.offset += chunkSize
+		}
+
+		read := f.pending[0]
+		f.pending = f.pending[1:]
+		response, err := f.client.response(read.id)
+		if err != nil {
+			return 0, err
+		}
+		switch response.kind {
+		case packetStatus:
+			if err := response.status(); err != io.EOF {
+				return 0, err
+			}
+			f.eof = true
+			if err := f.drain(); err != nil {
+				return 0, err
+			}
+		case packetData:
+			data, err := response.string()
+			if err != nil {
+				return 0, err
+			}
+			f.buffer = []byte(data)
+			// a short read leaves a gap before the reads sent after it
+			if uint32(len(data)) < read.length {
+				if err := f.drain(); err != nil {
+					return 0, err
+				}
+				f.offset = read.offset + int64(len(data))
+			}
+		default:
+			return 0, unexpected(response, packetData)
+		}
+	}
+	n := copy(p, f.buffer)
+	f.buffer = f.buffer[n:]
+	return n, nil
+}
+
+// drain discards the responses to the reads in flight
+func (f *File) drain() error {
+	for _, read := range f.pending {
+		if _, err := f.client.response(read.id); err != nil {
+			return err
+		}
+	}
+	f.pending = nil
+	return nil
+}
+
+// Close discards the reads in flight and closes the handle
+func (f *File) Close() error {
+	if err := f.drain(); err != nil {
+		return err
+	}
+	return f.client.closeHandle(f.handle)
+}
+
+// packet is a packet being built, or a response being parsed. The data of a
+// packet being built starts with room for the length.
+type packet struct {
+	kind byte
+	id   uint32
+	data []byte
+}
+
+func newPacket(kind byte) *packet {
+	return &packet{kind: kind, data: []byte{0, 0, 0, 0, kind}}
+}
+
+func (p *packet) putUint32(v uint32) {
+	p.data = append(p.data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (p *packet) putUint64(v uint64) {
+	p.putUint32(uint32(v >> 32))
+	p.putUint32(uint32(v))
+}
+
+func (p *packet) putString(s string) {
+	p.putUint32(uint32(len(s)))
+	p.data = append(p.data, s...)
+}
+
+var errShortPacket = errors.New("sftp: short packet")
+
+func (p *packet) uint32() (uint32, error) {
+	if len(p.data) < 4 {
+		return 0, errShortPacket
+	}
+	v := binary.BigEndian.Uint32(p.data)
+	p.data = p.data[4:]
+	return v, nil
+}
+
+func (p *packet) uint64() (uint64, error) {
+	if len(p.data) < 8 {
+		return 0, errShortPacket
+	}
+	v := binary.BigEndian.Uint64(p.data)
+	p.data = p.data[8:]
+	return v, nil
+}
+
+func (p *packet) string() (string, error) {
+	length, err := p.uint32()
+	if err != nil {
+		return "", err
+	}
+	if uint32(len(p.data)) < length {
+		return "", errShortPacket
+	}
+	s := string(p.data[:length])
+	p.data = p.data[length:]
+	return s, nil
+}
+
+// status returns nil for StatusOK, io.EOF for StatusEOF and a *StatusError
+// otherwise
+func (p *packet) status() error {
+	code, err := p.uint32()
+	if err != nil {
+		return err
+	}
+	message, _ := p.string()
+	switch code {
+	case StatusOK:
+		return nil
+	case StatusEOF:
+		return io.EOF
+	}
+	return &StatusError{Code: code, Message: message}
+}
+
+func (p *packet) attrs() (*FileInfo, error) {
+	flags, err := p.uint32()
+	if err != nil {
+		return nil, err
+	}
+	info := &FileInfo{}
+	if flags&attrSize != 0 {
+		size, err := p.uint64()
+		if err != nil {
+			return nil, err
+		}
+		info.Size = int64(size)
+	}
+	if flags&attrUIDGID != 0 {
+		if _, err := p.uint64(); err != nil {
+			return nil, err
+		}
+	}
+	if flags&attrPermissions != 0 {
+		if info.Mode, err = p.uint32(); err != nil {
+			return nil, err
+		}
+	}
+	if flags&attrACModTime != 0 {
+		if _, err := p.uint32(); err != nil { // atime
+			return nil, err
+		}
+		mtime, err := p.uint32()
+		if err != nil {
+			return nil, err
+		}
+		info.ModTime = time.Unix(int64(mtime), 0).UTC()
+	}
+	if flags&attrExtended != 0 {
+		count, err := p.uint32()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < 2*count; i++ {
+			if _, err := p.string(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return info, nil
+}
+
+func unexpected(p *packet, expected byte) error {
+	return fmt.Errorf("sftp: expected packet type %d, got %d", expected, p.kind)
+}
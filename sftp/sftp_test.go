@@ -0,0 +1,405 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an SFTP server of the files below root, answering a single
+// connection on a local port. Reads return at most maxRead bytes when it is set, like servers
+// with small buffers do.
+type testServer struct {
+	t       *testing.T
+	root    string
+	maxRead uint32
+	handles map[string]interface{}
+}
+
+// dial starts a server and returns a client connected to it
+func (s *testServer) dial() *Client {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "gfs" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	serverConfig.AddHostKey(hostKey)
+
+	// not a net.Pipe, both ends send their version first
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		if conn, err := listener.Accept(); err == nil {
+			s.accept(conn, serverConfig)
+		}
+	}()
+
+	clientConfig := &ssh.ClientConfig{
+		User:            "gfs",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	}
+	c, err := Dial(listener.Addr().String(), clientConfig)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return c
+}
+
+func (s *testServer) accept(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for r := range channelRequests {
+				subsystem := r.Type == "subsystem" && bytes.HasSuffix(r.Payload, []byte("sftp"))
+				r.Reply(subsystem, nil)
+				if subsystem {
+					go s.serve(channel)
+				}
+			}
+		}()
+	}
+}
+
+// serve answers the requests of a session
+func (s *testServer) serve(channel ssh.Channel) {
+	defer channel.Close()
+	s.handles = make(map[string]interface{})
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(channel, header[:]); err != nil {
+			return
+		}
+		request := &packet{kind: header[4], data: make([]byte, binary.BigEndian.Uint32(header[:4])-1)}
+		if _, err := io.ReadFull(channel, request.data); err != nil {
+			return
+		}
+		response := s.handle(request)
+		binary.BigEndian.PutUint32(response.data, uint32(len(response.data)-4))
+		if _, err := channel.Write(response.data); err != nil {
+			return
+		}
+	}
+}
+
+func (s *testServer) handle(request *packet) *packet {
+	if request.kind == packetInit {
+		response := newPacket(packetVersion)
+		response.putUint32(protocolVersion)
+		return response
+	}
+	id, _ := request.uint32()
+	switch request.kind {
+	case packetOpendir:
+		path, _ := request.string()
+		infos, err := ioutil.ReadDir(s.path(path))
+		if err != nil {
+			return statusPacket(id, err)
+		}
+		self, _ := os.Stat(s.path(path))
+		return s.newHandle(id, append([]os.FileInfo{namedInfo{self, "."}, namedInfo{self, ".."}}, infos...))
+	case packetOpen:
+		path, _ := request.string()
+		file, err := os.Open(s.path(path))
+		if err != nil {
+			return statusPacket(id, err)
+		}
+		return s.newHandle(id, file)
+	case packetReaddir:
+		handle, _ := request.string()
+		infos := s.handles[handle].([]os.FileInfo)
+		if len(infos) == 0 {
+			return statusPacket(id, io.EOF)
+		}
+		// two entries per response, listings take several requests
+		count := 2
+		if len(infos) < count {
+			count = len(infos)
+		}
+		response := responsePacket(packetName, id)
+		response.putUint32(uint32(count))
+		for _, info := range infos[:count] {
+			response.putString(info.Name())
+			response.putString("-rw-r--r-- 1 gfs gfs " + info.Name())
+			putAttrs(response, info)
+		}
+		s.handles[handle] = infos[count:]
+		return response
+	case packetRead:
+		handle, _ := request.string()
+		offset, _ := request.uint64()
+		length, _ := request.uint32()
+		if s.maxRead > 0 && length > s.maxRead {
+			length = s.maxRead
+		}
+		data := make([]byte, length)
+		n, err := s.handles[handle].(*os.File).ReadAt(data, int64(offset))
+		if n == 0 {
+			return statusPacket(id, err)
+		}
+		response := responsePacket(packetData, id)
+		response.putString(string(data[:n]))
+		return response
+	case packetStat:
+		path, _ := request.string()
+		info, err := os.Stat(s.path(path))
+		if err != nil {
+			return statusPacket(id, err)
+		}
+		response := responsePacket(packetAttrs, id)
+		putAttrs(response, info)
+		return response
+	case packetClose:
+		handle, _ := request.string()
+		if file, ok := s.handles[handle].(*os.File); ok {
+			file.Close()
+		}
+		delete(s.handles, handle)
+		return statusPacket(id, nil)
+	}
+	return statusPacket(id, &StatusError{Code: 8, Message: "operation unsupported"})
+}
+
+func (s *testServer) path(path string) string {
+	return filepath.Join(s.root, filepath.Clean("/"+path))
+}
+
+func (s *testServer) newHandle(id uint32, value interface{}) *packet {
+	handle := fmt.Sprint(len(s.handles) + 1)
+	s.handles[handle] = value
+	response := responsePacket(packetHandle, id)
+	response.putString(handle)
+	return response
+}
+
+func responsePacket(kind byte, id uint32) *packet {
+	p := newPacket(kind)
+	p.putUint32(id)
+	return p
+}
+
+func statusPacket(id uint32, err error) *packet {
+	code, message := uint32(StatusOK), "Success"
+	var statusErr *StatusError
+	switch {
+	case err == io.EOF:
+		code, message = StatusEOF, "End of file"
+	case os.IsNotExist(err):
+		code, message = StatusNoSuchFile, "No such file"
+	case errors.As(err, &statusErr):
+		code, message = statusErr.Code, statusErr.Message
+	case err != nil:
+		code, message = StatusFailure, err.Error()
+	}
+	p := responsePacket(packetStatus, id)
+	p.putUint32(code)
+	p.putString(message)
+	p.putString("en")
+	return p
+}
+
+func putAttrs(p *packet, info os.FileInfo) {
+	p.putUint32(attrSize | attrPermissions | attrACModTime)
+	p.putUint64(uint64(info.Size()))
+	mode := uint32(0100644)
+	if info.IsDir() {
+		mode = 0040755
+	}
+	p.putUint32(mode)
+	p.putUint32(uint32(info.ModTime().Unix()))
+	p.putUint32(uint32(info.ModTime().Unix()))
+}
+
+// namedInfo renames a FileInfo, for the . and .. entries of listings
+type namedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i namedInfo) Name() string {
+	return i.name
+}
+
+// newTestServer returns a server of a folder gfs.20180405/06 with a file of
+// size bytes, and the content of the file
+func newTestServer(t *testing.T, size int) (*testServer, []byte) {
+	root, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := filepath.Join(root, "gfs.20180405", "06")
+	if err := os.MkdirAll(filepath.Join(folder, "atmos"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	for _, name := range []string{"gfs.t06z.pgrb2.1p00.f000", "gfs.t06z.pgrb2.1p00.f003", "gfs.t06z.pgrb2.1p00.f006"} {
+		fileName := filepath.Join(folder, name)
+		if err := ioutil.WriteFile(fileName, content, 0666); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Date(2018, 4, 5, 9, 30, 0, 0, time.UTC)
+		if err := os.Chtimes(fileName, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &testServer{t: t, root: root}, content
+}
+
+func TestReadDir(t *testing.T) {
+	server, _ := newTestServer(t, 1000)
+	defer os.RemoveAll(server.root)
+	client := server.dial()
+	defer client.Close()
+
+	entries, err := client.ReadDir("/gfs.20180405/06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("got %d entries, want 3 files and a folder without . and ..", len(entries))
+	}
+	if entries[0].Name != "atmos" || !entries[0].IsDir() || entries[0].IsRegular() {
+		t.Errorf("got folder %+v", entries[0])
+	}
+	file := entries[1]
+	if file.Name != "gfs.t06z.pgrb2.1p00.f000" || !file.IsRegular() || file.Size != 1000 || !file.ModTime.Equal(time.Date(2018, 4, 5, 9, 30, 0, 0, time.UTC)) {
+		t.Errorf("got file %+v", file)
+	}
+
+	info, err := client.Stat("/gfs.20180405/06/gfs.t06z.pgrb2.1p00.f003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 1000 || !info.IsRegular() {
+		t.Errorf("got stat %+v", info)
+	}
+}
+
+func TestReadFromOffset(t *testing.T) {
+	size := 5*chunkSize + 123
+	for _, maxRead := range []uint32{0, 1000} {
+		server, content := newTestServer(t, size)
+		server.maxRead = maxRead
+		client := server.dial()
+
+		for _, offset := range []int64{0, chunkSize - 1, 3*chunkSize + 17, int64(size)} {
+			file, err := client.Open("/gfs.20180405/06/gfs.t06z.pgrb2.1p00.f000", offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			read, err := ioutil.ReadAll(file)
+			if err != nil {
+				t.Fatalf("max read %d, offset %d: %v", maxRead, offset, err)
+			}
+			if !bytes.Equal(read, content[offset:]) {
+				t.Errorf("max read %d, offset %d: read %d bytes, not the %d from the offset", maxRead, offset, len(read), size-int(offset))
+			}
+			if err := file.Close(); err != nil {
+				t.Errorf("max read %d, offset %d: close: %v", maxRead, offset, err)
+			}
+		}
+
+		// a file closed before it is read to the end
+		file, err := client.Open("/gfs.20180405/06/gfs.t06z.pgrb2.1p00.f003", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(file, make([]byte, 10)); err != nil {
+			t.Fatal(err)
+		}
+		if err := file.Close(); err != nil {
+			t.Errorf("max read %d: close of a partly read file: %v", maxRead, err)
+		}
+		if _, err := client.Stat("/gfs.20180405/06"); err != nil {
+			t.Errorf("max read %d: session unusable after close: %v", maxRead, err)
+		}
+
+		client.Close()
+		os.RemoveAll(server.root)
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	server, _ := newTestServer(t, 10)
+	defer os.RemoveAll(server.root)
+	client := server.dial()
+	defer client.Close()
+
+	isNoSuchFile := func(err error) bool {
+		var statusErr *StatusError
+		return errors.As(err, &statusErr) && statusErr.Code == StatusNoSuchFile
+	}
+	if _, err := client.ReadDir("/gfs.20180406/00"); !isNoSuchFile(err) {
+		t.Errorf("ReadDir of a missing folder: got %v", err)
+	}
+	if _, err := client.Open("/gfs.20180405/06/gfs.t06z.pgrb2.1p00.f384", 0); !isNoSuchFile(err) {
+		t.Errorf("Open of a missing file: got %v", err)
+	}
+	if _, err := client.Stat("/gfs.20180405/06/gfs.t06z.pgrb2.1p00.f384"); !isNoSuchFile(err) {
+		t.Errorf("Stat of a missing file: got %v", err)
+	}
+
+	// the failures leave the session usable
+	if _, err := client.ReadDir("/gfs.20180405/06"); err != nil {
+		t.Errorf("ReadDir after failures: %v", err)
+	}
+}
+
+func TestStatusOfPacket(t *testing.T) {
+	for code, want := range map[uint32]error{
+		StatusOK:               nil,
+		StatusEOF:              io.EOF,
+		StatusPermissionDenied: &StatusError{Code: StatusPermissionDenied, Message: "denied"},
+	} {
+		p := statusPacket(1, &StatusError{Code: code, Message: "denied"})
+		p.data = p.data[9:] // after the length, type and id
+		err := p.status()
+		if fmt.Sprint(err) != fmt.Sprint(want) {
+			t.Errorf("status %d: got %v, want %v", code, err, want)
+		}
+	}
+	if _, err := (&packet{data: []byte{0, 0}}).uint32(); err != errShortPacket {
+		t.Errorf("short packet: got %v", err)
+	}
+	if _, err := (&packet{data: []byte{0, 0, 0, 9, 'a'}}).string(); err != errShortPacket {
+		t.Errorf("string longer than the packet: got %v", err)
+	}
+}
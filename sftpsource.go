@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/nilsmagnus/ftplistener/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpSource is an SSH server with the SFTP subsystem, each listing and
+// download has a connection of its own like on FTP servers. The host key must
+// be in the known_hosts file.
+type sftpSource struct {
+	addr   string
+	config *ssh.ClientConfig
+}
+
+// newSFTPSource returns the source of an sftp://host URL, on port 22 unless
+// given. The user authenticates with the private key file if set, and with the
+// password if not empty.
+func newSFTPSource(u *url.URL, user, password, keyFile, knownHostsFile string) (*sftpSource, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []ssh.AuthMethod
+	if keyFile != "" {
+		pem, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("sftp needs a -sshKey or a password to authenticate")
+	}
+
+	return &sftpSource{addr: addr, config: &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         15 * time.Second,
+	}}, nil
+}
+
+func (s *sftpSource) list(folder string, keep func(*ftp.Entry) bool) ([]*ftp.Entry, error) {
+	client, err := sftp.Dial(s.addr, s.config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	infos, err := client.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]*ftp.Entry, 0)
+	for _, info := range infos {
+		e := &ftp.Entry{Name: info.Name, Time: info.ModTime}
+		switch {
+		case info.IsDir():
+			e.Type = ftp.EntryTypeFolder
+		case info.IsRegular():
+			e.Type = ftp.EntryTypeFile
+			e.Size = uint64(info.Size)
+		default:
+			e.Type = ftp.EntryTypeLink
+		}
+		if keep == nil || keep(e) {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
+
+func (s *sftpSource) open(folder string) (sourceFolder, error) {
+	client, err := sftp.Dial(s.addr, s.config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Stat(folder); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &sftpFolder{client: client, dir: folder, url: "sftp://" + s.addr + path.Join("/", folder)}, nil
+}
+
+// sftpFolder is a connection downloading the files of a folder
+type sftpFolder struct {
+	client *sftp.Client
+	dir    string
+	url    string
+}
+
+// modTime is the mtime of the listing, which has seconds
+func (f *sftpFolder) modTime(entry *ftp.Entry) time.Time {
+	return entry.Time
+}
+
+func (f *sftpFolder) retrieve(name string, offset int64) (io.ReadCloser, int64, error) {
+	file, err := f.client.Open(path.Join(f.dir, name), offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return file, offset, nil
+}
+
+func (f *sftpFolder) hashAlgorithm() string {
+	return ""
+}
+
+func (f *sftpFolder) hash(name string) (string, string, error) {
+	return "", "", errNoServerHash
+}
+
+func (f *sftpFolder) location(name string) string {
+	return f.url + "/" + name
+}
+
+func (f *sftpFolder) close() error {
+	return f.client.Close()
+}
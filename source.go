@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/nilsmagnus/ftplistener/proxy"
+	"github.com/nilsmagnus/ftplistener/s3"
+	"github.com/nilsmagnus/ftplistener/sftp"
+)
+
+// source is a mirror the cycle folders are listed on and downloaded from. Its
+// entries are described as ftp entries whatever the protocol.
+type source interface {
+	// list returns the entries of a folder that keep accepts, all entries when
+	// keep is nil
+	list(folder string, keep func(*ftp.Entry) bool) ([]*ftp.Entry, error)
+	// open starts a session for downloading the files of a folder
+	open(folder string) (sourceFolder, error)
+}
+
+// sourceFolder downloads the files of a folder of a source
+type sourceFolder interface {
+	// modTime returns the modification time of an entry on the server
+	modTime(entry *ftp.Entry) time.Time
+	// retrieve returns the content of a file from an offset, and the offset the
+	// content actually starts at since not every server resumes transfers
+	retrieve(name string, offset int64) (io.ReadCloser, int64, error)
+	// hashAlgorithm returns the checksum algorithm of the server if we can
+	// compute it locally, or an empty string
+	hashAlgorithm() string
+	// hash returns the algorithm and checksum of a file computed by the server
+	hash(name string) (string, string, error)
+	// location returns the URL of a file, recorded as the provenance of downloads
+	location(name string) string
+	close() error
+}
+
+// statSource is a source whose listings may round sizes and times, stat sets
+// the exact ones of a file entry of a folder
+type statSource interface {
+	stat(folder string, e *ftp.Entry) error
+}
+
+// errNotFound is returned for files and folders missing on a server
+var errNotFound = errors.New("not found")
+
+// isNotFound reports whether an error of a source is about a missing file or
+// folder, rather than a failure of the source
+func isNotFound(err error) bool {
+	if errors.Is(err, errNotFound) || errors.Is(err, errNotFiltered) {
+		return true
+	}
+	var storeErr *s3.Error
+	if errors.As(err, &storeErr) {
+		return storeErr.StatusCode == http.StatusNotFound
+	}
+	var sftpErr *sftp.StatusError
+	if errors.As(err, &sftpErr) {
+		return sftpErr.Code == sftp.StatusNoSuchFile
+	}
+	var ftpErr *textproto.Error
+	if errors.As(err, &ftpErr) {
+		return ftpErr.Code == ftp.StatusFileUnavailable
+	}
+	return false
+}
+
+// sourceConfig are the settings of the source given by the -host flag
+type sourceConfig struct {
+	host       string
+	port       string
+	user       string
+	password   string
+	baseDir    string
+	filter     gribFilter
+	tls        *tls.Config
+	sshKey     string
+	knownHosts string
+	ftpMode    string
+	active     ftp.ActiveMode
+	proxy      string
+}
+
+// Data connection modes of FTP hosts, see sourceConfig
+const (
+	ftpPassive = "passive"
+	ftpActive  = "active"
+)
+
+// parsePortRange parses a range of ports like 50000-50100, an empty range is
+// any free port
+func parsePortRange(value string) (int, int, error) {
+	if value == "" {
+		return 0, 0, nil
+	}
+	bounds := strings.SplitN(value, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %q, expected e.g. 50000-50100", value)
+	}
+	min, minErr := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	max, maxErr := strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if minErr != nil || maxErr != nil || min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %q, expected e.g. 50000-50100", value)
+	}
+	return min, max, nil
+}
+
+// newTLSConfig returns the TLS settings of FTPS hosts: the CA bundle trusted
+// besides the system roots, and the client certificate if the server asks
+// for one.
+func newTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if config.RootCAs, err = x509.SystemCertPool(); err != nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("a client certificate needs both -tlsCert and -tlsKey")
+		}
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// newSource returns the source of the -host flag: an FTP server for a host
+// name, or the server of an ftp://, ftps://, ftpes://, sftp://, http://,
+// https:// or s3:// URL. ftps is FTP over TLS from the start, on port 990
+// unless given, ftpes upgrades the connection with AUTH TLS. An http(s) URL of a
+// grib filter script downloads through the filter. FTP hosts open data
+// connections in active mode if the ftpMode is active, and are reached through
+// the proxy if set or given by the environment.
+func newSource(config sourceConfig) (source, error) {
+	u := &url.URL{Scheme: "ftp", Host: config.host}
+	if strings.Contains(config.host, "://") {
+		var err error
+		if u, err = url.Parse(config.host); err != nil {
+			return nil, err
+		}
+	}
+	switch u.Scheme {
+	case "ftp", "ftps", "ftpes":
+		user, password := config.user, config.password
+		if u.Port() == "" {
+			port := config.port
+			if u.Scheme == "ftps" {
+				port = "990"
+			}
+			u.Host = fmt.Sprintf("%s:%s", u.Host, port)
+		}
+		if u.User != nil {
+			user = u.User.Username()
+			password, _ = u.User.Password()
+		}
+		var options []ftp.DialOption
+		switch u.Scheme {
+		case "ftps":
+			options = append(options, ftp.DialWithTLS(config.tls))
+		case "ftpes":
+			options = append(options, ftp.DialWithExplicitTLS(config.tls))
+		}
+		if config.ftpMode == ftpActive {
+			options = append(options, ftp.DialWithActiveMode(config.active))
+		}
+		proxyURL := config.proxy
+		if proxyURL == "" {
+			proxyURL = proxy.FromEnvironment("ftp", u.Host)
+		}
+		if proxyURL != "" {
+			if config.ftpMode == ftpActive {
+				return nil, fmt.Errorf("host %s: active mode does not work through a proxy", u.Host)
+			}
+			dialer, err := proxy.New(proxyURL, 15*time.Second)
+			if err != nil {
+				return nil, err
+			}
+			log.Println("Connecting through proxy", "host", u.Host, "proxy", dialer.URL.Redacted())
+			options = append(options, ftp.DialWithDialFunc(dialer.Dial))
+		}
+		return newFTPSource(u.Scheme, u.Host, user, password, options...), nil
+	case "sftp":
+		user, password := config.user, config.password
+		if u.User != nil {
+			user = u.User.Username()
+			password, _ = u.User.Password()
+		}
+		return newSFTPSource(u, user, password, config.sshKey, config.knownHosts)
+	case "http", "https":
+		if filterScript.MatchString(u.Path) {
+			return newFilterSource(u, config.baseDir, config.filter), nil
+		}
+		src := newHTTPSource(u)
+		if strings.HasSuffix(u.Hostname(), nomadsHost) {
+			src.limiter = newRateLimiter(config.filter.perMinute)
+		}
+		return src, nil
+	case "s3":
+		return newS3Source(config.host)
+	}
+	return nil, fmt.Errorf("unsupported host %q, expected a host name or an ftp, ftps, ftpes, sftp, http, https or s3 URL", config.host)
+}
+
+// ftpSource is an FTP server, each listing and download has a connection of its own
+type ftpSource struct {
+	scheme      string
+	credentials map[string]string
+	options     []ftp.DialOption
+}
+
+func newFTPSource(scheme, host, user, password string, options ...ftp.DialOption) *ftpSource {
+	return &ftpSource{
+		scheme: scheme,
+		credentials: map[string]string{
+			"user":     user,
+			"password": password,
+			"host":     host,
+		},
+		options: options,
+	}
+}
+
+func (s *ftpSource) list(folder string, keep func(*ftp.Entry) bool) ([]*ftp.Entry, error) {
+	conn, conErr := ftpConnect(s.credentials, s.options...)
+	if conErr != nil {
+		return nil, conErr
+	}
+	defer conn.Quit()
+
+	list, err := conn.List(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make([]*ftp.Entry, 0)
+	for _, e := range list {
+		if keep == nil || keep(e) {
+			kept = append(kept, e)
+		}
+	}
+
+	// LIST times have no seconds and no year for recent files, ask for each file instead
+	if !conn.IsTimePreciseInList() && conn.IsGetTimeSupported() {
+		for _, e := range kept {
+			if e.Type != ftp.EntryTypeFile {
+				continue
+			}
+			if modTime, err := conn.GetTime(folder + "/" + e.Name); err == nil {
+				e.Time = modTime
+			}
+		}
+	}
+	return kept, nil
+}
+
+func (s *ftpSource) open(folder string) (sourceFolder, error) {
+	conn, err := ftpConnect(s.credentials, s.options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.ChangeDir(folder); err != nil {
+		conn.Logout()
+		return nil, err
+	}
+	return &ftpFolder{conn: conn, url: s.scheme + "://" + s.credentials["host"] + path.Join("/", folder)}, nil
+}
+
+// ftpFolder is a connection changed to the folder of the files to download
+type ftpFolder struct {
+	conn *ftp.ServerConn
+	url  string
+}
+
+// modTime prefers MDTM when available since LIST times lack seconds and
+// sometimes the year.
+func (f *ftpFolder) modTime(entry *ftp.Entry) time.Time {
+	if f.conn.IsGetTimeSupported() {
+		if modTime, err := f.conn.GetTime(entry.Name); err == nil {
+			return modTime
+		}
+	}
+	return entry.Time
+}
+
+// retrieve restarts from the beginning when the server refuses REST
+func (f *ftpFolder) retrieve(name string, offset int64) (io.ReadCloser, int64, error) {
+	if offset > 0 {
+		response, err := f.conn.RetrFrom(name, uint64(offset))
+		if err == nil {
+			return response, offset, nil
+		}
+		log.Println("Resume refused, downloading from the start", "entry", name, "error", err.Error())
+	}
+	response, err := f.conn.Retr(name)
+	return response, 0, err
+}
+
+func (f *ftpFolder) hashAlgorithm() string {
+	switch algorithm := f.conn.HashAlgorithm(); algorithm {
+	case ftp.HashSHA256, ftp.HashSHA1, ftp.HashMD5, ftp.HashCRC32:
+		return algorithm
+	}
+	return ""
+}
+
+func (f *ftpFolder) hash(name string) (string, string, error) {
+	return f.conn.Hash(name)
+}
+
+func (f *ftpFolder) location(name string) string {
+	return f.url + "/" + name
+}
+
+func (f *ftpFolder) close() error {
+	return f.conn.Logout()
+}
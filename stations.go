@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+const (
+	stationsFolderName = "stations"
+	stationsFormatCSV  = "csv"
+	stationsFormatJSON = "jsonl"
+)
+
+// stationConfig configures the station time series written for complete cycles:
+//
+//	{
+//	  "variables": ["TMP:2m", "UGRD:10m", "VGRD:10m"],
+//	  "interpolation": "bilinear",
+//	  "format": "csv",
+//	  "stations": [{"id": "ENGM", "name": "Oslo Gardermoen", "lat": 60.19, "lon": 11.1}]
+//	}
+type stationConfig struct {
+	Variables     []string  `json:"variables"`
+	Interpolation string    `json:"interpolation"`
+	Format        string    `json:"format"`
+	Stations      []station `json:"stations"`
+
+	selectors []fieldSelector
+}
+
+type station struct {
+	ID   string  `json:"id"`
+	Name string  `json:"name"`
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+}
+
+// stationsGrid returns the grid of the files the stations are read from, the GFS
+// grid cropped to the areas that are given
+func stationsGrid(areas ...*grib2.BoundingBox) (*grib2.Grid, error) {
+	grid := gfsGrid
+	for _, area := range areas {
+		if area == nil {
+			continue
+		}
+		cropped, _, err := grid.Crop(make([]float64, grid.Points()), *area)
+		if err != nil {
+			return nil, err
+		}
+		grid = cropped
+	}
+	return grid, nil
+}
+
+// readStationConfig reads and checks a station configuration file, the stations
+// must be inside the grid they are read from
+func readStationConfig(fileName string, grid *grib2.Grid) (*stationConfig, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	config := &stationConfig{}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	if len(config.Variables) == 0 || len(config.Stations) == 0 {
+		return nil, fmt.Errorf("%s: variables and stations are required", fileName)
+	}
+	if config.selectors, err = parsePointVariables(strings.Join(config.Variables, ",")); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	if config.Interpolation == "" {
+		config.Interpolation = interpolationBilinear
+	}
+	if config.Interpolation != interpolationNearest && config.Interpolation != interpolationBilinear {
+		return nil, fmt.Errorf("%s: interpolation must be nearest or bilinear", fileName)
+	}
+	if config.Format == "" {
+		config.Format = stationsFormatCSV
+	}
+	if config.Format != stationsFormatCSV && config.Format != stationsFormatJSON {
+		return nil, fmt.Errorf("%s: format must be csv or jsonl", fileName)
+	}
+	ids := make(map[string]bool)
+	for _, s := range config.Stations {
+		if s.ID == "" || ids[safeName(s.ID)] {
+			return nil, fmt.Errorf("%s: station ids must be given and unique, %q is not", fileName, s.ID)
+		}
+		if s.Lat < -90 || s.Lat > 90 {
+			return nil, fmt.Errorf("%s: station %s has latitude %g", fileName, s.ID, s.Lat)
+		}
+		if !grid.Contains(s.Lat, s.Lon) {
+			return nil, fmt.Errorf("%s: station %s at %g, %g is outside the area of the downloaded files", fileName, s.ID, s.Lat, s.Lon)
+		}
+		ids[safeName(s.ID)] = true
+	}
+	return config, nil
+}
+
+// stationFileName returns the file of a station below the stations folder of a cycle
+func (c *stationConfig) stationFileName(cycleFolder string, s station) string {
+	return filepath.Join(cycleFolder, stationsFolderName, safeName(s.ID)+"."+c.Format)
+}
+
+// extractDownloadedCycle writes the station time series of a complete cycle and
+// returns the written files. It returns nothing if nothing was downloaded and the
+// files already exist.
+func extractDownloadedCycle(destinationFolder, subDir string, downloaded int, options downloadOptions) ([]string, error) {
+	sourceFolder := cycleSourceFolder(destinationFolder, subDir, options)
+	cycleFolder := filepath.Join(destinationFolder, subDir)
+	if _, err := os.Stat(options.stations.stationFileName(cycleFolder, options.stations.Stations[0])); downloaded == 0 && err == nil {
+		return nil, nil
+	}
+
+	log.Println("Extracting stations", "cycle", sourceFolder, "stations", len(options.stations.Stations))
+	return writeStations(sourceFolder, cycleFolder, subDir, options.stations)
+}
+
+// writeStations interpolates the configured variables of all files of a folder
+// at every station and writes a file per station. Each field is decoded once.
+// Stations outside the grid of the cycle are logged and their values missing.
+func writeStations(folder, cycleFolder, subDir string, config *stationConfig) ([]string, error) {
+	cycle, err := readCycleFields(folder, config.selectors)
+	if err != nil {
+		return nil, err
+	}
+	referenceTime, err := cycleTime(subDir)
+	if err != nil {
+		return nil, err
+	}
+
+	forecasts := make([]*pointForecast, len(config.Stations))
+	for n, s := range config.Stations {
+		forecasts[n] = &pointForecast{
+			Cycle:         subDir,
+			ReferenceTime: referenceTime,
+			Lat:           s.Lat,
+			Lon:           s.Lon,
+			Interpolation: config.Interpolation,
+			Hours:         make([]int, len(cycle.files)),
+			Times:         make([]time.Time, len(cycle.files)),
+			Variables:     make([]pointSeries, len(config.selectors)),
+		}
+		for i, selector := range config.selectors {
+			forecasts[n].Variables[i] = pointSeries{
+				Name:   strings.TrimSpace(config.Variables[i]),
+				Field:  selector.String(),
+				Values: make([]*float64, len(cycle.files)),
+			}
+		}
+		for k, hour := range cycle.hours {
+			forecasts[n].Hours[k] = int(hour)
+			forecasts[n].Times[k] = referenceTime.Add(time.Duration(hour) * time.Hour)
+		}
+	}
+
+	inside := make([]bool, len(config.Stations))
+	for n, s := range config.Stations {
+		if inside[n] = cycle.grid.Contains(s.Lat, s.Lon); !inside[n] {
+			log.Println("Station outside the grid, its values are missing", "cycle", subDir, "station", s.ID, "lat", s.Lat, "lon", s.Lon)
+		}
+	}
+
+	for k, gribFile := range cycle.files {
+		if err := interpolateStations(gribFile, k, cycle, config, inside, forecasts); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(cycleFolder, stationsFolderName), 0777); err != nil {
+		return nil, err
+	}
+	fileNames := make([]string, len(config.Stations))
+	for n, s := range config.Stations {
+		fileNames[n] = config.stationFileName(cycleFolder, s)
+		if err := writeStationFile(fileNames[n], config.Format, forecasts[n]); err != nil {
+			return nil, err
+		}
+	}
+	return fileNames, nil
+}
+
+// interpolateStations decodes the fields of one file and interpolates them at
+// every station inside the grid, record is the index of the file in the cycle.
+func interpolateStations(gribFile string, record int, cycle *cycleFields, config *stationConfig, inside []bool, forecasts []*pointForecast) error {
+	file, err := os.Open(gribFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for i, selector := range config.selectors {
+		v := cycle.variable(selector)
+		if v == nil || v.fields[record] == nil {
+			continue
+		}
+		values, err := v.fields[record].Values(file)
+		if err != nil {
+			return err
+		}
+		for n, s := range config.Stations {
+			forecasts[n].Variables[i].Units = v.units
+			if !inside[n] {
+				continue
+			}
+			value, err := interpolate(cycle.grid, values, s.Lat, s.Lon, config.Interpolation)
+			if err != nil {
+				return fmt.Errorf("station %s: %v", s.ID, err)
+			}
+			if !math.IsNaN(value) {
+				forecasts[n].Variables[i].Values[record] = &value
+			}
+		}
+	}
+	return nil
+}
+
+// writeStationFile writes a station time series through a temporary file
+func writeStationFile(fileName, format string, forecast *pointForecast) error {
+	temporary := fileName + ".tmp"
+	out, err := os.Create(temporary)
+	if err != nil {
+		return err
+	}
+	if format == stationsFormatJSON {
+		err = writePointJSONLines(out, forecast)
+	} else {
+		err = writePointCSV(out, forecast)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return os.Rename(temporary, fileName)
+}
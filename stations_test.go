@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+func TestReadStationConfig(t *testing.T) {
+	folder, err := ioutil.TempDir("", "stations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	fileName := filepath.Join(folder, "stations.json")
+
+	grid, err := stationsGrid(&grib2.BoundingBox{South: 54, West: -10, North: 72, East: 35}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		stations string
+		valid    bool
+	}{
+		{`[{"id": "ENGM", "lat": 60.19, "lon": 11.1}, {"id": "EGLL", "lat": 54.5, "lon": 359.5}]`, true},
+		{`[{"id": "ENGM", "lat": 60.19, "lon": 11.1}, {"id": "LFPG", "lat": 49.01, "lon": 2.55}]`, false},
+		{`[{"id": "ENGM", "lat": 60.19, "lon": 11.1}, {"id": "ENGM", "lat": 60.19, "lon": 11.1}]`, false},
+	}
+	for _, test := range tests {
+		content := `{"variables": ["TMP:2m"], "stations": ` + test.stations + `}`
+		if err := ioutil.WriteFile(fileName, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		config, err := readStationConfig(fileName, grid)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v", test.stations, err)
+		}
+		if err == nil && (config.Interpolation != interpolationBilinear || config.Format != stationsFormatCSV) {
+			t.Errorf("got defaults %s and %s", config.Interpolation, config.Format)
+		}
+	}
+}
+
+func TestWriteStationsOutsideGrid(t *testing.T) {
+	destination, err := ioutil.TempDir("", "stations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	// a cycle of 60N to 40N and 0E to 40E
+	grid := grib2.Grid{Ni: 5, Nj: 3, La1: 60, Lo1: 0, La2: 40, Lo2: 40, Di: 10, Dj: 10, ScanningMode: grib2.ScanNorthToSouth}
+	for _, hour := range []int{0, 3} {
+		testCycleFile(t, destination, testReferenceTime, hour, grid, tmp2m(fill(grid, func(lat, lon float64) float64 {
+			return 250 + lat + lon/10 + float64(hour)
+		})))
+	}
+	selectors, err := parsePointVariables("TMP:2m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &stationConfig{
+		Variables:     []string{"TMP:2m"},
+		Interpolation: interpolationNearest,
+		Format:        stationsFormatCSV,
+		Stations:      []station{{ID: "ENGM", Lat: 60, Lon: 10}, {ID: "FACT", Lat: -33.97, Lon: 18.6}},
+		selectors:     selectors,
+	}
+
+	cycleFolder := filepath.Join(destination, "gfs.20180405/06")
+	fileNames, err := writeStations(cycleFolder, cycleFolder, "gfs.20180405/06", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fileNames) != 2 {
+		t.Fatalf("got files %v", fileNames)
+	}
+	for n, want := range []string{
+		"time,hour,TMP:2m\n2018-04-05T06:00:00Z,0,311\n2018-04-05T09:00:00Z,3,314\n",
+		"time,hour,TMP:2m\n2018-04-05T06:00:00Z,0,\n2018-04-05T09:00:00Z,3,\n",
+	} {
+		content, err := ioutil.ReadFile(fileNames[n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Replace(string(content), "\r\n", "\n", -1); got != want {
+			t.Errorf("station %s: got\n%s\nwant\n%s", config.Stations[n].ID, got, want)
+		}
+	}
+}
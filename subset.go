@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nilsmagnus/ftplistener/grib2"
+)
+
+const subsetManifestFileName = "subsets.json"
+
+// fieldSelector matches fields by parameter and level, e.g. "TMP:2 m above ground"
+type fieldSelector struct {
+	parameter string
+	level     string
+}
+
+func parseSelectors(list string) ([]fieldSelector, error) {
+	selectors := make([]fieldSelector, 0)
+	for _, s := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid variable %q, expected PARAMETER:level like TMP:2 m above ground", s)
+		}
+		selectors = append(selectors, fieldSelector{parameter: parts[0], level: parts[1]})
+	}
+	return selectors, nil
+}
+
+// parseOptionalSelectors parses a list of selectors, an empty list selects all fields
+func parseOptionalSelectors(list string) ([]fieldSelector, error) {
+	if list == "" {
+		return nil, nil
+	}
+	return parseSelectors(list)
+}
+
+func (s fieldSelector) matches(f *grib2.Field) bool {
+	return f.Parameter() == s.parameter && f.Product.Level() == s.level
+}
+
+func (s fieldSelector) String() string {
+	return s.parameter + ":" + s.level
+}
+
+// name turns a selector into a name usable in files, e.g. TMP_2_m_above_ground
+func (s fieldSelector) name() string {
+	return safeName(s.String())
+}
+
+// safeName replaces the characters of a value that are not safe in file names
+func safeName(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, value)
+}
+
+// hourRange is an inclusive range of forecast hours, e.g. "0-48"
+type hourRange struct {
+	from, to int
+}
+
+var allHours = hourRange{0, int(^uint(0) >> 1)}
+
+func parseHourRange(value string) (hourRange, error) {
+	if value == "" {
+		return allHours, nil
+	}
+	parts := strings.SplitN(value, "-", 2)
+	from, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return hourRange{}, fmt.Errorf("invalid hours %q: %v", value, err)
+	}
+	to := from
+	if len(parts) == 2 {
+		if to, err = strconv.Atoi(parts[1]); err != nil {
+			return hourRange{}, fmt.Errorf("invalid hours %q: %v", value, err)
+		}
+	}
+	return hourRange{from, to}, nil
+}
+
+func (h hourRange) contains(hour int) bool {
+	return hour >= h.from && hour <= h.to
+}
+
+// subsetFile is an entry of the subset manifest, listing where each message of
+// a subset file was copied from.
+type subsetFile struct {
+	File     string          `json:"file"`
+	Variable string          `json:"variable"`
+	Messages []subsetMessage `json:"messages"`
+}
+
+type subsetMessage struct {
+	Source string `json:"source"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Field  string `json:"field"`
+}
+
+// subsetCommand copies the messages of the selected variables from all files of
+// a cycle into one file per variable, and returns the process exit code.
+func subsetCommand(args []string) int {
+	flags := flag.NewFlagSet("subset", flag.ExitOnError)
+	cycleFolder := flags.String("cycle", "", "folder of the downloaded cycle, e.g. gribfiles/gfs.20180405/06")
+	variables := flags.String("vars", "", "comma separated variables to extract, e.g. \"TMP:2 m above ground,UGRD:10 m above ground\"")
+	hours := flags.String("hours", "", "forecast hours to extract, e.g. 0-48, accumulations by the end of their interval (default all)")
+	output := flags.String("output", "", "folder for the subset files (default <cycle>/subset)")
+	flags.Parse(args)
+
+	if *cycleFolder == "" || *variables == "" {
+		flags.Usage()
+		return 2
+	}
+	selectors, err := parseSelectors(*variables)
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+	hourRange, err := parseHourRange(*hours)
+	if err != nil {
+		log.Println(err.Error())
+		return 2
+	}
+	if *output == "" {
+		*output = filepath.Join(*cycleFolder, "subset")
+	}
+
+	subsets, err := writeSubsets(*cycleFolder, *output, selectors, hourRange)
+	if err != nil {
+		log.Println("Failed to subset", "cycle", *cycleFolder, "error", err.Error())
+		return 1
+	}
+	for _, s := range subsets {
+		log.Printf("Wrote %d messages of %s to %s\n", len(s.Messages), s.Variable, filepath.Join(*output, s.File))
+	}
+	return 0
+}
+
+// writeSubsets writes a file per selector in the output folder with the matching
+// messages of all GRIB2 files of the cycle folder, and a manifest of the copied messages.
+// Fields are selected by their forecast hour, the end of the interval of statistically
+// processed fields, e.g. 0-6 hour acc fcst is selected by hours 0-6 and not by 0-3.
+func writeSubsets(cycleFolder, output string, selectors []fieldSelector, hours hourRange) ([]*subsetFile, error) {
+	fileNames, err := cycleGribFiles(cycleFolder)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(output, 0777); err != nil {
+		return nil, err
+	}
+
+	subsets := make([]*subsetFile, len(selectors))
+	outputs := make([]*os.File, len(selectors))
+	for i, s := range selectors {
+		subsets[i] = &subsetFile{
+			File:     subsetFileName(s),
+			Variable: s.String(),
+			Messages: make([]subsetMessage, 0),
+		}
+		if outputs[i], err = os.Create(filepath.Join(output, subsets[i].File)); err != nil {
+			closeAll(outputs)
+			return nil, err
+		}
+	}
+	defer closeAll(outputs)
+
+	for _, fileName := range fileNames {
+		if err := subsetGribFile(fileName, selectors, hours, subsets, outputs); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range outputs {
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := json.MarshalIndent(subsets, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return subsets, ioutil.WriteFile(filepath.Join(output, subsetManifestFileName), manifest, 0666)
+}
+
+func subsetGribFile(fileName string, selectors []fieldSelector, hours hourRange, subsets []*subsetFile, outputs []*os.File) error {
+	file, err := grib2.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fields, err := file.Fields()
+	if err != nil {
+		return err
+	}
+
+	for i, s := range selectors {
+		var last *grib2.Message
+		for _, f := range fields {
+			// a message is copied whole, once, even if several of its fields match
+			if f.Message == last || !s.matches(f) || !hours.contains(f.Product.ForecastHours()) {
+				continue
+			}
+			if err := grib2.CopyMessage(outputs[i], file, f.Message); err != nil {
+				return err
+			}
+			last = f.Message
+			subsets[i].Messages = append(subsets[i].Messages, subsetMessage{
+				Source: fileName,
+				Offset: f.Message.Offset,
+				Length: f.Message.Length,
+				Field:  fmt.Sprintf("%s:%s:%s", f.Parameter(), f.Product.Level(), f.Product.Forecast()),
+			})
+		}
+	}
+	return nil
+}
+
+// subsetFileName turns a selector into a file name, e.g. TMP_2_m_above_ground.grib2
+func subsetFileName(s fieldSelector) string {
+	return s.name() + ".grib2"
+}
+
+// cycleGribFiles returns the downloaded GRIB2 files of a cycle folder, sorted by name
+// and hence by forecast hour.
+func cycleGribFiles(cycleFolder string) ([]string, error) {
+	infos, err := ioutil.ReadDir(cycleFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	fileNames := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.Mode().IsRegular() && gfsFileName.MatchString(info.Name()) &&
+			!strings.HasSuffix(info.Name(), ".idx") && !strings.HasSuffix(info.Name(), ".tmp") {
+			fileNames = append(fileNames, filepath.Join(cycleFolder, info.Name()))
+		}
+	}
+	sort.Strings(fileNames)
+	return fileNames, nil
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseHourRange(t *testing.T) {
+	tests := []struct {
+		value string
+		want  hourRange
+	}{
+		{"", allHours},
+		{"0-48", hourRange{0, 48}},
+		{"6", hourRange{6, 6}},
+	}
+	for _, test := range tests {
+		if got, err := parseHourRange(test.value); err != nil || got != test.want {
+			t.Errorf("%q: got %v, %v, want %v", test.value, got, err, test.want)
+		}
+	}
+	for _, invalid := range []string{"a", "0-", "-6"} {
+		if _, err := parseHourRange(invalid); err == nil {
+			t.Errorf("hours %q accepted", invalid)
+		}
+	}
+	if _, err := parseSelectors("TMP:2 m above ground,UGRD"); err == nil {
+		t.Error("variable without level accepted")
+	}
+}
+
+func TestWriteSubsets(t *testing.T) {
+	folder, err := ioutil.TempDir("", "subset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	values := make([]float64, testGlobalGrid.Points())
+	apcp := func(hours int) testField {
+		return testField{category: 1, number: 8, surface: 1, accumulated: hours, values: values}
+	}
+	tmp := tmp2m(values)
+	// GFS accumulates from the start of the run up to hour 6, then from hour 6 on
+	fields := map[int][]testField{
+		0: {tmp},
+		3: {tmp, apcp(3)},
+		6: {tmp, apcp(6)},
+		9: {tmp, apcp(3)},
+	}
+	var cycleFolder string
+	content := make(map[int][]byte)
+	for _, hour := range []int{0, 3, 6, 9} {
+		fileName := testCycleFile(t, folder, testReferenceTime, hour, testGlobalGrid, fields[hour]...)
+		cycleFolder = filepath.Dir(fileName)
+		content[hour] = testGRIB(testReferenceTime, hour, testGlobalGrid, fields[hour]...)
+	}
+	output := filepath.Join(cycleFolder, "subset")
+
+	selectors := []fieldSelector{{"TMP", "2 m above ground"}, {"APCP", "surface"}}
+	subsets, err := writeSubsets(cycleFolder, output, selectors, hourRange{0, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// accumulations are selected by the end of their interval
+	wantFields := [][]string{
+		{"TMP:2 m above ground:anl", "TMP:2 m above ground:3 hour fcst", "TMP:2 m above ground:6 hour fcst"},
+		{"APCP:surface:0-3 hour acc fcst", "APCP:surface:0-6 hour acc fcst"},
+	}
+	wantHours := [][]int{{0, 3, 6}, {3, 6}}
+	for i, s := range subsets {
+		got := make([]string, 0)
+		var want bytes.Buffer
+		for k, m := range s.Messages {
+			got = append(got, m.Field)
+			if m.Source != testCycleFile(t, folder, testReferenceTime, wantHours[i][k], testGlobalGrid) {
+				t.Errorf("%s: got message of %s", s.Variable, m.Source)
+			}
+			want.Write(content[wantHours[i][k]][m.Offset : m.Offset+m.Length])
+		}
+		if strings.Join(got, ",") != strings.Join(wantFields[i], ",") {
+			t.Errorf("%s: got fields %v, want %v", s.Variable, got, wantFields[i])
+		}
+		written, err := ioutil.ReadFile(filepath.Join(output, s.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(written, want.Bytes()) {
+			t.Errorf("%s: the subset file is not a copy of its messages", s.File)
+		}
+	}
+
+	manifest, err := ioutil.ReadFile(filepath.Join(output, subsetManifestFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []subsetFile
+	if err := json.Unmarshal(manifest, &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[1].File != "APCP_surface.grib2" || len(listed[1].Messages) != 2 || listed[1].Messages[1].Offset == 0 {
+		t.Errorf("got manifest %s", manifest)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// verifyCommand rechecks all files under the destination against the manifests of
+// their cycle folders and returns the process exit code.
+func verifyCommand(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	saveFolder := flags.String("destination", "gribfiles", "destination of the downloaded files to verify")
+	flags.Parse(args)
+
+	verified, corrupt := 0, 0
+	walkErr := filepath.Walk(*saveFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != manifestFileName {
+			return nil
+		}
+
+		entries, err := readManifest(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			fileName := filepath.Join(filepath.Dir(path), entry.Name)
+			if _, err := os.Stat(fileName); os.IsNotExist(err) && fileExists(filepath.Join(filepath.Dir(path), cropFolderName, entry.Name)) {
+				continue // replaced by its cropped version
+			}
+			verified++
+			if err := verifyFile(fileName, entry); err != nil {
+				log.Println("Corrupt file", "file", fileName, "error", err.Error())
+				corrupt++
+			}
+		}
+		return nil
+	})
+
+	if walkErr != nil {
+		log.Println("Failed to verify", "destination", *saveFolder, "error", walkErr.Error())
+		return 1
+	}
+
+	log.Printf("Verified %d files in %s, %d corrupt\n", verified, *saveFolder, corrupt)
+	if corrupt > 0 {
+		return 1
+	}
+	return 0
+}
+
+// verifyFile checks the size and checksum of a local file against its manifest entry
+func verifyFile(fileName string, entry manifestEntry) error {
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	if stat.Size() != entry.Size {
+		return fmt.Errorf("size is %d, expected %d", stat.Size(), entry.Size)
+	}
+
+	sum, err := fileSha256(fileName)
+	if err != nil {
+		return err
+	}
+	if sum != entry.Sha256 {
+		return fmt.Errorf("sha256 is %s, expected %s", sum, entry.Sha256)
+	}
+	return nil
+}
+
+func fileSha256(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func fileExists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
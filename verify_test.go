@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyFile(t *testing.T) {
+	destination, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	values := make([]float64, testGlobalGrid.Points())
+	fileNames := []string{
+		testCycleFile(t, destination, testReferenceTime, 0, testGlobalGrid, tmp2m(values)),
+		testCycleFile(t, destination, testReferenceTime, 3, testGlobalGrid, tmp2m(values)),
+	}
+	manifest := filepath.Join(filepath.Dir(fileNames[0]), manifestFileName)
+	entries := make([]manifestEntry, len(fileNames))
+	for i, fileName := range fileNames {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum, err := fileSha256(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[i] = manifestEntry{Name: filepath.Base(fileName), Size: info.Size(), Sha256: sum}
+		if err := appendManifest(manifest, entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, fileName := range fileNames {
+		if err := verifyFile(fileName, entries[i]); err != nil {
+			t.Errorf("%s: %v", fileName, err)
+		}
+	}
+	if code := verifyCommand([]string{"-destination", destination}); code != 0 {
+		t.Errorf("got exit code %d for intact files", code)
+	}
+
+	// a flipped bit keeps the size, a truncated file does not
+	content, err := ioutil.ReadFile(fileNames[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[len(content)/2] ^= 1
+	if err := ioutil.WriteFile(fileNames[1], content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyFile(fileNames[1], entries[1]); err == nil || !strings.Contains(err.Error(), "sha256") {
+		t.Errorf("got %v for a corrupted file", err)
+	}
+	if code := verifyCommand([]string{"-destination", destination}); code != 1 {
+		t.Errorf("got exit code %d for a corrupted file", code)
+	}
+	if err := ioutil.WriteFile(fileNames[1], content[:len(content)-1], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyFile(fileNames[1], entries[1]); err == nil || !strings.Contains(err.Error(), "size") {
+		t.Errorf("got %v for a truncated file", err)
+	}
+	os.Remove(fileNames[1])
+	if err := verifyFile(fileNames[1], entries[1]); !os.IsNotExist(err) {
+		t.Errorf("got %v for a missing file", err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nilsmagnus/ftplistener/s3"
+	"github.com/nilsmagnus/ftplistener/zarr"
+)
+
+// zarrChunkSize is the size of the chunks along latitude and longitude, the
+// chunks hold a single forecast hour.
+const zarrChunkSize = 90
+
+// zarrStore returns the store of a cycle below the zarr output, a local folder
+// or an s3://bucket/prefix URL, and its location, e.g. zarr/gfs.20180405/06.zarr
+func zarrStore(output, subDir string) (zarr.Store, string, error) {
+	name := strings.Trim(subDir, "/") + ".zarr"
+	if strings.HasPrefix(output, "s3://") {
+		bucket, prefix, err := s3.ParseURL(output)
+		if err != nil {
+			return nil, "", err
+		}
+		prefix = path.Join(prefix, name)
+		return &zarr.S3Store{Client: s3.NewClientFromEnv(), Bucket: bucket, Prefix: prefix}, "s3://" + bucket + "/" + prefix, nil
+	}
+	location := filepath.Join(output, filepath.FromSlash(name))
+	return zarr.DirectoryStore(location), location, nil
+}
+
+// chunkSize returns the chunk size along a dimension of n points
+func chunkSize(n int) int {
+	if n < zarrChunkSize {
+		return n
+	}
+	return zarrChunkSize
+}
+
+// assembleDownloadedCycle writes a complete cycle to its zarr store and returns
+// the store location. It returns "" if nothing was downloaded and the store
+// already exists.
+func assembleDownloadedCycle(destinationFolder, subDir string, downloaded int, options downloadOptions) (string, error) {
+	sourceFolder := cycleSourceFolder(destinationFolder, subDir, options)
+	store, location, err := zarrStore(options.zarr, subDir)
+	if err != nil {
+		return "", err
+	}
+	if downloaded == 0 {
+		if exists, err := store.Exists(zarr.ConsolidatedKey); err != nil || exists {
+			return "", err
+		}
+	}
+
+	log.Println("Assembling", "cycle", sourceFolder, "store", location)
+	if err := writeZarr(sourceFolder, store, options.zarrVars); err != nil {
+		return "", err
+	}
+	return location, nil
+}
+
+// writeZarr writes the selected variables of all GRIB2 files of a folder to a
+// zarr group, with one array per parameter and level chunked by forecast hour
+// and area, and the CF attributes xarray needs to decode the coordinates. Arrays
+// of variables no longer selected are removed from the store.
+func writeZarr(folder string, store zarr.Store, selectors []fieldSelector) error {
+	cycle, err := readCycleFields(folder, selectors)
+	if err != nil {
+		return err
+	}
+	grid := cycle.grid
+
+	group, err := zarr.NewGroup(store, map[string]interface{}{
+		"Conventions":             "CF-1.6",
+		"title":                   forecastTitle(grid),
+		"institution":             "NOAA/NCEP",
+		"forecast_reference_time": cycle.referenceTime.UTC().Format("2006-01-02T15:04:05Z"),
+	})
+	if err != nil {
+		return err
+	}
+
+	times, err := group.CreateArray("time", zarr.ArrayMetadata{
+		Shape: []int{len(cycle.hours)}, Chunks: []int{len(cycle.hours)}, DType: zarr.Float64, FillValue: zarr.NaN,
+	}, map[string]interface{}{
+		"_ARRAY_DIMENSIONS": []string{"time"},
+		"standard_name":     "time",
+		"units":             cycle.timeUnits(),
+		"calendar":          "standard",
+		"axis":              "T",
+	})
+	if err != nil {
+		return err
+	}
+	if err := times.WriteFloat64s(cycle.hours); err != nil {
+		return err
+	}
+
+	lat, err := group.CreateArray("lat", zarr.ArrayMetadata{
+		Shape: []int{grid.Nj}, Chunks: []int{grid.Nj}, DType: zarr.Float32, FillValue: zarr.NaN,
+	}, map[string]interface{}{
+		"_ARRAY_DIMENSIONS": []string{"lat"},
+		"standard_name":     "latitude",
+		"units":             "degrees_north",
+		"axis":              "Y",
+	})
+	if err != nil {
+		return err
+	}
+	if err := lat.WriteFloat32s(latitudes(grid)); err != nil {
+		return err
+	}
+
+	lon, err := group.CreateArray("lon", zarr.ArrayMetadata{
+		Shape: []int{grid.Ni}, Chunks: []int{grid.Ni}, DType: zarr.Float32, FillValue: zarr.NaN,
+	}, map[string]interface{}{
+		"_ARRAY_DIMENSIONS": []string{"lon"},
+		"standard_name":     "longitude",
+		"units":             "degrees_east",
+		"axis":              "X",
+	})
+	if err != nil {
+		return err
+	}
+	if err := lon.WriteFloat32s(longitudes(grid)); err != nil {
+		return err
+	}
+
+	arrays := make([]*zarr.Array, len(cycle.variables))
+	for i, v := range cycle.variables {
+		attributes := map[string]interface{}{
+			"_ARRAY_DIMENSIONS": []string{"time", "lat", "lon"},
+			"long_name":         v.selector.String(),
+		}
+		if v.units != "" {
+			attributes["units"] = v.units
+		}
+		arrays[i], err = group.CreateArray(v.selector.name(), zarr.ArrayMetadata{
+			Shape:      []int{len(cycle.hours), grid.Nj, grid.Ni},
+			Chunks:     []int{1, chunkSize(grid.Nj), chunkSize(grid.Ni)},
+			DType:      zarr.Float32,
+			Compressor: zarr.Zlib(1),
+			FillValue:  zarr.NaN,
+		}, attributes)
+		if err != nil {
+			return err
+		}
+	}
+
+	for record, gribFile := range cycle.files {
+		if err := writeZarrRecord(arrays, record, gribFile, cycle.variables); err != nil {
+			return err
+		}
+	}
+	if err := group.Consolidate(); err != nil {
+		return err
+	}
+	return group.RemoveStale()
+}
+
+// writeZarrRecord writes the values of the variables from one GRIB2 file, the
+// chunks of variables missing from the file are not written and read as NaN.
+func writeZarrRecord(arrays []*zarr.Array, record int, gribFile string, variables []*cycleVariable) error {
+	file, err := os.Open(gribFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for i, v := range variables {
+		f := v.fields[record]
+		if f == nil {
+			continue
+		}
+		data, err := float32Values(file, f, float32(math.NaN()))
+		if err != nil {
+			return err
+		}
+		if err := arrays[i].WriteGrid([]int{record}, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+// Package zarr writes groups of chunked arrays in the Zarr storage format
+// version 2, with consolidated metadata as written by the zarr Python package.
+//
+// A group is a tree of keys: .zgroup and .zattrs for the group, name/.zarray
+// and name/.zattrs for each array and name/i.j.k for each chunk of an array.
+// The consolidated metadata in .zmetadata holds all metadata documents so a
+// reader can open the group with a single request.
+package zarr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nilsmagnus/ftplistener/s3"
+)
+
+// Store holds the keys of a group
+type Store interface {
+	Put(key string, value []byte) error
+	Exists(key string) (bool, error)
+	// Keys returns all keys of the store
+	Keys() ([]string, error)
+	// Delete removes a key, removing a missing key succeeds
+	Delete(key string) error
+}
+
+// DirectoryStore stores keys as files below a directory
+type DirectoryStore string
+
+// Put writes a key to its file, through a temporary file so readers never see
+// partial chunks.
+func (d DirectoryStore) Put(key string, value []byte) error {
+	fileName := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(fileName), 0777); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fileName+".tmp", value, 0666); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// Exists reports whether the file of a key exists
+func (d DirectoryStore) Exists(key string) (bool, error) {
+	_, err := os.Stat(filepath.Join(string(d), filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Keys walks the directory, a missing directory has no keys
+func (d DirectoryStore) Keys() ([]string, error) {
+	keys := make([]string, 0)
+	err := filepath.Walk(string(d), func(fileName string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		key, err := filepath.Rel(string(d), fileName)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(key))
+		return nil
+	})
+	return keys, err
+}
+
+// Delete removes the file of a key, and its folder once empty
+func (d DirectoryStore) Delete(key string) error {
+	fileName := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if folder := filepath.Dir(fileName); folder != filepath.Clean(string(d)) {
+		os.Remove(folder)
+	}
+	return nil
+}
+
+// S3Store stores keys as objects below a prefix of a bucket
+type S3Store struct {
+	Client *s3.Client
+	Bucket string
+	Prefix string
+}
+
+// Put uploads a key
+func (s *S3Store) Put(key string, value []byte) error {
+	contentType := "application/octet-stream"
+	if strings.HasPrefix(filepath.Base(key), ".z") {
+		contentType = "application/json"
+	}
+	return s.Client.PutObject(s.Bucket, s.object(key), value, contentType)
+}
+
+// Exists reports whether the object of a key exists
+func (s *S3Store) Exists(key string) (bool, error) {
+	return s.Client.ObjectExists(s.Bucket, s.object(key))
+}
+
+// Keys lists the objects below the prefix
+func (s *S3Store) Keys() ([]string, error) {
+	prefix := s.object("")
+	objects, _, err := s.Client.ListObjects(s.Bucket, prefix, "")
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(objects))
+	for i, o := range objects {
+		keys[i] = strings.TrimPrefix(o.Key, prefix)
+	}
+	return keys, nil
+}
+
+// Delete removes the object of a key
+func (s *S3Store) Delete(key string) error {
+	return s.Client.DeleteObject(s.Bucket, s.object(key))
+}
+
+func (s *S3Store) object(key string) string {
+	if s.Prefix == "" {
+		return key
+	}
+	return strings.TrimSuffix(s.Prefix, "/") + "/" + key
+}
+
+// Metadata keys
+const (
+	GroupKey        = ".zgroup"
+	AttributesKey   = ".zattrs"
+	ArrayKey        = ".zarray"
+	ConsolidatedKey = ".zmetadata"
+)
+
+// Compressor is the codec configuration of the chunks. Only zlib is supported.
+type Compressor struct {
+	ID    string `json:"id"`
+	Level int    `json:"level"`
+}
+
+// Zlib is the zlib codec of numcodecs at the given level
+func Zlib(level int) *Compressor {
+	return &Compressor{ID: "zlib", Level: level}
+}
+
+// ArrayMetadata is the .zarray document of an array
+type ArrayMetadata struct {
+	ZarrFormat int           `json:"zarr_format"`
+	Shape      []int         `json:"shape"`
+	Chunks     []int         `json:"chunks"`
+	DType      string        `json:"dtype"`
+	Compressor *Compressor   `json:"compressor"`
+	FillValue  interface{}   `json:"fill_value"`
+	Order      string        `json:"order"`
+	Filters    []interface{} `json:"filters"`
+}
+
+// Data types of the arrays, little endian as numpy writes them
+const (
+	Float32 = "<f4"
+	Float64 = "<f8"
+)
+
+// NaN is the JSON encoding of a NaN fill value
+const NaN = "NaN"
+
+// Group is a group of arrays at the root of a store
+type Group struct {
+	store    Store
+	mutex    sync.Mutex
+	metadata map[string]interface{}
+}
+
+// NewGroup writes the metadata of a group with its attributes to the store
+func NewGroup(store Store, attributes map[string]interface{}) (*Group, error) {
+	g := &Group{store: store, metadata: make(map[string]interface{})}
+	if err := g.putJSON(GroupKey, map[string]int{"zarr_format": 2}); err != nil {
+		return nil, err
+	}
+	if err := g.putJSON(AttributesKey, attributes); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Array is an array of a group
+type Array struct {
+	group    *Group
+	name     string
+	metadata ArrayMetadata
+}
+
+// CreateArray writes the metadata and attributes of an array of the group
+func (g *Group) CreateArray(name string, metadata ArrayMetadata, attributes map[string]interface{}) (*Array, error) {
+	metadata.ZarrFormat = 2
+	if metadata.Order == "" {
+		metadata.Order = "C"
+	}
+	if len(metadata.Shape) != len(metadata.Chunks) {
+		return nil, fmt.Errorf("zarr: array %s has %d dimensions but %d chunk sizes", name, len(metadata.Shape), len(metadata.Chunks))
+	}
+	if metadata.Compressor != nil && metadata.Compressor.ID != "zlib" {
+		return nil, fmt.Errorf("zarr: unsupported compressor %s", metadata.Compressor.ID)
+	}
+	if err := g.putJSON(name+"/"+ArrayKey, metadata); err != nil {
+		return nil, err
+	}
+	if err := g.putJSON(name+"/"+AttributesKey, attributes); err != nil {
+		return nil, err
+	}
+	return &Array{group: g, name: name, metadata: metadata}, nil
+}
+
+// Consolidate writes the metadata of the group and all its arrays to .zmetadata.
+// It is written last, readers of consolidated metadata only see complete groups.
+func (g *Group) Consolidate() error {
+	g.mutex.Lock()
+	metadata := make(map[string]interface{}, len(g.metadata))
+	for k, v := range g.metadata {
+		metadata[k] = v
+	}
+	g.mutex.Unlock()
+	return g.putJSON(ConsolidatedKey, map[string]interface{}{
+		"zarr_consolidated_format": 1,
+		"metadata":                 metadata,
+	})
+}
+
+// RemoveStale removes the arrays left in the store by earlier groups that were
+// not created in this one, like variables no longer selected. It is called
+// after Consolidate so readers of consolidated metadata never miss an array.
+func (g *Group) RemoveStale() error {
+	keys, err := g.store.Keys()
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	created := make(map[string]bool)
+	for k := range g.metadata {
+		if strings.HasSuffix(k, "/"+ArrayKey) {
+			created[strings.TrimSuffix(k, "/"+ArrayKey)] = true
+		}
+	}
+	g.mutex.Unlock()
+
+	for _, key := range keys {
+		slash := strings.Index(key, "/")
+		if slash < 0 || created[key[:slash]] {
+			continue
+		}
+		if err := g.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Group) putJSON(key string, document interface{}) error {
+	value, err := json.MarshalIndent(document, "", "    ")
+	if err != nil {
+		return err
+	}
+	if key != ConsolidatedKey {
+		g.mutex.Lock()
+		g.metadata[key] = document
+		g.mutex.Unlock()
+	}
+	return g.store.Put(key, value)
+}
+
+// WriteFloat64s writes all values of a one dimensional array of Float64 in a
+// single chunk, the chunk size must be the array size.
+func (a *Array) WriteFloat64s(values []float64) error {
+	if a.metadata.DType != Float64 || len(a.metadata.Shape) != 1 || a.metadata.Chunks[0] != a.metadata.Shape[0] || len(values) != a.metadata.Shape[0] {
+		return fmt.Errorf("zarr: %d values do not fit array %s", len(values), a.name)
+	}
+	return a.writeChunk([]int{0}, values)
+}
+
+// WriteFloat32s writes all values of a one dimensional array of Float32 in a
+// single chunk, the chunk size must be the array size.
+func (a *Array) WriteFloat32s(values []float32) error {
+	if a.metadata.DType != Float32 || len(a.metadata.Shape) != 1 || a.metadata.Chunks[0] != a.metadata.Shape[0] || len(values) != a.metadata.Shape[0] {
+		return fmt.Errorf("zarr: %d values do not fit array %s", len(values), a.name)
+	}
+	return a.writeChunk([]int{0}, values)
+}
+
+// WriteGrid writes the values of the last two dimensions of a Float32 array
+// at the given indexes of the leading dimensions, whose chunk size must be 1.
+// The chunks of the grid are written concurrently.
+func (a *Array) WriteGrid(leading []int, values []float32) error {
+	m := a.metadata
+	n := len(m.Shape)
+	if m.DType != Float32 || n < 2 || len(leading) != n-2 {
+		return fmt.Errorf("zarr: can not write a grid of array %s", a.name)
+	}
+	for k := range leading {
+		if m.Chunks[k] != 1 {
+			return fmt.Errorf("zarr: dimension %d of array %s is chunked by %d", k, a.name, m.Chunks[k])
+		}
+	}
+	ny, nx, cy, cx := m.Shape[n-2], m.Shape[n-1], m.Chunks[n-2], m.Chunks[n-1]
+	if len(values) != ny*nx {
+		return fmt.Errorf("zarr: %d values for a grid of %dx%d in array %s", len(values), ny, nx, a.name)
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	concurrent := make(chan bool, 8)
+	for y := 0; y*cy < ny; y++ {
+		for x := 0; x*cx < nx; x++ {
+			// edge chunks have the full size, padded with NaN
+			chunk := make([]float32, cy*cx)
+			for j := 0; j < cy; j++ {
+				for i := 0; i < cx; i++ {
+					row, column := y*cy+j, x*cx+i
+					if row < ny && column < nx {
+						chunk[j*cx+i] = values[row*nx+column]
+					} else {
+						chunk[j*cx+i] = float32(math.NaN())
+					}
+				}
+			}
+			index := append(append([]int(nil), leading...), y, x)
+
+			wg.Add(1)
+			concurrent <- true
+			go func() {
+				defer wg.Done()
+				err := a.writeChunk(index, chunk)
+				<-concurrent
+				if err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// writeChunk encodes and compresses a chunk and stores it
+func (a *Array) writeChunk(index []int, values interface{}) error {
+	var raw bytes.Buffer
+	if err := binary.Write(&raw, binary.LittleEndian, values); err != nil {
+		return err
+	}
+	data := raw.Bytes()
+	if a.metadata.Compressor != nil {
+		var compressed bytes.Buffer
+		w, err := zlib.NewWriterLevel(&compressed, a.metadata.Compressor.Level)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+	}
+
+	parts := make([]string, len(index))
+	for i, k := range index {
+		parts[i] = strconv.Itoa(k)
+	}
+	return a.group.store.Put(a.name+"/"+strings.Join(parts, "."), data)
+}
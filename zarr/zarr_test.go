@@ -0,0 +1,271 @@
+package zarr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nilsmagnus/ftplistener/s3"
+)
+
+func tempStore(t *testing.T) DirectoryStore {
+	folder, err := ioutil.TempDir("", "zarr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DirectoryStore(filepath.Join(folder, "06.zarr"))
+}
+
+// readChunk decompresses and decodes a chunk of float32 values
+func readChunk(t *testing.T, store DirectoryStore, key string, n int) []float32 {
+	compressed, err := ioutil.ReadFile(filepath.Join(string(store), filepath.FromSlash(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]float32, n)
+	if err := binary.Read(r, binary.LittleEndian, values); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func readJSON(t *testing.T, store DirectoryStore, key string, document interface{}) {
+	content, err := ioutil.ReadFile(filepath.Join(string(store), filepath.FromSlash(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, document); err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+}
+
+// gridArray creates an array of 2 forecast hours of a 3x5 grid in chunks of 2x3
+func gridArray(t *testing.T, group *Group, name string) *Array {
+	a, err := group.CreateArray(name, ArrayMetadata{
+		Shape: []int{2, 3, 5}, Chunks: []int{1, 2, 3}, DType: Float32, Compressor: Zlib(1), FillValue: NaN,
+	}, map[string]interface{}{"_ARRAY_DIMENSIONS": []string{"time", "lat", "lon"}, "units": "K"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestWriteGridChunks(t *testing.T) {
+	store := tempStore(t)
+	defer os.RemoveAll(filepath.Dir(string(store)))
+	group, err := NewGroup(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := gridArray(t, group, "t2m")
+
+	values := make([]float32, 15)
+	for i := range values {
+		values[i] = float32(i)
+	}
+	if err := a.WriteGrid([]int{1}, values); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteGrid([]int{1}, values[:14]); err == nil {
+		t.Error("grid of 14 values written to an array of 3x5")
+	}
+
+	keys, err := store.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	want := []string{".zattrs", ".zgroup", "t2m/.zarray", "t2m/.zattrs", "t2m/1.0.0", "t2m/1.0.1", "t2m/1.1.0", "t2m/1.1.1"}
+	if strings.Join(keys, " ") != strings.Join(want, " ") {
+		t.Fatalf("got keys %v, want %v", keys, want)
+	}
+
+	// rows 0-1 and columns 0-2, then row 2 and columns 3-4 padded with NaN
+	first := readChunk(t, store, "t2m/1.0.0", 6)
+	for i, v := range []float32{0, 1, 2, 5, 6, 7} {
+		if first[i] != v {
+			t.Fatalf("got chunk 1.0.0 %v", first)
+		}
+	}
+	last := readChunk(t, store, "t2m/1.1.1", 6)
+	if last[0] != 13 || last[1] != 14 {
+		t.Errorf("got chunk 1.1.1 %v", last)
+	}
+	for _, v := range last[2:] {
+		if !math.IsNaN(float64(v)) {
+			t.Errorf("got chunk 1.1.1 %v, want NaN outside the grid", last)
+			break
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	store := tempStore(t)
+	defer os.RemoveAll(filepath.Dir(string(store)))
+	group, err := NewGroup(store, map[string]interface{}{"title": "GFS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gridArray(t, group, "t2m")
+	if _, err := group.CreateArray("lat", ArrayMetadata{Shape: []int{3}, Chunks: []int{3, 1}, DType: Float32}, nil); err == nil {
+		t.Error("array with more chunk sizes than dimensions created")
+	}
+	if err := group.Consolidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var array map[string]interface{}
+	readJSON(t, store, "t2m/.zarray", &array)
+	encoded, _ := json.Marshal(array)
+	if want := `{"chunks":[1,2,3],"compressor":{"id":"zlib","level":1},"dtype":"\u003cf4","fill_value":"NaN","filters":null,"order":"C","shape":[2,3,5],"zarr_format":2}`; string(encoded) != want {
+		t.Errorf("got .zarray %s, want %s", encoded, want)
+	}
+	var attributes map[string]interface{}
+	readJSON(t, store, "t2m/.zattrs", &attributes)
+	if attributes["units"] != "K" {
+		t.Errorf("got .zattrs %v", attributes)
+	}
+
+	var consolidated struct {
+		Format   int                               `json:"zarr_consolidated_format"`
+		Metadata map[string]map[string]interface{} `json:"metadata"`
+	}
+	readJSON(t, store, ConsolidatedKey, &consolidated)
+	if consolidated.Format != 1 || len(consolidated.Metadata) != 4 {
+		t.Fatalf("got consolidated metadata %+v", consolidated)
+	}
+	if consolidated.Metadata[GroupKey]["zarr_format"] != 2.0 || consolidated.Metadata[AttributesKey]["title"] != "GFS" || consolidated.Metadata["t2m/.zarray"]["dtype"] != Float32 {
+		t.Errorf("got consolidated metadata %+v", consolidated.Metadata)
+	}
+}
+
+func TestRemoveStale(t *testing.T) {
+	store := tempStore(t)
+	defer os.RemoveAll(filepath.Dir(string(store)))
+	values := make([]float32, 15)
+
+	// an earlier run wrote t2m and apcp, this one only selects t2m
+	for _, names := range [][]string{{"t2m", "apcp"}, {"t2m"}} {
+		group, err := NewGroup(store, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if err := gridArray(t, group, name).WriteGrid([]int{0}, values); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := group.Consolidate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := group.RemoveStale(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := store.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, "apcp/") {
+			t.Errorf("stale key %s kept", key)
+		}
+	}
+	if len(keys) != 9 {
+		t.Errorf("got keys %v, want the group metadata and t2m", keys)
+	}
+	if _, err := os.Stat(filepath.Join(string(store), "apcp")); !os.IsNotExist(err) {
+		t.Errorf("folder of the stale array kept: %v", err)
+	}
+}
+
+// objectServer keeps objects in memory like a bucket
+type objectServer struct {
+	mutex        sync.Mutex
+	objects      map[string][]byte
+	contentTypes map[string]string
+}
+
+func (s *objectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == "PUT":
+		s.objects[key], _ = ioutil.ReadAll(r.Body)
+		s.contentTypes[key] = r.Header.Get("Content-Type")
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+	case r.Method == "GET" && r.URL.Path == "/bucket":
+		var result struct {
+			XMLName  xml.Name    `xml:"ListBucketResult"`
+			Contents []s3.Object `xml:"Contents"`
+		}
+		for k := range s.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, s3.Object{Key: k})
+			}
+		}
+		xml.NewEncoder(w).Encode(result)
+	case s.objects[key] != nil:
+		w.Write(s.objects[key])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	handler := &objectServer{objects: make(map[string][]byte), contentTypes: make(map[string]string)}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	handler.objects["zarr/gfs.20180405/06.zarr/apcp/0.0.0"] = []byte("stale")
+	handler.objects["zarr/gfs.20180405/00.zarr/apcp/0.0.0"] = []byte("other cycle")
+	store := &S3Store{Client: &s3.Client{Endpoint: server.URL, Region: "us-east-1"}, Bucket: "bucket", Prefix: "zarr/gfs.20180405/06.zarr/"}
+
+	if exists, err := store.Exists(ConsolidatedKey); err != nil || exists {
+		t.Fatalf("got %v, %v for a missing key", exists, err)
+	}
+	group, err := NewGroup(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gridArray(t, group, "t2m").WriteGrid([]int{0}, make([]float32, 15)); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.Consolidate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.RemoveStale(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := store.Exists(ConsolidatedKey); err != nil || !exists {
+		t.Fatalf("got %v, %v for the consolidated metadata", exists, err)
+	}
+
+	if len(handler.objects) != 10 {
+		t.Errorf("got %d objects, want 9 of the group and the other cycle", len(handler.objects))
+	}
+	if handler.objects["zarr/gfs.20180405/06.zarr/apcp/0.0.0"] != nil || handler.objects["zarr/gfs.20180405/00.zarr/apcp/0.0.0"] == nil {
+		t.Error("removed the wrong stale objects")
+	}
+	if handler.contentTypes["zarr/gfs.20180405/06.zarr/t2m/.zarray"] != "application/json" || handler.contentTypes["zarr/gfs.20180405/06.zarr/t2m/0.1.1"] != "application/octet-stream" {
+		t.Errorf("got content types %v", handler.contentTypes)
+	}
+}